@@ -0,0 +1,103 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// configFileVersion is the only supported version of the -config file.
+const configFileVersion = "v1"
+
+// configFile is the -config file, each other key is the name of a flag, e.g.
+//
+//	version: v1
+//	http: 127.0.0.1:8000
+//	grpc-tls-cert: /etc/ext-authz/cert.pem
+//	policy-file: /etc/ext-authz/policy.yaml
+//	allowed-values: [allow, yes]
+type configFile struct {
+	Version string                 `yaml:"version"`
+	Flags   map[string]interface{} `yaml:",inline"`
+}
+
+// setFlagsFromFile sets the flags that are not set on the command line or by the environment from
+// the config file, a list value is joined by commas. Unknown flags are errors.
+func setFlagsFromFile(fs *flag.FlagSet, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+	var file configFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return fmt.Errorf("config file %s: %v", path, err)
+	}
+	if file.Version != configFileVersion {
+		return fmt.Errorf("config file %s: version must be %s but got %q", path, configFileVersion, file.Version)
+	}
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	names := make([]string, 0, len(file.Flags))
+	for name := range file.Flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if fs.Lookup(name) == nil || name == "config" || name == "validate-config" {
+			return fmt.Errorf("config file %s: unknown field %q", path, name)
+		}
+		value, err := configValue(file.Flags[name])
+		if err != nil {
+			return fmt.Errorf("config file %s: field %q %v", path, name, err)
+		}
+		if set[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("config file %s: invalid field %q: %v", path, name, err)
+		}
+	}
+	return nil
+}
+
+// configValue returns the flag value of the scalar or list field.
+func configValue(field interface{}) (string, error) {
+	switch v := field.(type) {
+	case nil:
+		return "", nil
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			value, err := configValue(item)
+			if err != nil || strings.Contains(value, ",") {
+				return "", fmt.Errorf("must be a list of scalars without commas")
+			}
+			items = append(items, value)
+		}
+		return strings.Join(items, ","), nil
+	case map[interface{}]interface{}:
+		return "", fmt.Errorf("must be a scalar or a list")
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
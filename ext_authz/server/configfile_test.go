@@ -0,0 +1,100 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/yangminzhu/playground/ext_authz/server/extauthz"
+)
+
+// loadConfigFile returns the config and the listen addresses of the -config file like main.
+func loadConfigFile(t *testing.T, path string, overrides map[string]string) (extauthz.Config, string, string, error) {
+	t.Helper()
+	fs := flag.NewFlagSet("ext-authz", flag.ContinueOnError)
+	config := extauthz.DefaultConfig()
+	config.RegisterFlags(fs)
+	httpAddr := fs.String("http", "8000", "")
+	grpcAddr := fs.String("grpc", "9000", "")
+	for name, value := range overrides {
+		if err := fs.Set(name, value); err != nil {
+			t.Fatalf("failed to set -%s: %v", name, err)
+		}
+	}
+	err := setFlagsFromFile(fs, path)
+	return config, *httpAddr, *grpcAddr, err
+}
+
+func TestValidateConfigFixtures(t *testing.T) {
+	cases := []struct {
+		file    string
+		wantErr string
+	}{
+		{file: "good.yaml"},
+		{file: "bad-version.yaml", wantErr: `version must be v1 but got "v2"`},
+		{file: "bad-unknown-field.yaml", wantErr: `unknown field "check-heder"`},
+		{file: "bad-regex.yaml", wantErr: "invalid -allowed-value-regex"},
+		{file: "bad-cel.yaml", wantErr: `invalid CEL expression "request.http.method =="`},
+		{file: "bad-policy.yaml", wantErr: `rule allow-all: action must be "allow" or "deny" but got "permit"`},
+		{file: "bad-cert.yaml", wantErr: "failed to read -http-tls-cert and -http-tls-key"},
+		{file: "bad-address.yaml", wantErr: `invalid gRPC address: invalid listen address "localhost"`},
+		{file: "bad-metrics.yaml", wantErr: `-metrics must be admin or empty but got "http"`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.file, func(t *testing.T) {
+			config, httpAddr, grpcAddr, err := loadConfigFile(t, filepath.Join("testdata", tc.file), nil)
+			if err == nil {
+				err = extauthz.ValidateConfig(config, httpAddr, grpcAddr)
+			}
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Fatalf("got error %v, want valid", err)
+			case tc.wantErr != "" && err == nil:
+				t.Fatalf("got valid, want error %q", tc.wantErr)
+			case tc.wantErr != "" && !strings.Contains(err.Error(), tc.wantErr):
+				t.Fatalf("got error %v, want error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateConfigOpensNoSinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ext-authz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sinks := map[string]string{
+		"access-log-path": filepath.Join(dir, "access.log"),
+		"audit-log-path":  filepath.Join(dir, "audit.log"),
+	}
+	config, httpAddr, grpcAddr, err := loadConfigFile(t, filepath.Join("testdata", "good.yaml"), sinks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := extauthz.ValidateConfig(config, httpAddr, grpcAddr); err != nil {
+		t.Fatalf("got error %v, want valid", err)
+	}
+	for name, path := range sinks {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("-%s %s was created by the validation", name, path)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/yangminzhu/playground/ext_authz/server/extauthz"
+)
+
+// envPrefix prefixes the environment variables of the flags, e.g. EXT_AUTHZ_ALLOWED_VALUE for
+// -allowed-value.
+const envPrefix = "EXT_AUTHZ_"
+
+// envName returns the environment variable of the flag.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// setFlagsFromEnv sets the flags that are not set on the command line from their environment
+// variables, so a flag takes precedence over its variable and the variable over the default. The
+// EXT_AUTHZ_ variables without a flag are warned about.
+func setFlagsFromEnv(fs *flag.FlagSet) error {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	known := map[string]bool{}
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		name := envName(f.Name)
+		known[name] = true
+		value, ok := os.LookupEnv(name)
+		if !ok || set[f.Name] || err != nil {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid %s: %v", name, setErr)
+		}
+	})
+	for _, env := range os.Environ() {
+		name := strings.SplitN(env, "=", 2)[0]
+		if strings.HasPrefix(name, envPrefix) && !known[name] {
+			log.Printf("Warning: ignoring %s, it matches no flag", name)
+		}
+	}
+	return err
+}
+
+// isSecretFlag returns true if the flag value must not be logged, the sensitive flags of the
+// configuration and any flag named like a secret.
+func isSecretFlag(name string) bool {
+	return extauthz.IsSensitiveFlag(name) ||
+		strings.Contains(name, "secret") || strings.Contains(name, "password") || strings.Contains(name, "token")
+}
+
+// logFlags logs the flags that differ from their defaults with the secrets redacted.
+func logFlags(fs *flag.FlagSet) {
+	var changed []string
+	fs.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if value == f.DefValue {
+			return
+		}
+		if isSecretFlag(f.Name) {
+			value = "REDACTED"
+		}
+		changed = append(changed, fmt.Sprintf("-%s=%q", f.Name, value))
+	})
+	if len(changed) == 0 {
+		log.Printf("Effective configuration: all defaults")
+		return
+	}
+	log.Printf("Effective configuration: %s", strings.Join(changed, " "))
+}
@@ -0,0 +1,162 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/yangminzhu/playground/ext_authz/server/extauthz"
+)
+
+// captureLog returns the buffer of the standard logger until restore is called.
+func captureLog() (out *bytes.Buffer, restore func()) {
+	out = &bytes.Buffer{}
+	flags := log.Flags()
+	log.SetOutput(out)
+	log.SetFlags(0)
+	return out, func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(flags)
+	}
+}
+
+// setEnv sets the environment variables until unset is called.
+func setEnv(t *testing.T, env map[string]string) (unset func()) {
+	t.Helper()
+	for name, value := range env {
+		if err := os.Setenv(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return func() {
+		for name := range env {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	cases := []struct {
+		flag string
+		want string
+	}{
+		{flag: "allowed-value", want: "EXT_AUTHZ_ALLOWED_VALUE"},
+		{flag: "http", want: "EXT_AUTHZ_HTTP"},
+		{flag: "jwt-hs256-secret", want: "EXT_AUTHZ_JWT_HS256_SECRET"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.flag, func(t *testing.T) {
+			if got := envName(tc.flag); got != tc.want {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSetFlagsFromEnv(t *testing.T) {
+	cases := []struct {
+		name        string
+		args        []string
+		env         map[string]string
+		wantHeader  string
+		wantHTTP    string
+		wantErr     string
+		wantWarning string
+	}{
+		{name: "default", wantHeader: "x-ext-authz", wantHTTP: "8000"},
+		{name: "env over default", env: map[string]string{"EXT_AUTHZ_CHECK_HEADER": "x-env", "EXT_AUTHZ_HTTP": "8080"},
+			wantHeader: "x-env", wantHTTP: "8080"},
+		{name: "flag over env", args: []string{"-check-header=x-flag"}, env: map[string]string{"EXT_AUTHZ_CHECK_HEADER": "x-env"},
+			wantHeader: "x-flag", wantHTTP: "8000"},
+		{name: "flag set to the default over env", args: []string{"-check-header=x-ext-authz"},
+			env: map[string]string{"EXT_AUTHZ_CHECK_HEADER": "x-env"}, wantHeader: "x-ext-authz", wantHTTP: "8000"},
+		{name: "unknown variable is warned about", env: map[string]string{"EXT_AUTHZ_CHECK_HEADR": "x-typo"},
+			wantHeader: "x-ext-authz", wantHTTP: "8000", wantWarning: "Warning: ignoring EXT_AUTHZ_CHECK_HEADR, it matches no flag"},
+		{name: "invalid value", env: map[string]string{"EXT_AUTHZ_LOG_DECISIONS": "maybe"},
+			wantErr: "invalid EXT_AUTHZ_LOG_DECISIONS"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("ext-authz", flag.ContinueOnError)
+			config := extauthz.DefaultConfig()
+			config.RegisterFlags(fs)
+			httpAddr := fs.String("http", "8000", "")
+			if err := fs.Parse(tc.args); err != nil {
+				t.Fatal(err)
+			}
+			defer setEnv(t, tc.env)()
+			out, restore := captureLog()
+			err := setFlagsFromEnv(fs)
+			restore()
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want error containing %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.CheckHeader != tc.wantHeader || *httpAddr != tc.wantHTTP {
+				t.Fatalf("got -check-header %q and -http %q, want %q and %q", config.CheckHeader, *httpAddr, tc.wantHeader, tc.wantHTTP)
+			}
+			if got := strings.Contains(out.String(), "Warning"); got != (tc.wantWarning != "") || !strings.Contains(out.String(), tc.wantWarning) {
+				t.Fatalf("got log %q, want warning %q", out.String(), tc.wantWarning)
+			}
+		})
+	}
+}
+
+func TestLogFlags(t *testing.T) {
+	cases := []struct {
+		name    string
+		args    []string
+		want    string
+		wantNot string
+	}{
+		{name: "all defaults", want: "Effective configuration: all defaults"},
+		{name: "changed flags", args: []string{"-allowed-value=team", "-log-decisions=false"},
+			want: `Effective configuration: -allowed-value="team" -log-decisions="false"`},
+		{name: "secret is redacted", args: []string{"-jwt-hs256-secret=hunter2"},
+			want: `-jwt-hs256-secret="REDACTED"`, wantNot: "hunter2"},
+		{name: "LDAP bind DN is redacted", args: []string{"-ldap-bind-dn=cn=admin,dc=example,dc=com"},
+			want: `-ldap-bind-dn="REDACTED"`, wantNot: "cn=admin"},
+		{name: "required query is redacted", args: []string{"-required-query=token=hunter2"},
+			want: `-required-query="REDACTED"`, wantNot: "hunter2"},
+		{name: "introspection client ID is redacted", args: []string{"-introspection-client-id=ext-authz-prod"},
+			want: `-introspection-client-id="REDACTED"`, wantNot: "ext-authz-prod"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("ext-authz", flag.ContinueOnError)
+			config := extauthz.DefaultConfig()
+			config.RegisterFlags(fs)
+			if err := fs.Parse(tc.args); err != nil {
+				t.Fatal(err)
+			}
+			out, restore := captureLog()
+			logFlags(fs)
+			restore()
+			if !strings.Contains(out.String(), tc.want) || (tc.wantNot != "" && strings.Contains(out.String(), tc.wantNot)) {
+				t.Fatalf("got log %q, want %q", out.String(), tc.want)
+			}
+		})
+	}
+}
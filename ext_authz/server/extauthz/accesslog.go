@@ -0,0 +1,314 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// defaultAccessLogFormat is the -access-log-format default, similar to the Envoy default format.
+	defaultAccessLogFormat = `[%START_TIME%] "%REQ(:METHOD)% %REQ(:PATH)%" %PROTOCOL% %DECISION% %REASON% %RULE% %DURATION% "%REQ(:AUTHORITY)%" "%DOWNSTREAM_REMOTE_ADDRESS_WITHOUT_PORT%" "%REQ(X-REQUEST-ID)%"` + "\n"
+	// accessLogFlushInterval bounds the time a line stays in the buffer.
+	accessLogFlushInterval = time.Second
+	// accessLogMaxBackoff bounds the interval of the warnings about the failed writes.
+	accessLogMaxBackoff = time.Minute
+)
+
+// accessLogEntry is what the tokens of the access log format are expanded from.
+type accessLogEntry struct {
+	protocol string
+	request  *checkRequest
+	decision decision
+	start    time.Time
+	duration time.Duration
+	path     string
+}
+
+// accessLogToken expands a token, an empty value is written as "-" like Envoy does.
+type accessLogToken func(e *accessLogEntry) string
+
+// parseAccessLogFormat parses the format into literal text and the tokens:
+//
+//	%START_TIME%                              start of the check request in RFC 3339 with milliseconds in UTC
+//	%REQ(NAME)% or %REQ(NAME?ALT)%             request header, :METHOD, :AUTHORITY and :PATH are the pseudo headers
+//	%PROTOCOL%                                grpc, http, ext_proc or tcp
+//	%DECISION%, %REASON%, %RULE%              result, short reason and rule of the decision
+//	%DURATION%                                time to decide in milliseconds
+//	%DOWNSTREAM_REMOTE_ADDRESS_WITHOUT_PORT%  source IP of the request
+func parseAccessLogFormat(format string) ([]accessLogToken, error) {
+	var tokens []accessLogToken
+	for format != "" {
+		i := strings.Index(format, "%")
+		if i == -1 {
+			tokens = append(tokens, literalToken(format))
+			break
+		}
+		if i > 0 {
+			tokens = append(tokens, literalToken(format[:i]))
+		}
+		format = format[i+1:]
+		j := strings.Index(format, "%")
+		if j == -1 {
+			return nil, fmt.Errorf("unterminated token %%%s", format)
+		}
+		token, err := parseAccessLogToken(format[:j])
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+		format = format[j+1:]
+	}
+	return tokens, nil
+}
+
+func literalToken(text string) accessLogToken {
+	return func(*accessLogEntry) string { return text }
+}
+
+func parseAccessLogToken(name string) (accessLogToken, error) {
+	switch name {
+	case "START_TIME":
+		return func(e *accessLogEntry) string { return e.start.UTC().Format("2006-01-02T15:04:05.000Z07:00") }, nil
+	case "PROTOCOL":
+		return func(e *accessLogEntry) string { return e.protocol }, nil
+	case "DECISION":
+		return func(e *accessLogEntry) string { return e.decision.result() }, nil
+	case "REASON":
+		return func(e *accessLogEntry) string { return e.decision.resultDetail() }, nil
+	case "RULE":
+		return func(e *accessLogEntry) string { return e.decision.ruleName() }, nil
+	case "DURATION":
+		return func(e *accessLogEntry) string { return fmt.Sprint(e.duration.Milliseconds()) }, nil
+	case "DOWNSTREAM_REMOTE_ADDRESS_WITHOUT_PORT":
+		return func(e *accessLogEntry) string {
+			if e.request.sourceIP == nil {
+				return ""
+			}
+			return e.request.sourceIP.String()
+		}, nil
+	}
+	if strings.HasPrefix(name, "REQ(") && strings.HasSuffix(name, ")") {
+		names := strings.SplitN(strings.ToLower(name[len("REQ("):len(name)-1]), "?", 2)
+		if names[0] == "" {
+			return nil, fmt.Errorf("empty header name in %%%s%%", name)
+		}
+		return func(e *accessLogEntry) string {
+			for _, n := range names {
+				if v := e.header(n); v != "" {
+					return v
+				}
+			}
+			return ""
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown token %%%s%%", name)
+}
+
+// header returns the request header or pseudo header, the sensitive headers are redacted.
+func (e *accessLogEntry) header(name string) string {
+	switch name {
+	case ":method":
+		return e.request.method
+	case ":authority":
+		return e.request.host
+	case ":path":
+		return e.path
+	}
+	value := e.request.header(name)
+	if value != "" && sensitiveHeaders[name] {
+		return redacted
+	}
+	return value
+}
+
+// accessLog writes a line per decision to the -access-log-path. The writes are buffered and the
+// file is reopened on SIGUSR2 after logrotate moved it, a failed write never fails the check.
+type accessLog struct {
+	path   string
+	tokens []accessLogToken
+	logger Logger
+
+	// stop ends the periodic flush and the reopen on SIGUSR2.
+	stop   chan struct{}
+	mu     sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	// failures counts the failed writes since the last warning, the warnings are backed off up
+	// to accessLogMaxBackoff while the writes keep failing.
+	failures    int
+	backoff     time.Duration
+	nextWarning time.Time
+}
+
+func newAccessLog(path, format string, logger Logger) (*accessLog, error) {
+	// A newline is hard to pass in a flag, every line ends with one anyway.
+	if !strings.HasSuffix(format, "\n") {
+		format += "\n"
+	}
+	tokens, err := parseAccessLogFormat(format)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -access-log-format: %v", err)
+	}
+	return &accessLog{path: path, tokens: tokens, logger: logger, stop: make(chan struct{})}, nil
+}
+
+// start opens the file, flushes it periodically and reopens it on SIGUSR2, it does nothing if nil.
+func (l *accessLog) start() error {
+	if l == nil {
+		return nil
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+	go l.flushPeriodically()
+	go l.reopenOnSignal()
+	l.logger.Infof("Writing the access log to %s", l.path)
+	return nil
+}
+
+func (l *accessLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open the access log: %v", err)
+	}
+	l.file, l.writer = file, bufio.NewWriter(file)
+	return nil
+}
+
+// reopen flushes and closes the current file and opens the path again, the current file is kept
+// if it fails.
+func (l *accessLog) reopen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.flushLocked()
+	previous := l.file
+	if err := l.open(); err != nil {
+		return err
+	}
+	return previous.Close()
+}
+
+func (l *accessLog) reopenOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case <-signals:
+			if err := l.reopen(); err != nil {
+				l.logger.Errorf("Failed to reopen the access log %s, keeping the previous file: %v", l.path, err)
+				continue
+			}
+			l.logger.Infof("Reopened the access log %s", l.path)
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+func (l *accessLog) flushPeriodically() {
+	ticker := time.NewTicker(accessLogFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.flush()
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// close stops the periodic flush and the reopen on SIGUSR2, then flushes and closes the file. It
+// does nothing if nil or not started.
+func (l *accessLog) close() {
+	if l == nil || l.file == nil {
+		return
+	}
+	close(l.stop)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.flushLocked()
+	l.file.Close()
+}
+
+func (l *accessLog) flush() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.flushLocked()
+}
+
+// flushLocked writes the buffered lines, only a flush that wrote them ends the failures since a
+// buffered write never fails.
+func (l *accessLog) flushLocked() {
+	if l.writer.Buffered() == 0 {
+		return
+	}
+	l.failed(l.writer.Flush())
+}
+
+// write appends the line of the entry, it does nothing if the access log is disabled.
+func (l *accessLog) write(e *accessLogEntry) {
+	if l == nil {
+		return
+	}
+	var line strings.Builder
+	for _, token := range l.tokens {
+		if value := token(e); value != "" {
+			line.WriteString(value)
+		} else {
+			line.WriteString("-")
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.writer.WriteString(line.String()); err != nil {
+		l.failed(err)
+	}
+}
+
+// failed warns about the failed write with backoff, the buffered writer keeps failing once it
+// failed so the pending lines are dropped to retry with the next lines.
+func (l *accessLog) failed(err error) {
+	if err == nil {
+		l.failures, l.backoff = 0, 0
+		return
+	}
+	l.writer.Reset(l.file)
+	l.failures++
+	now := time.Now()
+	if now.Before(l.nextWarning) {
+		return
+	}
+	l.logger.Warnf("failed to write the access log %s, dropped %d writes: %v", l.path, l.failures, err)
+	l.failures = 0
+	if l.backoff = 2 * l.backoff; l.backoff == 0 {
+		l.backoff = time.Second
+	} else if l.backoff > accessLogMaxBackoff {
+		l.backoff = accessLogMaxBackoff
+	}
+	l.nextWarning = now.Add(l.backoff)
+}
@@ -0,0 +1,259 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseAccessLogFormat(t *testing.T) {
+	entry := &accessLogEntry{
+		protocol: "grpc",
+		request: &checkRequest{method: "GET", host: "example.com", sourceIP: net.ParseIP("10.0.0.1"),
+			headers: map[string]string{"x-request-id": "req-1", "authorization": "Bearer s3cret", "user-agent": "curl"}},
+		decision: decision{allowed: true, rule: "public", reason: "allowed by rule public"},
+		start:    time.Date(2024, 1, 2, 3, 4, 5, 6e6, time.FixedZone("CET", 3600)),
+		duration: 1500 * time.Microsecond,
+		path:     "/api?token=REDACTED",
+	}
+	cases := []struct {
+		name    string
+		format  string
+		want    string
+		wantErr string
+	}{
+		{name: "literal", format: "plain text", want: "plain text"},
+		{name: "start time in UTC", format: "%START_TIME%", want: "2024-01-02T02:04:05.006Z"},
+		{name: "pseudo headers", format: "%REQ(:METHOD)% %REQ(:AUTHORITY)% %REQ(:PATH)%", want: "GET example.com /api?token=REDACTED"},
+		{name: "header is case insensitive", format: "%REQ(X-Request-ID)%", want: "req-1"},
+		{name: "alternative header", format: "%REQ(X-FORWARDED-FOR?USER-AGENT)%", want: "curl"},
+		{name: "missing header", format: `"%REQ(X-MISSING)%"`, want: `"-"`},
+		{name: "sensitive header is redacted", format: "%REQ(AUTHORIZATION)%", want: redacted},
+		{name: "decision", format: "%PROTOCOL% %DECISION% %RULE% %DURATION%", want: "grpc allowed public 1"},
+		{name: "source IP", format: "%DOWNSTREAM_REMOTE_ADDRESS_WITHOUT_PORT%", want: "10.0.0.1"},
+		{name: "adjacent tokens", format: "%PROTOCOL%%DECISION%", want: "grpcallowed"},
+		{name: "default", format: defaultAccessLogFormat,
+			want: `[2024-01-02T02:04:05.006Z] "GET /api?token=REDACTED" grpc allowed allowed public 1 "example.com" "10.0.0.1" "req-1"` + "\n"},
+		{name: "unterminated", format: "%START_TIME", wantErr: "unterminated token %START_TIME"},
+		{name: "unknown token", format: "%BYTES_SENT%", wantErr: "unknown token %BYTES_SENT%"},
+		{name: "empty header name", format: "%REQ()%", wantErr: "empty header name in %REQ()%"},
+		{name: "single percent", format: "100%", wantErr: "unterminated token %"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tokens, err := parseAccessLogFormat(tc.format)
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("got error %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got strings.Builder
+			for _, token := range tokens {
+				if value := token(entry); value != "" {
+					got.WriteString(value)
+				} else {
+					got.WriteString("-")
+				}
+			}
+			if got.String() != tc.want {
+				t.Fatalf("got %q, want %q", got.String(), tc.want)
+			}
+		})
+	}
+}
+
+// startAccessLog starts the access log of the format in a temporary directory, the caller closes
+// it and removes the directory.
+func startAccessLog(t *testing.T, format string, out *syncBuffer) (l *accessLog, dir string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, err = newAccessLog(filepath.Join(dir, "access.log"), format, NewTextLogger(out)); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	if err := l.start(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return l, dir
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestAccessLogReopen(t *testing.T) {
+	cases := []struct {
+		name   string
+		reopen func(t *testing.T, l *accessLog)
+	}{
+		{name: "reopen", reopen: func(t *testing.T, l *accessLog) {
+			if err := l.reopen(); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{name: "SIGUSR2", reopen: func(t *testing.T, l *accessLog) {
+			// The signal is also delivered here for the rest of the test binary so that it never
+			// terminates it, it is sent until the access log handles it since it may not be
+			// notified yet.
+			signal.Notify(make(chan os.Signal, 1), syscall.SIGUSR2)
+			for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+				if err := syscall.Kill(os.Getpid(), syscall.SIGUSR2); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := os.Stat(l.path); err == nil {
+					return
+				}
+			}
+			t.Fatal("the access log was not reopened on SIGUSR2")
+		}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out syncBuffer
+			l, dir := startAccessLog(t, "%PROTOCOL%", &out)
+			defer os.RemoveAll(dir)
+			defer l.close()
+			l.write(&accessLogEntry{protocol: "before", request: &checkRequest{}})
+			// logrotate moves the file, the buffered line is flushed to the moved file on reopen.
+			rotated := l.path + ".1"
+			if err := os.Rename(l.path, rotated); err != nil {
+				t.Fatal(err)
+			}
+			tc.reopen(t, l)
+			l.write(&accessLogEntry{protocol: "after", request: &checkRequest{}})
+			l.flush()
+			if got := readFile(t, rotated); got != "before\n" {
+				t.Fatalf("got rotated file %q, want %q", got, "before\n")
+			}
+			if got := readFile(t, l.path); got != "after\n" {
+				t.Fatalf("got reopened file %q, want %q", got, "after\n")
+			}
+		})
+	}
+}
+
+func TestAccessLogReopenError(t *testing.T) {
+	var out syncBuffer
+	l, dir := startAccessLog(t, "%PROTOCOL%", &out)
+	defer os.RemoveAll(dir)
+	defer l.close()
+	path := l.path
+	// The path cannot be opened again, the current file is kept.
+	l.path = filepath.Join(dir, "missing", "access.log")
+	if err := l.reopen(); err == nil || !strings.Contains(err.Error(), "failed to open the access log") {
+		t.Fatalf("got error %v, want failed to open the access log", err)
+	}
+	l.write(&accessLogEntry{protocol: "kept", request: &checkRequest{}})
+	l.flush()
+	if got := readFile(t, path); got != "kept\n" {
+		t.Fatalf("got %q, want %q", got, "kept\n")
+	}
+}
+
+func TestAccessLogWriteErrors(t *testing.T) {
+	var out syncBuffer
+	l, dir := startAccessLog(t, "%PROTOCOL%", &out)
+	defer os.RemoveAll(dir)
+	defer l.close()
+	l.file.Close()
+	steps := []struct {
+		name  string
+		write func()
+		// wantWarnings is the number of warnings logged so far.
+		wantWarnings int
+	}{
+		{name: "first failure is warned about", wantWarnings: 1, write: func() {
+			l.write(&accessLogEntry{protocol: "grpc", request: &checkRequest{}})
+			l.flush()
+		}},
+		{name: "next failures are backed off", wantWarnings: 1, write: func() {
+			for i := 0; i < 3; i++ {
+				l.write(&accessLogEntry{protocol: "grpc", request: &checkRequest{}})
+				l.flush()
+			}
+		}},
+		{name: "warned about again after the backoff with the dropped writes", wantWarnings: 2, write: func() {
+			l.mu.Lock()
+			l.nextWarning = time.Time{}
+			l.mu.Unlock()
+			l.write(&accessLogEntry{protocol: "grpc", request: &checkRequest{}})
+			l.flush()
+		}},
+	}
+	for _, step := range steps {
+		step.write()
+		if got := strings.Count(out.String(), "failed to write the access log"); got != step.wantWarnings {
+			t.Fatalf("%s: got %d warnings in %q, want %d", step.name, got, out.String(), step.wantWarnings)
+		}
+	}
+	if !strings.Contains(out.String(), "dropped 4 writes") {
+		t.Fatalf("got log %q, want dropped 4 writes", out.String())
+	}
+	if l.backoff != 2*time.Second {
+		t.Fatalf("got backoff %v, want %v", l.backoff, 2*time.Second)
+	}
+}
+
+func TestAccessLogServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var out syncBuffer
+	c := DefaultConfig()
+	c.AccessLogPath = filepath.Join(dir, "access.log")
+	c.AccessLogFormat = "%PROTOCOL% %DECISION% %REQ(X-REQUEST-ID)%"
+	c.Logger = NewTextLogger(&out)
+	s := startTLSServer(t, c)
+	checkGRPC(t, s, testRequest{headers: map[string]string{"x-ext-authz": "allow", "x-request-id": "req-1"}})
+	checkHTTP(s, testRequest{headers: map[string]string{"x-request-id": "req-2"}})
+	// A failed write never fails the check.
+	s.accessLog.flush()
+	s.accessLog.mu.Lock()
+	s.accessLog.file.Close()
+	s.accessLog.mu.Unlock()
+	if !grpcAllowed(checkGRPC(t, s, testRequest{headers: map[string]string{"x-ext-authz": "allow"}})) {
+		t.Fatal("got the check denied after the access log failed")
+	}
+	s.Stop()
+	if got, want := readFile(t, c.AccessLogPath), "grpc allowed req-1\nhttp denied req-2\n"; got != want {
+		t.Fatalf("got access log %q, want %q", got, want)
+	}
+	if !strings.Contains(out.String(), "failed to write the access log") {
+		t.Fatalf("got log %q, want the failed write warned about", out.String())
+	}
+}
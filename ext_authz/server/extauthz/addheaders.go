@@ -0,0 +1,106 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// headerTemplate is a header added to the allowed upstream request, the value supports the
+// substitutions %REQ_ID% (the x-request-id header) and %DECISION_TIME% (RFC 3339 in UTC).
+type headerTemplate struct {
+	name  string
+	value string
+}
+
+func newHeaderTemplate(name, value string) (headerTemplate, error) {
+	if !httpguts.ValidHeaderFieldName(name) {
+		return headerTemplate{}, fmt.Errorf("invalid header name %q", name)
+	}
+	if !httpguts.ValidHeaderFieldValue(value) {
+		return headerTemplate{}, fmt.Errorf("invalid value of header %s", name)
+	}
+	return headerTemplate{name: strings.ToLower(name), value: value}, nil
+}
+
+// parseHeaderTemplates parses the name=value pairs of the add-headers flag.
+func parseHeaderTemplates(pairs []string) ([]headerTemplate, error) {
+	var templates []headerTemplate
+	for _, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid header %q, expected name=value", pair)
+		}
+		t, err := newHeaderTemplate(kv[0], kv[1])
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, t)
+	}
+	return templates, nil
+}
+
+// headerTemplates returns the templates of the add_headers map of a rule, sorted by name.
+func headerTemplates(headers map[string]string) ([]headerTemplate, error) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var templates []headerTemplate
+	for _, name := range names {
+		t, err := newHeaderTemplate(name, headers[name])
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, t)
+	}
+	return templates, nil
+}
+
+func (t headerTemplate) expand(request *checkRequest, now time.Time) string {
+	if !strings.Contains(t.value, "%") {
+		return t.value
+	}
+	return strings.NewReplacer(
+		"%REQ_ID%", request.header("x-request-id"),
+		"%DECISION_TIME%", now.UTC().Format(time.RFC3339),
+	).Replace(t.value)
+}
+
+// injectHeaders adds the headers of the matched rule and the -add-headers flag to the allowed
+// decision. The rule takes precedence over the flag, the headers set by the decision itself, e.g.
+// the user identity, are never replaced.
+func (s *ExtAuthzServer) injectHeaders(request *checkRequest, d *decision) {
+	if len(d.addHeaders) == 0 && len(s.addHeaders) == 0 {
+		return
+	}
+	headers := map[string]string{}
+	for k, v := range d.headers {
+		headers[k] = v
+	}
+	now := s.now()
+	for _, t := range append(d.addHeaders, s.addHeaders...) {
+		if _, ok := headers[t.name]; !ok {
+			headers[t.name] = t.expand(request, now)
+		}
+	}
+	d.headers = headers
+}
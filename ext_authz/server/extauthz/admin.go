@@ -0,0 +1,260 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	// forceNone decides the requests normally, forceAllowAll and forceDenyAll override every
+	// decision except the bypass paths and the maintenance mode.
+	forceNone     = "policy"
+	forceAllowAll = "allow-all"
+	forceDenyAll  = "deny-all"
+)
+
+func (s *ExtAuthzServer) currentDefaultAction() string {
+	return s.defaultAction.Load().(string)
+}
+
+func (s *ExtAuthzServer) currentForceMode() string {
+	return s.forceMode.Load().(string)
+}
+
+// setRuntime changes the default action or the force mode, the cached decisions of the previous
+// setting are dropped.
+func (s *ExtAuthzServer) setRuntime(defaultAction, forceMode string) {
+	if defaultAction != "" {
+		s.defaultAction.Store(defaultAction)
+	}
+	if forceMode != "" {
+		s.forceMode.Store(forceMode)
+	}
+	if s.decisionCache != nil {
+		s.decisionCache.clear()
+	}
+}
+
+// forcedDecision returns the decision of the force mode, ok is false if the requests are decided
+// normally.
+func (s *ExtAuthzServer) forcedDecision() (decision, bool) {
+	switch s.currentForceMode() {
+	case forceAllowAll:
+		return decision{allowed: true, reason: "forced " + forceAllowAll + " by the admin", detail: "forced-allow"}, true
+	case forceDenyAll:
+		return decision{reason: "forced " + forceDenyAll + " by the admin", detail: "forced-deny"}, true
+	}
+	return decision{}, false
+}
+
+// adminState is the JSON of GET /admin/state.
+type adminState struct {
+	DefaultAction    string   `json:"default_action"`
+	ForceMode        string   `json:"force_mode"`
+	LogLevel         string   `json:"log_level"`
+	Maintenance      bool     `json:"maintenance"`
+	CheckHeader      string   `json:"check_header"`
+	AllowedValues    string   `json:"allowed_values"`
+	ConfigGeneration int      `json:"config_generation"`
+	ConfigFiles      []string `json:"config_files,omitempty"`
+	PolicyRules      int      `json:"policy_rules"`
+	CacheHits        uint64   `json:"cache_hits"`
+	CacheMisses      uint64   `json:"cache_misses"`
+}
+
+func (s *ExtAuthzServer) adminState() adminState {
+	files := s.files.files()
+	state := adminState{
+		DefaultAction:    s.currentDefaultAction(),
+		ForceMode:        s.currentForceMode(),
+		LogLevel:         levelNames[s.currentLogLevel()],
+		Maintenance:      s.inMaintenance(),
+		CheckHeader:      s.checkHeader,
+		AllowedValues:    s.expectedValues(),
+		ConfigGeneration: files.generation,
+		ConfigFiles:      s.files.paths(),
+	}
+	if files.policy != nil {
+		state.PolicyRules = len(files.policy.Rules)
+	}
+	if s.decisionCache != nil {
+		state.CacheHits, state.CacheMisses = s.decisionCache.stats()
+	}
+	return state
+}
+
+// adminHandler serves the admin endpoints on the -admin-port, the POST requests require the
+// -admin-token as a bearer token if set:
+//
+//	GET  /healthz, /readyz                              see serveHealth
+//	GET  /metrics                                       see writeMetrics, only with -metrics=admin
+//	GET  /version                                       the BuildInfo as JSON
+//	GET  /stats, POST /stats/reset                      see serveStats, unless -stats=false
+//	GET  /admin/state                                   the effective settings as JSON
+//	POST /admin/default-action {"action":"allow"}       sets the default action, allow or deny
+//	POST /admin/force {"mode":"deny-all"}               sets the force mode, allow-all, deny-all or policy
+//	POST /admin/loglevel {"level":"debug"}              sets the log level, debug, info, warn or error
+//	GET|POST /admin/maintenance?on=true                 see handleMaintenance, only with -maintenance-admin
+//	GET  /debug/decisions?decision=denied               see serveDecisions, unless -decision-history=0
+//	GET  /debug/grpc                                    see writeChannelz, only with -enable-channelz
+//	GET  /debug/pprof/, /debug/vars, /debug/goroutines  see registerDebug, only with -enable-pprof
+func (s *ExtAuthzServer) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	for _, path := range []string{healthzPath, readyzPath} {
+		mux.HandleFunc(path, func(response http.ResponseWriter, request *http.Request) {
+			s.serveHealth(response, request)
+		})
+	}
+	mux.HandleFunc(versionPath, s.serveVersion)
+	for _, path := range []string{statsPath, statsResetPath} {
+		mux.HandleFunc(path, func(response http.ResponseWriter, request *http.Request) {
+			if !s.serveStats(response, request) {
+				http.NotFound(response, request)
+			}
+		})
+	}
+	if s.metrics != nil {
+		mux.HandleFunc(metricsPath, s.serveMetrics)
+	}
+	mux.HandleFunc("/admin/state", func(response http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodGet {
+			response.Header().Set("Allow", "GET")
+			http.Error(response, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.writeAdminState(response)
+	})
+	mux.HandleFunc("/admin/default-action", s.adminPost(func(body map[string]string) error {
+		action := body["action"]
+		if action != actionAllow && action != actionDeny {
+			return fmt.Errorf("action must be %s or %s but got %q", actionAllow, actionDeny, action)
+		}
+		s.setRuntime(action, "")
+		return nil
+	}))
+	mux.HandleFunc("/admin/loglevel", s.adminPost(func(body map[string]string) error {
+		level, err := parseLogLevel(body["level"])
+		if err != nil {
+			return err
+		}
+		s.setLogLevel(level)
+		return nil
+	}))
+	mux.HandleFunc("/admin/force", s.adminPost(func(body map[string]string) error {
+		mode := body["mode"]
+		if mode != forceAllowAll && mode != forceDenyAll && mode != forceNone {
+			return fmt.Errorf("mode must be %s, %s or %s but got %q", forceAllowAll, forceDenyAll, forceNone, mode)
+		}
+		s.setRuntime("", mode)
+		return nil
+	}))
+	if s.maintenanceAdmin {
+		mux.HandleFunc(maintenancePath, func(response http.ResponseWriter, request *http.Request) {
+			if request.Method == http.MethodPost && !s.adminAuthorized(request) {
+				http.Error(response, "invalid admin token", http.StatusUnauthorized)
+				return
+			}
+			s.handleMaintenance(response, request)
+		})
+	}
+	if s.history != nil {
+		mux.HandleFunc(decisionsPath, s.serveDecisions)
+	}
+	if s.channelz != nil {
+		mux.HandleFunc(grpcDebugPath, s.serveGRPCDebug)
+	}
+	if s.enablePprof {
+		registerDebug(mux, s.logger)
+	}
+	return mux
+}
+
+// adminAuthorized returns true if the request has the admin token or none is required.
+func (s *ExtAuthzServer) adminAuthorized(request *http.Request) bool {
+	if s.adminToken == "" {
+		return true
+	}
+	token := strings.TrimPrefix(request.Header.Get("authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) == 1
+}
+
+// adminPost returns the handler of a POST endpoint with a JSON object body of strings, it returns
+// the state after the change.
+func (s *ExtAuthzServer) adminPost(change func(body map[string]string) error) http.HandlerFunc {
+	return func(response http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodPost {
+			response.Header().Set("Allow", "POST")
+			http.Error(response, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !s.adminAuthorized(request) {
+			http.Error(response, "invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		var body map[string]string
+		if err := json.NewDecoder(http.MaxBytesReader(response, request.Body, 4096)).Decode(&body); err != nil {
+			http.Error(response, "body must be a JSON object of strings: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := change(body); err != nil {
+			http.Error(response, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.logger.Infof("Admin %s set %s to %v", request.RemoteAddr, request.URL.Path, body)
+		s.writeAdminState(response)
+	}
+}
+
+func (s *ExtAuthzServer) writeAdminState(response http.ResponseWriter) {
+	response.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(response).Encode(s.adminState()); err != nil {
+		s.logger.Errorf("Failed to write the admin state: %v", err)
+	}
+}
+
+// adminAddress returns the listen address of the -admin-port, a bare port is only bound to localhost.
+func adminAddress(value string) (string, error) {
+	if isPort(value) {
+		return net.JoinHostPort("127.0.0.1", value), nil
+	}
+	if _, port, err := net.SplitHostPort(value); err != nil || !isPort(port) {
+		return "", fmt.Errorf("%q must be a port or a host:port", value)
+	}
+	return value, nil
+}
+
+// startAdmin listens on the admin address and serves the admin server in the background.
+func (s *ExtAuthzServer) startAdmin(server *http.Server) error {
+	listener, err := net.Listen("tcp", s.adminAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for the admin server: %v", err)
+	}
+	s.logger.Infof("Starting admin server at http://%s (token required: %v)", listener.Addr(), s.adminToken != "")
+	go func() {
+		defer s.logger.Infof("Stopped admin server")
+		if err := serveHTTP(server, listener); err != nil {
+			s.errs <- fmt.Errorf("failed to serve admin server: %v", err)
+			return
+		}
+		s.errs <- nil
+	}()
+	return nil
+}
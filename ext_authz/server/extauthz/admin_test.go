@@ -0,0 +1,160 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// adminRequest sends the request to the admin handler, the token is sent as a bearer token if set.
+func adminRequest(s *ExtAuthzServer, method, path, body, token string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		request.Header.Set("authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	s.adminHandler().ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestAdminRuntime(t *testing.T) {
+	c := DefaultConfig()
+	c.AdminPort = "0"
+	s := newTestServer(t, c)
+	defer s.close()
+	allow := testRequest{headers: map[string]string{"x-ext-authz": "allow"}}
+	steps := []struct {
+		name    string
+		path    string
+		body    string
+		request testRequest
+		want    bool
+	}{
+		{name: "allowed by the check header", request: allow, want: true},
+		{name: "denied without the check header"},
+		{name: "deny-all overrides the check header", path: "/admin/force", body: `{"mode":"deny-all"}`, request: allow},
+		{name: "allow-all overrides the missing header", path: "/admin/force", body: `{"mode":"allow-all"}`, want: true},
+		{name: "policy decides normally again", path: "/admin/force", body: `{"mode":"policy"}`},
+		{name: "default action allow", path: "/admin/default-action", body: `{"action":"allow"}`, want: true},
+		{name: "default action deny", path: "/admin/default-action", body: `{"action":"deny"}`},
+	}
+	for _, step := range steps {
+		if step.path != "" {
+			if got := adminRequest(s, http.MethodPost, step.path, step.body, ""); got.Code != http.StatusOK {
+				t.Fatalf("%s: got admin status %d %q, want %d", step.name, got.Code, got.Body.String(), http.StatusOK)
+			}
+		}
+		// The change is observed by the next check of both protocols.
+		grpcOK, httpOK := checkBoth(t, s, step.request)
+		if grpcOK != step.want || httpOK != step.want {
+			t.Fatalf("%s: got allowed gRPC %v and HTTP %v, want %v", step.name, grpcOK, httpOK, step.want)
+		}
+	}
+}
+
+func TestAdminEndpoints(t *testing.T) {
+	cases := []struct {
+		name       string
+		token      string
+		method     string
+		path       string
+		body       string
+		sendToken  string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "state", method: http.MethodGet, path: "/admin/state", wantStatus: http.StatusOK, wantBody: `"force_mode":"policy"`},
+		{name: "state is GET only", method: http.MethodPost, path: "/admin/state", wantStatus: http.StatusMethodNotAllowed},
+		{name: "force is POST only", method: http.MethodGet, path: "/admin/force", wantStatus: http.StatusMethodNotAllowed},
+		{name: "change returns the state", method: http.MethodPost, path: "/admin/force", body: `{"mode":"deny-all"}`,
+			wantStatus: http.StatusOK, wantBody: `"force_mode":"deny-all"`},
+		{name: "invalid mode", method: http.MethodPost, path: "/admin/force", body: `{"mode":"maybe"}`,
+			wantStatus: http.StatusBadRequest, wantBody: `mode must be allow-all, deny-all or policy but got "maybe"`},
+		{name: "invalid action", method: http.MethodPost, path: "/admin/default-action", body: `{"action":"maybe"}`,
+			wantStatus: http.StatusBadRequest, wantBody: `action must be allow or deny but got "maybe"`},
+		{name: "invalid body", method: http.MethodPost, path: "/admin/force", body: `{"mode":1}`,
+			wantStatus: http.StatusBadRequest, wantBody: "body must be a JSON object of strings"},
+		{name: "missing token", token: "s3cret", method: http.MethodPost, path: "/admin/force", body: `{"mode":"deny-all"}`,
+			wantStatus: http.StatusUnauthorized},
+		{name: "wrong token", token: "s3cret", method: http.MethodPost, path: "/admin/force", body: `{"mode":"deny-all"}`,
+			sendToken: "guess", wantStatus: http.StatusUnauthorized},
+		{name: "token", token: "s3cret", method: http.MethodPost, path: "/admin/force", body: `{"mode":"deny-all"}`,
+			sendToken: "s3cret", wantStatus: http.StatusOK},
+		{name: "state needs no token", token: "s3cret", method: http.MethodGet, path: "/admin/state", wantStatus: http.StatusOK},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.AdminPort = "0"
+			c.AdminToken = tc.token
+			s := newTestServer(t, c)
+			defer s.close()
+			got := adminRequest(s, tc.method, tc.path, tc.body, tc.sendToken)
+			if got.Code != tc.wantStatus || !strings.Contains(got.Body.String(), tc.wantBody) {
+				t.Fatalf("got status %d %q, want %d %q", got.Code, got.Body.String(), tc.wantStatus, tc.wantBody)
+			}
+		})
+	}
+}
+
+func TestAdminState(t *testing.T) {
+	c := DefaultConfig()
+	c.AdminPort = "0"
+	c.CheckHeader = "x-team"
+	c.AllowedValues = "payments,search"
+	s := newTestServer(t, c)
+	defer s.close()
+	got := adminRequest(s, http.MethodGet, "/admin/state", "", "")
+	if content := got.Header().Get("content-type"); content != "application/json" {
+		t.Fatalf("got content-type %q, want application/json", content)
+	}
+	var state adminState
+	if err := json.Unmarshal(got.Body.Bytes(), &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.DefaultAction != actionDeny || state.ForceMode != forceNone || state.CheckHeader != "x-team" ||
+		!strings.Contains(state.AllowedValues, "payments") || state.LogLevel != "info" {
+		t.Fatalf("got state %+v", state)
+	}
+}
+
+func TestAdminAddress(t *testing.T) {
+	cases := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{value: "9100", want: "127.0.0.1:9100"},
+		{value: "0.0.0.0:9100", want: "0.0.0.0:9100"},
+		{value: "localhost:9100", want: "localhost:9100"},
+		{value: "admin", wantErr: true},
+		{value: "127.0.0.1:admin", wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.value, func(t *testing.T) {
+			got, err := adminAddress(tc.value)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
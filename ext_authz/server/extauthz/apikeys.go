@@ -0,0 +1,124 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+const clientHeader = "x-ext-authz-client"
+
+// apiKey is the metadata of an API key in the keys file.
+type apiKey struct {
+	Owner string `yaml:"owner"`
+	// Paths are the allowed path prefixes, all paths are allowed if empty.
+	Paths []string `yaml:"paths"`
+	// DailyQuota is the number of allowed requests per UTC day, unlimited if 0.
+	DailyQuota int64 `yaml:"daily_quota"`
+}
+
+// apiKeyStore holds the API keys loaded from the keys file. The keys are indexed by their SHA-256
+// hash so a lookup never compares the raw key.
+//
+// Example (JSON is also accepted):
+//
+//	key-for-team-a:
+//	  owner: team-a
+//	  paths: [/api/a/, /status]
+//	  daily_quota: 1000
+type apiKeyStore struct {
+	mu   sync.RWMutex
+	keys map[[sha256.Size]byte]*apiKey
+}
+
+func loadAPIKeys(file string) (*apiKeyStore, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API keys file: %v", err)
+	}
+	var raw map[string]*apiKey
+	if err := yaml.UnmarshalStrict(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse API keys file %s: %v", file, err)
+	}
+	store := &apiKeyStore{keys: map[[sha256.Size]byte]*apiKey{}}
+	for key, meta := range raw {
+		if key == "" || meta == nil || meta.Owner == "" {
+			return nil, fmt.Errorf("invalid API keys file %s: every key must have an owner", file)
+		}
+		if meta.DailyQuota < 0 {
+			return nil, fmt.Errorf("invalid API keys file %s: daily_quota of %s must not be negative", file, meta.Owner)
+		}
+		store.keys[sha256.Sum256([]byte(key))] = meta
+	}
+	return store, nil
+}
+
+func (a *apiKeyStore) lookup(key string) (*apiKey, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	meta, ok := a.keys[sha256.Sum256([]byte(key))]
+	return meta, ok
+}
+
+func (a *apiKeyStore) size() int {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return len(a.keys)
+}
+
+func (k *apiKey) allowsPath(path string) bool {
+	if len(k.Paths) == 0 {
+		return true
+	}
+	for _, prefix := range k.Paths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// apiKeyDecision returns the decision for a request in the API key mode.
+func (s *ExtAuthzServer) apiKeyDecision(request *checkRequest) decision {
+	key := request.header(s.apiKeyHeader)
+	if key == "" {
+		return decision{reason: "missing API key in " + s.apiKeyHeader, status: http.StatusUnauthorized}
+	}
+	meta, ok := request.files.apiKeys.lookup(key)
+	if !ok {
+		return decision{reason: "unknown API key", status: http.StatusUnauthorized}
+	}
+	if !meta.allowsPath(request.urlPath) {
+		return decision{reason: "API key of " + meta.Owner + " is not allowed for " + request.urlPath, status: http.StatusForbidden}
+	}
+	d := decision{allowed: true, reason: "valid API key of " + meta.Owner, headers: map[string]string{clientHeader: meta.Owner}}
+	if meta.DailyQuota > 0 {
+		denied, remaining, exceeded := s.quotaDecision(request, key, meta)
+		if exceeded {
+			return denied
+		}
+		if remaining >= 0 {
+			d.headers[quotaRemainingHeader] = fmt.Sprint(remaining)
+		}
+	}
+	return d
+}
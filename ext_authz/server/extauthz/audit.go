@@ -0,0 +1,277 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/golang/protobuf/jsonpb"
+)
+
+const (
+	// auditLogQueue is the number of the records queued for the writer, more are dropped.
+	auditLogQueue = 4096
+	// auditLogFlushInterval bounds the time a record stays in the buffer while more are queued.
+	auditLogFlushInterval = time.Second
+)
+
+// auditRecord is a line of the audit log.
+type auditRecord struct {
+	// Seq increases by one per written record, the dropped records are only counted.
+	Seq      uint64    `json:"seq"`
+	Time     time.Time `json:"ts"`
+	Protocol string    `json:"protocol"`
+	Decision string    `json:"decision"`
+	Reason   string    `json:"reason"`
+	Detail   string    `json:"detail"`
+	Rule     string    `json:"rule"`
+	// Attributes are the redacted Envoy attributes of the gRPC check request, or the request view
+	// of the HTTP and ext_proc check requests.
+	Attributes interface{} `json:"attributes"`
+}
+
+// auditRequest is the request view of the check requests without Envoy attributes.
+type auditRequest struct {
+	Method     string            `json:"method,omitempty"`
+	Host       string            `json:"host,omitempty"`
+	Path       string            `json:"path,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	SourceIP   string            `json:"source_ip,omitempty"`
+	PolicyName string            `json:"policy,omitempty"`
+	Body       string            `json:"body,omitempty"`
+}
+
+// auditAttributes marshals the Envoy attributes in the writer with the proto field names.
+type auditAttributes struct {
+	attributes *auth.AttributeContext
+}
+
+func (a auditAttributes) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := (&jsonpb.Marshaler{OrigName: true}).Marshal(&buf, a.attributes); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// auditLog appends every decision as a JSON line to a file, rotated to the path with .1 appended
+// once it exceeds maxBytes. The records are written by a dedicated goroutine so that the check
+// requests never wait for the file.
+type auditLog struct {
+	// dropped comes first for the alignment of the atomic on 32-bit platforms.
+	dropped uint64
+	// seq is only used by the writer.
+	seq    uint64
+	path   string
+	logger Logger
+	// maxBytes rotates the file if positive.
+	maxBytes int64
+	records  chan *auditRecord
+	stop     chan struct{}
+	done     chan struct{}
+	file     *os.File
+	writer   *bufio.Writer
+	size     int64
+}
+
+func newAuditLog(path string, maxMB int, logger Logger) (*auditLog, error) {
+	if maxMB < 0 {
+		return nil, fmt.Errorf("-audit-log-max-mb must not be negative but got %d", maxMB)
+	}
+	return &auditLog{
+		path:     path,
+		logger:   logger,
+		maxBytes: int64(maxMB) << 20,
+		records:  make(chan *auditRecord, auditLogQueue),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// start opens the file and starts the writer, it does nothing if nil.
+func (l *auditLog) start() error {
+	if l == nil {
+		return nil
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+	go l.run()
+	return nil
+}
+
+func (l *auditLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open the audit log: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open the audit log: %v", err)
+	}
+	l.file, l.writer, l.size = file, bufio.NewWriter(file), info.Size()
+	return nil
+}
+
+// record queues the record, it is dropped if the queue is full. It does nothing if nil.
+func (l *auditLog) record(r *auditRecord) {
+	if l == nil {
+		return
+	}
+	select {
+	case l.records <- r:
+	default:
+		atomic.AddUint64(&l.dropped, 1)
+	}
+}
+
+// droppedRecords returns the number of the records dropped for the full queue.
+func (l *auditLog) droppedRecords() uint64 {
+	return atomic.LoadUint64(&l.dropped)
+}
+
+func (l *auditLog) run() {
+	defer close(l.done)
+	ticker := time.NewTicker(auditLogFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case r := <-l.records:
+			l.write(r)
+			// The buffer is flushed once the queue is drained.
+			if len(l.records) == 0 {
+				l.flush()
+			}
+		case <-ticker.C:
+			l.flush()
+		case <-l.stop:
+			for {
+				select {
+				case r := <-l.records:
+					l.write(r)
+				default:
+					l.flush()
+					l.file.Close()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (l *auditLog) write(r *auditRecord) {
+	l.seq++
+	r.Seq = l.seq
+	data, err := json.Marshal(r)
+	if err != nil {
+		l.logger.Warnf("failed to marshal the audit record %d: %v", r.Seq, err)
+		return
+	}
+	data = append(data, '\n')
+	if l.maxBytes > 0 && l.size > 0 && l.size+int64(len(data)) > l.maxBytes {
+		l.rotate()
+	}
+	n, err := l.writer.Write(data)
+	l.size += int64(n)
+	if err != nil {
+		l.logger.Warnf("failed to write the audit record %d to %s: %v", r.Seq, l.path, err)
+		l.writer.Reset(l.file)
+	}
+}
+
+func (l *auditLog) flush() {
+	if err := l.writer.Flush(); err != nil {
+		l.logger.Warnf("failed to flush the audit log %s: %v", l.path, err)
+		l.writer.Reset(l.file)
+	}
+}
+
+// rotate renames the file to the path with .1 appended, replacing the previous one, and continues
+// in a new file. The current file is kept if it fails.
+func (l *auditLog) rotate() {
+	l.flush()
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		l.logger.Errorf("Failed to rotate the audit log %s, keeping the current file: %v", l.path, err)
+		return
+	}
+	previous := l.file
+	if err := l.open(); err != nil {
+		l.logger.Errorf("Failed to rotate the audit log %s, keeping the current file: %v", l.path, err)
+		l.writer = bufio.NewWriter(previous)
+		l.file = previous
+		return
+	}
+	previous.Close()
+	l.logger.Infof("Rotated the audit log %s at %d bytes", l.path, l.maxBytes)
+}
+
+// close writes the queued records and closes the file, it does nothing if nil or not started. The
+// records of the check requests still in flight are dropped.
+func (l *auditLog) close() {
+	if l == nil || l.file == nil {
+		return
+	}
+	close(l.stop)
+	<-l.done
+	if dropped := l.droppedRecords(); dropped != 0 {
+		l.logger.Warnf("dropped %d audit records for the full queue", dropped)
+	}
+}
+
+// auditDecision queues the decision of the check request with the redacted attributes.
+func (s *ExtAuthzServer) auditDecision(protocol string, request *checkRequest, d decision, start time.Time) {
+	if s.auditLog == nil {
+		return
+	}
+	r := &auditRecord{
+		Time:     start,
+		Protocol: protocol,
+		Decision: d.result(),
+		Reason:   d.reason,
+		Detail:   d.resultDetail(),
+		Rule:     d.ruleName(),
+	}
+	if request.attributes != nil {
+		r.Attributes = auditAttributes{attributes: s.redactAttributes(request.attributes)}
+	} else {
+		view := auditRequest{
+			Method:     request.method,
+			Host:       request.host,
+			Path:       s.redactPath(request.path),
+			Headers:    make(map[string]string, len(request.headers)),
+			PolicyName: request.policyName,
+			Body:       string(request.body),
+		}
+		for name, value := range request.headers {
+			if sensitiveHeaders[name] {
+				value = redacted
+			}
+			view.Headers[name] = value
+		}
+		if request.sourceIP != nil {
+			view.SourceIP = request.sourceIP.String()
+		}
+		r.Attributes = view
+	}
+	s.auditLog.record(r)
+}
@@ -0,0 +1,271 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// auditLine is the decoded line of the audit log.
+type auditLine struct {
+	Seq        uint64                 `json:"seq"`
+	Protocol   string                 `json:"protocol"`
+	Decision   string                 `json:"decision"`
+	Rule       string                 `json:"rule"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+// readAuditLog decodes the NDJSON lines of the audit log, every line must be a JSON object.
+func readAuditLog(t *testing.T, path string) (lines []auditLine, raw string) {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var line auditLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("got invalid line %q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	if len(data) != 0 && data[len(data)-1] != '\n' {
+		t.Fatalf("got the last line %q without a newline", data)
+	}
+	return lines, string(data)
+}
+
+func tempAuditPath(t *testing.T) (path string, remove func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "audit.log"), func() { os.RemoveAll(dir) }
+}
+
+func TestAuditLogConcurrentChecks(t *testing.T) {
+	path, remove := tempAuditPath(t)
+	defer remove()
+	c := DefaultConfig()
+	c.AuditLogPath = path
+	s := startTLSServer(t, c)
+	const checks = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, checks)
+	for i := 0; i < checks; i++ {
+		wg.Add(2)
+		r := testRequest{path: fmt.Sprintf("/items/%d", i), headers: map[string]string{
+			"x-ext-authz": "allow", "authorization": "Bearer s3cret", "cookie": "session=c00kie"}}
+		go func() {
+			defer wg.Done()
+			if _, err := s.Check(context.Background(), r.grpc()); err != nil {
+				errs <- err
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			checkHTTP(s, r)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	// Stop writes the queued records.
+	s.Stop()
+	lines, raw := readAuditLog(t, path)
+	if len(lines) != 2*checks {
+		t.Fatalf("got %d lines, want %d", len(lines), 2*checks)
+	}
+	if strings.Contains(raw, "s3cret") || strings.Contains(raw, "c00kie") {
+		t.Fatal("got the sensitive header values in the audit log")
+	}
+	protocols := map[string]int{}
+	for i, line := range lines {
+		if line.Seq != uint64(i+1) {
+			t.Fatalf("got sequence number %d on line %d, want %d", line.Seq, i+1, i+1)
+		}
+		if line.Decision != "allowed" || line.Attributes == nil {
+			t.Fatalf("got line %+v, want allowed with the attributes", line)
+		}
+		protocols[line.Protocol]++
+	}
+	if protocols["grpc"] != checks || protocols["http"] != checks {
+		t.Fatalf("got lines per protocol %v, want %d each", protocols, checks)
+	}
+}
+
+func TestAuditAttributes(t *testing.T) {
+	path, remove := tempAuditPath(t)
+	defer remove()
+	c := DefaultConfig()
+	c.AuditLogPath = path
+	s := startTLSServer(t, c)
+	r := testRequest{method: "PUT", host: "example.com", path: "/items", sourceIP: "10.0.0.1",
+		headers: map[string]string{"authorization": "Bearer s3cret", "x-team": "payments"}}
+	checkGRPC(t, s, r)
+	checkHTTP(s, r)
+	s.Stop()
+	lines, _ := readAuditLog(t, path)
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2", len(lines))
+	}
+	cases := []struct {
+		name string
+		line auditLine
+		// want are the values of the attribute paths, the gRPC attributes keep the proto field names.
+		want map[string]interface{}
+	}{
+		{name: "grpc", line: lines[0], want: map[string]interface{}{
+			"request.http.method":                   "PUT",
+			"request.http.host":                     "example.com",
+			"request.http.headers.authorization":    redacted,
+			"request.http.headers.x-team":           "payments",
+			"source.address.socket_address.address": "10.0.0.1",
+		}},
+		{name: "http", line: lines[1], want: map[string]interface{}{
+			"method":                "PUT",
+			"host":                  "example.com",
+			"path":                  "/items",
+			"headers.authorization": redacted,
+			"headers.x-team":        "payments",
+			"source_ip":             "10.0.0.1",
+		}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.line.Protocol != tc.name || tc.line.Decision != "denied" || tc.line.Rule != "default" {
+				t.Fatalf("got line %+v", tc.line)
+			}
+			for key, want := range tc.want {
+				var got interface{} = tc.line.Attributes
+				for _, field := range strings.Split(key, ".") {
+					m, _ := got.(map[string]interface{})
+					got = m[field]
+				}
+				if got != want {
+					t.Fatalf("got attribute %s %v, want %v", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	path, remove := tempAuditPath(t)
+	defer remove()
+	l, err := newAuditLog(path, 1, NewTextLogger(ioutil.Discard))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The file is rotated before the record that would exceed the limit.
+	l.maxBytes = 400
+	if err := l.start(); err != nil {
+		t.Fatal(err)
+	}
+	const records = 10
+	for i := 0; i < records; i++ {
+		l.record(&auditRecord{Protocol: "grpc", Decision: "allowed", Attributes: auditRequest{Path: fmt.Sprintf("/items/%d", i)}})
+	}
+	l.close()
+	rotated, _ := readAuditLog(t, path+".1")
+	current, _ := readAuditLog(t, path)
+	if len(rotated) == 0 || len(current) == 0 {
+		t.Fatalf("got %d rotated and %d current lines, want both", len(rotated), len(current))
+	}
+	// Earlier rotated files are replaced, the sequence numbers continue across the last two.
+	lines := append(rotated, current...)
+	last := lines[len(lines)-1].Seq
+	if last != records {
+		t.Fatalf("got last sequence number %d, want %d", last, records)
+	}
+	for i := 1; i < len(lines); i++ {
+		if lines[i].Seq != lines[i-1].Seq+1 {
+			t.Fatalf("got sequence number %d after %d", lines[i].Seq, lines[i-1].Seq)
+		}
+	}
+	for _, file := range []string{path, path + ".1"} {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > l.maxBytes {
+			t.Fatalf("got %s of %d bytes, want at most %d", file, info.Size(), l.maxBytes)
+		}
+	}
+}
+
+func TestAuditLogDropsWhenFull(t *testing.T) {
+	path, remove := tempAuditPath(t)
+	defer remove()
+	var out syncBuffer
+	l, err := newAuditLog(path, 0, NewTextLogger(&out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The writer is not started, the records beyond the queue never block.
+	l.records = make(chan *auditRecord, 2)
+	for i := 0; i < 5; i++ {
+		l.record(&auditRecord{Protocol: "grpc"})
+	}
+	if got := l.droppedRecords(); got != 3 {
+		t.Fatalf("got %d dropped records, want 3", got)
+	}
+	if err := l.start(); err != nil {
+		t.Fatal(err)
+	}
+	l.close()
+	if lines, _ := readAuditLog(t, path); len(lines) != 2 {
+		t.Fatalf("got %d lines, want the 2 queued", len(lines))
+	}
+	if !strings.Contains(out.String(), "dropped 3 audit records for the full queue") {
+		t.Fatalf("got log %q, want the dropped records warned about", out.String())
+	}
+}
+
+func TestNewAuditLog(t *testing.T) {
+	cases := []struct {
+		name    string
+		maxMB   int
+		wantErr string
+	}{
+		{name: "never rotated"},
+		{name: "rotated", maxMB: 100},
+		{name: "negative", maxMB: -1, wantErr: "-audit-log-max-mb must not be negative but got -1"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.AuditLogPath = filepath.Join(os.TempDir(), "audit.log")
+			c.AuditLogMaxMB = tc.maxMB
+			if got := newServerError(c); (tc.wantErr == "") != (got == "") || !strings.Contains(got, tc.wantErr) {
+				t.Fatalf("got error %q, want %q", got, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+)
+
+// partialBodyHeader is set by Envoy if the body in the check request is truncated by max_request_bytes.
+const partialBodyHeader = "x-envoy-auth-partial-body"
+
+func (s *ExtAuthzServer) bodyRulesEnabled() bool {
+	return len(s.bodyMustContain) != 0 || len(s.bodyMustNotContain) != 0
+}
+
+// grpcBody returns the body forwarded by Envoy with_request_body, capped at maxBodyBytes.
+func (s *ExtAuthzServer) grpcBody(httpAttrs *auth.AttributeContext_HttpRequest) (body []byte, truncated bool) {
+	body = httpAttrs.GetRawBody()
+	if len(body) == 0 {
+		body = []byte(httpAttrs.GetBody())
+	}
+	truncated = httpAttrs.GetHeaders()[partialBodyHeader] == "true" || int64(len(body)) < httpAttrs.GetSize()
+	if int64(len(body)) > s.maxBodyBytes {
+		body, truncated = body[:s.maxBodyBytes], true
+	}
+	return body, truncated
+}
+
+// httpBody reads at most maxBodyBytes of the request body and closes it.
+func (s *ExtAuthzServer) httpBody(request *http.Request) (body []byte, truncated bool) {
+	defer request.Body.Close()
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, request.Body, s.maxBodyBytes))
+	if err != nil {
+		// MaxBytesReader fails once the limit is exceeded, keep the part that has been read.
+		return body, true
+	}
+	return body, false
+}
+
+// bodyDecision returns a denied decision if the body violates the body rules, ok is false otherwise.
+func (s *ExtAuthzServer) bodyDecision(request *checkRequest) (decision, bool) {
+	if request.bodyTruncated {
+		s.logger.Infof("Body of %s%s is incomplete, only the first %d bytes are checked",
+			request.host, s.redactPath(request.path), len(request.body))
+	}
+	for _, text := range s.bodyMustContain {
+		if !bytes.Contains(request.body, []byte(text)) {
+			return decision{reason: "body does not contain " + text}, true
+		}
+	}
+	for _, text := range s.bodyMustNotContain {
+		if bytes.Contains(request.body, []byte(text)) {
+			return decision{reason: "body contains " + text}, true
+		}
+	}
+	return decision{}, false
+}
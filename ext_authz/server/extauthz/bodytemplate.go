@@ -0,0 +1,120 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"io/ioutil"
+	"mime"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// maxTemplateBodyBytes caps the rendered denied body.
+const maxTemplateBodyBytes = 64 * 1024
+
+var errBodyTooLarge = errors.New("rendered body exceeds the size limit")
+
+// bodyTemplate renders the denied body per request from a text/template file, HTML files use
+// html/template with the same syntax so that the request details are escaped.
+type bodyTemplate struct {
+	template interface {
+		Execute(w io.Writer, data interface{}) error
+	}
+	contentType string
+}
+
+// bodyTemplateData are the fields available to the denied body template.
+type bodyTemplateData struct {
+	Method    string
+	Path      string
+	Host      string
+	Reason    string
+	RequestID string
+	Status    int
+}
+
+// loadBodyTemplate parses the template file and validates it by rendering sample data.
+func loadBodyTemplate(file string) (*bodyTemplate, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read denied body template: %v", err)
+	}
+	b := &bodyTemplate{contentType: textContentType}
+	if contentType := mime.TypeByExtension(filepath.Ext(file)); contentType != "" {
+		b.contentType = contentType
+	}
+	name := filepath.Base(file)
+	if strings.HasPrefix(b.contentType, "text/html") {
+		b.template, err = htmltemplate.New(name).Option("missingkey=error").Parse(string(data))
+	} else {
+		b.template, err = template.New(name).Option("missingkey=error").Parse(string(data))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse denied body template: %v", err)
+	}
+	sample := bodyTemplateData{Method: "GET", Path: "/", Host: "example.com", Reason: "denied", RequestID: "id", Status: 403}
+	if _, err := b.render(sample); err != nil {
+		return nil, fmt.Errorf("failed to render denied body template: %v", err)
+	}
+	return b, nil
+}
+
+// limitedBuffer fails the writes beyond the limit so that a template cannot render a huge body.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > b.limit {
+		return 0, errBodyTooLarge
+	}
+	return b.Buffer.Write(p)
+}
+
+func (b *bodyTemplate) render(data bodyTemplateData) (string, error) {
+	buf := &limitedBuffer{limit: maxTemplateBodyBytes}
+	if err := b.template.Execute(buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// templateBody renders the denied body of the request, ok is false if there is no template or it
+// fails to render so that the static body is used instead.
+func (s *ExtAuthzServer) templateBody(request *checkRequest, d decision) (string, bool) {
+	if s.bodyTemplate == nil {
+		return "", false
+	}
+	body, err := s.bodyTemplate.render(bodyTemplateData{
+		Method:    request.method,
+		Path:      s.redactPath(request.path),
+		Host:      request.host,
+		Reason:    d.reason,
+		RequestID: request.header("x-request-id"),
+		Status:    d.deniedStatus(),
+	})
+	if err != nil {
+		s.logger.Errorf("Failed to render the denied body template, using the static body: %v", err)
+		return "", false
+	}
+	return body, true
+}
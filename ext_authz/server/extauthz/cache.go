@@ -0,0 +1,249 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// decisionCacheStatsInterval is how often the hit and miss counters are logged.
+const decisionCacheStatsInterval = time.Minute
+
+// decisionCache caches the evaluated decisions for ttl, the least recently used decision is evicted
+// once maxEntries is reached.
+type decisionCache struct {
+	ttl        time.Duration
+	maxEntries int
+	// ignoredHeaders are the lowercase headers excluded from the key, all other headers are included.
+	ignoredHeaders map[string]bool
+	logger         Logger
+
+	hits   uint64
+	misses uint64
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[[sha256.Size]byte]*list.Element
+	// stop ends the logging of the counters.
+	stop chan struct{}
+}
+
+type cachedDecision struct {
+	key      [sha256.Size]byte
+	decision decision
+	expires  time.Time
+}
+
+func newDecisionCache(ttl time.Duration, maxEntries int, ignoredHeaders []string, logger Logger) *decisionCache {
+	c := &decisionCache{
+		ttl:            ttl,
+		maxEntries:     maxEntries,
+		ignoredHeaders: map[string]bool{},
+		logger:         logger,
+		lru:            list.New(),
+		entries:        map[[sha256.Size]byte]*list.Element{},
+		stop:           make(chan struct{}),
+	}
+	for _, name := range ignoredHeaders {
+		c.ignoredHeaders[name] = true
+	}
+	return c
+}
+
+// start logs the counters periodically, it does nothing if nil.
+func (c *decisionCache) start() {
+	if c != nil {
+		go c.logStats()
+	}
+}
+
+// logStats logs the hit and miss counters if they changed until the cache is closed.
+func (c *decisionCache) logStats() {
+	ticker := time.NewTicker(decisionCacheStatsInterval)
+	defer ticker.Stop()
+	var lastHits, lastMisses uint64
+	for {
+		select {
+		case <-ticker.C:
+			hits, misses := c.stats()
+			if hits != lastHits || misses != lastMisses {
+				c.logger.Infof("Decision cache has %d hits and %d misses", hits, misses)
+				lastHits, lastMisses = hits, misses
+			}
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// close stops logging the counters, it does nothing if nil.
+func (c *decisionCache) close() {
+	if c == nil {
+		return
+	}
+	close(c.stop)
+}
+
+// stats returns the hit and miss counters.
+func (c *decisionCache) stats() (hits, misses uint64) {
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
+
+// key hashes the request attributes the decision depends on.
+func (c *decisionCache) key(request *checkRequest) [sha256.Size]byte {
+	h := sha256.New()
+	source := ""
+	if request.sourceIP != nil {
+		source = request.sourceIP.String()
+	}
+	parts := []string{request.method, request.host, request.path, source, request.policyName}
+	names := make([]string, 0, len(request.headers))
+	for name := range request.headers {
+		if !c.ignoredHeaders[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		parts = append(parts, name+":"+request.headers[name])
+	}
+	// The separator cannot appear in valid header values.
+	h.Write([]byte(strings.Join(parts, "\x00")))
+	var key [sha256.Size]byte
+	copy(key[:], h.Sum(nil))
+	return key
+}
+
+// size returns the number of cached decisions including the expired ones not evicted yet.
+func (c *decisionCache) size() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// clear drops all cached decisions.
+func (c *decisionCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[[sha256.Size]byte]*list.Element{}
+	c.lru.Init()
+}
+
+func (c *decisionCache) get(key [sha256.Size]byte) (decision, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || time.Now().After(e.Value.(*cachedDecision).expires) {
+		if ok {
+			c.lru.Remove(e)
+			delete(c.entries, key)
+		}
+		atomic.AddUint64(&c.misses, 1)
+		return decision{}, false
+	}
+	atomic.AddUint64(&c.hits, 1)
+	c.lru.MoveToFront(e)
+	return e.Value.(*cachedDecision).decision.clone(), true
+}
+
+// put caches the decision for the TTL, or until expires if earlier and not zero.
+func (c *decisionCache) put(key [sha256.Size]byte, d decision, expires time.Time) {
+	if deadline := time.Now().Add(c.ttl); expires.IsZero() || deadline.Before(expires) {
+		expires = deadline
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.lru.Remove(e)
+	}
+	c.entries[key] = c.lru.PushFront(&cachedDecision{key: key, decision: d.clone(), expires: expires})
+	for c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Remove(c.lru.Back()).(*cachedDecision)
+		delete(c.entries, oldest.key)
+	}
+}
+
+// clone returns a copy of the decision that does not share the headers.
+func (d decision) clone() decision {
+	if d.headers != nil {
+		headers := make(map[string]string, len(d.headers))
+		for k, v := range d.headers {
+			headers[k] = v
+		}
+		d.headers = headers
+	}
+	if d.headersToRemove != nil {
+		d.headersToRemove = append([]string(nil), d.headersToRemove...)
+	}
+	if d.addHeaders != nil {
+		d.addHeaders = append([]headerTemplate(nil), d.addHeaders...)
+	}
+	if d.querySet != nil {
+		d.querySet = append([]queryRequirement(nil), d.querySet...)
+	}
+	if d.queryRemove != nil {
+		d.queryRemove = append([]string(nil), d.queryRemove...)
+	}
+	if d.overwrite != nil {
+		overwrite := make(map[string]bool, len(d.overwrite))
+		for k, v := range d.overwrite {
+			overwrite[k] = v
+		}
+		d.overwrite = overwrite
+	}
+	return d
+}
+
+// cacheable returns true if the decision of the request can be cached. The decisions that depend on
+// state changed by every request, e.g. rate limits and nonces, are never cached.
+func (s *ExtAuthzServer) cacheable(request *checkRequest) bool {
+	if s.decisionCache == nil || s.inMaintenance() || s.currentForceMode() != forceNone {
+		return false
+	}
+	if s.rateLimiter != nil || s.nonces != nil || s.quotas != nil || s.bodyRulesEnabled() {
+		return false
+	}
+	for _, directive := range strings.Split(request.header("cache-control"), ",") {
+		if strings.EqualFold(strings.TrimSpace(directive), "no-cache") {
+			return false
+		}
+	}
+	return true
+}
+
+// cachedEvaluate returns the cached decision of the request, or evaluates and caches it.
+func (s *ExtAuthzServer) cachedEvaluate(request *checkRequest) decision {
+	if !s.cacheable(request) {
+		return s.evaluate(request)
+	}
+	key := s.decisionCache.key(request)
+	if d, ok := s.decisionCache.get(key); ok {
+		d.reason = "cached " + d.reason
+		return d
+	}
+	d := s.evaluate(request)
+	// The decision of a time window would outlive the window if cached, the decision of a
+	// time-dependent credential is only cached until it changes.
+	if !request.timed && (request.expires.IsZero() || time.Now().Before(request.expires)) {
+		s.decisionCache.put(key, d, request.expires)
+	}
+	return d
+}
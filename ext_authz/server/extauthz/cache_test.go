@@ -0,0 +1,165 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is the decision clock of a test, it is advanced by the test.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) time() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+func TestCacheTimeDependentCredentials(t *testing.T) {
+	// The credentials change within lifetime of the cached decision, far below the cache TTL.
+	const lifetime = 50 * time.Millisecond
+	signed := time.Unix(1700000000, 0)
+	secret := []byte("s3cret")
+	cases := []struct {
+		name      string
+		configure func(c *Config)
+		// request returns the request of the credential and the decision clock before and after
+		// the credential changes.
+		request      func(t *testing.T, s *ExtAuthzServer) (r testRequest, before, after time.Time)
+		wantAllowed  bool
+		wantAfterAll bool
+	}{
+		{name: "JWT expires", configure: func(c *Config) {
+			c.JWTHS256Secret = string(secret)
+			c.JWTClockSkew = 0
+		}, request: func(t *testing.T, s *ExtAuthzServer) (testRequest, time.Time, time.Time) {
+			token := signJWT(t, "", secret, map[string]interface{}{"sub": "alice", "exp": float64(signed.Unix())})
+			return testRequest{headers: map[string]string{"authorization": "Bearer " + token}},
+				signed.Add(-lifetime), signed.Add(time.Second)
+		}, wantAllowed: true},
+		{name: "JWT expires with the clock skew", configure: func(c *Config) {
+			c.JWTHS256Secret = string(secret)
+			c.JWTClockSkew = time.Minute
+		}, request: func(t *testing.T, s *ExtAuthzServer) (testRequest, time.Time, time.Time) {
+			token := signJWT(t, "", secret, map[string]interface{}{"sub": "alice", "exp": float64(signed.Unix())})
+			return testRequest{headers: map[string]string{"authorization": "Bearer " + token}},
+				signed.Add(time.Minute - lifetime), signed.Add(time.Minute + time.Second)
+		}, wantAllowed: true},
+		{name: "JWT becomes valid", configure: func(c *Config) {
+			c.JWTHS256Secret = string(secret)
+			c.JWTClockSkew = 0
+		}, request: func(t *testing.T, s *ExtAuthzServer) (testRequest, time.Time, time.Time) {
+			token := signJWT(t, "", secret, map[string]interface{}{"sub": "alice", "nbf": float64(signed.Unix())})
+			return testRequest{headers: map[string]string{"authorization": "Bearer " + token}},
+				signed.Add(-lifetime), signed
+		}, wantAfterAll: true},
+		{name: "signature timestamp becomes stale", configure: func(c *Config) {
+			c.HMACSecret = string(secret)
+			c.HMACMaxSkew = time.Second
+		}, request: func(t *testing.T, s *ExtAuthzServer) (testRequest, time.Time, time.Time) {
+			timestamp := strconv.FormatInt(signed.Unix(), 10)
+			return testRequest{method: "GET", path: "/items", headers: map[string]string{
+					SignatureHeader: Signature(secret, "GET", "/items", timestamp, ""), TimestampHeader: timestamp}},
+				signed.Add(time.Second - lifetime), signed.Add(2 * time.Second)
+		}, wantAllowed: true},
+		{name: "session expires", configure: func(c *Config) {
+			c.SessionCookieName = "session"
+			c.SessionSecret = string(secret)
+			c.SessionTTL = lifetime
+		}, request: func(t *testing.T, s *ExtAuthzServer) (testRequest, time.Time, time.Time) {
+			// The sessions expire with time.Now, the decision clock is not used.
+			cookie, err := s.sessions.create()
+			if err != nil {
+				t.Fatal(err)
+			}
+			return testRequest{headers: map[string]string{"cookie": "session=" + cookie}}, signed, signed
+		}, wantAllowed: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.CacheTTL = time.Minute
+			tc.configure(&c)
+			s := newTestServer(t, c)
+			defer s.close()
+			clock := &fakeClock{}
+			s.clock = clock.time
+			r, before, after := tc.request(t, s)
+			clock.set(before)
+			if got := grpcAllowed(checkGRPC(t, s, r)); got != tc.wantAllowed {
+				t.Fatalf("got allowed %v before the credential changes, want %v", got, tc.wantAllowed)
+			}
+			clock.set(after)
+			time.Sleep(2 * lifetime)
+			// The cached decision expired with the credential.
+			if got := grpcAllowed(checkGRPC(t, s, r)); got != tc.wantAfterAll {
+				t.Fatalf("got allowed %v after the credential changed, want %v", got, tc.wantAfterAll)
+			}
+		})
+	}
+}
+
+func TestCacheCredentialWithinLifetime(t *testing.T) {
+	secret := []byte("s3cret")
+	c := DefaultConfig()
+	c.CacheTTL = time.Minute
+	c.JWTHS256Secret = string(secret)
+	s := newTestServer(t, c)
+	defer s.close()
+	token := signJWT(t, "", secret, map[string]interface{}{"sub": "alice", "exp": float64(time.Now().Add(time.Hour).Unix())})
+	r := testRequest{headers: map[string]string{"authorization": "Bearer " + token}}
+	checkGRPC(t, s, r)
+	// The decision of the token is cached until it expires.
+	hits, _ := s.decisionCache.stats()
+	if !grpcAllowed(checkGRPC(t, s, r)) {
+		t.Fatal("got the cached decision denied")
+	}
+	if got, _ := s.decisionCache.stats(); got != hits+1 {
+		t.Fatalf("got %d cache hits, want %d", got, hits+1)
+	}
+}
+
+func TestCacheRendersAddedHeaders(t *testing.T) {
+	c := DefaultConfig()
+	c.CacheTTL = time.Minute
+	c.AddHeaders = []string{"x-authz-time=%DECISION_TIME%"}
+	s := newTestServer(t, c)
+	defer s.close()
+	clock := &fakeClock{}
+	s.clock = clock.time
+	r := testRequest{headers: map[string]string{"x-ext-authz": "allow"}}
+	for _, now := range []time.Time{time.Unix(1700000000, 0), time.Unix(1700000060, 0)} {
+		clock.set(now)
+		// The headers are rendered for every check, the cached decision only keeps the templates.
+		if got, want := grpcHeader(checkGRPC(t, s, r), "x-authz-time"), now.UTC().Format(time.RFC3339); got != want {
+			t.Fatalf("got x-authz-time %q, want %q", got, want)
+		}
+	}
+	if hits, _ := s.decisionCache.stats(); hits != 1 {
+		t.Fatalf("got %d cache hits, want 1", hits)
+	}
+}
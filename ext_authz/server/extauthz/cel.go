@@ -0,0 +1,108 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+)
+
+// celExpression is a compiled CEL expression evaluated against the request attributes, e.g.
+//
+//	request.http.path.startsWith('/admin') && request.http.headers['x-role'] == 'admin'
+//
+// The request variable has the fields http.method, http.host, http.path, http.headers (lowercase
+// names) and source.address.
+type celExpression struct {
+	text    string
+	program cel.Program
+}
+
+var celEnv *cel.Env
+
+func init() {
+	env, err := cel.NewEnv(cel.Declarations(
+		decls.NewVar("request", decls.NewMapType(decls.String, decls.Dyn)),
+	))
+	if err != nil {
+		panic(fmt.Sprintf("failed to create CEL environment: %v", err))
+	}
+	celEnv = env
+}
+
+// compileCEL compiles the expression, the error includes the position of any compilation issue.
+func compileCEL(text string) (*celExpression, error) {
+	ast, issues := celEnv.Compile(text)
+	if issues != nil && issues.Err() != nil {
+		return nil, fmt.Errorf("invalid CEL expression %q: %v", text, issues.Err())
+	}
+	if t := ast.ResultType(); t.GetPrimitive() != decls.Bool.GetPrimitive() && t.GetDyn() == nil {
+		return nil, fmt.Errorf("invalid CEL expression %q: must return bool but got %v", text, t)
+	}
+	program, err := celEnv.Program(ast)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CEL expression %q: %v", text, err)
+	}
+	return &celExpression{text: text, program: program}, nil
+}
+
+// celActivation returns the CEL variables of the request.
+func (r *checkRequest) celActivation() map[string]interface{} {
+	source := ""
+	if r.sourceIP != nil {
+		source = r.sourceIP.String()
+	}
+	return map[string]interface{}{
+		"request": map[string]interface{}{
+			"http": map[string]interface{}{
+				"method":  r.method,
+				"host":    r.host,
+				"path":    r.path,
+				"headers": r.headers,
+			},
+			"source": map[string]interface{}{
+				"address": source,
+			},
+		},
+	}
+}
+
+// eval evaluates the expression, any evaluation error or non-bool result is returned as error.
+func (e *celExpression) eval(request *checkRequest) (bool, error) {
+	val, _, err := e.program.Eval(request.celActivation())
+	if err != nil {
+		return false, err
+	}
+	result, ok := val.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("expected bool but got %v", val.Type())
+	}
+	return result, nil
+}
+
+// celDecision returns the decision of the CEL policy, evaluation errors always deny.
+func (s *ExtAuthzServer) celDecision(request *checkRequest) decision {
+	allowed, err := s.celPolicy.eval(request)
+	if err != nil {
+		s.logger.Errorf("Failed to evaluate CEL policy: %v", err)
+		return decision{reason: fmt.Sprintf("failed to evaluate CEL policy: %v", err)}
+	}
+	if allowed {
+		return decision{allowed: true, reason: "CEL policy is true"}
+	}
+	return decision{reason: "CEL policy is false"}
+}
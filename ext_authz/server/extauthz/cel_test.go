@@ -0,0 +1,148 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+// celBenchmarks are the expressions of the benchmarks, from a single comparison to the typical
+// policy of several attributes.
+var celBenchmarks = []struct {
+	name string
+	text string
+}{
+	{name: "method", text: `request.http.method == 'GET'`},
+	{name: "path prefix", text: `request.http.path.startsWith('/admin')`},
+	{name: "path and header", text: `request.http.path.startsWith('/admin') && request.http.headers['x-role'] == 'admin'`},
+	{name: "header presence", text: `'x-role' in request.http.headers && request.source.address != ''`},
+}
+
+func celTestRequest() *checkRequest {
+	return &checkRequest{
+		method:   "GET",
+		host:     "example.com",
+		path:     "/admin/users?page=2",
+		headers:  map[string]string{"x-role": "admin", "user-agent": "curl/7.68.0", "x-request-id": "abc"},
+		sourceIP: net.ParseIP("10.0.0.1"),
+	}
+}
+
+func TestCELEval(t *testing.T) {
+	cases := []struct {
+		text    string
+		want    bool
+		wantErr string
+	}{
+		{text: `request.http.method == 'GET'`, want: true},
+		{text: `request.http.host == 'example.com' && request.http.path.startsWith('/admin')`, want: true},
+		{text: `request.http.headers['x-role'] == 'viewer'`, want: false},
+		{text: `request.source.address == '10.0.0.1'`, want: true},
+		{text: `request.http.headers['x-missing'] == 'admin'`, wantErr: "no such key"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.text, func(t *testing.T) {
+			e, err := compileCEL(tc.text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := e.eval(celTestRequest())
+			switch {
+			case tc.wantErr != "":
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want error containing %q", err, tc.wantErr)
+				}
+			case err != nil:
+				t.Fatalf("got error %v", err)
+			case got != tc.want:
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRuleCELEvalErrorIsLogged(t *testing.T) {
+	cases := []struct {
+		action string
+		want   bool
+	}{
+		// An allow rule must not allow by accident, a deny rule denies.
+		{action: actionAllow, want: false},
+		{action: actionDeny, want: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.action, func(t *testing.T) {
+			e, err := compileCEL(`request.http.headers['x-missing'] == 'admin'`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			r := &rule{Name: "broken", Action: tc.action, cel: e}
+			if got := r.matches(celTestRequest(), NewTextLogger(&out)); got != tc.want {
+				t.Errorf("got matched %v, want %v", got, tc.want)
+			}
+			if !strings.Contains(out.String(), "Failed to evaluate CEL of rule broken") {
+				t.Errorf("got log %q, want the evaluation error", out.String())
+			}
+		})
+	}
+}
+
+// BenchmarkCELEval measures the per-request cost of an expression, including the activation of
+// the request attributes.
+func BenchmarkCELEval(b *testing.B) {
+	for _, bc := range celBenchmarks {
+		b.Run(bc.name, func(b *testing.B) {
+			e, err := compileCEL(bc.text)
+			if err != nil {
+				b.Fatal(err)
+			}
+			request := celTestRequest()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := e.eval(request); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkCELActivation measures the share of the activation in BenchmarkCELEval.
+func BenchmarkCELActivation(b *testing.B) {
+	request := celTestRequest()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = request.celActivation()
+	}
+}
+
+// BenchmarkCELCompile measures the startup cost of an expression, it is not paid per request.
+func BenchmarkCELCompile(b *testing.B) {
+	for _, bc := range celBenchmarks {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := compileCEL(bc.text); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
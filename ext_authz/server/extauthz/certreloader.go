@@ -0,0 +1,147 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// certPollInterval is the interval to check the modification time of the cert and key files.
+const certPollInterval = 10 * time.Second
+
+// certReloader serves the key pair of the TLS listener and re-reads it when the files are modified
+// or on SIGHUP, so the rotated certificate is used by the new handshakes without a restart. The
+// previous key pair is kept if the reload fails.
+type certReloader struct {
+	prefix   string
+	certFile string
+	keyFile  string
+	logger   Logger
+
+	// cert holds the *tls.Certificate, it is replaced atomically on reload.
+	cert atomic.Value
+
+	mu sync.Mutex
+	// certModTime and keyModTime are the modification times of the loaded files.
+	certModTime time.Time
+	keyModTime  time.Time
+	// stop ends the watch of the files.
+	stop chan struct{}
+}
+
+func newCertReloader(prefix, certFile, keyFile string, logger Logger) (*certReloader, error) {
+	r := &certReloader{prefix: prefix, certFile: certFile, keyFile: keyFile, logger: logger, stop: make(chan struct{})}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// start reloads the key pair when it is rotated until closed, it does nothing if nil.
+func (r *certReloader) start() {
+	if r != nil {
+		go r.watch()
+	}
+}
+
+// modTimes returns the modification times of the cert and key files.
+func (r *certReloader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+func (r *certReloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	certModTime, keyModTime, err := r.modTimes()
+	if err != nil {
+		return fmt.Errorf("failed to read -%s-tls-cert and -%s-tls-key: %v", r.prefix, r.prefix, err)
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load -%s-tls-cert and -%s-tls-key: %v", r.prefix, r.prefix, err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return fmt.Errorf("failed to parse -%s-tls-cert: %v", r.prefix, err)
+	}
+	r.cert.Store(&cert)
+	r.certModTime, r.keyModTime = certModTime, keyModTime
+	r.logger.Infof("Serving the %s certificate %s of %s valid until %s", r.prefix, r.certFile,
+		cert.Leaf.Subject, cert.Leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// modified returns true if the cert or key file was modified since it was loaded.
+func (r *certReloader) modified() bool {
+	certModTime, keyModTime, err := r.modTimes()
+	if err != nil {
+		// The files may be missing in the middle of a rotation, reload reports the error if it persists.
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !certModTime.Equal(r.certModTime) || !keyModTime.Equal(r.keyModTime)
+}
+
+// watch reloads the key pair when the files are modified or on SIGHUP until closed.
+func (r *certReloader) watch() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	ticker := time.NewTicker(certPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-signals:
+		case <-ticker.C:
+			if !r.modified() {
+				continue
+			}
+		case <-r.stop:
+			return
+		}
+		if err := r.reload(); err != nil {
+			r.logger.Errorf("Failed to reload the %s certificate, keeping the previous one: %v", r.prefix, err)
+		}
+	}
+}
+
+// close stops the watch of the files, it does nothing if nil.
+func (r *certReloader) close() {
+	if r == nil {
+		return
+	}
+	close(r.stop)
+}
+
+// getCertificate implements tls.Config.GetCertificate with the current key pair.
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load().(*tls.Certificate), nil
+}
@@ -0,0 +1,39 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+const challengeHeader = "www-authenticate"
+
+// challenged returns the denied decision with the -challenge header if it is denied for missing or
+// invalid credentials, other denials like rate limits or the maintenance mode are not challenged.
+// The status is set if the decision has none, and the challenge of the decision itself, e.g. of
+// the basic auth mode, is kept.
+func (s *ExtAuthzServer) challenged(d decision, status int) decision {
+	if s.challenge == "" || d.allowed || !d.unauthenticated {
+		return d
+	}
+	if _, ok := d.headers[challengeHeader]; ok {
+		return d
+	}
+	headers := map[string]string{challengeHeader: s.challenge}
+	for k, v := range d.headers {
+		headers[k] = v
+	}
+	d.headers = headers
+	if d.status == 0 {
+		d.status = status
+	}
+	return d
+}
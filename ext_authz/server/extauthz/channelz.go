@@ -0,0 +1,185 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"google.golang.org/grpc"
+	channelzpb "google.golang.org/grpc/channelz/grpc_channelz_v1"
+	channelzsvc "google.golang.org/grpc/channelz/service"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const (
+	grpcDebugPath = "/debug/grpc"
+	// channelzAddress is the listen address of the in-memory channelz server of /debug/grpc, which is
+	// left out of the summary.
+	channelzAddress = "bufconn"
+	channelzTimeout = 5 * time.Second
+)
+
+// channelzClient queries the channelz data of the process for /debug/grpc. The channelz service has
+// no in-process API, so it is served on an in-memory listener started on the first query.
+//
+// Importing the channelz service turns on the channelz data collection of the process, only the
+// service and the endpoint are gated by -enable-channelz.
+type channelzClient struct {
+	once   sync.Once
+	server *grpc.Server
+	conn   *grpc.ClientConn
+	err    error
+}
+
+func (c *channelzClient) client() (channelzpb.ChannelzClient, error) {
+	c.once.Do(func() {
+		listener := bufconn.Listen(1 << 16)
+		c.server = grpc.NewServer()
+		channelzsvc.RegisterChannelzServiceToServer(c.server)
+		go c.server.Serve(listener)
+		c.conn, c.err = grpc.Dial(channelzAddress, grpc.WithInsecure(),
+			grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return listener.Dial() }))
+	})
+	if c.err != nil {
+		return nil, c.err
+	}
+	return channelzpb.NewChannelzClient(c.conn), nil
+}
+
+// close stops the in-memory channelz server if started, it does nothing if nil.
+func (c *channelzClient) close() {
+	if c == nil || c.server == nil {
+		return
+	}
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.server.Stop()
+}
+
+// serveGRPCDebug serves the text summary of the gRPC servers of the process on GET /debug/grpc.
+func (s *ExtAuthzServer) serveGRPCDebug(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		response.Header().Set("Allow", "GET")
+		http.Error(response, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	client, err := s.channelz.client()
+	if err != nil {
+		http.Error(response, "channelz is unavailable: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ctx, cancel := context.WithTimeout(request.Context(), channelzTimeout)
+	defer cancel()
+	response.Header().Set("content-type", "text/plain; charset=utf-8")
+	response.Header().Set("cache-control", "no-store")
+	if err := writeChannelz(ctx, response, client); err != nil {
+		s.logger.Errorf("Failed to write the %s response: %v", request.URL.Path, err)
+	}
+}
+
+// writeChannelz writes the gRPC servers with their listen sockets and the stream and message
+// counters of their sockets:
+//
+//	server 1: calls started 12, succeeded 12, failed 0, last call 2021-03-04T05:06:07Z
+//	  listen socket 2: [::]:9000
+//	  socket 5: 10.0.0.1:9000 <- 10.0.0.2:53122, streams started 12, succeeded 12, failed 0, messages sent 12, received 12, keepalives sent 0, last stream 2021-03-04T05:06:07Z
+func writeChannelz(ctx context.Context, out io.Writer, client channelzpb.ChannelzClient) error {
+	w := bufio.NewWriter(out)
+	var servers []*channelzpb.Server
+	for start := int64(0); ; {
+		page, err := client.GetServers(ctx, &channelzpb.GetServersRequest{StartServerId: start})
+		if err != nil {
+			return err
+		}
+		servers = append(servers, page.GetServer()...)
+		if page.GetEnd() || len(page.GetServer()) == 0 {
+			break
+		}
+		start = page.GetServer()[len(page.GetServer())-1].GetRef().GetServerId() + 1
+	}
+	for _, server := range servers {
+		if isChannelzServer(server) {
+			continue
+		}
+		data := server.GetData()
+		fmt.Fprintf(w, "server %d: calls started %d, succeeded %d, failed %d, last call %s\n", server.GetRef().GetServerId(),
+			data.GetCallsStarted(), data.GetCallsSucceeded(), data.GetCallsFailed(), formatTimestamp(data.GetLastCallStartedTimestamp()))
+		for _, ref := range server.GetListenSocket() {
+			fmt.Fprintf(w, "  listen socket %d: %s\n", ref.GetSocketId(), ref.GetName())
+		}
+		var refs []*channelzpb.SocketRef
+		for start := int64(0); ; {
+			page, err := client.GetServerSockets(ctx, &channelzpb.GetServerSocketsRequest{ServerId: server.GetRef().GetServerId(), StartSocketId: start})
+			if err != nil {
+				return err
+			}
+			refs = append(refs, page.GetSocketRef()...)
+			if page.GetEnd() || len(page.GetSocketRef()) == 0 {
+				break
+			}
+			start = page.GetSocketRef()[len(page.GetSocketRef())-1].GetSocketId() + 1
+		}
+		for _, ref := range refs {
+			result, err := client.GetSocket(ctx, &channelzpb.GetSocketRequest{SocketId: ref.GetSocketId()})
+			if err != nil {
+				// The socket is gone if closed since listed.
+				continue
+			}
+			socket := result.GetSocket()
+			data := socket.GetData()
+			fmt.Fprintf(w, "  socket %d: %s <- %s, streams started %d, succeeded %d, failed %d, messages sent %d, received %d, keepalives sent %d, last stream %s\n",
+				ref.GetSocketId(), formatAddress(socket.GetLocal()), formatAddress(socket.GetRemote()),
+				data.GetStreamsStarted(), data.GetStreamsSucceeded(), data.GetStreamsFailed(),
+				data.GetMessagesSent(), data.GetMessagesReceived(), data.GetKeepAlivesSent(),
+				formatTimestamp(data.GetLastRemoteStreamCreatedTimestamp()))
+		}
+	}
+	return w.Flush()
+}
+
+// isChannelzServer returns true for the in-memory channelz server of /debug/grpc.
+func isChannelzServer(server *channelzpb.Server) bool {
+	sockets := server.GetListenSocket()
+	return len(sockets) == 1 && sockets[0].GetName() == channelzAddress
+}
+
+func formatAddress(address *channelzpb.Address) string {
+	switch a := address.GetAddress().(type) {
+	case *channelzpb.Address_TcpipAddress:
+		return net.JoinHostPort(net.IP(a.TcpipAddress.GetIpAddress()).String(), strconv.Itoa(int(a.TcpipAddress.GetPort())))
+	case *channelzpb.Address_UdsAddress_:
+		return "unix://" + a.UdsAddress.GetFilename()
+	case *channelzpb.Address_OtherAddress_:
+		return a.OtherAddress.GetName()
+	}
+	return "-"
+}
+
+func formatTimestamp(ts *timestamp.Timestamp) string {
+	if ts == nil || (ts.GetSeconds() == 0 && ts.GetNanos() == 0) {
+		return "never"
+	}
+	return ts.AsTime().UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,180 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"google.golang.org/grpc"
+	channelzpb "google.golang.org/grpc/channelz/grpc_channelz_v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// serverSummary returns the lines of the server with the listen address in the /debug/grpc
+// summary, the summary also has the servers of the other tests of the process.
+func serverSummary(summary, listenAddress string) []string {
+	var server []string
+	found := false
+	for _, line := range strings.Split(summary, "\n") {
+		if strings.HasPrefix(line, "server ") {
+			if found {
+				break
+			}
+			server = nil
+		}
+		server = append(server, line)
+		if strings.HasPrefix(line, "  listen socket ") && strings.HasSuffix(line, ": "+listenAddress) {
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+	return server
+}
+
+func TestGRPCDebugSummary(t *testing.T) {
+	c := DefaultConfig()
+	c.AdminPort = "0"
+	c.EnableChannelz = true
+	s := startTLSServer(t, c)
+	defer s.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// The checks share a connection so that its socket is listed.
+	conn, err := grpc.DialContext(ctx, s.GRPCAddr().String(), grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; i < 3; i++ {
+		if _, err := auth.NewAuthorizationClient(conn).Check(ctx, testRequest{}.grpc()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := adminRequest(s, http.MethodGet, grpcDebugPath, "", "")
+	if got.Code != http.StatusOK {
+		t.Fatalf("got status %d %q, want %d", got.Code, got.Body.String(), http.StatusOK)
+	}
+	if content := got.Header().Get("content-type"); content != "text/plain; charset=utf-8" {
+		t.Fatalf("got content-type %q, want text/plain", content)
+	}
+	server := serverSummary(got.Body.String(), s.GRPCAddr().String())
+	if server == nil {
+		t.Fatalf("got no server listening on %s in %q", s.GRPCAddr(), got.Body.String())
+	}
+	cases := []struct {
+		name string
+		// want is the line of the server starting with the prefix and containing the counters.
+		prefix string
+		want   string
+	}{
+		{name: "server calls", prefix: "server ", want: "calls started 3, succeeded 3, failed 0, last call 20"},
+		{name: "socket addresses", prefix: "  socket ", want: ": " + s.GRPCAddr().String() + " <- 127.0.0.1:"},
+		{name: "socket streams", prefix: "  socket ", want: "streams started 3, succeeded 3, failed 0, messages sent 3, received 3"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, line := range server {
+				if strings.HasPrefix(line, tc.prefix) && strings.Contains(line, tc.want) {
+					return
+				}
+			}
+			t.Fatalf("got server %q, want a line %q...%q", server, tc.prefix, tc.want)
+		})
+	}
+	// The in-memory channelz server of the endpoint is left out.
+	if strings.Contains(got.Body.String(), ": "+channelzAddress) {
+		t.Fatalf("got the in-memory channelz server in %q", got.Body.String())
+	}
+}
+
+func TestChannelzService(t *testing.T) {
+	cases := []struct {
+		name     string
+		enabled  bool
+		wantCode codes.Code
+		// wantStatus is the status of /debug/grpc on the admin server.
+		wantStatus int
+	}{
+		{name: "enabled", enabled: true, wantCode: codes.OK, wantStatus: http.StatusOK},
+		{name: "disabled", wantCode: codes.Unimplemented, wantStatus: http.StatusNotFound},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.AdminPort = "0"
+			c.EnableChannelz = tc.enabled
+			s := startTLSServer(t, c)
+			defer s.Stop()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := grpc.DialContext(ctx, s.GRPCAddr().String(), grpc.WithInsecure())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			// grpcdebug queries the service on the check listener.
+			_, err = channelzpb.NewChannelzClient(conn).GetServers(ctx, &channelzpb.GetServersRequest{})
+			if got := status.Code(err); got != tc.wantCode {
+				t.Fatalf("got GetServers code %v, want %v", got, tc.wantCode)
+			}
+			if got := adminRequest(s, http.MethodGet, grpcDebugPath, "", ""); got.Code != tc.wantStatus {
+				t.Fatalf("got %s status %d, want %d", grpcDebugPath, got.Code, tc.wantStatus)
+			}
+			if tc.enabled {
+				if got := adminRequest(s, http.MethodPost, grpcDebugPath, "", ""); got.Code != http.StatusMethodNotAllowed {
+					t.Fatalf("got POST status %d, want %d", got.Code, http.StatusMethodNotAllowed)
+				}
+			}
+		})
+	}
+}
+
+func TestFormatChannelz(t *testing.T) {
+	cases := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{name: "IPv4", got: formatAddress(&channelzpb.Address{Address: &channelzpb.Address_TcpipAddress{
+			TcpipAddress: &channelzpb.Address_TcpIpAddress{IpAddress: net.ParseIP("10.0.0.1").To4(), Port: 9000}}}), want: "10.0.0.1:9000"},
+		{name: "IPv6", got: formatAddress(&channelzpb.Address{Address: &channelzpb.Address_TcpipAddress{
+			TcpipAddress: &channelzpb.Address_TcpIpAddress{IpAddress: net.ParseIP("::1"), Port: 9000}}}), want: "[::1]:9000"},
+		{name: "unix", got: formatAddress(&channelzpb.Address{Address: &channelzpb.Address_UdsAddress_{
+			UdsAddress: &channelzpb.Address_UdsAddress{Filename: "/run/ext-authz.sock"}}}), want: "unix:///run/ext-authz.sock"},
+		{name: "other", got: formatAddress(&channelzpb.Address{Address: &channelzpb.Address_OtherAddress_{
+			OtherAddress: &channelzpb.Address_OtherAddress{Name: "bufconn"}}}), want: "bufconn"},
+		{name: "no address", got: formatAddress(nil), want: "-"},
+		{name: "timestamp", got: formatTimestamp(&timestamp.Timestamp{Seconds: 1614834367}), want: "2021-03-04T05:06:07Z"},
+		{name: "zero timestamp", got: formatTimestamp(&timestamp.Timestamp{}), want: "never"},
+		{name: "no timestamp", got: formatTimestamp(nil), want: "never"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.got != tc.want {
+				t.Fatalf("got %q, want %q", tc.got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseCIDRs parses a comma-separated list of IPv4 or IPv6 CIDRs.
+func parseCIDRs(value string) ([]*net.IPNet, error) {
+	var cidrs []*net.IPNet
+	for _, c := range parseList(value) {
+		_, cidr, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %v", c, err)
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs, nil
+}
+
+// matchCIDRs returns the CIDR containing the IP, a nil IP never matches.
+func matchCIDRs(cidrs []*net.IPNet, ip net.IP) (*net.IPNet, bool) {
+	if ip == nil {
+		return nil, false
+	}
+	for _, cidr := range cidrs {
+		if cidr.Contains(ip) {
+			return cidr, true
+		}
+	}
+	return nil, false
+}
+
+// parseIP parses an IP with an optional port, it returns nil if the address is not parsable.
+func parseIP(address string) net.IP {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(address, "["), "]"))
+}
+
+// httpPeerIP returns the peer IP of the HTTP check request. If trustedHops is positive, the peer is the
+// right-most X-Forwarded-For entry that is not added by a trusted hop, RemoteAddr is used otherwise.
+func httpPeerIP(request *http.Request, trustedHops int) net.IP {
+	if trustedHops > 0 {
+		var entries []string
+		for _, xff := range request.Header["X-Forwarded-For"] {
+			entries = append(entries, strings.Split(xff, ",")...)
+		}
+		if len(entries) >= trustedHops {
+			return parseIP(strings.TrimSpace(entries[len(entries)-trustedHops]))
+		}
+	}
+	return parseIP(request.RemoteAddr)
+}
@@ -0,0 +1,106 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// claimHeader copies a claim of the validated JWT to a header of the upstream request.
+type claimHeader struct {
+	claim  string
+	header string
+}
+
+// parseClaimHeaders parses the comma-separated claim=header mappings, e.g. sub=x-user-id.
+func parseClaimHeaders(value string) ([]claimHeader, error) {
+	var mappings []claimHeader
+	for _, item := range parseList(value) {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || !httpguts.ValidHeaderFieldName(parts[1]) {
+			return nil, fmt.Errorf("invalid mapping %q: must be claim=header", item)
+		}
+		mappings = append(mappings, claimHeader{claim: parts[0], header: strings.ToLower(parts[1])})
+	}
+	return mappings, nil
+}
+
+// claimValue returns the header value of the claim, nested claims are addressed with dots and
+// arrays are joined with commas. ok is false if the claim is missing or not a scalar or array.
+func (t *jwtToken) claimValue(name string) (string, bool) {
+	v, found := t.claims[name]
+	if !found {
+		// The name is only split if no claim has the dotted name, e.g. a URL.
+		var current interface{} = t.claims
+		for _, part := range strings.Split(name, ".") {
+			object, ok := current.(map[string]interface{})
+			if !ok {
+				return "", false
+			}
+			if current, ok = object[part]; !ok {
+				return "", false
+			}
+		}
+		v = current
+	}
+	if items, ok := v.([]interface{}); ok {
+		values := make([]string, 0, len(items))
+		for _, item := range items {
+			value, ok := scalarClaim(item)
+			if !ok {
+				return "", false
+			}
+			values = append(values, value)
+		}
+		return strings.Join(values, ","), true
+	}
+	return scalarClaim(v)
+}
+
+func scalarClaim(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	default:
+		return "", false
+	}
+}
+
+// addClaimHeaders adds the -claim-to-header headers to the allowed decision, the headers overwrite
+// the values sent by the client so the upstream can trust them.
+func (s *ExtAuthzServer) addClaimHeaders(d *decision, token *jwtToken) {
+	for _, m := range s.claimHeaders {
+		value, ok := token.claimValue(m.claim)
+		if !ok {
+			continue
+		}
+		if d.headers == nil {
+			d.headers = map[string]string{}
+		}
+		if d.overwrite == nil {
+			d.overwrite = map[string]bool{}
+		}
+		d.headers[m.header] = value
+		d.overwrite[m.header] = true
+	}
+}
@@ -0,0 +1,482 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"flag"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Config is the configuration of the server, each field is named after the command line flag
+// registered by RegisterFlags, e.g. AllowedValueRegex is -allowed-value-regex.
+type Config struct {
+	UnixSocketMode            string
+	BindAddress               string
+	CheckHeader               string
+	AllowedValue              string
+	AllowedValues             string
+	AllowedValueRegex         string
+	ValueMatch                string
+	DefaultAction             string
+	ResultHeader              string
+	ResultDetailHeader        string
+	VersionHeader             bool
+	DeniedStatus              int
+	DeniedBody                string
+	HTTPDeniedStatus          int
+	HTTPDeniedBody            string
+	HTTPDeniedBodyFile        string
+	HTTPDeniedContentType     string
+	DeniedBodyTemplateFile    string
+	Challenge                 string
+	RedirectOnDenyURL         string
+	HTTPDeniedRealm           string
+	BypassPaths               string
+	ReadOnlyAllow             bool
+	OptionsAllow              bool
+	DeniedHosts               string
+	ForbiddenHeaders          string
+	AllowedContentTypes       string
+	RequireContentType        bool
+	MaxHeaderBytesTotal       int
+	MaxHeaderValueLen         int
+	MaxPathLen                int
+	LogMaxLen                 int
+	DetectPathTraversal       bool
+	DeniedUserAgents          string
+	AllowedUserAgents         string
+	RequiredHeaders           []string
+	AddHeaders                []string
+	AddResponseHeaders        []string
+	StripHeaders              bool
+	StripRequestHeaders       string
+	SetQuery                  string
+	RemoveQuery               string
+	RequiredQuery             string
+	AllowedCIDRs              string
+	TCPAllowedCIDRs           string
+	TCPAllowedPorts           string
+	XFFTrustedHops            int
+	JWTHS256Secret            string
+	JWKSURL                   string
+	JWKSRefreshInterval       time.Duration
+	JWTIssuer                 string
+	JWTAudience               string
+	JWTIssuers                string
+	JWTAudiences              string
+	ExposeRuleHeader          bool
+	EchoRequestInfo           bool
+	EchoMaxLen                int
+	EmitDynamicMetadata       bool
+	AppendHeaders             string
+	ClaimToHeader             string
+	JWTClockSkew              time.Duration
+	HtpasswdFile              string
+	BasicAuthRealm            string
+	LDAPURL                   string
+	LDAPBaseDN                string
+	LDAPUserAttr              string
+	LDAPBindDN                string
+	LDAPBindPassword          string
+	LDAPStartTLS              bool
+	LDAPCAFile                string
+	LDAPTimeout               time.Duration
+	LDAPNegativeCacheTTL      time.Duration
+	APIKeysFile               string
+	APIKeyHeader              string
+	AllowedTokens             string
+	IntrospectionURL          string
+	IntrospectionClientID     string
+	IntrospectionClientSecret string
+	IntrospectionCacheTTL     time.Duration
+	IntrospectionTimeout      time.Duration
+	FailOpen                  bool
+	AllowedSpiffeIDs          string
+	RateLimitQPS              float64
+	RateLimitBurst            int
+	RateLimitKey              string
+	RedisAddr                 string
+	RedisTimeout              time.Duration
+	LimiterFailOpen           bool
+	BodyMustContain           string
+	BodyMustNotContain        string
+	BodyMaxBytes              int64
+	CELPolicy                 string
+	OPAURL                    string
+	OPATimeout                time.Duration
+	OPACacheTTL               time.Duration
+	OPAFailOpen               bool
+	DelegateURL               string
+	DelegateHeaders           string
+	DelegateTimeout           time.Duration
+	DelegateFailOpen          bool
+	AllowPercentage           float64
+	Seed                      int64
+	SessionCookieName         string
+	SessionSecret             string
+	SessionTTL                time.Duration
+	SessionMaxEntries         int
+	SetCookie                 string
+	SetCookiePath             string
+	SetCookieMaxAge           int
+	SetCookieHTTPOnly         bool
+	SetCookieSecure           bool
+	SetCookieUpstream         bool
+	HMACSecret                string
+	HMACMaxSkew               time.Duration
+	RequireNonce              bool
+	NonceWindow               time.Duration
+	NonceMaxEntries           int
+	Maintenance               bool
+	MaintenanceAdmin          bool
+	MaintenanceBody           string
+	MaintenanceRetryAfter     time.Duration
+	CacheTTL                  time.Duration
+	CacheSize                 int
+	CacheIgnoredHeaders       string
+	PolicyFile                string
+	WatchConfig               bool
+	GRPCTLSCert               string
+	GRPCTLSKey                string
+	GRPCTLSClientCA           string
+	HTTPTLSCert               string
+	HTTPTLSKey                string
+	HTTPTLSClientCA           string
+	PathPrefix                string
+	HTTPH2C                   bool
+	SinglePort                bool
+	GRPCKeepaliveTime         time.Duration
+	GRPCKeepaliveTimeout      time.Duration
+	GRPCMaxConcurrentStreams  uint
+	GRPCMaxRecvMsgSize        int
+	GRPCMaxConnectionAge      time.Duration
+	ProxyProtocol             bool
+	EnableRateLimitService    bool
+	RateLimitServiceLimit     string
+	EnableExtProc             bool
+	ShutdownGracePeriod       time.Duration
+	ShutdownDelay             time.Duration
+	AdminPort                 string
+	AdminToken                string
+	EnablePprof               bool
+	EnableChannelz            bool
+	Metrics                   string
+	StatsdAddr                string
+	StatsdTagsFormat          string
+	Tracing                   bool
+	LogFormat                 string
+	LogLevel                  string
+	LogDecisions              bool
+	Stats                     bool
+	SlowCheckThreshold        time.Duration
+	DecisionHistory           int
+	AccessLogPath             string
+	AccessLogFormat           string
+	AuditLogPath              string
+	AuditLogMaxMB             int
+	HealthIncludeDependencies bool
+
+	// Logger is not a flag, it replaces the logger of the LogFormat if set, see WithLogger.
+	Logger Logger
+}
+
+// DefaultConfig returns the configuration with the defaults of the command line flags.
+func DefaultConfig() Config {
+	return Config{
+		UnixSocketMode:        "0660",
+		CheckHeader:           "x-ext-authz",
+		ValueMatch:            valueMatchExact,
+		DefaultAction:         actionDeny,
+		ResultHeader:          resultHeader,
+		DeniedStatus:          http.StatusForbidden,
+		HTTPDeniedStatus:      http.StatusForbidden,
+		LogMaxLen:             4096,
+		JWKSRefreshInterval:   10 * time.Minute,
+		EchoMaxLen:            2048,
+		EmitDynamicMetadata:   true,
+		JWTClockSkew:          30 * time.Second,
+		BasicAuthRealm:        "ext-authz",
+		LDAPUserAttr:          "uid",
+		LDAPTimeout:           2 * time.Second,
+		LDAPNegativeCacheTTL:  10 * time.Second,
+		APIKeyHeader:          "x-api-key",
+		IntrospectionCacheTTL: 30 * time.Second,
+		IntrospectionTimeout:  2 * time.Second,
+		RateLimitBurst:        10,
+		RateLimitKey:          rateLimitKeySourceIP,
+		RedisTimeout:          100 * time.Millisecond,
+		LimiterFailOpen:       true,
+		BodyMaxBytes:          64 * 1024,
+		OPATimeout:            2 * time.Second,
+		OPACacheTTL:           10 * time.Second,
+		DelegateHeaders:       "authorization,cookie",
+		DelegateTimeout:       2 * time.Second,
+		SessionTTL:            time.Hour,
+		SessionMaxEntries:     10000,
+		SetCookiePath:         "/",
+		SetCookieHTTPOnly:     true,
+		HMACMaxSkew:           5 * time.Minute,
+		NonceWindow:           5 * time.Minute,
+		NonceMaxEntries:       100000,
+		MaintenanceBody:       "Service is under maintenance, please retry later.\n",
+		MaintenanceRetryAfter: time.Minute,
+		CacheSize:             10000,
+		CacheIgnoredHeaders:   "x-request-id,x-b3-traceid,x-b3-spanid,x-b3-parentspanid,x-b3-sampled,x-b3-flags,traceparent,tracestate,x-envoy-expected-rq-timeout-ms,x-envoy-attempt-count",
+		RateLimitServiceLimit: "10/second",
+		ShutdownGracePeriod:   10 * time.Second,
+		LogFormat:             LogFormatText,
+		LogLevel:              "info",
+		LogDecisions:          true,
+		AccessLogFormat:       defaultAccessLogFormat,
+		Stats:                 true,
+		SlowCheckThreshold:    100 * time.Millisecond,
+		DecisionHistory:       100,
+		AuditLogMaxMB:         100,
+		StatsdTagsFormat:      statsdTagsStatsd,
+	}
+}
+
+// sensitiveFlags are the flags of RegisterFlags whose values are credentials or reveal them, e.g.
+// the LDAP bind DN and the query parameters that allow the request.
+var sensitiveFlags = map[string]bool{
+	"required-query":              true,
+	"jwt-hs256-secret":            true,
+	"ldap-bind-dn":                true,
+	"ldap-bind-password":          true,
+	"allowed-tokens":              true,
+	"introspection-client-id":     true,
+	"introspection-client-secret": true,
+	"session-secret":              true,
+	"hmac-secret":                 true,
+	"admin-token":                 true,
+}
+
+// IsSensitiveFlag returns true if the value of the flag must not be logged.
+func IsSensitiveFlag(name string) bool {
+	return sensitiveFlags[name]
+}
+
+// RegisterFlags registers the command line flags of the configuration in the flag set, the current
+// values of the configuration are the flag defaults.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.UnixSocketMode, "unix-socket-mode", c.UnixSocketMode, "Octal file mode of the Unix domain sockets of -http and -grpc")
+	fs.StringVar(&c.BindAddress, "bind-address", c.BindAddress, "Host or IP address of the bare -http and -grpc ports, e.g. 127.0.0.1 for a sidecar, all interfaces if empty")
+	fs.StringVar(&c.CheckHeader, "check-header", c.CheckHeader, "Request header checked for the allowed value")
+	fs.StringVar(&c.AllowedValue, "allowed-value", c.AllowedValue, "Value of the check header that allows the request, allow if neither -allowed-values nor -allowed-value-regex is set")
+	fs.StringVar(&c.AllowedValues, "allowed-values", c.AllowedValues, "Comma-separated list of check header values that allow the request")
+	fs.StringVar(&c.AllowedValueRegex, "allowed-value-regex", c.AllowedValueRegex, "Regex of check header values that allow the request, exclusive with -allowed-value(s)")
+	fs.StringVar(&c.ValueMatch, "value-match", c.ValueMatch, "Comparison of the check header value, either exact, case-insensitive or trimmed")
+	fs.StringVar(&c.DefaultAction, "default-action", c.DefaultAction, "Action for requests without an allowed check header, either allow or deny")
+	fs.StringVar(&c.ResultHeader, "result-header", c.ResultHeader, "Header carrying the allowed or denied result, empty disables it")
+	fs.StringVar(&c.ResultDetailHeader, "result-detail-header", c.ResultDetailHeader, "Header carrying the short machine-readable reason of the decision if set, e.g. x-ext-authz-result-detail")
+	fs.BoolVar(&c.VersionHeader, "version-header", c.VersionHeader, "Add the "+versionHeader+" header with the version and commit of the server to the decisions")
+	fs.IntVar(&c.DeniedStatus, "denied-status", c.DeniedStatus, "HTTP status of the gRPC denied response if the decision has no specific status")
+	fs.StringVar(&c.DeniedBody, "denied-body", c.DeniedBody, "Body of the gRPC denied response if the decision has no specific body")
+	fs.IntVar(&c.HTTPDeniedStatus, "http-denied-status", c.HTTPDeniedStatus, "HTTP status of the HTTP denied response if the decision has no specific status")
+	fs.StringVar(&c.HTTPDeniedBody, "http-denied-body", c.HTTPDeniedBody, "Body of the HTTP denied response if the decision has no specific body")
+	fs.StringVar(&c.HTTPDeniedBodyFile, "http-denied-body-file", c.HTTPDeniedBodyFile, "File with the body of the HTTP denied response, re-read on SIGHUP, exclusive with -http-denied-body")
+	fs.StringVar(&c.HTTPDeniedContentType, "http-denied-content-type", c.HTTPDeniedContentType, "Content-Type of the HTTP denied body, detected from the file extension or text/plain by default")
+	fs.StringVar(&c.DeniedBodyTemplateFile, "denied-body-template-file", c.DeniedBodyTemplateFile, "Go text/template file of the denied body of both gRPC and HTTP with .Method, .Path, .Host, .Reason, .RequestID and .Status")
+	fs.StringVar(&c.Challenge, "challenge", c.Challenge, "WWW-Authenticate challenge of the denials for missing or invalid credentials, e.g. 'Bearer realm=\"istio\", error=\"invalid_token\"'")
+	fs.StringVar(&c.RedirectOnDenyURL, "redirect-on-deny-url", c.RedirectOnDenyURL, "Login URL that unauthenticated browser requests are redirected to, with the original path in the redirect_uri query parameter")
+	fs.StringVar(&c.HTTPDeniedRealm, "http-denied-realm", c.HTTPDeniedRealm, "Realm of the WWW-Authenticate Bearer challenge added to the HTTP denied response with status 401")
+	fs.StringVar(&c.BypassPaths, "bypass-paths", c.BypassPaths, "Comma-separated list of path prefixes that are always allowed, e.g. /healthz,/ready")
+	fs.BoolVar(&c.ReadOnlyAllow, "read-only-allow", c.ReadOnlyAllow, "Allow GET and HEAD requests without the check header")
+	fs.BoolVar(&c.OptionsAllow, "options-allow", c.OptionsAllow, "Allow OPTIONS (CORS preflight) requests without the check header")
+	fs.StringVar(&c.DeniedHosts, "denied-hosts", c.DeniedHosts, "Comma-separated list of denied hosts, e.g. admin.example.com,*.internal.example.com")
+	fs.StringVar(&c.ForbiddenHeaders, "forbidden-headers", c.ForbiddenHeaders, "Comma-separated headers that deny the request if present, e.g. x-internal-debug,x-envoy-force-trace")
+	fs.StringVar(&c.AllowedContentTypes, "allowed-content-types", c.AllowedContentTypes, "Comma-separated media types allowed for POST, PUT and PATCH requests, e.g. application/json")
+	fs.BoolVar(&c.RequireContentType, "require-content-type", c.RequireContentType, "Deny POST, PUT and PATCH requests without content-type")
+	fs.IntVar(&c.MaxHeaderBytesTotal, "max-header-bytes-total", c.MaxHeaderBytesTotal, "Maximum total size of the header names and values, larger requests are denied with 431, 0 disables the limit")
+	fs.IntVar(&c.MaxHeaderValueLen, "max-header-value-len", c.MaxHeaderValueLen, "Maximum length of a header value, larger requests are denied with 431, 0 disables the limit")
+	fs.IntVar(&c.MaxPathLen, "max-path-len", c.MaxPathLen, "Maximum length of the path including the query, longer requests are denied with 414, 0 disables the limit")
+	fs.IntVar(&c.LogMaxLen, "log-max-len", c.LogMaxLen, "Maximum length of the attributes or headers in the decision log, 0 disables the truncation")
+	fs.BoolVar(&c.DetectPathTraversal, "detect-path-traversal", c.DetectPathTraversal, "Deny paths with .. segments, null bytes or double-encoded separators after percent-decoding")
+	fs.StringVar(&c.DeniedUserAgents, "denied-user-agents", c.DeniedUserAgents, "Comma-separated user agent substrings (or regexes prefixed by re:) denied without an allowed check header")
+	fs.StringVar(&c.AllowedUserAgents, "allowed-user-agents", c.AllowedUserAgents, "Comma-separated user agent substrings (or regexes prefixed by re:) allowed without the check header")
+	fs.Var((*listFlag)(&c.RequiredHeaders), "required-headers", "Comma-separated or repeated name=value headers that must all match instead of the check header, e.g. x-ext-authz=allow,x-tenant=acme")
+	fs.Var((*listFlag)(&c.AddHeaders), "add-headers", "Comma-separated or repeated name=value headers added to the allowed request, the values support %REQ_ID% and %DECISION_TIME%")
+	fs.Var((*listFlag)(&c.AddResponseHeaders), "add-response-headers", "Comma-separated or repeated name=value headers added to the downstream response of the allowed gRPC check request, overwritten unless in -append-headers")
+	fs.BoolVar(&c.StripHeaders, "strip-headers", c.StripHeaders, "Remove the -forbidden-headers from the allowed gRPC check request instead of denying it")
+	fs.StringVar(&c.StripRequestHeaders, "strip-request-headers", c.StripRequestHeaders, "Comma-separated headers removed from the allowed gRPC check request, e.g. client-supplied x-user-id")
+	fs.StringVar(&c.SetQuery, "set-query", c.SetQuery, "Comma-separated name=value query parameters set in the allowed gRPC check request, e.g. authz=ok")
+	fs.StringVar(&c.RemoveQuery, "remove-query", c.RemoveQuery, "Comma-separated query parameters removed from the allowed gRPC check request, e.g. token")
+	fs.StringVar(&c.RequiredQuery, "required-query", c.RequiredQuery, "Comma-separated name=value query parameters that allow the request, e.g. token=secret")
+	fs.StringVar(&c.AllowedCIDRs, "allowed-cidrs", c.AllowedCIDRs, "Comma-separated list of source CIDRs that are allowed without the check header")
+	fs.StringVar(&c.TCPAllowedCIDRs, "tcp-allowed-cidrs", c.TCPAllowedCIDRs, "Comma-separated source CIDRs allowed by the check requests of the ext_authz network filter")
+	fs.StringVar(&c.TCPAllowedPorts, "tcp-allowed-ports", c.TCPAllowedPorts, "Comma-separated destination ports allowed by the check requests of the ext_authz network filter")
+	fs.IntVar(&c.XFFTrustedHops, "xff-trusted-hops", c.XFFTrustedHops, "Number of trusted hops in X-Forwarded-For used to find the HTTP peer IP, 0 uses the remote address")
+	fs.StringVar(&c.JWTHS256Secret, "jwt-hs256-secret", c.JWTHS256Secret, "Shared secret to validate HS256 bearer tokens instead of the check header")
+	fs.StringVar(&c.JWKSURL, "jwks-url", c.JWKSURL, "JWKS URL to validate RS256 and ES256 bearer tokens instead of the check header")
+	fs.DurationVar(&c.JWKSRefreshInterval, "jwks-refresh-interval", c.JWKSRefreshInterval, "Interval to refresh the JWKS, 0 disables the periodic refresh")
+	fs.StringVar(&c.JWTIssuer, "jwt-issuer", c.JWTIssuer, "Required iss claim of the bearer token if set")
+	fs.StringVar(&c.JWTAudience, "jwt-audience", c.JWTAudience, "Required aud claim of the bearer token if set")
+	fs.StringVar(&c.JWTIssuers, "jwt-issuers", c.JWTIssuers, "Comma-separated list of allowed iss claims of the bearer token, added to -jwt-issuer")
+	fs.StringVar(&c.JWTAudiences, "jwt-audiences", c.JWTAudiences, "Comma-separated list of expected aud claims, the bearer token must have one of them or -jwt-audience")
+	fs.BoolVar(&c.ExposeRuleHeader, "expose-rule-header", c.ExposeRuleHeader, "Add the "+ruleHeader+" header with the matched policy rule or default to every decision, it leaks the policy structure")
+	fs.BoolVar(&c.EchoRequestInfo, "echo-request-info", c.EchoRequestInfo, "Add the "+receivedHeader+" header summarizing the check request to every decision, it leaks the request details")
+	fs.IntVar(&c.EchoMaxLen, "echo-max-len", c.EchoMaxLen, "Max length of the "+receivedHeader+" header value")
+	fs.BoolVar(&c.EmitDynamicMetadata, "emit-dynamic-metadata", c.EmitDynamicMetadata, "Emit the decision, rule, principal and duration as dynamic metadata in the gRPC check response")
+	fs.StringVar(&c.AppendHeaders, "append-headers", c.AppendHeaders, "Comma-separated injected headers appended to the existing values instead of overwriting them, e.g. x-ext-authz-result")
+	fs.StringVar(&c.ClaimToHeader, "claim-to-header", c.ClaimToHeader, "Comma-separated claim=header mappings that copy the JWT claims to the upstream request, e.g. sub=x-user-id,realm_access.roles=x-roles")
+	fs.DurationVar(&c.JWTClockSkew, "jwt-clock-skew", c.JWTClockSkew, "Allowed clock skew when checking the exp, nbf and iat claims of the bearer token")
+	fs.StringVar(&c.HtpasswdFile, "htpasswd-file", c.HtpasswdFile, "htpasswd file with bcrypt hashes to validate basic auth credentials instead of the check header")
+	fs.StringVar(&c.BasicAuthRealm, "basic-auth-realm", c.BasicAuthRealm, "Realm of the WWW-Authenticate challenge in the basic auth mode")
+	fs.StringVar(&c.LDAPURL, "ldap-url", c.LDAPURL, "LDAP server (ldap:// or ldaps://) to validate basic auth credentials instead of the check header")
+	fs.StringVar(&c.LDAPBaseDN, "ldap-base-dn", c.LDAPBaseDN, "Base DN to search the user in the LDAP mode")
+	fs.StringVar(&c.LDAPUserAttr, "ldap-user-attr", c.LDAPUserAttr, "Attribute matched against the basic auth user name in the LDAP mode")
+	fs.StringVar(&c.LDAPBindDN, "ldap-bind-dn", c.LDAPBindDN, "DN to bind as for the user search, the search is anonymous if not set")
+	fs.StringVar(&c.LDAPBindPassword, "ldap-bind-password", c.LDAPBindPassword, "Password of -ldap-bind-dn")
+	fs.BoolVar(&c.LDAPStartTLS, "ldap-start-tls", c.LDAPStartTLS, "Use StartTLS on ldap:// connections")
+	fs.StringVar(&c.LDAPCAFile, "ldap-ca-file", c.LDAPCAFile, "PEM file with the CA certificates to verify the LDAP server, the system pool is used if not set")
+	fs.DurationVar(&c.LDAPTimeout, "ldap-timeout", c.LDAPTimeout, "Timeout of the LDAP operations")
+	fs.DurationVar(&c.LDAPNegativeCacheTTL, "ldap-negative-cache-ttl", c.LDAPNegativeCacheTTL, "Duration to cache failed LDAP logins, 0 disables the cache")
+	fs.StringVar(&c.APIKeysFile, "api-keys-file", c.APIKeysFile, "JSON or YAML file mapping API keys to the owner and allowed paths, validated instead of the check header")
+	fs.StringVar(&c.APIKeyHeader, "api-key-header", c.APIKeyHeader, "Request header carrying the API key")
+	fs.StringVar(&c.AllowedTokens, "allowed-tokens", c.AllowedTokens, "Comma-separated list of bearer tokens that are allowed without the check header")
+	fs.StringVar(&c.IntrospectionURL, "introspection-url", c.IntrospectionURL, "RFC 7662 token introspection endpoint to validate bearer tokens instead of the check header")
+	fs.StringVar(&c.IntrospectionClientID, "introspection-client-id", c.IntrospectionClientID, "Client ID to authenticate to the introspection endpoint")
+	fs.StringVar(&c.IntrospectionClientSecret, "introspection-client-secret", c.IntrospectionClientSecret, "Client secret to authenticate to the introspection endpoint")
+	fs.DurationVar(&c.IntrospectionCacheTTL, "introspection-cache-ttl", c.IntrospectionCacheTTL, "Duration to cache introspection results, 0 disables the cache")
+	fs.DurationVar(&c.IntrospectionTimeout, "introspection-timeout", c.IntrospectionTimeout, "Timeout of the introspection call")
+	fs.BoolVar(&c.FailOpen, "fail-open", c.FailOpen, "Allow the request if the introspection endpoint is unreachable")
+	fs.StringVar(&c.AllowedSpiffeIDs, "allowed-spiffe-ids", c.AllowedSpiffeIDs, "Comma-separated SPIFFE IDs allowed in XFCC instead of the check header, e.g. spiffe://td/ns/foo/sa/*")
+	fs.Float64Var(&c.RateLimitQPS, "rate-limit-qps", c.RateLimitQPS, "Requests per second allowed per rate limit key, 0 disables rate limiting")
+	fs.IntVar(&c.RateLimitBurst, "rate-limit-burst", c.RateLimitBurst, "Burst size of the per-key token bucket")
+	fs.StringVar(&c.RateLimitKey, "rate-limit-key", c.RateLimitKey, "Rate limit key, either source-ip or a request header name, the requests without it share one bucket")
+	fs.StringVar(&c.RedisAddr, "redis-addr", c.RedisAddr, "Redis address to share the rate limit counters between replicas, the limiter is in-memory if not set")
+	fs.DurationVar(&c.RedisTimeout, "redis-timeout", c.RedisTimeout, "Timeout of the Redis commands")
+	fs.BoolVar(&c.LimiterFailOpen, "limiter-fail-open", c.LimiterFailOpen, "Allow the request if the rate limiter fails, e.g. Redis is unreachable")
+	fs.StringVar(&c.BodyMustContain, "body-must-contain", c.BodyMustContain, "Comma-separated texts the request body must contain, requires with_request_body in Envoy")
+	fs.StringVar(&c.BodyMustNotContain, "body-must-not-contain", c.BodyMustNotContain, "Comma-separated texts that deny the request if found in the request body")
+	fs.Int64Var(&c.BodyMaxBytes, "body-max-bytes", c.BodyMaxBytes, "Maximum number of request body bytes scanned by the body rules")
+	fs.StringVar(&c.CELPolicy, "cel-policy", c.CELPolicy, "CEL expression that allows the request if true, evaluated instead of the check header")
+	fs.StringVar(&c.OPAURL, "opa-url", c.OPAURL, "OPA data API to delegate the decision to instead of the check header, e.g. http://opa:8181/v1/data/authz/allow")
+	fs.DurationVar(&c.OPATimeout, "opa-timeout", c.OPATimeout, "Timeout of the OPA call")
+	fs.DurationVar(&c.OPACacheTTL, "opa-cache-ttl", c.OPACacheTTL, "Duration to cache OPA results, 0 disables the cache")
+	fs.BoolVar(&c.OPAFailOpen, "opa-fail-open", c.OPAFailOpen, "Allow the request if the OPA server is unreachable")
+	fs.StringVar(&c.DelegateURL, "delegate-url", c.DelegateURL, "HTTP webhook to delegate the decision to instead of the check header, 2xx allows and 401/403 denies")
+	fs.StringVar(&c.DelegateHeaders, "delegate-headers", c.DelegateHeaders, "Comma-separated request headers forwarded to the webhook")
+	fs.DurationVar(&c.DelegateTimeout, "delegate-timeout", c.DelegateTimeout, "Timeout of the webhook call")
+	fs.BoolVar(&c.DelegateFailOpen, "delegate-fail-open", c.DelegateFailOpen, "Allow the request if the webhook is unreachable or returns an unexpected status")
+	fs.Float64Var(&c.AllowPercentage, "allow-percentage", c.AllowPercentage, "Percentage (0-100) of the denied requests that are allowed anyway, for canary and chaos demos")
+	fs.Int64Var(&c.Seed, "seed", c.Seed, "Seed of the -allow-percentage sampler, a time based seed is used if 0")
+	fs.StringVar(&c.SessionCookieName, "session-cookie-name", c.SessionCookieName, "Cookie name of the sessions issued by /login on the HTTP listener, allowed instead of the check header")
+	fs.StringVar(&c.SessionSecret, "session-secret", c.SessionSecret, "HMAC key to sign the session cookies, required with -session-cookie-name")
+	fs.DurationVar(&c.SessionTTL, "session-ttl", c.SessionTTL, "Lifetime of the sessions")
+	fs.IntVar(&c.SessionMaxEntries, "session-max-entries", c.SessionMaxEntries, "Maximum number of sessions, the least recently used session is evicted")
+	fs.StringVar(&c.SetCookie, "set-cookie", c.SetCookie, "Cookie name=value set in the downstream response of the allowed requests, e.g. authz=ok")
+	fs.StringVar(&c.SetCookiePath, "set-cookie-path", c.SetCookiePath, "Path attribute of the -set-cookie")
+	fs.IntVar(&c.SetCookieMaxAge, "set-cookie-max-age", c.SetCookieMaxAge, "Max-Age attribute of the -set-cookie in seconds, 0 omits it")
+	fs.BoolVar(&c.SetCookieHTTPOnly, "set-cookie-http-only", c.SetCookieHTTPOnly, "HttpOnly attribute of the -set-cookie")
+	fs.BoolVar(&c.SetCookieSecure, "set-cookie-secure", c.SetCookieSecure, "Secure attribute of the -set-cookie")
+	fs.BoolVar(&c.SetCookieUpstream, "set-cookie-upstream", c.SetCookieUpstream, "Also add the -set-cookie to the upstream request headers for Envoy versions without response_headers_to_add")
+	fs.StringVar(&c.HMACSecret, "hmac-secret", c.HMACSecret, "Secret to verify the x-signature HMAC-SHA256 of the request instead of the check header")
+	fs.DurationVar(&c.HMACMaxSkew, "hmac-max-skew", c.HMACMaxSkew, "Maximum difference between x-timestamp and the current time in the HMAC signature mode")
+	fs.BoolVar(&c.RequireNonce, "require-nonce", c.RequireNonce, "Require a unique x-nonce header in each request to deny replayed requests, the nonce is signed in the HMAC signature mode")
+	fs.DurationVar(&c.NonceWindow, "nonce-window", c.NonceWindow, "Duration to remember the seen nonces")
+	fs.IntVar(&c.NonceMaxEntries, "nonce-max-entries", c.NonceMaxEntries, "Maximum number of remembered nonces, the oldest are dropped before the window ends once reached")
+	fs.BoolVar(&c.Maintenance, "maintenance", c.Maintenance, "Start in the maintenance mode that denies all requests except the bypass paths with 503")
+	fs.BoolVar(&c.MaintenanceAdmin, "maintenance-admin", c.MaintenanceAdmin, "Serve POST /admin/maintenance?on=true|false on the admin server to toggle the maintenance mode, requires -admin-port")
+	fs.StringVar(&c.MaintenanceBody, "maintenance-body", c.MaintenanceBody, "Body of the denied response in the maintenance mode")
+	fs.DurationVar(&c.MaintenanceRetryAfter, "maintenance-retry-after", c.MaintenanceRetryAfter, "Retry-After of the denied response in the maintenance mode")
+	fs.DurationVar(&c.CacheTTL, "cache-ttl", c.CacheTTL, "Duration to cache the decisions, at most until the credential of the decision expires, 0 disables the decision cache")
+	fs.IntVar(&c.CacheSize, "cache-size", c.CacheSize, "Maximum number of cached decisions, the least recently used decision is evicted")
+	fs.StringVar(&c.CacheIgnoredHeaders, "cache-ignored-headers", c.CacheIgnoredHeaders, "Comma-separated per-request headers excluded from the decision cache key, all other headers are included")
+	fs.BoolVar(&c.WatchConfig, "watch-config", c.WatchConfig, "Also reload the -policy-file, -api-keys-file and -htpasswd-file when they change, not only on SIGHUP")
+	fs.StringVar(&c.PolicyFile, "policy-file", c.PolicyFile, "YAML file with the ordered allow/deny rules, the check header is used if not set")
+	fs.StringVar(&c.GRPCTLSCert, "grpc-tls-cert", c.GRPCTLSCert, "PEM certificate file to serve the gRPC listener over TLS, requires -grpc-tls-key, re-read when modified or on SIGHUP")
+	fs.StringVar(&c.GRPCTLSKey, "grpc-tls-key", c.GRPCTLSKey, "PEM private key file of -grpc-tls-cert")
+	fs.StringVar(&c.GRPCTLSClientCA, "grpc-tls-client-ca", c.GRPCTLSClientCA, "PEM CA file to require and verify the client certificates of the gRPC listener (mTLS)")
+	fs.StringVar(&c.HTTPTLSCert, "http-tls-cert", c.HTTPTLSCert, "PEM certificate file to serve the HTTP listener over HTTPS, requires -http-tls-key, re-read when modified or on SIGHUP")
+	fs.StringVar(&c.HTTPTLSKey, "http-tls-key", c.HTTPTLSKey, "PEM private key file of -http-tls-cert")
+	fs.StringVar(&c.HTTPTLSClientCA, "http-tls-client-ca", c.HTTPTLSClientCA, "PEM CA file to require and verify the client certificates of the HTTP listener (mTLS)")
+	fs.StringVar(&c.PathPrefix, "path-prefix", c.PathPrefix, "path_prefix of the Envoy HTTP authorization service stripped from the HTTP check path, other paths return 404")
+	fs.BoolVar(&c.HTTPH2C, "http-h2c", c.HTTPH2C, "Also serve HTTP/2 cleartext (h2c) with prior knowledge on the plaintext HTTP listener")
+	fs.BoolVar(&c.SinglePort, "single-port", c.SinglePort, "Serve both the gRPC and HTTP checks on the -http port, gRPC uses the -http-tls-* flags in this mode")
+	fs.DurationVar(&c.GRPCKeepaliveTime, "grpc-keepalive-time", c.GRPCKeepaliveTime, "Idle time after which the gRPC server pings the client, at least 1s, 0 keeps the gRPC default of 2h")
+	fs.DurationVar(&c.GRPCKeepaliveTimeout, "grpc-keepalive-timeout", c.GRPCKeepaliveTimeout, "Time to wait for the keepalive ping ack before closing the connection, 0 keeps the gRPC default of 20s")
+	fs.UintVar(&c.GRPCMaxConcurrentStreams, "grpc-max-concurrent-streams", c.GRPCMaxConcurrentStreams, "Maximum concurrent streams per gRPC connection, 0 is unlimited")
+	fs.IntVar(&c.GRPCMaxRecvMsgSize, "grpc-max-recv-msg-size", c.GRPCMaxRecvMsgSize, "Maximum size in bytes of a gRPC check request, 0 keeps the gRPC default of 4MB")
+	fs.DurationVar(&c.GRPCMaxConnectionAge, "grpc-max-connection-age", c.GRPCMaxConnectionAge, "Maximum age of a gRPC connection before it is gracefully closed, 0 is infinite")
+	fs.BoolVar(&c.ProxyProtocol, "proxy-protocol", c.ProxyProtocol, "Require the PROXY protocol v1 or v2 header on the TCP connections of both listeners to recover the client address behind an L4 load balancer")
+	fs.BoolVar(&c.EnableRateLimitService, "enable-ratelimit-service", c.EnableRateLimitService, "Serve the Envoy RateLimitService on the gRPC listener, in Redis if -redis-addr is set")
+	fs.StringVar(&c.RateLimitServiceLimit, "ratelimit-service-limit", c.RateLimitServiceLimit, "Default requests/unit limit of the rate limit descriptors without a limit override, the unit is second, minute, hour or day")
+	fs.BoolVar(&c.EnableExtProc, "enable-ext-proc", c.EnableExtProc, "Serve the Envoy ext_proc API on the gRPC listener, deciding the request headers like the check request")
+	fs.StringVar(&c.AdminPort, "admin-port", c.AdminPort, "Port of the admin server on 127.0.0.1 or host:port to flip the default action and force mode and inspect /admin/state, disabled if empty")
+	fs.StringVar(&c.AdminToken, "admin-token", c.AdminToken, "Bearer token required by the POST requests of the admin server if set")
+	fs.StringVar(&c.Metrics, "metrics", c.Metrics, "Serve the Prometheus metrics at /metrics on the admin server if admin, requires -admin-port, disabled if empty")
+	fs.StringVar(&c.StatsdAddr, "statsd-addr", c.StatsdAddr, "StatsD server host:port to send the decision counters and timings to over UDP, disabled if empty")
+	fs.StringVar(&c.StatsdTagsFormat, "statsd-tags-format", c.StatsdTagsFormat, "Format of the StatsD tags, statsd to append the tag values to the metric name or datadog for the DogStatsD tags")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "Format of the decision logs and the messages, text or json with one object per line")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "Minimum level of the logs, debug adds the request attributes to the decisions, info, warn or error, changeable at runtime with POST /admin/loglevel")
+	fs.BoolVar(&c.LogDecisions, "log-decisions", c.LogDecisions, "Log a line per decision at the info level, the startup, shutdown and error logs are kept if false")
+	fs.DurationVar(&c.SlowCheckThreshold, "slow-check-threshold", c.SlowCheckThreshold, "Log the time in the parse, local_rules, external_callout and response_build stages of the check requests taking at least this long at the debug level, disabled if 0")
+	fs.IntVar(&c.DecisionHistory, "decision-history", c.DecisionHistory, "Number of the recent decisions served with the redacted headers on GET /debug/decisions of the admin server, disabled if 0 or without -admin-port")
+	fs.BoolVar(&c.Stats, "stats", c.Stats, "Serve the decision statistics on GET /stats, ?format=text for text, and reset them on POST /stats/reset with the -admin-token if set, on the admin server if -admin-port is set")
+	fs.StringVar(&c.AccessLogPath, "access-log-path", c.AccessLogPath, "File to append a line per decision to, reopened on SIGUSR2 for logrotate, disabled if empty")
+	fs.StringVar(&c.AccessLogFormat, "access-log-format", c.AccessLogFormat, "Format of the access log lines with the tokens %START_TIME%, %REQ(NAME)%, %PROTOCOL%, %DECISION%, %REASON%, %RULE%, %DURATION% and %DOWNSTREAM_REMOTE_ADDRESS_WITHOUT_PORT%")
+	fs.StringVar(&c.AuditLogPath, "audit-log-path", c.AuditLogPath, "File to append every decision to as a JSON line with the redacted attributes of the check request, disabled if empty")
+	fs.IntVar(&c.AuditLogMaxMB, "audit-log-max-mb", c.AuditLogMaxMB, "Size in MiB at which the audit log is rotated to the -audit-log-path with .1 appended, never rotated if 0")
+	fs.BoolVar(&c.Tracing, "tracing", c.Tracing, "Export the spans of the check requests to the OTLP/HTTP collector of the OTEL_EXPORTER_OTLP_* environment variables with the JSON encoding, sampled by OTEL_TRACES_SAMPLER")
+	fs.BoolVar(&c.EnableChannelz, "enable-channelz", c.EnableChannelz, "Register the gRPC channelz service on the gRPC server for grpcdebug, and serve its summary on GET /debug/grpc of the admin server if -admin-port is set")
+	fs.BoolVar(&c.EnablePprof, "enable-pprof", c.EnablePprof, "Serve /debug/pprof/, /debug/vars and /debug/goroutines on the admin server, requires -admin-port")
+	fs.DurationVar(&c.ShutdownGracePeriod, "shutdown-grace-period", c.ShutdownGracePeriod, "Time to wait for the in-flight checks on SIGINT or SIGTERM before closing the connections")
+	fs.DurationVar(&c.ShutdownDelay, "shutdown-delay", c.ShutdownDelay, "Time to report not ready in /readyz and NOT_SERVING on SIGINT or SIGTERM before the listeners close, e.g. the readiness probe period")
+	fs.BoolVar(&c.HealthIncludeDependencies, "health-include-dependencies", c.HealthIncludeDependencies, "Report NOT_SERVING in the gRPC health service and not ready in /readyz while OPA, Redis or the JWKS endpoint is unreachable")
+}
+
+// Option configures the server created by NewExtAuthzServer.
+type Option func(*Config)
+
+// WithConfig replaces the whole configuration, e.g. with the one parsed by RegisterFlags.
+func WithConfig(config Config) Option {
+	return func(c *Config) {
+		*c = config
+	}
+}
+
+// WithCheckHeader sets the request header checked for the allowed values.
+func WithCheckHeader(name string) Option {
+	return func(c *Config) {
+		c.CheckHeader = name
+	}
+}
+
+// WithAllowedValues sets the check header values that allow the request.
+func WithAllowedValues(values ...string) Option {
+	return func(c *Config) {
+		c.AllowedValue = ""
+		c.AllowedValues = strings.Join(values, ",")
+	}
+}
+
+// WithLogger sets the logger of the decisions and the messages of the server, e.g. to capture the
+// entries in a test. It must follow WithConfig.
+func WithLogger(logger Logger) Option {
+	return func(c *Config) {
+		c.Logger = logger
+	}
+}
+
+// WithDefaultAction sets the action of the requests without an allowed check header, either allow
+// or deny.
+func WithDefaultAction(action string) Option {
+	return func(c *Config) {
+		c.DefaultAction = action
+	}
+}
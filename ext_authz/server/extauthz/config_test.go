@@ -0,0 +1,32 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"flag"
+	"testing"
+)
+
+func TestSensitiveFlagsRegistered(t *testing.T) {
+	fs := flag.NewFlagSet("ext-authz", flag.ContinueOnError)
+	c := DefaultConfig()
+	c.RegisterFlags(fs)
+	// A renamed flag would be logged in plain text.
+	for name := range sensitiveFlags {
+		if fs.Lookup(name) == nil {
+			t.Fatalf("got sensitive flag -%s not registered", name)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// writeMethods are the methods that typically carry a body and are subject to the content type rules.
+var writeMethods = map[string]bool{
+	http.MethodPost:  true,
+	http.MethodPut:   true,
+	http.MethodPatch: true,
+}
+
+// parseMediaTypes validates the media types, e.g. application/json, and returns them in lowercase.
+func parseMediaTypes(values []string) ([]string, error) {
+	var types []string
+	for _, value := range values {
+		mediaType, params, err := mime.ParseMediaType(value)
+		if err != nil || len(params) != 0 || !strings.Contains(mediaType, "/") {
+			return nil, fmt.Errorf("invalid media type %q", value)
+		}
+		types = append(types, mediaType)
+	}
+	return types, nil
+}
+
+// contentTypeDecision returns a denied decision if the content type of a write request is not
+// allowed, ok is false otherwise. Parameters like charset are ignored.
+func (s *ExtAuthzServer) contentTypeDecision(request *checkRequest) (decision, bool) {
+	if !writeMethods[strings.ToUpper(request.method)] {
+		return decision{}, false
+	}
+	value := request.header("content-type")
+	if value == "" {
+		if s.requireContentType {
+			return decision{reason: "missing content-type for " + request.method, status: http.StatusUnsupportedMediaType}, true
+		}
+		return decision{}, false
+	}
+	if len(s.allowedContentTypes) == 0 {
+		return decision{}, false
+	}
+	mediaType, _, err := mime.ParseMediaType(value)
+	if err != nil {
+		return decision{reason: fmt.Sprintf("malformed content-type %q", value), status: http.StatusUnsupportedMediaType}, true
+	}
+	for _, allowed := range s.allowedContentTypes {
+		if mediaType == allowed {
+			return decision{}, false
+		}
+	}
+	return decision{reason: "content-type " + mediaType + " is not allowed", status: http.StatusUnsupportedMediaType}, true
+}
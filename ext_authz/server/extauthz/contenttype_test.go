@@ -0,0 +1,121 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMediaTypes(t *testing.T) {
+	cases := []struct {
+		values  []string
+		want    []string
+		wantErr bool
+	}{
+		{values: []string{"application/json", "Text/Plain"}, want: []string{"application/json", "text/plain"}},
+		{values: []string{"application/merge-patch+json"}, want: []string{"application/merge-patch+json"}},
+		{values: []string{"application/json; charset=utf-8"}, wantErr: true},
+		{values: []string{"json"}, wantErr: true},
+		{values: []string{"application/json;"}, want: []string{"application/json"}},
+		{values: []string{""}, wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(strings.Join(tc.values, ","), func(t *testing.T) {
+			got, err := parseMediaTypes(tc.values)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tc.wantErr)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestContentTypes(t *testing.T) {
+	cases := []struct {
+		name        string
+		allowed     string
+		require     bool
+		method      string
+		contentType string
+		want        bool
+	}{
+		{name: "allowed", allowed: "application/json", method: "POST", contentType: "application/json", want: true},
+		{name: "charset is ignored", allowed: "application/json", method: "PUT", contentType: "application/json; charset=utf-8", want: true},
+		{name: "parameters without spaces", allowed: "application/json", method: "PUT", contentType: "application/json;charset=UTF-8;v=2", want: true},
+		{name: "quoted parameter", allowed: "multipart/form-data", method: "POST", contentType: `multipart/form-data; boundary="a;b"`, want: true},
+		{name: "case-insensitive", allowed: "application/json", method: "PATCH", contentType: "Application/JSON", want: true},
+		{name: "second allowed type", allowed: "application/json,text/plain", method: "POST", contentType: "text/plain", want: true},
+		{name: "not allowed", allowed: "application/json", method: "POST", contentType: "text/html"},
+		{name: "suffix is not the type", allowed: "application/json", method: "POST", contentType: "application/json-seq"},
+		{name: "malformed", allowed: "application/json", method: "POST", contentType: "application/json; charset"},
+		{name: "parameters only", allowed: "application/json", method: "POST", contentType: "; charset=utf-8"},
+		{name: "read method is not checked", allowed: "application/json", method: "GET", contentType: "text/html", want: true},
+		{name: "lowercase method", allowed: "application/json", method: "post", contentType: "text/html"},
+		{name: "missing is allowed by default", allowed: "application/json", method: "POST", want: true},
+		{name: "missing is denied when required", allowed: "application/json", require: true, method: "POST"},
+		{name: "required without allowlist", require: true, method: "PUT", contentType: "text/html", want: true},
+		{name: "required read method", require: true, method: "DELETE", want: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.DefaultAction = actionAllow
+			c.AllowedContentTypes = tc.allowed
+			c.RequireContentType = tc.require
+			s := newTestServer(t, c)
+			defer s.close()
+			r := testRequest{method: tc.method, headers: map[string]string{}}
+			if tc.contentType != "" {
+				r.headers["content-type"] = tc.contentType
+			}
+			if got := grpcAllowed(checkGRPC(t, s, r)); got != tc.want {
+				t.Fatalf("got allowed gRPC %v, want %v", got, tc.want)
+			}
+			wantStatus := http.StatusOK
+			if !tc.want {
+				wantStatus = http.StatusUnsupportedMediaType
+			}
+			if got := checkHTTP(s, r).Code; got != wantStatus {
+				t.Fatalf("got HTTP status %d, want %d", got, wantStatus)
+			}
+		})
+	}
+}
+
+func TestContentTypesValidation(t *testing.T) {
+	cases := []struct {
+		allowed string
+		wantErr string
+	}{
+		{allowed: "application/json,text/plain"},
+		{allowed: "application/json; charset=utf-8", wantErr: "invalid -allowed-content-types"},
+		{allowed: "json", wantErr: "invalid -allowed-content-types"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.allowed, func(t *testing.T) {
+			c := DefaultConfig()
+			c.AllowedContentTypes = tc.allowed
+			got := newServerError(c)
+			if (tc.wantErr == "") != (got == "") || !strings.Contains(got, tc.wantErr) {
+				t.Fatalf("got error %q, want %q", got, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// newSetCookie returns the cookie of the name=value pair with the attributes, it is nil if the
+// pair is empty.
+func newSetCookie(pair, path string, maxAge int, httpOnly, secure bool) (*http.Cookie, error) {
+	if pair == "" {
+		return nil, nil
+	}
+	kv := strings.SplitN(pair, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return nil, fmt.Errorf("invalid cookie %q, expected name=value", pair)
+	}
+	// http.Cookie.String silently drops an invalid name or value.
+	if !httpguts.ValidHeaderFieldName(kv[0]) {
+		return nil, fmt.Errorf("invalid cookie name %q", kv[0])
+	}
+	for _, b := range []byte(kv[1]) {
+		if b <= ' ' || b >= 0x7f || b == '"' || b == ';' || b == '\\' || b == ',' {
+			return nil, fmt.Errorf("invalid cookie value %q", kv[1])
+		}
+	}
+	return &http.Cookie{Name: kv[0], Value: kv[1], Path: path, MaxAge: maxAge, HttpOnly: httpOnly, Secure: secure}, nil
+}
+
+// setCookieHeaders returns the set-cookie header added to the downstream response of the allowed
+// request, the gRPC check response carries it in the response_headers_to_add supported by Envoy
+// 1.17 or later.
+func (s *ExtAuthzServer) setCookieHeaders() []responseHeader {
+	if s.setCookie == nil {
+		return nil
+	}
+	return []responseHeader{{name: "set-cookie", value: s.setCookie.String()}}
+}
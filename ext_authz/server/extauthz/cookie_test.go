@@ -0,0 +1,130 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"strings"
+	"testing"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+)
+
+func TestNewSetCookie(t *testing.T) {
+	cases := []struct {
+		name     string
+		pair     string
+		path     string
+		maxAge   int
+		httpOnly bool
+		secure   bool
+		want     string
+		wantErr  string
+	}{
+		{name: "empty"},
+		{name: "all attributes", pair: "authz=ok", path: "/", maxAge: 3600, httpOnly: true, secure: true,
+			want: "authz=ok; Path=/; Max-Age=3600; HttpOnly; Secure"},
+		{name: "no attributes", pair: "authz=ok", want: "authz=ok"},
+		{name: "empty value", pair: "authz=", path: "/app", want: "authz=; Path=/app"},
+		{name: "value with equals", pair: "authz=a=b", want: "authz=a=b"},
+		{name: "missing value", pair: "authz", wantErr: `invalid cookie "authz", expected name=value`},
+		{name: "missing name", pair: "=ok", wantErr: `invalid cookie "=ok", expected name=value`},
+		{name: "invalid name", pair: "auth z=ok", wantErr: `invalid cookie name "auth z"`},
+		{name: "invalid value", pair: "authz=a;b", wantErr: `invalid cookie value "a;b"`},
+		{name: "quoted value", pair: `authz="ok"`, wantErr: `invalid cookie value "\"ok\""`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cookie, err := newSetCookie(tc.pair, tc.path, tc.maxAge, tc.httpOnly, tc.secure)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want error containing %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got string
+			if cookie != nil {
+				got = cookie.String()
+			}
+			if got != tc.want {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// headerValues returns the values of the header in the header value options.
+func headerValues(headers []*core.HeaderValueOption, name string) []string {
+	var values []string
+	for _, h := range headers {
+		if strings.EqualFold(h.GetHeader().GetKey(), name) {
+			values = append(values, h.GetHeader().GetValue())
+		}
+	}
+	return values
+}
+
+func TestSetCookie(t *testing.T) {
+	const cookie = "authz=ok; Path=/; HttpOnly"
+	cases := []struct {
+		name         string
+		upstream     bool
+		allow        bool
+		wantUpstream bool
+	}{
+		{name: "downstream response", allow: true},
+		{name: "upstream fallback", upstream: true, allow: true, wantUpstream: true},
+		{name: "denied"},
+		{name: "denied with upstream fallback", upstream: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.SetCookie = "authz=ok"
+			c.SetCookieUpstream = tc.upstream
+			s := newTestServer(t, c)
+			defer s.close()
+			r := testRequest{headers: map[string]string{}}
+			if tc.allow {
+				r.headers["x-ext-authz"] = "allow"
+			}
+			response := checkGRPC(t, s, r)
+			ok := response.GetOkResponse()
+			if got := headerValues(ok.GetResponseHeadersToAdd(), "set-cookie"); tc.allow != (len(got) == 1 && got[0] == cookie) {
+				t.Fatalf("got response headers to add %q, want %q only if allowed", got, cookie)
+			}
+			for _, h := range ok.GetResponseHeadersToAdd() {
+				if h.GetHeader().GetKey() == "set-cookie" && !h.GetAppend().GetValue() {
+					t.Fatal("got set-cookie overwriting the upstream cookies, want it appended")
+				}
+			}
+			if got := headerValues(ok.GetHeaders(), "set-cookie"); (len(got) == 1) != tc.wantUpstream {
+				t.Fatalf("got request headers %q, want the cookie %v", got, tc.wantUpstream)
+			}
+			if got := headerValues(response.GetDeniedResponse().GetHeaders(), "set-cookie"); len(got) != 0 {
+				t.Fatalf("got denied response headers %q, want no cookie", got)
+			}
+			wantHTTP := ""
+			if tc.allow {
+				wantHTTP = cookie
+			}
+			if got := checkHTTP(s, r).Header().Get("set-cookie"); got != wantHTTP {
+				t.Fatalf("got HTTP set-cookie %q, want %q", got, wantHTTP)
+			}
+		})
+	}
+}
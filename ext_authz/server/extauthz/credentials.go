@@ -0,0 +1,70 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+// credentialMode validates one kind of credential instead of the check header.
+type credentialMode struct {
+	enabled bool
+	// present is true if the request carries this kind of credential.
+	present bool
+	// kind names the credential in the decision detail, e.g. missing-token or bad-token.
+	kind   string
+	decide func(request *checkRequest) decision
+}
+
+// decision returns the decision of the mode with the detail of the credential.
+func (m credentialMode) decision(request *checkRequest) decision {
+	d := m.decide(request)
+	if !d.allowed && d.detail == "" {
+		// The specific denials like a missing scope or an exhausted quota have a detail.
+		d.unauthenticated = true
+	}
+	switch {
+	case d.allowed:
+		return d.withDetail("valid-" + m.kind)
+	case !m.present:
+		return d.withDetail("missing-" + m.kind)
+	default:
+		return d.withDetail("bad-" + m.kind)
+	}
+}
+
+// credentialDecision returns the decision of the credential modes, ok is false if none is enabled.
+// The mode of the credential present in the request is used, otherwise the first enabled mode
+// denies the request for the missing credential.
+func (s *ExtAuthzServer) credentialDecision(request *checkRequest) (decision, bool) {
+	_, _, hasBasic := basicCredentials(request)
+	_, hasBearer := bearerToken(request)
+	modes := []credentialMode{
+		{enabled: request.files.htpasswd != nil, present: hasBasic, kind: "basic-auth", decide: s.basicAuthDecision},
+		{enabled: s.ldap != nil, present: hasBasic, kind: "basic-auth", decide: s.ldapDecision},
+		{enabled: s.jwtEnabled(), present: hasBearer, kind: "token", decide: s.jwtDecision},
+		{enabled: s.introspection != nil, present: hasBearer, kind: "token", decide: s.introspectionDecision},
+		{enabled: len(s.allowedSpiffeIDs) != 0, present: request.header(xfccHeader) != "", kind: "peer", decide: s.spiffeDecision},
+		{enabled: len(s.hmacSecret) != 0, present: request.header(SignatureHeader) != "", kind: "signature", decide: s.signatureDecision},
+		{enabled: request.files.apiKeys != nil, present: request.header(s.apiKeyHeader) != "", kind: "api-key", decide: s.apiKeyDecision},
+	}
+	for _, m := range modes {
+		if m.enabled && m.present {
+			return m.decision(request), true
+		}
+	}
+	for _, m := range modes {
+		if m.enabled {
+			return m.decision(request), true
+		}
+	}
+	return decision{}, false
+}
@@ -0,0 +1,42 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	runtimepprof "runtime/pprof"
+)
+
+// registerDebug adds the net/http/pprof handlers, /debug/vars and /debug/goroutines to the admin
+// mux. They are never served on the check listeners.
+func registerDebug(mux *http.ServeMux, logger Logger) {
+	logger.Warnf("the pprof and debug endpoints are enabled on the admin server, they expose the memory and stacks of the process")
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/goroutines", func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Set("content-type", "text/plain; charset=utf-8")
+		logger.Infof("Admin %s dumped the stacks of %d goroutines", request.RemoteAddr, runtime.NumGoroutine())
+		if err := runtimepprof.Lookup("goroutine").WriteTo(response, 2); err != nil {
+			logger.Errorf("Failed to write the goroutines: %v", err)
+		}
+	})
+}
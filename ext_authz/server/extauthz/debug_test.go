@@ -0,0 +1,83 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDebugEndpoints(t *testing.T) {
+	cases := []struct {
+		name        string
+		enablePprof bool
+		path        string
+		wantStatus  int
+		// wantPrefix is the start of the body, e.g. the gzip magic of the profiles.
+		wantPrefix string
+		wantBody   string
+	}{
+		{name: "heap profile", enablePprof: true, path: "/debug/pprof/heap", wantStatus: http.StatusOK, wantPrefix: "\x1f\x8b"},
+		{name: "index", enablePprof: true, path: "/debug/pprof/", wantStatus: http.StatusOK, wantBody: "heap"},
+		{name: "vars", enablePprof: true, path: "/debug/vars", wantStatus: http.StatusOK, wantBody: `"memstats"`},
+		{name: "goroutines", enablePprof: true, path: "/debug/goroutines", wantStatus: http.StatusOK, wantBody: "goroutine "},
+		{name: "disabled", path: "/debug/pprof/heap", wantStatus: http.StatusNotFound},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out syncBuffer
+			c := DefaultConfig()
+			c.AdminPort = "0"
+			c.EnablePprof = tc.enablePprof
+			c.Logger = NewTextLogger(&out)
+			s := newTestServer(t, c)
+			defer s.close()
+			got := adminRequest(s, http.MethodGet, tc.path, "", "")
+			if got.Code != tc.wantStatus || !bytes.HasPrefix(got.Body.Bytes(), []byte(tc.wantPrefix)) ||
+				!strings.Contains(got.Body.String(), tc.wantBody) {
+				t.Fatalf("got %d with body of %d bytes, want %d with %q", got.Code, got.Body.Len(), tc.wantStatus, tc.wantPrefix+tc.wantBody)
+			}
+			if warned := strings.Contains(out.String(), "the pprof and debug endpoints are enabled"); warned != tc.enablePprof {
+				t.Fatalf("got log %q, want the warning logged %v", out.String(), tc.enablePprof)
+			}
+		})
+	}
+}
+
+func TestDebugNotOnCheckListener(t *testing.T) {
+	c := DefaultConfig()
+	c.AdminPort = "0"
+	c.EnablePprof = true
+	s := newTestServer(t, c)
+	defer s.close()
+	for _, path := range []string{"/debug/pprof/heap", "/debug/vars", "/debug/goroutines"} {
+		t.Run(path, func(t *testing.T) {
+			// The path is decided like any other check request.
+			if got := checkHTTP(s, testRequest{path: path}); got.Code != http.StatusForbidden {
+				t.Fatalf("got status %d on the check listener, want %d", got.Code, http.StatusForbidden)
+			}
+		})
+	}
+}
+
+func TestPprofRequiresAdmin(t *testing.T) {
+	c := DefaultConfig()
+	c.EnablePprof = true
+	if got := newServerError(c); !strings.Contains(got, "-enable-pprof requires -admin-port") {
+		t.Fatalf("got error %q, want -enable-pprof requires -admin-port", got)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// delegateHeaderPrefix selects the webhook response headers copied to the check response.
+	delegateHeaderPrefix = "x-ext-authz-"
+	delegateMaxBytes     = 64 * 1024
+)
+
+// delegate forwards a summary of the request to an HTTP webhook that makes the decision.
+type delegate struct {
+	url      string
+	headers  []string
+	timeout  time.Duration
+	failOpen bool
+	client   *http.Client
+}
+
+// delegateRequest is the JSON body sent to the webhook, header names are lowercase.
+type delegateRequest struct {
+	Method   string            `json:"method"`
+	Host     string            `json:"host"`
+	Path     string            `json:"path"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	SourceIP string            `json:"source_ip,omitempty"`
+}
+
+func newDelegate(url string, headers []string, timeout time.Duration, failOpen bool) *delegate {
+	// The default transport keeps only 2 idle connections per host, which is too few for a webhook
+	// that receives every request.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 64
+	return &delegate{
+		url:      url,
+		headers:  headers,
+		timeout:  timeout,
+		failOpen: failOpen,
+		client:   &http.Client{Transport: transport},
+	}
+}
+
+// call posts the request to the webhook and returns the status code and the copied headers.
+// The call is bounded by both the configured timeout and the deadline of the context.
+func (d *delegate) call(ctx context.Context, request *checkRequest) (int, map[string]string, error) {
+	body := delegateRequest{Method: request.method, Host: request.host, Path: request.path}
+	for _, name := range d.headers {
+		if value := request.header(name); value != "" {
+			if body.Headers == nil {
+				body.Headers = map[string]string{}
+			}
+			body.Headers[name] = value
+		}
+	}
+	if request.sourceIP != nil {
+		body.SourceIP = request.sourceIP.String()
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPost, d.url, bytes.NewReader(data))
+	if err != nil {
+		return 0, nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	injectTraceContext(ctx, req.Header)
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	// Drain a bounded part of the body so that the connection can be reused.
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, delegateMaxBytes))
+
+	headers := map[string]string{}
+	for name, values := range resp.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, delegateHeaderPrefix) && name != resultHeader {
+			headers[name] = strings.Join(values, ",")
+		}
+	}
+	return resp.StatusCode, headers, nil
+}
+
+// delegateDecision returns the decision of the webhook, 2xx allows and 401/403 denies.
+func (s *ExtAuthzServer) delegateDecision(request *checkRequest) decision {
+	ctx, sp := startSpan(request.ctx, "webhook")
+	c := startCallout(request.ctx, "webhook")
+	status, headers, err := s.delegate.call(ctx, request)
+	c.done()
+	sp.finish(err)
+	switch {
+	case err == nil && status >= 200 && status < 300:
+		return decision{allowed: true, reason: fmt.Sprintf("webhook returned status %d", status), headers: headers}
+	case err == nil && (status == http.StatusUnauthorized || status == http.StatusForbidden):
+		return decision{reason: fmt.Sprintf("webhook returned status %d", status), status: status, headers: headers}
+	case err == nil:
+		err = fmt.Errorf("unexpected status %d", status)
+	}
+	if s.delegate.failOpen {
+		return decision{allowed: true, reason: "webhook failed, fail open: " + err.Error()}
+	}
+	return decision{reason: "webhook failed: " + err.Error()}
+}
@@ -0,0 +1,147 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+)
+
+const textContentType = "text/plain; charset=utf-8"
+
+// deniedPage is the default status and body of the HTTP denied response. The body file is read
+// at startup and re-read on SIGHUP.
+type deniedPage struct {
+	status      int
+	realm       string
+	contentType string
+	file        string
+	logger      Logger
+	// body holds the body string, it is replaced atomically on reload.
+	body atomic.Value
+	// stop ends the reload on SIGHUP, nil without the body file.
+	stop chan struct{}
+}
+
+func newDeniedPage(status int, body, file, contentType, realm string, logger Logger) (*deniedPage, error) {
+	if status < 400 || status > 599 {
+		return nil, fmt.Errorf("-http-denied-status must be a 4xx or 5xx status but got %d", status)
+	}
+	if body != "" && file != "" {
+		return nil, fmt.Errorf("-http-denied-body and -http-denied-body-file are exclusive")
+	}
+	p := &deniedPage{status: status, realm: realm, contentType: contentType, file: file, logger: logger}
+	if p.contentType == "" {
+		p.contentType = textContentType
+		if t := mime.TypeByExtension(filepath.Ext(file)); file != "" && t != "" {
+			p.contentType = t
+		}
+	}
+	p.body.Store(body)
+	if file != "" {
+		if err := p.reload(); err != nil {
+			return nil, err
+		}
+		p.stop = make(chan struct{})
+	}
+	return p, nil
+}
+
+// start re-reads the body file on SIGHUP, it does nothing if nil or without the body file.
+func (p *deniedPage) start() {
+	if p != nil && p.stop != nil {
+		go p.reloadOnSignal()
+	}
+}
+
+func (p *deniedPage) reload() error {
+	data, err := ioutil.ReadFile(p.file)
+	if err != nil {
+		return fmt.Errorf("failed to read denied body file: %v", err)
+	}
+	p.body.Store(string(data))
+	return nil
+}
+
+// reloadOnSignal re-reads the body file on SIGHUP until closed, the previous body is kept if it
+// fails.
+func (p *deniedPage) reloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case <-signals:
+			if err := p.reload(); err != nil {
+				p.logger.Errorf("Failed to reload the HTTP denied body, keeping the previous one: %v", err)
+				continue
+			}
+			p.logger.Infof("Reloaded the HTTP denied body from %s", p.file)
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// close stops the reload on SIGHUP, it does nothing if nil or without the body file.
+func (p *deniedPage) close() {
+	if p == nil || p.stop == nil {
+		return
+	}
+	close(p.stop)
+}
+
+// httpDenied returns the denied decision with the status, body and headers of the HTTP denied
+// response, the decision status and body take precedence over the body template and the denied page.
+func (s *ExtAuthzServer) httpDenied(request *checkRequest, d decision) decision {
+	headers := map[string]string{}
+	for k, v := range d.headers {
+		headers[k] = v
+	}
+	d.headers = headers
+	if d.body != "" {
+		if _, ok := d.headers["content-type"]; !ok {
+			d.headers["content-type"] = textContentType
+		}
+	}
+	if s.deniedPage == nil {
+		return d
+	}
+	if d.status == 0 {
+		d.status = s.deniedPage.status
+	}
+	if d.body == "" {
+		if body, ok := s.templateBody(request, d); ok {
+			d.body = body
+			d.headers["content-type"] = s.bodyTemplate.contentType
+		}
+	}
+	if d.body == "" {
+		if d.body = s.deniedPage.body.Load().(string); d.body != "" {
+			d.headers["content-type"] = s.deniedPage.contentType
+		}
+	}
+	if _, ok := d.headers["www-authenticate"]; !ok && d.status == http.StatusUnauthorized && s.deniedPage.realm != "" {
+		d.headers["www-authenticate"] = fmt.Sprintf("Bearer realm=%q", s.deniedPage.realm)
+	}
+	return d
+}
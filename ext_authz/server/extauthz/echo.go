@@ -0,0 +1,49 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"fmt"
+)
+
+const receivedHeader = "x-ext-authz-check-received"
+
+// receivedSummary returns the summary of the check request as seen by the server, with the
+// sensitive headers redacted and truncated to echoMaxLen.
+func (s *ExtAuthzServer) receivedSummary(request *checkRequest) string {
+	headers := make(map[string]string, len(request.headers))
+	for name, value := range request.headers {
+		if sensitiveHeaders[name] {
+			value = redacted
+		}
+		headers[name] = value
+	}
+	summary := fmt.Sprintf("%s %s%s, headers: %v", request.method, request.host, s.redactPath(request.path), headers)
+	if s.echoMaxLen > 0 && len(summary) > s.echoMaxLen {
+		summary = summary[:s.echoMaxLen]
+	}
+	return summary
+}
+
+// echoReceived adds the received summary header to the decision, it is added to the upstream
+// request if allowed and to the denied response otherwise.
+func (s *ExtAuthzServer) echoReceived(request *checkRequest, d *decision) {
+	headers := make(map[string]string, len(d.headers)+1)
+	for k, v := range d.headers {
+		headers[k] = v
+	}
+	headers[receivedHeader] = s.receivedSummary(request)
+	d.headers = headers
+}
@@ -0,0 +1,311 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The tests embed the server through its exported API only, like the importers of the package.
+package extauthz_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/grpc"
+
+	"github.com/yangminzhu/playground/ext_authz/server/extauthz"
+)
+
+// startServer starts the server of the options on port 0 for both listeners.
+func startServer(t *testing.T, opts ...extauthz.Option) *extauthz.ExtAuthzServer {
+	t.Helper()
+	s, err := extauthz.NewExtAuthzServer(append(opts, extauthz.WithLogger(extauthz.NewTextLogger(ioutil.Discard)))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start("127.0.0.1:0", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// checkPorts sends the check request with the headers to the gRPC and HTTP ports and returns the
+// decisions.
+func checkPorts(t *testing.T, s *extauthz.ExtAuthzServer, headers map[string]string) (grpcOK, httpOK bool) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, fmt.Sprintf("127.0.0.1:%d", s.GRPCPort()), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	response, err := auth.NewAuthorizationClient(conn).Check(ctx, &auth.CheckRequest{Attributes: &auth.AttributeContext{
+		Source: &auth.AttributeContext_Peer{Address: &core.Address{}},
+		Request: &auth.AttributeContext_Request{Http: &auth.AttributeContext_HttpRequest{
+			Method: "GET", Host: "example.com", Path: "/", Headers: headers,
+		}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%d/", s.HTTPPort()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range headers {
+		request.Header.Set(k, v)
+	}
+	httpResponse, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpResponse.Body.Close()
+	return response.GetStatus().GetCode() == int32(code.Code_OK), httpResponse.StatusCode == http.StatusOK
+}
+
+func TestServerInProcess(t *testing.T) {
+	cases := []struct {
+		name    string
+		opts    []extauthz.Option
+		headers map[string]string
+		want    bool
+	}{
+		{name: "defaults allow the check header", headers: map[string]string{"x-ext-authz": "allow"}, want: true},
+		{name: "defaults deny without the check header"},
+		{name: "check header", opts: []extauthz.Option{extauthz.WithCheckHeader("x-custom")},
+			headers: map[string]string{"x-custom": "allow"}, want: true},
+		{name: "check header replaces the default one", opts: []extauthz.Option{extauthz.WithCheckHeader("x-custom")},
+			headers: map[string]string{"x-ext-authz": "allow"}},
+		{name: "allowed values", opts: []extauthz.Option{extauthz.WithAllowedValues("alpha", "beta")},
+			headers: map[string]string{"x-ext-authz": "beta"}, want: true},
+		{name: "allowed values replace the default one", opts: []extauthz.Option{extauthz.WithAllowedValues("alpha")},
+			headers: map[string]string{"x-ext-authz": "allow"}},
+		{name: "default action", opts: []extauthz.Option{extauthz.WithDefaultAction("allow")}, want: true},
+		{name: "options follow the config", opts: []extauthz.Option{
+			extauthz.WithConfig(extauthz.DefaultConfig()), extauthz.WithCheckHeader("x-custom"),
+		}, headers: map[string]string{"x-custom": "allow"}, want: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := startServer(t, tc.opts...)
+			defer s.Stop()
+			if s.HTTPPort() <= 0 || s.GRPCPort() <= 0 || s.HTTPPort() == s.GRPCPort() {
+				t.Fatalf("got HTTP port %d and gRPC port %d, want distinct ports", s.HTTPPort(), s.GRPCPort())
+			}
+			grpcOK, httpOK := checkPorts(t, s, tc.headers)
+			if grpcOK != tc.want || httpOK != tc.want {
+				t.Fatalf("got allowed gRPC %v and HTTP %v, want %v", grpcOK, httpOK, tc.want)
+			}
+		})
+	}
+}
+
+func TestServerPorts(t *testing.T) {
+	cases := []struct {
+		name               string
+		httpAddr, grpcAddr string
+		wantHTTP, wantGRPC bool
+	}{
+		{name: "both", httpAddr: "127.0.0.1:0", grpcAddr: "127.0.0.1:0", wantHTTP: true, wantGRPC: true},
+		{name: "HTTP disabled", httpAddr: extauthz.Disabled, grpcAddr: "127.0.0.1:0", wantGRPC: true},
+		{name: "gRPC disabled", httpAddr: "127.0.0.1:0", grpcAddr: extauthz.Disabled, wantHTTP: true},
+	}
+	port := func(enabled bool, got int) bool {
+		if enabled {
+			return got > 0
+		}
+		return got == extauthz.DisabledPort
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := extauthz.NewExtAuthzServer(extauthz.WithLogger(extauthz.NewTextLogger(ioutil.Discard)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.HTTPPort() != 0 || s.GRPCPort() != 0 {
+				t.Fatalf("got HTTP port %d and gRPC port %d before Start, want 0", s.HTTPPort(), s.GRPCPort())
+			}
+			if err := s.Start(tc.httpAddr, tc.grpcAddr); err != nil {
+				t.Fatal(err)
+			}
+			s.Stop()
+			if err := s.Wait(); err != nil {
+				t.Fatalf("got Wait error %v after Stop, want nil", err)
+			}
+			// The ports are kept after Stop.
+			if !port(tc.wantHTTP, s.HTTPPort()) || !port(tc.wantGRPC, s.GRPCPort()) {
+				t.Fatalf("got HTTP port %d and gRPC port %d, want enabled HTTP %v and gRPC %v",
+					s.HTTPPort(), s.GRPCPort(), tc.wantHTTP, tc.wantGRPC)
+			}
+		})
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	used, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer used.Close()
+	cases := []struct {
+		name               string
+		opts               []extauthz.Option
+		httpAddr, grpcAddr string
+		wantNewErr         string
+		wantStartErr       string
+	}{
+		{name: "invalid default action", opts: []extauthz.Option{extauthz.WithDefaultAction("maybe")}, wantNewErr: "maybe"},
+		{name: "invalid check header", opts: []extauthz.Option{extauthz.WithCheckHeader("bad header")}, wantNewErr: "bad header"},
+		{name: "HTTP port in use", httpAddr: used.Addr().String(), grpcAddr: "127.0.0.1:0", wantStartErr: "address already in use"},
+		{name: "gRPC port in use", httpAddr: "127.0.0.1:0", grpcAddr: used.Addr().String(), wantStartErr: "address already in use"},
+		{name: "both disabled", httpAddr: extauthz.Disabled, grpcAddr: extauthz.Disabled, wantStartErr: "disabled"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := extauthz.NewExtAuthzServer(append(tc.opts, extauthz.WithLogger(extauthz.NewTextLogger(ioutil.Discard)))...)
+			if tc.wantNewErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantNewErr) {
+					t.Fatalf("got error %v, want error containing %q", err, tc.wantNewErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = s.Start(tc.httpAddr, tc.grpcAddr)
+			if err == nil || !strings.Contains(err.Error(), tc.wantStartErr) {
+				s.Stop()
+				t.Fatalf("got Start error %v, want error containing %q", err, tc.wantStartErr)
+			}
+		})
+	}
+}
+
+// freePort returns a port that is free to listen on.
+func freePort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// TestListenersSpeakTheirProtocol is a regression test of the HTTP and gRPC addresses swapped by
+// Start.
+func TestListenersSpeakTheirProtocol(t *testing.T) {
+	httpPort, grpcPort := freePort(t), freePort(t)
+	s, err := extauthz.NewExtAuthzServer(extauthz.WithLogger(extauthz.NewTextLogger(ioutil.Discard)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(fmt.Sprintf("127.0.0.1:%d", httpPort), fmt.Sprintf("127.0.0.1:%d", grpcPort)); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	if s.HTTPPort() != httpPort || s.GRPCPort() != grpcPort {
+		t.Fatalf("got HTTP port %d and gRPC port %d, want %d and %d", s.HTTPPort(), s.GRPCPort(), httpPort, grpcPort)
+	}
+	cases := []struct {
+		name   string
+		port   int
+		client string
+		want   bool
+	}{
+		{name: "gRPC client on the gRPC port", port: grpcPort, client: "gRPC", want: true},
+		{name: "HTTP client on the HTTP port", port: httpPort, client: "HTTP", want: true},
+		{name: "gRPC client on the HTTP port", port: httpPort, client: "gRPC"},
+		{name: "HTTP client on the gRPC port", port: grpcPort, client: "HTTP"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			address := fmt.Sprintf("127.0.0.1:%d", tc.port)
+			var err error
+			if tc.client == "gRPC" {
+				var conn *grpc.ClientConn
+				if conn, err = grpc.DialContext(ctx, address, grpc.WithInsecure()); err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				_, err = auth.NewAuthorizationClient(conn).Check(ctx, &auth.CheckRequest{})
+			} else {
+				var response *http.Response
+				if response, err = (&http.Client{Timeout: 5 * time.Second}).Get("http://" + address + "/"); err == nil {
+					response.Body.Close()
+					if response.StatusCode != http.StatusForbidden {
+						err = fmt.Errorf("got HTTP status %d, want the denied check", response.StatusCode)
+					}
+				}
+			}
+			if got := err == nil; got != tc.want {
+				t.Fatalf("got error %v, want the %s client to succeed %v", err, tc.client, tc.want)
+			}
+		})
+	}
+}
+
+// TestGRPCServesConfiguredInstance is a regression test of the gRPC server registering a zero
+// ExtAuthzServer instead of the configured one.
+func TestGRPCServesConfiguredInstance(t *testing.T) {
+	c := extauthz.DefaultConfig()
+	c.DeniedStatus = http.StatusServiceUnavailable
+	s := startServer(t, extauthz.WithConfig(c), extauthz.WithCheckHeader("x-team"), extauthz.WithAllowedValues("payments"))
+	defer s.Stop()
+	conn, err := grpc.Dial(fmt.Sprintf("127.0.0.1:%d", s.GRPCPort()), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cases := []struct {
+		name       string
+		headers    map[string]string
+		want       bool
+		wantStatus int32
+	}{
+		{name: "configured value", headers: map[string]string{"x-team": "payments"}, want: true},
+		{name: "default value", headers: map[string]string{"x-ext-authz": "allow"}, wantStatus: http.StatusServiceUnavailable},
+		{name: "other value", headers: map[string]string{"x-team": "search"}, wantStatus: http.StatusServiceUnavailable},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			response, err := auth.NewAuthorizationClient(conn).Check(ctx, &auth.CheckRequest{Attributes: &auth.AttributeContext{
+				Source: &auth.AttributeContext_Peer{Address: &core.Address{}},
+				Request: &auth.AttributeContext_Request{Http: &auth.AttributeContext_HttpRequest{
+					Method: "GET", Host: "example.com", Path: "/", Headers: tc.headers,
+				}},
+			}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := response.GetStatus().GetCode() == int32(code.Code_OK); got != tc.want {
+				t.Fatalf("got allowed %v, want %v", got, tc.want)
+			}
+			if got := int32(response.GetDeniedResponse().GetStatus().GetCode()); got != tc.wantStatus {
+				t.Fatalf("got denied status %d, want %d", got, tc.wantStatus)
+			}
+		})
+	}
+}
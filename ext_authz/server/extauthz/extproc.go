@@ -0,0 +1,146 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+)
+
+// externalProcessor serves the Envoy ext_proc API with the ext_authz decision of the request
+// headers, the other phases continue unchanged.
+type externalProcessor struct {
+	s *ExtAuthzServer
+}
+
+// newExtProcCheckRequest returns the check request of the request headers, the method, path and
+// host are read from the pseudo-headers. The source IP is not known as ext_proc doesn't send it.
+func newExtProcCheckRequest(ctx context.Context, headers *extproc.HttpHeaders) *checkRequest {
+	r := &checkRequest{ctx: ctx, headers: map[string]string{}}
+	for _, h := range headers.GetHeaders().GetHeaders() {
+		r.headers[strings.ToLower(h.GetKey())] = h.GetValue()
+	}
+	r.method = r.headers[":method"]
+	r.path = r.headers[":path"]
+	r.host = r.headers[":authority"]
+	r.parsePath()
+	return r
+}
+
+// responseCodeDetails returns the Envoy response code details of the decision detail, which must
+// not contain whitespace, e.g. ext_authz_missing_header.
+func responseCodeDetails(detail string) string {
+	return "ext_authz_" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, detail)
+}
+
+// Process implements the ext_proc stream, it returns when Envoy closes the stream.
+func (p externalProcessor) Process(stream extproc.ExternalProcessor_ProcessServer) error {
+	ctx := stream.Context()
+	for {
+		request, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				// The stream is cancelled, e.g. the downstream request is reset.
+				return nil
+			}
+			return err
+		}
+		response, err := p.process(ctx, request)
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(response); err != nil {
+			return err
+		}
+	}
+}
+
+func (p externalProcessor) process(ctx context.Context, request *extproc.ProcessingRequest) (*extproc.ProcessingResponse, error) {
+	switch r := request.GetRequest().(type) {
+	case *extproc.ProcessingRequest_RequestHeaders:
+		return p.s.processRequestHeaders(ctx, r.RequestHeaders), nil
+	case *extproc.ProcessingRequest_ResponseHeaders:
+		return &extproc.ProcessingResponse{Response: &extproc.ProcessingResponse_ResponseHeaders{
+			ResponseHeaders: &extproc.HeadersResponse{}}}, nil
+	case *extproc.ProcessingRequest_RequestBody:
+		return &extproc.ProcessingResponse{Response: &extproc.ProcessingResponse_RequestBody{
+			RequestBody: &extproc.BodyResponse{}}}, nil
+	case *extproc.ProcessingRequest_ResponseBody:
+		return &extproc.ProcessingResponse{Response: &extproc.ProcessingResponse_ResponseBody{
+			ResponseBody: &extproc.BodyResponse{}}}, nil
+	case *extproc.ProcessingRequest_RequestTrailers:
+		return &extproc.ProcessingResponse{Response: &extproc.ProcessingResponse_RequestTrailers{
+			RequestTrailers: &extproc.TrailersResponse{}}}, nil
+	case *extproc.ProcessingRequest_ResponseTrailers:
+		return &extproc.ProcessingResponse{Response: &extproc.ProcessingResponse_ResponseTrailers{
+			ResponseTrailers: &extproc.TrailersResponse{}}}, nil
+	default:
+		return nil, grpcstatus.Errorf(codes.InvalidArgument, "unknown processing request %T", r)
+	}
+}
+
+// processRequestHeaders continues with the header mutation of the allowed request, or returns the
+// immediate response of the denied request.
+func (s *ExtAuthzServer) processRequestHeaders(ctx context.Context, headers *extproc.HttpHeaders) *extproc.ProcessingResponse {
+	start := time.Now()
+	checkRequest := newExtProcCheckRequest(ctx, headers)
+	stages := s.startStages(checkRequest, start)
+	defer s.finishStages("ext_proc", checkRequest, stages)
+	d := s.decide(checkRequest)
+	stages.evaluated()
+	s.metrics.observeCheck("ext_proc", d, start)
+	s.logDecision("ext_proc", checkRequest, d, start, func(bool) string {
+		return fmt.Sprintf("[ext_proc][%s]: %s %s%s, %s, rule=%s\n", d.tag(),
+			checkRequest.method, checkRequest.host, s.redactPath(checkRequest.path), d.reason, d.ruleName())
+	})
+	if d.allowed {
+		return &extproc.ProcessingResponse{Response: &extproc.ProcessingResponse_RequestHeaders{
+			RequestHeaders: &extproc.HeadersResponse{Response: &extproc.CommonResponse{
+				Status: extproc.CommonResponse_CONTINUE,
+				HeaderMutation: &extproc.HeaderMutation{
+					SetHeaders:    s.headerValueOptions(d),
+					RemoveHeaders: d.headersToRemove,
+				},
+			}},
+		}}
+	}
+	d = s.grpcDeniedDecision(checkRequest, d)
+	immediate := &extproc.ImmediateResponse{
+		Status:  &typev3.HttpStatus{Code: typev3.StatusCode(d.status)},
+		Headers: &extproc.HeaderMutation{SetHeaders: s.headerValueOptions(d)},
+		Body:    d.body,
+		Details: responseCodeDetails(d.resultDetail()),
+	}
+	if checkRequest.isGRPC() {
+		immediate.GrpcStatus = &extproc.GrpcStatus{Status: uint32(grpcStatus(d.status))}
+	}
+	return &extproc.ProcessingResponse{Response: &extproc.ProcessingResponse_ImmediateResponse{ImmediateResponse: immediate}}
+}
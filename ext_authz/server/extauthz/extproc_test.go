@@ -0,0 +1,241 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+)
+
+// requestHeaders returns the processing request of the request headers, the pseudo-headers are
+// added to the headers.
+func requestHeaders(headers map[string]string) *extproc.ProcessingRequest {
+	all := map[string]string{":method": "GET", ":path": "/api", ":authority": "example.com"}
+	for k, v := range headers {
+		all[k] = v
+	}
+	var values []*core.HeaderValue
+	for k, v := range all {
+		values = append(values, &core.HeaderValue{Key: k, Value: v})
+	}
+	return &extproc.ProcessingRequest{Request: &extproc.ProcessingRequest_RequestHeaders{
+		RequestHeaders: &extproc.HttpHeaders{Headers: &core.HeaderMap{Headers: values}},
+	}}
+}
+
+// processStep is a processing request sent on the stream and the processing response it wants.
+type processStep struct {
+	request *extproc.ProcessingRequest
+	want    *extproc.ProcessingResponse
+}
+
+func TestExtProcStream(t *testing.T) {
+	allowed := processStep{
+		request: requestHeaders(map[string]string{"x-ext-authz": "allow"}),
+		want: &extproc.ProcessingResponse{Response: &extproc.ProcessingResponse_RequestHeaders{
+			RequestHeaders: &extproc.HeadersResponse{Response: &extproc.CommonResponse{
+				Status:         extproc.CommonResponse_CONTINUE,
+				HeaderMutation: &extproc.HeaderMutation{SetHeaders: resultHeaderOption("allowed")},
+			}},
+		}},
+	}
+	denied := processStep{
+		request: requestHeaders(nil),
+		want: &extproc.ProcessingResponse{Response: &extproc.ProcessingResponse_ImmediateResponse{
+			ImmediateResponse: &extproc.ImmediateResponse{
+				Status:  &typev3.HttpStatus{Code: typev3.StatusCode_Forbidden},
+				Headers: &extproc.HeaderMutation{SetHeaders: resultHeaderOption("denied")},
+				Details: "ext_authz_missing_header",
+			},
+		}},
+	}
+	cases := []struct {
+		name    string
+		steps   []processStep
+		wantErr codes.Code
+	}{
+		{name: "allowed request continues through all phases", steps: []processStep{
+			allowed,
+			{
+				request: &extproc.ProcessingRequest{Request: &extproc.ProcessingRequest_RequestBody{RequestBody: &extproc.HttpBody{Body: []byte("{}")}}},
+				want:    &extproc.ProcessingResponse{Response: &extproc.ProcessingResponse_RequestBody{RequestBody: &extproc.BodyResponse{}}},
+			},
+			{
+				request: &extproc.ProcessingRequest{Request: &extproc.ProcessingRequest_RequestTrailers{RequestTrailers: &extproc.HttpTrailers{}}},
+				want:    &extproc.ProcessingResponse{Response: &extproc.ProcessingResponse_RequestTrailers{RequestTrailers: &extproc.TrailersResponse{}}},
+			},
+			{
+				request: &extproc.ProcessingRequest{Request: &extproc.ProcessingRequest_ResponseHeaders{ResponseHeaders: &extproc.HttpHeaders{}}},
+				want:    &extproc.ProcessingResponse{Response: &extproc.ProcessingResponse_ResponseHeaders{ResponseHeaders: &extproc.HeadersResponse{}}},
+			},
+			{
+				request: &extproc.ProcessingRequest{Request: &extproc.ProcessingRequest_ResponseBody{ResponseBody: &extproc.HttpBody{}}},
+				want:    &extproc.ProcessingResponse{Response: &extproc.ProcessingResponse_ResponseBody{ResponseBody: &extproc.BodyResponse{}}},
+			},
+			{
+				request: &extproc.ProcessingRequest{Request: &extproc.ProcessingRequest_ResponseTrailers{ResponseTrailers: &extproc.HttpTrailers{}}},
+				want:    &extproc.ProcessingResponse{Response: &extproc.ProcessingResponse_ResponseTrailers{ResponseTrailers: &extproc.TrailersResponse{}}},
+			},
+		}},
+		{name: "denied request gets an immediate response", steps: []processStep{denied}},
+		{name: "denied gRPC request has the gRPC status", steps: []processStep{{
+			request: requestHeaders(map[string]string{"content-type": "application/grpc"}),
+			want: &extproc.ProcessingResponse{Response: &extproc.ProcessingResponse_ImmediateResponse{
+				ImmediateResponse: &extproc.ImmediateResponse{
+					Status: &typev3.HttpStatus{Code: typev3.StatusCode_Forbidden},
+					Headers: &extproc.HeaderMutation{SetHeaders: append(resultHeaderOption("denied"), &core.HeaderValueOption{
+						Header: &core.HeaderValue{Key: "grpc-status", Value: "7"},
+						Append: &wrappers.BoolValue{Value: false},
+					})},
+					Details:    "ext_authz_missing_header",
+					GrpcStatus: &extproc.GrpcStatus{Status: uint32(codes.PermissionDenied)},
+				},
+			}},
+		}}},
+		{name: "requests are decided independently on the stream", steps: []processStep{allowed, denied, allowed}},
+		{name: "unknown request fails the stream", steps: []processStep{{request: &extproc.ProcessingRequest{}}},
+			wantErr: codes.InvalidArgument},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.EnableExtProc = true
+			s := startTLSServer(t, c)
+			defer s.Stop()
+			conn, err := grpc.Dial(s.GRPCAddr().String(), grpc.WithInsecure())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			stream, err := extproc.NewExternalProcessorClient(conn).Process(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, step := range tc.steps {
+				if err := stream.Send(step.request); err != nil {
+					t.Fatal(err)
+				}
+				got, err := stream.Recv()
+				if tc.wantErr != codes.OK {
+					if code := grpcstatus.Code(err); code != tc.wantErr {
+						t.Fatalf("step %d: got error %v, want code %v", i, err, tc.wantErr)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+				if !proto.Equal(got, step.want) {
+					t.Fatalf("step %d: got response %v, want %v", i, got, step.want)
+				}
+			}
+			// The stream ends without an error once Envoy closes its side.
+			if err := stream.CloseSend(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := stream.Recv(); err != io.EOF {
+				t.Fatalf("got %v after closing the stream, want EOF", err)
+			}
+		})
+	}
+}
+
+func TestExtProcDisabled(t *testing.T) {
+	s := startTLSServer(t, DefaultConfig())
+	defer s.Stop()
+	conn, err := grpc.Dial(s.GRPCAddr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := extproc.NewExternalProcessorClient(conn).Process(ctx)
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if code := grpcstatus.Code(err); code != codes.Unimplemented {
+		t.Fatalf("got error %v, want code %v", err, codes.Unimplemented)
+	}
+}
+
+// fakeProcessStream returns the receive error from Recv if set, the denied request headers
+// otherwise. Send returns the send error.
+type fakeProcessStream struct {
+	grpc.ServerStream
+	ctx     context.Context
+	recvErr error
+	sendErr error
+}
+
+func (f *fakeProcessStream) Context() context.Context {
+	return f.ctx
+}
+
+func (f *fakeProcessStream) Recv() (*extproc.ProcessingRequest, error) {
+	if f.recvErr != nil {
+		return nil, f.recvErr
+	}
+	return requestHeaders(nil), nil
+}
+
+func (f *fakeProcessStream) Send(*extproc.ProcessingResponse) error {
+	return f.sendErr
+}
+
+func TestExtProcStreamErrors(t *testing.T) {
+	failed := errors.New("connection reset")
+	cases := []struct {
+		name      string
+		recvErr   error
+		sendErr   error
+		cancelled bool
+		wantErr   error
+	}{
+		{name: "EOF ends the stream", recvErr: io.EOF},
+		{name: "cancelled stream ends without an error", recvErr: context.Canceled, cancelled: true},
+		{name: "receive error", recvErr: failed, wantErr: failed},
+		{name: "send error", sendErr: failed, wantErr: failed},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, DefaultConfig())
+			defer s.close()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tc.cancelled {
+				cancel()
+			}
+			stream := &fakeProcessStream{ctx: ctx, recvErr: tc.recvErr, sendErr: tc.sendErr}
+			if err := (externalProcessor{s: s}).Process(stream); err != tc.wantErr {
+				t.Fatalf("got error %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+)
+
+const grpcStatusHeader = "grpc-status"
+
+// isGRPC returns true if the request is gRPC traffic to the upstream, detected by its content-type.
+func (r *checkRequest) isGRPC() bool {
+	contentType := strings.ToLower(r.header("content-type"))
+	return contentType == "application/grpc" || strings.HasPrefix(contentType, "application/grpc+") ||
+		strings.HasPrefix(contentType, "application/grpc;")
+}
+
+// grpcMethod parses the /package.Service/Method path of a gRPC request, ok is false if the path
+// is not a gRPC method. Streaming and unary methods have the same path format.
+func (r *checkRequest) grpcMethod() (service, method string, ok bool) {
+	if !r.isGRPC() || r.urlPath != r.path || !strings.HasPrefix(r.path, "/") {
+		return "", "", false
+	}
+	parts := strings.Split(r.path[1:], "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// grpcStatus returns the gRPC status code of a denied HTTP status, Envoy returns it in the
+// grpc-status of the denied response to gRPC clients.
+func grpcStatus(status int) codes.Code {
+	switch status {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusNotFound:
+		return codes.Unimplemented
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	default:
+		return codes.PermissionDenied
+	}
+}
+
+// grpcDenied adds the grpc-status header to the denied decision of a gRPC request, it is called
+// with the final status of the denied response.
+func grpcDenied(d decision) decision {
+	headers := map[string]string{}
+	for k, v := range d.headers {
+		headers[k] = v
+	}
+	d.headers = headers
+	d.headers[grpcStatusHeader] = fmt.Sprint(int(grpcStatus(d.deniedStatus())))
+	return d
+}
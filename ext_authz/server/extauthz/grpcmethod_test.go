@@ -0,0 +1,153 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+)
+
+func TestGRPCMethod(t *testing.T) {
+	cases := []struct {
+		name        string
+		contentType string
+		path        string
+		wantService string
+		wantMethod  string
+		wantOK      bool
+	}{
+		{name: "unary", contentType: "application/grpc", path: "/helloworld.Greeter/SayHello",
+			wantService: "helloworld.Greeter", wantMethod: "SayHello", wantOK: true},
+		{name: "server streaming", contentType: "application/grpc+proto", path: "/routeguide.RouteGuide/ListFeatures",
+			wantService: "routeguide.RouteGuide", wantMethod: "ListFeatures", wantOK: true},
+		{name: "bidirectional streaming", contentType: "application/grpc;charset=utf-8", path: "/routeguide.RouteGuide/RouteChat",
+			wantService: "routeguide.RouteGuide", wantMethod: "RouteChat", wantOK: true},
+		{name: "uppercase content-type", contentType: "Application/GRPC", path: "/helloworld.Greeter/SayHello",
+			wantService: "helloworld.Greeter", wantMethod: "SayHello", wantOK: true},
+		{name: "service without a package", contentType: "application/grpc", path: "/Greeter/SayHello",
+			wantService: "Greeter", wantMethod: "SayHello", wantOK: true},
+		{name: "not gRPC", contentType: "application/json", path: "/helloworld.Greeter/SayHello"},
+		{name: "gRPC-Web is not gRPC", contentType: "application/grpc-web", path: "/helloworld.Greeter/SayHello"},
+		{name: "missing content-type", path: "/helloworld.Greeter/SayHello"},
+		{name: "no method", contentType: "application/grpc", path: "/helloworld.Greeter"},
+		{name: "empty method", contentType: "application/grpc", path: "/helloworld.Greeter/"},
+		{name: "empty service", contentType: "application/grpc", path: "//SayHello"},
+		{name: "too many segments", contentType: "application/grpc", path: "/api/helloworld.Greeter/SayHello"},
+		{name: "query string", contentType: "application/grpc", path: "/helloworld.Greeter/SayHello?x=1"},
+		{name: "root", contentType: "application/grpc", path: "/"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			headers := map[string]string{}
+			if tc.contentType != "" {
+				headers["content-type"] = tc.contentType
+			}
+			service, method, ok := policyRequest("POST", "example.com", tc.path, headers).grpcMethod()
+			if service != tc.wantService || method != tc.wantMethod || ok != tc.wantOK {
+				t.Fatalf("got %q %q %v, want %q %q %v", service, method, ok, tc.wantService, tc.wantMethod, tc.wantOK)
+			}
+		})
+	}
+}
+
+func TestGRPCStatus(t *testing.T) {
+	cases := []struct {
+		status int
+		want   codes.Code
+	}{
+		{status: http.StatusForbidden, want: codes.PermissionDenied},
+		{status: http.StatusBadRequest, want: codes.InvalidArgument},
+		{status: http.StatusUnauthorized, want: codes.Unauthenticated},
+		{status: http.StatusNotFound, want: codes.Unimplemented},
+		{status: http.StatusTooManyRequests, want: codes.ResourceExhausted},
+		{status: http.StatusServiceUnavailable, want: codes.Unavailable},
+		{status: http.StatusTeapot, want: codes.PermissionDenied},
+	}
+	for _, tc := range cases {
+		t.Run(fmt.Sprint(tc.status), func(t *testing.T) {
+			if got := grpcStatus(tc.status); got != tc.want {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGRPCMethodRules(t *testing.T) {
+	file := writeTestFile(t, `
+rules:
+- name: deny-grpc-admin
+  grpc_service: helloworld.Admin
+  action: deny
+- name: allow-say-hello
+  grpc_service: helloworld.Greeter
+  grpc_method: SayHello
+  action: allow
+- name: allow-streaming
+  grpc_method: RouteChat
+  action: allow
+- name: deny-all
+  action: deny
+`)
+	defer os.Remove(file)
+	grpcHeaders := map[string]string{"content-type": "application/grpc"}
+	cases := []struct {
+		name           string
+		request        testRequest
+		want           bool
+		wantGRPCStatus string
+	}{
+		{name: "allowed method", request: testRequest{method: "POST", path: "/helloworld.Greeter/SayHello", headers: grpcHeaders},
+			want: true},
+		{name: "other method of the service", request: testRequest{method: "POST", path: "/helloworld.Greeter/SayGoodbye",
+			headers: grpcHeaders}, wantGRPCStatus: "7"},
+		{name: "denied service", request: testRequest{method: "POST", path: "/helloworld.Admin/Reset", headers: grpcHeaders},
+			wantGRPCStatus: "7"},
+		{name: "streaming method of any service", request: testRequest{method: "POST", path: "/routeguide.RouteGuide/RouteChat",
+			headers: grpcHeaders}, want: true},
+		{name: "not a gRPC method path", request: testRequest{method: "POST", path: "/helloworld.Greeter/SayHello/extra",
+			headers: grpcHeaders}, wantGRPCStatus: "7"},
+		{name: "HTTP traffic to the method path", request: testRequest{method: "POST", path: "/helloworld.Greeter/SayHello"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.PolicyFile = file
+			s := newTestServer(t, c)
+			defer s.close()
+			response := checkGRPC(t, s, tc.request)
+			if got := grpcAllowed(response); got != tc.want {
+				t.Fatalf("got allowed gRPC %v, want %v", got, tc.want)
+			}
+			recorder := checkHTTP(s, tc.request)
+			if got := recorder.Code == http.StatusOK; got != tc.want {
+				t.Fatalf("got HTTP status %d, want allowed %v", recorder.Code, tc.want)
+			}
+			if tc.want {
+				return
+			}
+			// Envoy returns the grpc-status of the denied response to gRPC clients.
+			if got := grpcHeader(response, grpcStatusHeader); got != tc.wantGRPCStatus {
+				t.Fatalf("got gRPC denied grpc-status %q, want %q", got, tc.wantGRPCStatus)
+			}
+			if got := recorder.Header().Get(grpcStatusHeader); got != tc.wantGRPCStatus {
+				t.Fatalf("got HTTP denied grpc-status %q, want %q", got, tc.wantGRPCStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+// minKeepaliveTime is the minimum keepalive time enforced by gRPC, smaller values are raised to it.
+const minKeepaliveTime = time.Second
+
+// grpcTuning is the tuning of the gRPC server, the zero values keep the gRPC defaults.
+type grpcTuning struct {
+	keepaliveTime        time.Duration
+	keepaliveTimeout     time.Duration
+	maxConcurrentStreams uint32
+	maxRecvMsgSize       int
+	maxConnectionAge     time.Duration
+}
+
+func (t grpcTuning) validate() error {
+	if t.keepaliveTime != 0 && t.keepaliveTime < minKeepaliveTime {
+		return fmt.Errorf("-grpc-keepalive-time must be at least %v but got %v", minKeepaliveTime, t.keepaliveTime)
+	}
+	if t.keepaliveTimeout < 0 || t.maxConnectionAge < 0 || t.maxRecvMsgSize < 0 {
+		return fmt.Errorf("-grpc-keepalive-timeout, -grpc-max-connection-age and -grpc-max-recv-msg-size must not be negative")
+	}
+	return nil
+}
+
+// serverOptions returns the gRPC server options of the tuning.
+func (t grpcTuning) serverOptions() []grpc.ServerOption {
+	var options []grpc.ServerOption
+	if t.keepaliveTime > 0 || t.keepaliveTimeout > 0 || t.maxConnectionAge > 0 {
+		options = append(options, grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:             t.keepaliveTime,
+			Timeout:          t.keepaliveTimeout,
+			MaxConnectionAge: t.maxConnectionAge,
+		}))
+	}
+	if t.maxConcurrentStreams > 0 {
+		options = append(options, grpc.MaxConcurrentStreams(t.maxConcurrentStreams))
+	}
+	if t.maxRecvMsgSize > 0 {
+		options = append(options, grpc.MaxRecvMsgSize(t.maxRecvMsgSize))
+	}
+	return options
+}
+
+// log logs the tuning that differs from the gRPC defaults.
+func (t grpcTuning) log(logger Logger) {
+	if t != (grpcTuning{}) {
+		logger.Infof("Tuning gRPC server with keepalive time %v, keepalive timeout %v, max concurrent streams %d, "+
+			"max receive message size %d, max connection age %v (0 is the gRPC default)",
+			t.keepaliveTime, t.keepaliveTimeout, t.maxConcurrentStreams, t.maxRecvMsgSize, t.maxConnectionAge)
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+)
+
+func TestGRPCTuningValidation(t *testing.T) {
+	cases := []struct {
+		name    string
+		config  func(c *Config)
+		wantErr string
+	}{
+		{name: "defaults", config: func(c *Config) {}},
+		{name: "all set", config: func(c *Config) {
+			c.GRPCKeepaliveTime = time.Minute
+			c.GRPCKeepaliveTimeout = 20 * time.Second
+			c.GRPCMaxConcurrentStreams = 100
+			c.GRPCMaxRecvMsgSize = 8 << 20
+			c.GRPCMaxConnectionAge = time.Hour
+		}},
+		{name: "minimum keepalive time", config: func(c *Config) { c.GRPCKeepaliveTime = time.Second }},
+		{name: "keepalive time below the minimum", config: func(c *Config) { c.GRPCKeepaliveTime = 500 * time.Millisecond },
+			wantErr: "-grpc-keepalive-time must be at least 1s but got 500ms"},
+		{name: "negative keepalive timeout", config: func(c *Config) { c.GRPCKeepaliveTimeout = -time.Second },
+			wantErr: "must not be negative"},
+		{name: "negative max connection age", config: func(c *Config) { c.GRPCMaxConnectionAge = -time.Second },
+			wantErr: "must not be negative"},
+		{name: "negative max receive message size", config: func(c *Config) { c.GRPCMaxRecvMsgSize = -1 },
+			wantErr: "must not be negative"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := DefaultConfig()
+			tc.config(&c)
+			got := newServerError(c)
+			if (tc.wantErr == "") != (got == "") || !strings.Contains(got, tc.wantErr) {
+				t.Fatalf("got error %q, want %q", got, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestGRPCTuningLog(t *testing.T) {
+	cases := []struct {
+		name   string
+		tuning grpcTuning
+		want   string
+	}{
+		{name: "defaults"},
+		{name: "tuned", tuning: grpcTuning{keepaliveTime: time.Minute, maxRecvMsgSize: 1024},
+			want: "Tuning gRPC server with keepalive time 1m0s, keepalive timeout 0s, max concurrent streams 0, " +
+				"max receive message size 1024, max connection age 0s (0 is the gRPC default)\n"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			tc.tuning.log(NewTextLogger(&out))
+			if got := out.String(); !strings.HasSuffix(got, tc.want) || (tc.want == "") != (got == "") {
+				t.Fatalf("got log %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGRPCMaxRecvMsgSize(t *testing.T) {
+	c := DefaultConfig()
+	c.GRPCMaxRecvMsgSize = 1024
+	s := newTestServer(t, c)
+	if err := s.Start("127.0.0.1:0", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	cases := []struct {
+		name       string
+		headerSize int
+		wantCode   codes.Code
+	}{
+		{name: "below the max", headerSize: 100, wantCode: codes.OK},
+		{name: "above the max", headerSize: 2048, wantCode: codes.ResourceExhausted},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := testRequest{headers: map[string]string{"x-ext-authz": "allow", "x-padding": strings.Repeat("a", tc.headerSize)}}
+			_, err := grpcCheck(s, r, grpc.WithInsecure())
+			if got := grpcstatus.Code(err); got != tc.wantCode {
+				t.Fatalf("got code %v with error %v, want %v", got, err, tc.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// h2cTransport sends HTTP/2 requests with prior knowledge over cleartext, like Envoy does.
+var h2cTransport = &http2.Transport{
+	AllowHTTP: true,
+	DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+		return net.Dial(network, addr)
+	},
+}
+
+// syncBuffer is the log of a running server, it is written by the server goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestHTTPH2C(t *testing.T) {
+	cases := []struct {
+		name      string
+		h2c       bool
+		transport http.RoundTripper
+		want      string
+		wantErr   bool
+	}{
+		{name: "h2c", h2c: true, transport: h2cTransport, want: "HTTP/2.0"},
+		{name: "HTTP/1.1 on the h2c listener", h2c: true, transport: &http.Transport{}, want: "HTTP/1.1"},
+		{name: "HTTP/1.1", transport: &http.Transport{}, want: "HTTP/1.1"},
+		{name: "h2c disabled", transport: h2cTransport, wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out syncBuffer
+			c := DefaultConfig()
+			c.HTTPH2C = tc.h2c
+			c.Logger = NewTextLogger(&out)
+			s := newTestServer(t, c)
+			if err := s.Start("127.0.0.1:0", Disabled); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Stop()
+			for _, header := range []string{"allow", "deny"} {
+				request, err := http.NewRequest(http.MethodGet, "http://"+s.HTTPAddr().String()+"/api", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				request.Header.Set("x-ext-authz", header)
+				response, err := (&http.Client{Timeout: 5 * time.Second, Transport: tc.transport}).Do(request)
+				if gotErr := err != nil; gotErr != tc.wantErr {
+					t.Fatalf("got error %v, want error %v", err, tc.wantErr)
+				}
+				if err != nil {
+					return
+				}
+				response.Body.Close()
+				wantStatus := http.StatusOK
+				if header == "deny" {
+					wantStatus = http.StatusForbidden
+				}
+				if response.Proto != tc.want || response.StatusCode != wantStatus {
+					t.Fatalf("got %s %d, want %s %d", response.Proto, response.StatusCode, tc.want, wantStatus)
+				}
+			}
+			// The decision logs report the protocol Envoy used.
+			if got := strings.Count(out.String(), "/api "+tc.want+", "); got != 2 {
+				t.Fatalf("got log %q, want %s in both decisions", out.String(), tc.want)
+			}
+		})
+	}
+}
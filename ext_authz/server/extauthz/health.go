@@ -0,0 +1,169 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	// dependencyCheckInterval and dependencyCheckTimeout bound the reachability checks of the
+	// external dependencies reflected in the health status.
+	dependencyCheckInterval = 10 * time.Second
+	dependencyCheckTimeout  = 2 * time.Second
+
+	// healthzPath and readyzPath are only served on the admin server, a 200 on the HTTP check
+	// listener would allow the downstream request. The check listeners report the health in the
+	// gRPC health service.
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+)
+
+// dependency is an external service the decisions depend on.
+type dependency struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// dependencies returns the configured external dependencies, i.e. OPA, Redis and the JWKS endpoint.
+func (s *ExtAuthzServer) dependencies() []dependency {
+	var deps []dependency
+	if s.opa != nil {
+		healthURL, err := url.Parse(s.opa.url)
+		if err == nil {
+			// OPA serves its own health API at /health.
+			healthURL.Path, healthURL.RawQuery = "/health", ""
+			deps = append(deps, dependency{name: "opa", check: httpGetCheck(s.opa.client, healthURL.String())})
+		}
+	}
+	if s.redis != nil {
+		deps = append(deps, dependency{name: "redis", check: func(ctx context.Context) error {
+			return s.redis.WithContext(ctx).Ping().Err()
+		}})
+	}
+	if s.jwks != nil {
+		deps = append(deps, dependency{name: "jwks", check: httpGetCheck(s.jwks.client, s.jwks.url)})
+	}
+	return deps
+}
+
+// httpGetCheck returns a check that expects a 2xx status of the URL.
+func httpGetCheck(client *http.Client, url string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("status %d", resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// unreachableDependencies returns the failed checks, empty if all dependencies are reachable.
+func unreachableDependencies(deps []dependency) []string {
+	var failed []string
+	for _, dep := range deps {
+		ctx, cancel := context.WithTimeout(context.Background(), dependencyCheckTimeout)
+		if err := dep.check(ctx); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", dep.name, err))
+		}
+		cancel()
+	}
+	return failed
+}
+
+// watchDependencies reports NOT_SERVING while any dependency is unreachable, the status is checked
+// every dependencyCheckInterval.
+func (s *ExtAuthzServer) watchDependencies(deps []dependency) {
+	serving := true
+	for range time.Tick(dependencyCheckInterval) {
+		failed := unreachableDependencies(deps)
+		s.unreachable.Store(failed)
+		if ok := len(failed) == 0; ok != serving {
+			serving = ok
+			if ok {
+				s.logger.Infof("Dependencies are reachable again, reporting SERVING")
+				s.health.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+			} else {
+				s.logger.Infof("Dependencies are unreachable, reporting NOT_SERVING: %s", strings.Join(failed, ", "))
+				s.health.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+			}
+		}
+	}
+}
+
+// notReady returns the failing components of the readiness, empty if ready.
+func (s *ExtAuthzServer) notReady() []string {
+	var failing []string
+	if atomic.LoadInt32(&s.draining) != 0 {
+		failing = append(failing, "shutdown: draining")
+	}
+	if atomic.LoadInt32(&s.listening) == 0 {
+		failing = append(failing, "listeners: not bound")
+	}
+	if s.files.policyFile != "" && s.files.files().policy == nil {
+		failing = append(failing, "policy: not loaded")
+	}
+	if failed, ok := s.unreachable.Load().([]string); ok {
+		failing = append(failing, failed...)
+	}
+	return failing
+}
+
+// healthResponse is the JSON of /healthz and /readyz.
+type healthResponse struct {
+	Status  string   `json:"status"`
+	Failing []string `json:"failing,omitempty"`
+}
+
+// serveHealth serves /healthz and /readyz, it returns false for the other paths.
+func (s *ExtAuthzServer) serveHealth(response http.ResponseWriter, request *http.Request) bool {
+	var failing []string
+	switch request.URL.Path {
+	case healthzPath:
+		// The process is alive if it can answer.
+	case readyzPath:
+		failing = s.notReady()
+	default:
+		return false
+	}
+	result, status := healthResponse{Status: "ok"}, http.StatusOK
+	if len(failing) != 0 {
+		result, status = healthResponse{Status: "unavailable", Failing: failing}, http.StatusServiceUnavailable
+	}
+	response.Header().Set("content-type", "application/json")
+	response.Header().Set("cache-control", "no-store")
+	response.WriteHeader(status)
+	if err := json.NewEncoder(response).Encode(result); err != nil {
+		s.logger.Errorf("Failed to write the %s response: %v", request.URL.Path, err)
+	}
+	return true
+}
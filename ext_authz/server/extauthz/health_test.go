@@ -0,0 +1,249 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestGRPCHealth(t *testing.T) {
+	c := DefaultConfig()
+	c.ShutdownDelay = 500 * time.Millisecond
+	s := newTestServer(t, c)
+	if err := s.Start("127.0.0.1:0", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := grpc.Dial(s.GRPCAddr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+	status := func(service string) (healthpb.HealthCheckResponse_ServingStatus, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		response, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+		return response.GetStatus(), err
+	}
+	if got, err := status(""); err != nil || got != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("got status %v with error %v, want SERVING", got, err)
+	}
+	if _, err := status("unknown.Service"); err == nil {
+		t.Fatal("got the status of an unknown service, want NOT_FOUND")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+	defer func() { <-stopped }()
+	// The listener stays open during the shutdown delay so Envoy sees NOT_SERVING and drains.
+	deadline := time.Now().Add(c.ShutdownDelay)
+	for {
+		got, err := status("")
+		if err == nil && got == healthpb.HealthCheckResponse_NOT_SERVING {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got status %v with error %v during the shutdown delay, want NOT_SERVING", got, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUnreachableDependencies(t *testing.T) {
+	reachable := dependency{name: "opa", check: func(context.Context) error { return nil }}
+	unreachable := dependency{name: "redis", check: func(context.Context) error { return errors.New("connection refused") }}
+	cases := []struct {
+		name string
+		deps []dependency
+		want []string
+	}{
+		{name: "none"},
+		{name: "reachable", deps: []dependency{reachable}},
+		{name: "unreachable", deps: []dependency{reachable, unreachable}, want: []string{"redis: connection refused"}},
+		{name: "all checked", deps: []dependency{unreachable, reachable, unreachable},
+			want: []string{"redis: connection refused", "redis: connection refused"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := unreachableDependencies(tc.deps); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestOPADependency(t *testing.T) {
+	cases := []struct {
+		name    string
+		status  int
+		wantErr string
+	}{
+		{name: "healthy", status: http.StatusOK},
+		{name: "unhealthy", status: http.StatusInternalServerError, wantErr: "status 500"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var path string
+			opa := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+				path = request.URL.Path
+				response.WriteHeader(tc.status)
+			}))
+			defer opa.Close()
+			c := DefaultConfig()
+			c.OPAURL = opa.URL + "/v1/data/authz/allow?pretty"
+			s := newTestServer(t, c)
+			defer s.close()
+			deps := s.dependencies()
+			if len(deps) != 1 || deps[0].name != "opa" {
+				t.Fatalf("got dependencies %v, want opa", deps)
+			}
+			got := strings.Join(unreachableDependencies(deps), ",")
+			if (tc.wantErr == "") != (got == "") || !strings.Contains(got, tc.wantErr) {
+				t.Fatalf("got %q, want %q", got, tc.wantErr)
+			}
+			// OPA serves its health API at /health of the data API server.
+			if path != "/health" {
+				t.Fatalf("got path %q, want /health", path)
+			}
+		})
+	}
+}
+
+func TestServeHealth(t *testing.T) {
+	cases := []struct {
+		name       string
+		path       string
+		listening  bool
+		draining   bool
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "alive before listening", path: healthzPath, wantStatus: http.StatusOK, wantBody: `{"status":"ok"}`},
+		{name: "ready", path: readyzPath, listening: true, wantStatus: http.StatusOK, wantBody: `{"status":"ok"}`},
+		{name: "not listening", path: readyzPath, wantStatus: http.StatusServiceUnavailable,
+			wantBody: `{"status":"unavailable","failing":["listeners: not bound"]}`},
+		{name: "draining", path: readyzPath, listening: true, draining: true, wantStatus: http.StatusServiceUnavailable,
+			wantBody: `{"status":"unavailable","failing":["shutdown: draining"]}`},
+		{name: "alive while draining", path: healthzPath, listening: true, draining: true, wantStatus: http.StatusOK,
+			wantBody: `{"status":"ok"}`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, DefaultConfig())
+			defer s.close()
+			if tc.listening {
+				s.listening = 1
+			}
+			if tc.draining {
+				s.draining = 1
+			}
+			recorder := httptest.NewRecorder()
+			if !s.serveHealth(recorder, httptest.NewRequest(http.MethodGet, tc.path, nil)) {
+				t.Fatalf("got %s not served", tc.path)
+			}
+			if recorder.Code != tc.wantStatus || strings.TrimSpace(recorder.Body.String()) != tc.wantBody {
+				t.Fatalf("got %d %s, want %d %s", recorder.Code, recorder.Body, tc.wantStatus, tc.wantBody)
+			}
+		})
+	}
+}
+
+func TestReadinessTransitions(t *testing.T) {
+	c := DefaultConfig()
+	c.AdminPort = "0"
+	c.ShutdownDelay = 500 * time.Millisecond
+	s := newTestServer(t, c)
+	ready := func() (int, string) {
+		recorder := adminRequest(s, http.MethodGet, readyzPath, "", "")
+		return recorder.Code, strings.TrimSpace(recorder.Body.String())
+	}
+	steps := []struct {
+		name       string
+		transition func()
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "created", wantStatus: http.StatusServiceUnavailable,
+			wantBody: `{"status":"unavailable","failing":["listeners: not bound"]}`},
+		{name: "started", transition: func() {
+			if err := s.Start("127.0.0.1:0", "127.0.0.1:0"); err != nil {
+				t.Fatal(err)
+			}
+		}, wantStatus: http.StatusOK, wantBody: `{"status":"ok"}`},
+		{name: "shutdown started", transition: func() {
+			go s.Stop()
+			// The draining is reported within the shutdown delay while the check listeners still accept.
+			deadline := time.Now().Add(c.ShutdownDelay)
+			for atomic.LoadInt32(&s.draining) == 0 && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+		}, wantStatus: http.StatusServiceUnavailable, wantBody: `{"status":"unavailable","failing":["shutdown: draining"]}`},
+	}
+	for _, step := range steps {
+		if step.transition != nil {
+			step.transition()
+		}
+		if status, body := ready(); status != step.wantStatus || body != step.wantBody {
+			t.Fatalf("%s: got %d %s, want %d %s", step.name, status, body, step.wantStatus, step.wantBody)
+		}
+	}
+	// The HTTP check listener is still open during the shutdown delay and decides the request.
+	response, err := http.Get("http://" + s.HTTPAddr().String() + readyzPath)
+	if err != nil {
+		t.Fatalf("got %v, want the HTTP listener open during the shutdown delay", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusForbidden {
+		t.Fatalf("got HTTP status %d for %s on the check listener, want the denied check", response.StatusCode, readyzPath)
+	}
+	s.Stop()
+}
+
+func TestHealthBypassesDecisions(t *testing.T) {
+	cases := []struct {
+		name string
+		path string
+	}{
+		{name: "liveness", path: healthzPath},
+		{name: "readiness", path: readyzPath},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.AdminPort = "0"
+			s := newTestServer(t, c)
+			defer s.close()
+			s.listening = 1
+			s.setRuntime("", forceDenyAll)
+			if got := adminRequest(s, http.MethodGet, tc.path, "", ""); got.Code != http.StatusOK {
+				t.Fatalf("got %s status %d with deny-all, want %d", tc.path, got.Code, http.StatusOK)
+			}
+		})
+	}
+}
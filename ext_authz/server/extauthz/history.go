@@ -0,0 +1,122 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const decisionsPath = "/debug/decisions"
+
+// decisionRecord is a recent decision served on /debug/decisions.
+type decisionRecord struct {
+	Time     time.Time `json:"ts"`
+	Protocol string    `json:"protocol"`
+	Method   string    `json:"method,omitempty"`
+	Host     string    `json:"host,omitempty"`
+	Path     string    `json:"path,omitempty"`
+	// Headers are keyed by the lowercase name, the sensitive headers are redacted.
+	Headers  map[string]string `json:"headers,omitempty"`
+	Decision string            `json:"decision"`
+	Reason   string            `json:"reason"`
+	Rule     string            `json:"rule"`
+}
+
+// decisionHistory is a fixed-size ring buffer of the most recent decisions.
+type decisionHistory struct {
+	mu      sync.Mutex
+	records []decisionRecord
+	// next is the number of the added records, the next one is written at next % len(records).
+	next uint64
+}
+
+func newDecisionHistory(size int) *decisionHistory {
+	return &decisionHistory{records: make([]decisionRecord, size)}
+}
+
+// add overwrites the oldest record once the buffer is full, it does nothing if nil.
+func (h *decisionHistory) add(r decisionRecord) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	h.records[h.next%uint64(len(h.records))] = r
+	h.next++
+	h.mu.Unlock()
+}
+
+// recent returns the records with the decision, or all if empty, newest first.
+func (h *decisionHistory) recent(decision string) []decisionRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := h.next
+	if n > uint64(len(h.records)) {
+		n = uint64(len(h.records))
+	}
+	result := make([]decisionRecord, 0, n)
+	for i := uint64(1); i <= n; i++ {
+		r := h.records[(h.next-i)%uint64(len(h.records))]
+		if decision == "" || r.Decision == decision {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// recordDecision adds the decision of the check request to the history if enabled, the copy of
+// the headers is made before taking the lock.
+func (s *ExtAuthzServer) recordDecision(protocol string, request *checkRequest, d decision, start time.Time) {
+	if s.history == nil {
+		return
+	}
+	headers := make(map[string]string, len(request.headers))
+	for name, value := range request.headers {
+		if sensitiveHeaders[name] {
+			value = redacted
+		}
+		headers[name] = value
+	}
+	s.history.add(decisionRecord{
+		Time:     start,
+		Protocol: protocol,
+		Method:   request.method,
+		Host:     request.host,
+		Path:     s.redactPath(request.path),
+		Headers:  headers,
+		Decision: d.result(),
+		Reason:   d.reason,
+		Rule:     d.ruleName(),
+	})
+}
+
+// serveDecisions serves the recent decisions as JSON on GET /debug/decisions, newest first, only
+// those with the decision allowed, denied or allowed-by-sampling with ?decision=.
+func (s *ExtAuthzServer) serveDecisions(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		response.Header().Set("Allow", "GET")
+		http.Error(response, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	response.Header().Set("content-type", "application/json")
+	response.Header().Set("cache-control", "no-store")
+	encoder := json.NewEncoder(response)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(s.history.recent(request.URL.Query().Get("decision"))); err != nil {
+		s.logger.Errorf("Failed to write the %s response: %v", request.URL.Path, err)
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecisionHistoryWraparound(t *testing.T) {
+	cases := []struct {
+		name     string
+		size     int
+		added    int
+		decision string
+		// want are the paths of the records, newest first.
+		want []string
+	}{
+		{name: "empty", size: 3, want: []string{}},
+		{name: "partially filled", size: 3, added: 2, want: []string{"/1", "/0"}},
+		{name: "full", size: 3, added: 3, want: []string{"/2", "/1", "/0"}},
+		{name: "oldest overwritten", size: 3, added: 4, want: []string{"/3", "/2", "/1"}},
+		{name: "wrapped more than once", size: 3, added: 8, want: []string{"/7", "/6", "/5"}},
+		{name: "size one", size: 1, added: 5, want: []string{"/4"}},
+		// The odd records are denied.
+		{name: "filter after wraparound", size: 4, added: 7, decision: "denied", want: []string{"/5", "/3"}},
+		{name: "filter without match", size: 4, added: 7, decision: "allowed-by-sampling", want: []string{}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newDecisionHistory(tc.size)
+			for i := 0; i < tc.added; i++ {
+				result := "allowed"
+				if i%2 == 1 {
+					result = "denied"
+				}
+				h.add(decisionRecord{Path: fmt.Sprintf("/%d", i), Decision: result})
+			}
+			got := []string{}
+			for _, r := range h.recent(tc.decision) {
+				got = append(got, r.Path)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestServeDecisions(t *testing.T) {
+	c := DefaultConfig()
+	c.AdminPort = "0"
+	c.DecisionHistory = 2
+	s := newTestServer(t, c)
+	defer s.close()
+	checkGRPC(t, s, testRequest{path: "/first", headers: map[string]string{"x-ext-authz": "allow"}})
+	checkHTTP(s, testRequest{path: "/second", headers: map[string]string{"authorization": "Bearer s3cret", "cookie": "session=c00kie"}})
+	checkGRPC(t, s, testRequest{method: "POST", host: "example.com", path: "/third?id=1", headers: map[string]string{"x-ext-authz": "allow"}})
+	cases := []struct {
+		name       string
+		method     string
+		query      string
+		wantStatus int
+		// wantPaths are the paths of the records, newest first.
+		wantPaths []string
+	}{
+		{name: "newest first", method: http.MethodGet, wantStatus: http.StatusOK, wantPaths: []string{"/third?id=1", "/second"}},
+		{name: "denied", method: http.MethodGet, query: "?decision=denied", wantStatus: http.StatusOK, wantPaths: []string{"/second"}},
+		{name: "allowed", method: http.MethodGet, query: "?decision=allowed", wantStatus: http.StatusOK, wantPaths: []string{"/third?id=1"}},
+		{name: "GET only", method: http.MethodDelete, wantStatus: http.StatusMethodNotAllowed},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := adminRequest(s, tc.method, decisionsPath+tc.query, "", "")
+			if got.Code != tc.wantStatus {
+				t.Fatalf("got status %d, want %d", got.Code, tc.wantStatus)
+			}
+			if tc.wantPaths == nil {
+				return
+			}
+			if content := got.Header().Get("content-type"); content != "application/json" {
+				t.Fatalf("got content-type %q, want application/json", content)
+			}
+			if body := got.Body.String(); strings.Contains(body, "s3cret") || strings.Contains(body, "c00kie") {
+				t.Fatalf("got the sensitive header values in %s", body)
+			}
+			var records []decisionRecord
+			if err := json.Unmarshal(got.Body.Bytes(), &records); err != nil {
+				t.Fatal(err)
+			}
+			var paths []string
+			for _, r := range records {
+				paths = append(paths, r.Path)
+			}
+			if !reflect.DeepEqual(paths, tc.wantPaths) {
+				t.Fatalf("got paths %v, want %v", paths, tc.wantPaths)
+			}
+		})
+	}
+}
+
+func TestDecisionRecord(t *testing.T) {
+	c := DefaultConfig()
+	c.AdminPort = "0"
+	s := newTestServer(t, c)
+	defer s.close()
+	checkHTTP(s, testRequest{method: "PUT", host: "example.com", path: "/items",
+		headers: map[string]string{"authorization": "Bearer s3cret", "cookie": "session=c00kie", "x-team": "payments"}})
+	records := s.history.recent("")
+	if len(records) != 1 {
+		t.Fatalf("got %d records, want 1", len(records))
+	}
+	got := records[0]
+	if got.Time.IsZero() || got.Protocol != "http" || got.Method != "PUT" || got.Host != "example.com" ||
+		got.Path != "/items" || got.Decision != "denied" || got.Rule != "default" || got.Reason == "" {
+		t.Fatalf("got record %+v", got)
+	}
+	want := map[string]string{"authorization": redacted, "cookie": redacted, "x-team": "payments"}
+	for name, value := range want {
+		if got.Headers[name] != value {
+			t.Fatalf("got header %s %q, want %q", name, got.Headers[name], value)
+		}
+	}
+}
+
+func TestDecisionHistoryDisabled(t *testing.T) {
+	cases := []struct {
+		name            string
+		adminPort       string
+		decisionHistory int
+		wantErr         string
+	}{
+		{name: "disabled with 0", adminPort: "0"},
+		{name: "without the admin server", decisionHistory: 100},
+		{name: "negative", adminPort: "0", decisionHistory: -1, wantErr: "-decision-history must not be negative but got -1"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.AdminPort = tc.adminPort
+			c.DecisionHistory = tc.decisionHistory
+			if tc.wantErr != "" {
+				if got := newServerError(c); !strings.Contains(got, tc.wantErr) {
+					t.Fatalf("got error %q, want %q", got, tc.wantErr)
+				}
+				return
+			}
+			s := newTestServer(t, c)
+			defer s.close()
+			if s.history != nil {
+				t.Fatal("got the decision history enabled")
+			}
+			// The decisions are not recorded and the endpoint is not served.
+			checkGRPC(t, s, testRequest{})
+			if s.adminAddr == "" {
+				return
+			}
+			if got := adminRequest(s, http.MethodGet, decisionsPath, "", ""); got.Code != http.StatusNotFound {
+				t.Fatalf("got status %d, want %d", got.Code, http.StatusNotFound)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// parseHostPattern validates and normalizes a host pattern. A pattern is either an exact host or
+// has a single leading wildcard label, e.g. *.example.com.
+func parseHostPattern(pattern string) (string, error) {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	if pattern == "" {
+		return "", fmt.Errorf("empty host pattern")
+	}
+	rest := strings.TrimPrefix(pattern, "*.")
+	if rest == "" || strings.Contains(rest, "*") {
+		return "", fmt.Errorf("invalid host pattern %q: only a single leading wildcard label is supported", pattern)
+	}
+	return pattern, nil
+}
+
+// hostMatches returns true if the host matches the normalized pattern, any port in the host is ignored.
+// Same as Envoy virtual hosts, the wildcard matches one or more labels.
+func hostMatches(pattern, host string) bool {
+	host = strings.ToLower(stripPort(host))
+	if strings.HasPrefix(pattern, "*.") {
+		suffix := pattern[1:]
+		return len(host) > len(suffix) && strings.HasSuffix(host, suffix)
+	}
+	return host == pattern
+}
+
+// stripPort removes the port from the host or :authority value, IPv6 literals are returned without brackets.
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
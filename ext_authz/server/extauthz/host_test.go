@@ -0,0 +1,133 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseHostPattern(t *testing.T) {
+	cases := []struct {
+		pattern string
+		want    string
+		wantErr bool
+	}{
+		{pattern: "Example.COM", want: "example.com"},
+		{pattern: " *.internal.example.com ", want: "*.internal.example.com"},
+		{pattern: "", wantErr: true},
+		{pattern: "*", wantErr: true},
+		{pattern: "*.", wantErr: true},
+		{pattern: "foo.*.com", wantErr: true},
+		{pattern: "*.*.example.com", wantErr: true},
+		{pattern: "*example.com", wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.pattern, func(t *testing.T) {
+			got, err := parseHostPattern(tc.pattern)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHostMatches(t *testing.T) {
+	cases := []struct {
+		pattern string
+		host    string
+		want    bool
+	}{
+		{pattern: "example.com", host: "example.com", want: true},
+		{pattern: "example.com", host: "EXAMPLE.com:8080", want: true},
+		{pattern: "example.com", host: "www.example.com"},
+		{pattern: "*.example.com", host: "api.example.com", want: true},
+		{pattern: "*.example.com", host: "api.example.com:443", want: true},
+		{pattern: "*.example.com", host: "a.b.example.com", want: true},
+		{pattern: "*.example.com", host: "example.com"},
+		{pattern: "*.example.com", host: "badexample.com"},
+		{pattern: "::1", host: "[::1]:8080", want: true},
+		{pattern: "::1", host: "[::1]", want: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.pattern+" "+tc.host, func(t *testing.T) {
+			if got := hostMatches(tc.pattern, tc.host); got != tc.want {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDeniedHosts(t *testing.T) {
+	policy := writeTestFile(t, `
+rules:
+- name: deny-internal
+  host: "*.Internal.example.com"
+  action: deny
+- name: allow-all
+  action: allow
+`)
+	defer os.Remove(policy)
+	cases := []struct {
+		name   string
+		config func(c *Config)
+		host   string
+		want   bool
+	}{
+		{name: "flag exact host with port", config: func(c *Config) { c.DeniedHosts = "admin.example.com" },
+			host: "Admin.Example.com:8443"},
+		{name: "flag wildcard", config: func(c *Config) { c.DeniedHosts = "*.internal.example.com" }, host: "db.internal.example.com"},
+		{name: "flag other host", config: func(c *Config) { c.DeniedHosts = "admin.example.com" }, host: "www.example.com:80", want: true},
+		{name: "policy wildcard with port", config: func(c *Config) { c.PolicyFile = policy }, host: "db.internal.example.com:9000"},
+		{name: "policy other host", config: func(c *Config) { c.PolicyFile = policy }, host: "internal.example.com", want: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.DefaultAction = actionAllow
+			tc.config(&c)
+			s := newTestServer(t, c)
+			defer s.close()
+			grpcOK, httpOK := checkBoth(t, s, testRequest{host: tc.host})
+			if grpcOK != tc.want || httpOK != tc.want {
+				t.Fatalf("got allowed gRPC %v and HTTP %v, want %v", grpcOK, httpOK, tc.want)
+			}
+		})
+	}
+}
+
+func TestDeniedHostsValidation(t *testing.T) {
+	cases := []struct {
+		deniedHosts string
+		wantErr     string
+	}{
+		{deniedHosts: "admin.example.com,*.internal.example.com"},
+		{deniedHosts: "foo.*.com", wantErr: "invalid -denied-hosts"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.deniedHosts, func(t *testing.T) {
+			c := DefaultConfig()
+			c.DeniedHosts = tc.deniedHosts
+			got := newServerError(c)
+			if (tc.wantErr == "") != (got == "") || !strings.Contains(got, tc.wantErr) {
+				t.Fatalf("got error %q, want %q", got, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// htpasswdCheckInterval limits how often the file mtime is checked for changes.
+const htpasswdCheckInterval = time.Second
+
+// htpasswd holds the bcrypt password hashes loaded from an htpasswd file, the file is re-read
+// when its mtime changes.
+type htpasswd struct {
+	file   string
+	logger Logger
+
+	mu        sync.RWMutex
+	users     map[string][]byte
+	mtime     time.Time
+	lastCheck time.Time
+}
+
+func newHtpasswd(file string, logger Logger) (*htpasswd, error) {
+	h := &htpasswd{file: file, logger: logger}
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read htpasswd file: %v", err)
+	}
+	if err := h.load(info.ModTime()); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// load reads the file, malformed lines and unsupported hashes are skipped with a warning.
+func (h *htpasswd) load(mtime time.Time) error {
+	data, err := ioutil.ReadFile(h.file)
+	if err != nil {
+		return fmt.Errorf("failed to read htpasswd file: %v", err)
+	}
+	users := map[string][]byte{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			h.logger.Warnf("skipped malformed line %d in htpasswd file %s", n, h.file)
+			continue
+		}
+		if _, err := bcrypt.Cost([]byte(parts[1])); err != nil {
+			h.logger.Warnf("skipped line %d in htpasswd file %s, only bcrypt is supported: %v", n, h.file, err)
+			continue
+		}
+		users[parts[0]] = []byte(parts[1])
+	}
+
+	h.mu.Lock()
+	h.users = users
+	h.mtime = mtime
+	h.mu.Unlock()
+	h.logger.Infof("Loaded %d users from htpasswd file %s", len(users), h.file)
+	return nil
+}
+
+// reloadIfChanged re-reads the file if its mtime changed, errors keep the current users.
+func (h *htpasswd) reloadIfChanged() {
+	h.mu.Lock()
+	if time.Since(h.lastCheck) < htpasswdCheckInterval {
+		h.mu.Unlock()
+		return
+	}
+	h.lastCheck = time.Now()
+	mtime := h.mtime
+	h.mu.Unlock()
+
+	info, err := os.Stat(h.file)
+	if err != nil {
+		h.logger.Warnf("failed to check htpasswd file %s: %v", h.file, err)
+		return
+	}
+	if !info.ModTime().Equal(mtime) {
+		if err := h.load(info.ModTime()); err != nil {
+			h.logger.Warnf("failed to reload htpasswd file %s: %v", h.file, err)
+		}
+	}
+}
+
+// verify returns true if the password matches the bcrypt hash of the user.
+func (h *htpasswd) verify(user, password string) bool {
+	h.reloadIfChanged()
+	h.mu.RLock()
+	hash, ok := h.users[user]
+	h.mu.RUnlock()
+	return ok && bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+// basicCredentials returns the credentials in the Authorization header, the scheme is case-insensitive.
+func basicCredentials(request *checkRequest) (user, password string, ok bool) {
+	parts := strings.SplitN(request.header("authorization"), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return "", "", false
+	}
+	credentials := strings.SplitN(string(decoded), ":", 2)
+	if len(credentials) != 2 {
+		return "", "", false
+	}
+	return credentials[0], credentials[1], true
+}
+
+// basicAuthDecision returns the decision for a request in the basic auth mode.
+func (s *ExtAuthzServer) basicAuthDecision(request *checkRequest) decision {
+	challenge := map[string]string{"www-authenticate": fmt.Sprintf("Basic realm=%q", s.basicAuthRealm)}
+	user, password, ok := basicCredentials(request)
+	if !ok {
+		return decision{reason: "missing basic auth credentials", headers: challenge, status: http.StatusUnauthorized}
+	}
+	if !request.files.htpasswd.verify(user, password) {
+		return decision{reason: "invalid basic auth credentials for " + user, headers: challenge, status: http.StatusUnauthorized}
+	}
+	return decision{allowed: true, reason: "valid basic auth credentials for " + user, headers: map[string]string{userHeader: user}}
+}
@@ -0,0 +1,165 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	scopeHeader = "x-ext-authz-scope"
+	// introspectionMaxCacheEntries bounds the cache, expired entries are pruned once it is reached.
+	introspectionMaxCacheEntries = 10000
+	introspectionMaxBytes        = 1 << 20
+)
+
+// introspection validates bearer tokens with an RFC 7662 token introspection endpoint.
+type introspection struct {
+	url          string
+	clientID     string
+	clientSecret string
+	timeout      time.Duration
+	failOpen     bool
+	cacheTTL     time.Duration
+	client       *http.Client
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]introspectionEntry
+}
+
+type introspectionResult struct {
+	Active bool   `json:"active"`
+	Sub    string `json:"sub"`
+	Scope  string `json:"scope"`
+}
+
+type introspectionEntry struct {
+	result  introspectionResult
+	expires time.Time
+}
+
+func (i *introspection) cached(key [sha256.Size]byte) (introspectionResult, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	entry, ok := i.cache[key]
+	if !ok || time.Now().After(entry.expires) {
+		return introspectionResult{}, false
+	}
+	return entry.result, true
+}
+
+func (i *introspection) store(key [sha256.Size]byte, result introspectionResult) {
+	if i.cacheTTL <= 0 {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	now := time.Now()
+	if i.cache == nil {
+		i.cache = map[[sha256.Size]byte]introspectionEntry{}
+	}
+	if len(i.cache) >= introspectionMaxCacheEntries {
+		for k, entry := range i.cache {
+			if now.After(entry.expires) {
+				delete(i.cache, k)
+			}
+		}
+		if len(i.cache) >= introspectionMaxCacheEntries {
+			return
+		}
+	}
+	i.cache[key] = introspectionEntry{result: result, expires: now.Add(i.cacheTTL)}
+}
+
+// introspect returns the introspection result of the token, the call is bounded by both the
+// configured timeout and the deadline of the context.
+func (i *introspection) introspect(ctx context.Context, token string) (introspectionResult, error) {
+	key := sha256.Sum256([]byte(token))
+	if result, ok := i.cached(key); ok {
+		return result, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, i.timeout)
+	defer cancel()
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequest(http.MethodPost, i.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return introspectionResult{}, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	injectTraceContext(ctx, req.Header)
+	if i.clientID != "" {
+		req.SetBasicAuth(url.QueryEscape(i.clientID), url.QueryEscape(i.clientSecret))
+	}
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return introspectionResult{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return introspectionResult{}, fmt.Errorf("introspection endpoint returned status %d", resp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, introspectionMaxBytes))
+	if err != nil {
+		return introspectionResult{}, err
+	}
+	var result introspectionResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return introspectionResult{}, fmt.Errorf("invalid introspection response: %v", err)
+	}
+	i.store(key, result)
+	return result, nil
+}
+
+// introspectionDecision returns the decision for a request in the token introspection mode.
+func (s *ExtAuthzServer) introspectionDecision(request *checkRequest) decision {
+	token, ok := bearerToken(request)
+	if !ok {
+		return decision{reason: "missing bearer token", status: http.StatusUnauthorized}
+	}
+	ctx, sp := startSpan(request.ctx, "introspection")
+	c := startCallout(request.ctx, "introspection")
+	result, err := s.introspection.introspect(ctx, token)
+	c.done()
+	sp.finish(err)
+	if err != nil {
+		if s.introspection.failOpen {
+			return decision{allowed: true, reason: "introspection failed, fail open: " + err.Error()}
+		}
+		return decision{reason: "introspection failed: " + err.Error()}
+	}
+	if !result.Active {
+		return decision{reason: "inactive token " + tokenFingerprint(token), status: http.StatusUnauthorized}
+	}
+	d := decision{allowed: true, reason: "active token " + tokenFingerprint(token), headers: map[string]string{}}
+	if result.Sub != "" {
+		d.headers[userHeader] = result.Sub
+	}
+	if result.Scope != "" {
+		d.headers[scopeHeader] = result.Scope
+	}
+	return d
+}
@@ -0,0 +1,286 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// jwksMinRefreshInterval limits how often an unknown kid can trigger a refresh.
+	jwksMinRefreshInterval = 10 * time.Second
+	jwksFetchTimeout       = 5 * time.Second
+	jwksMaxBytes           = 1 << 20
+)
+
+// jwks caches the public keys fetched from a remote JWKS endpoint.
+type jwks struct {
+	url      string
+	interval time.Duration
+	client   *http.Client
+	logger   Logger
+
+	mu          sync.RWMutex
+	keys        map[string]crypto.PublicKey
+	lastRefresh time.Time
+	// refreshing is closed once the refresh of an unknown kid completes, nil if none is in flight.
+	refreshing chan struct{}
+	// stop ends the background refresh.
+	stop chan struct{}
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// newJWKS returns the JWKS of the url, the keys are fetched once started.
+func newJWKS(url string, interval time.Duration, logger Logger) *jwks {
+	return &jwks{url: url, interval: interval, client: &http.Client{Timeout: jwksFetchTimeout}, logger: logger,
+		stop: make(chan struct{})}
+}
+
+// start fetches the JWKS and refreshes it in the background with the interval if positive, it
+// does nothing if nil.
+func (j *jwks) start() error {
+	if j == nil {
+		return nil
+	}
+	if err := j.refresh(context.Background()); err != nil {
+		return err
+	}
+	if j.interval > 0 {
+		go j.refreshPeriodically(j.interval)
+	}
+	return nil
+}
+
+// refreshPeriodically refreshes the keys with the interval until closed.
+func (j *jwks) refreshPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := j.refresh(context.Background()); err != nil {
+				j.logger.Warnf("failed to refresh JWKS, keep using the cached keys: %v", err)
+			}
+		case <-j.stop:
+			return
+		}
+	}
+}
+
+// close stops the background refresh, it does nothing if nil.
+func (j *jwks) close() {
+	if j == nil {
+		return
+	}
+	close(j.stop)
+}
+
+// refresh fetches the keys, the fetch is canceled with the ctx.
+func (j *jwks) refresh(ctx context.Context) error {
+	j.mu.Lock()
+	j.lastRefresh = time.Now()
+	j.mu.Unlock()
+
+	req, err := http.NewRequest(http.MethodGet, j.url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to fetch JWKS from %s: %v", j.url, err)
+	}
+	resp, err := j.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to fetch JWKS from %s: %v", j.url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch JWKS from %s: status %d", j.url, resp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, jwksMaxBytes))
+	if err != nil {
+		return fmt.Errorf("failed to read JWKS from %s: %v", j.url, err)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("failed to parse JWKS from %s: %v", j.url, err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			j.logger.Warnf("skipped JWK %q: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+
+	j.mu.Lock()
+	j.keys = keys
+	j.mu.Unlock()
+	j.logger.Infof("Loaded %d keys from JWKS %s", len(keys), j.url)
+	return nil
+}
+
+// key returns the public key with the kid, an unknown kid triggers a refresh at most every
+// jwksMinRefreshInterval. The concurrent checks of unknown kids share the refresh in flight, each
+// waits for it until its ctx is done.
+func (j *jwks) key(ctx context.Context, kid string) (crypto.PublicKey, bool) {
+	j.mu.RLock()
+	key, ok := j.keys[kid]
+	j.mu.RUnlock()
+	if ok {
+		return key, ok
+	}
+
+	j.mu.Lock()
+	done := j.refreshing
+	if done == nil {
+		if time.Since(j.lastRefresh) <= jwksMinRefreshInterval {
+			j.mu.Unlock()
+			return nil, false
+		}
+		done = make(chan struct{})
+		j.refreshing = done
+		j.mu.Unlock()
+		j.refreshUnknownKid(ctx, kid, done)
+	} else {
+		j.mu.Unlock()
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil, false
+	}
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	key, ok = j.keys[kid]
+	return key, ok
+}
+
+// refreshUnknownKid refreshes the keys with the ctx of the check and closes done for the checks
+// waiting for it.
+func (j *jwks) refreshUnknownKid(ctx context.Context, kid string, done chan struct{}) {
+	err := j.refresh(ctx)
+	j.mu.Lock()
+	j.refreshing = nil
+	if err != nil && ctx.Err() != nil {
+		// The refresh was cut short by the check, the next unknown kid does not wait for the interval.
+		j.lastRefresh = time.Time{}
+	}
+	j.mu.Unlock()
+	close(done)
+	if err != nil {
+		j.logger.Warnf("failed to refresh JWKS for unknown kid %q: %v", kid, err)
+	}
+}
+
+// verify verifies the RS256 or ES256 signature of the token, the refresh of an unknown kid is
+// canceled with the ctx.
+func (j *jwks) verify(ctx context.Context, t *jwtToken) error {
+	kid := t.stringHeader("kid")
+	key, ok := j.key(ctx, kid)
+	if !ok {
+		return fmt.Errorf("unknown key id %q", kid)
+	}
+	digest := sha256.Sum256([]byte(t.signingInput))
+	switch alg := t.stringHeader("alg"); alg {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key %q is not an RSA key", kid)
+		}
+		if err := rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], t.signature); err != nil {
+			return fmt.Errorf("invalid token signature")
+		}
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key %q is not an EC key", kid)
+		}
+		if len(t.signature) != 64 {
+			return fmt.Errorf("invalid token signature")
+		}
+		r := new(big.Int).SetBytes(t.signature[:32])
+		s := new(big.Int).SetBytes(t.signature[32:])
+		if !ecdsa.Verify(ecKey, digest[:], r, s) {
+			return fmt.Errorf("invalid token signature")
+		}
+	default:
+		return fmt.Errorf("unsupported token algorithm %q", alg)
+	}
+	return nil
+}
+
+func (k *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus: %v", err)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exponent: %v", err)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x coordinate: %v", err)
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y coordinate: %v", err)
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve P-256")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,384 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// signJWT returns the compact JWT of the claims signed with the key, an *rsa.PrivateKey for RS256,
+// an *ecdsa.PrivateKey for ES256 or the []byte secret for HS256.
+func signJWT(t testing.TB, kid string, key interface{}, claims map[string]interface{}) string {
+	t.Helper()
+	header := map[string]interface{}{"typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		header["alg"] = "RS256"
+	case *ecdsa.PrivateKey:
+		header["alg"] = "ES256"
+	case []byte:
+		header["alg"] = "HS256"
+	}
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	input := encode(header) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(input))
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The signature is r and s padded to 32 bytes each.
+		signature = make([]byte, 64)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(signature[32-len(rb):32], rb)
+		copy(signature[64-len(sb):], sb)
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(input))
+		signature = mac.Sum(nil)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// publicJWK returns the JWK of the public key of the RSA or ECDSA private key.
+func publicJWK(kid string, key interface{}) jsonWebKey {
+	encode := func(i *big.Int) string { return base64.RawURLEncoding.EncodeToString(i.Bytes()) }
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return jsonWebKey{Kty: "RSA", Kid: kid, N: encode(k.N), E: encode(big.NewInt(int64(k.E)))}
+	case *ecdsa.PrivateKey:
+		return jsonWebKey{Kty: "EC", Kid: kid, Crv: "P-256", X: encode(k.X), Y: encode(k.Y)}
+	}
+	return jsonWebKey{}
+}
+
+// fakeJWKS serves the keys as the JWKS, or the status if it is not OK.
+type fakeJWKS struct {
+	mu      sync.Mutex
+	keys    []jsonWebKey
+	status  int
+	fetches int
+}
+
+func (f *fakeJWKS) set(status int, keys ...jsonWebKey) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status, f.keys = status, keys
+}
+
+func (f *fakeJWKS) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fetches++
+	if f.status != http.StatusOK {
+		http.Error(response, "unavailable", f.status)
+		return
+	}
+	json.NewEncoder(response).Encode(map[string]interface{}{"keys": f.keys})
+}
+
+func generateTestKeys(t testing.TB) (*rsa.PrivateKey, *ecdsa.PrivateKey) {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rsaKey, ecKey
+}
+
+func bearer(token string) map[string]string {
+	return map[string]string{"authorization": "Bearer " + token}
+}
+
+func TestJWKSValidation(t *testing.T) {
+	rsaKey, ecKey := generateTestKeys(t)
+	otherKey, _ := generateTestKeys(t)
+	fake := &fakeJWKS{}
+	fake.set(http.StatusOK, publicJWK("rsa", rsaKey), publicJWK("ec", ecKey))
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	c := DefaultConfig()
+	c.JWKSURL = server.URL
+	s := newTestServer(t, c)
+	defer s.close()
+	valid := map[string]interface{}{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()}
+	cases := []struct {
+		name  string
+		token string
+		want  bool
+	}{
+		{name: "RS256", token: signJWT(t, "rsa", rsaKey, valid), want: true},
+		{name: "ES256", token: signJWT(t, "ec", ecKey, valid), want: true},
+		{name: "wrong key", token: signJWT(t, "rsa", otherKey, valid)},
+		{name: "algorithm of the other key type", token: signJWT(t, "ec", rsaKey, valid)},
+		{name: "expired", token: signJWT(t, "rsa", rsaKey, map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()})},
+		{name: "HS256 without a secret", token: signJWT(t, "rsa", []byte("secret"), valid)},
+		{name: "malformed", token: "not.a.jwt"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			grpcOK, httpOK := checkBoth(t, s, testRequest{headers: bearer(tc.token)})
+			if grpcOK != tc.want || httpOK != tc.want {
+				t.Fatalf("got allowed gRPC %v and HTTP %v, want %v", grpcOK, httpOK, tc.want)
+			}
+		})
+	}
+}
+
+func TestJWKSKeyRotation(t *testing.T) {
+	oldKey, _ := generateTestKeys(t)
+	newKey, _ := generateTestKeys(t)
+	fake := &fakeJWKS{}
+	fake.set(http.StatusOK, publicJWK("old", oldKey))
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	c := DefaultConfig()
+	c.JWKSURL = server.URL
+	c.JWKSRefreshInterval = 0
+	s := newTestServer(t, c)
+	defer s.close()
+	claims := map[string]interface{}{"sub": "alice"}
+	oldToken, newToken := signJWT(t, "old", oldKey, claims), signJWT(t, "new", newKey, claims)
+	// stale lets the next unknown kid refresh the keys without waiting for jwksMinRefreshInterval.
+	stale := func() {
+		s.jwks.mu.Lock()
+		s.jwks.lastRefresh = time.Now().Add(-time.Minute)
+		s.jwks.mu.Unlock()
+	}
+
+	steps := []struct {
+		name   string
+		rotate func()
+		token  string
+		want   bool
+	}{
+		{name: "old key before the rotation", token: oldToken, want: true},
+		{name: "unknown kid within the minimum refresh interval", rotate: func() {
+			fake.set(http.StatusOK, publicJWK("new", newKey))
+		}, token: newToken},
+		{name: "unknown kid refreshes the keys", rotate: stale, token: newToken, want: true},
+		{name: "old key is removed by the refresh", token: oldToken},
+		{name: "refresh failure keeps the cached keys", rotate: func() {
+			fake.set(http.StatusInternalServerError)
+			stale()
+			if err := s.jwks.refresh(context.Background()); err == nil {
+				t.Fatal("got refresh succeeded, want error")
+			}
+		}, token: newToken, want: true},
+	}
+	for _, step := range steps {
+		if step.rotate != nil {
+			step.rotate()
+		}
+		if got := grpcAllowed(checkGRPC(t, s, testRequest{headers: bearer(step.token)})); got != step.want {
+			t.Fatalf("%s: got allowed %v, want %v", step.name, got, step.want)
+		}
+	}
+}
+
+func TestJWKSStartup(t *testing.T) {
+	rsaKey, _ := generateTestKeys(t)
+	cases := []struct {
+		name    string
+		status  int
+		wantErr string
+	}{
+		{name: "fetched", status: http.StatusOK},
+		{name: "fetch failure is fatal", status: http.StatusServiceUnavailable, wantErr: "failed to fetch JWKS"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := &fakeJWKS{}
+			fake.set(tc.status, publicJWK("rsa", rsaKey))
+			server := httptest.NewServer(fake)
+			defer server.Close()
+			c := DefaultConfig()
+			c.JWKSURL = server.URL
+			got := newServerError(c)
+			if (tc.wantErr == "") != (got == "") || !strings.Contains(got, tc.wantErr) {
+				t.Fatalf("got error %q, want %q", got, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestJWKSRefreshPeriodically(t *testing.T) {
+	rsaKey, _ := generateTestKeys(t)
+	fake := &fakeJWKS{}
+	fake.set(http.StatusOK, publicJWK("rsa", rsaKey))
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	c := DefaultConfig()
+	c.JWKSURL = server.URL
+	c.JWKSRefreshInterval = 20 * time.Millisecond
+	s := newTestServer(t, c)
+	defer s.close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		fake.mu.Lock()
+		fetches := fake.fetches
+		fake.mu.Unlock()
+		if fetches >= 3 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d fetches, want the periodic refreshes", fetches)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// newBlockingJWKS serves the fake JWKS once released, requests counts the fetches started.
+func newBlockingJWKS(fake *fakeJWKS, release chan struct{}, requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		atomic.AddInt32(requests, 1)
+		select {
+		case <-release:
+			fake.ServeHTTP(response, request)
+		case <-request.Context().Done():
+		}
+	}))
+}
+
+func TestJWKSRefreshCoalesced(t *testing.T) {
+	rsaKey, _ := generateTestKeys(t)
+	fake := &fakeJWKS{}
+	fake.set(http.StatusOK, publicJWK("new", rsaKey))
+	release := make(chan struct{})
+	var requests int32
+	server := newBlockingJWKS(fake, release, &requests)
+	defer server.Close()
+	// The keys were never fetched, the first unknown kid refreshes them.
+	j := newJWKS(server.URL, 0, NewTextLogger(ioutil.Discard))
+	const checks = 20
+	found := make(chan bool, checks)
+	for i := 0; i < checks; i++ {
+		go func() {
+			_, ok := j.key(context.Background(), "new")
+			found <- ok
+		}()
+	}
+	for atomic.LoadInt32(&requests) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// The other checks wait for the refresh in flight.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	for i := 0; i < checks; i++ {
+		if !<-found {
+			t.Fatal("got the key not found after the refresh")
+		}
+	}
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Fatalf("got %d fetches, want the refreshes coalesced into 1", got)
+	}
+}
+
+func TestJWKSRefreshCanceled(t *testing.T) {
+	rsaKey, _ := generateTestKeys(t)
+	fake := &fakeJWKS{}
+	fake.set(http.StatusOK, publicJWK("new", rsaKey))
+	release := make(chan struct{})
+	var requests int32
+	server := newBlockingJWKS(fake, release, &requests)
+	defer server.Close()
+	j := newJWKS(server.URL, 0, NewTextLogger(ioutil.Discard))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, ok := j.key(ctx, "new"); ok {
+		t.Fatal("got the key found, want the refresh canceled")
+	}
+	if elapsed := time.Since(start); elapsed > jwksFetchTimeout/2 {
+		t.Fatalf("got the refresh canceled after %v, want it bounded by the check deadline", elapsed)
+	}
+	// The canceled refresh does not hold back the next unknown kid for the minimum refresh interval.
+	close(release)
+	if _, ok := j.key(context.Background(), "new"); !ok {
+		t.Fatal("got the key not found after the canceled refresh")
+	}
+	if got := atomic.LoadInt32(&requests); got != 2 {
+		t.Fatalf("got %d fetches, want 2", got)
+	}
+}
+
+func TestJWKSWaitCanceled(t *testing.T) {
+	rsaKey, _ := generateTestKeys(t)
+	fake := &fakeJWKS{}
+	fake.set(http.StatusOK, publicJWK("new", rsaKey))
+	release := make(chan struct{})
+	var requests int32
+	server := newBlockingJWKS(fake, release, &requests)
+	defer server.Close()
+	j := newJWKS(server.URL, 0, NewTextLogger(ioutil.Discard))
+	found := make(chan bool)
+	go func() {
+		_, ok := j.key(context.Background(), "new")
+		found <- ok
+	}()
+	for atomic.LoadInt32(&requests) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// The check waiting for the refresh of another check gives up with its own ctx.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, ok := j.key(ctx, "new"); ok {
+		t.Fatal("got the key found before the refresh completed")
+	}
+	close(release)
+	if !<-found {
+		t.Fatal("got the key not found by the refreshing check")
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const userHeader = "x-ext-authz-user"
+
+// jwtToken is a parsed but not yet verified JWT.
+type jwtToken struct {
+	header       map[string]interface{}
+	claims       map[string]interface{}
+	signingInput string
+	signature    []byte
+}
+
+// parseJWT decodes the compact serialization of a JWT without verifying it.
+func parseJWT(token string) (*jwtToken, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token: expected 3 parts but got %d", len(parts))
+	}
+	t := &jwtToken{signingInput: parts[0] + "." + parts[1]}
+	if err := decodeJWTPart(parts[0], &t.header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %v", err)
+	}
+	if err := decodeJWTPart(parts[1], &t.claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %v", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %v", err)
+	}
+	t.signature = signature
+	return t, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// stringHeader returns the string value of the given JOSE header.
+func (t *jwtToken) stringHeader(name string) string {
+	v, _ := t.header[name].(string)
+	return v
+}
+
+// stringClaim returns the string value of the given claim.
+func (t *jwtToken) stringClaim(name string) string {
+	v, _ := t.claims[name].(string)
+	return v
+}
+
+// stringsClaim returns the value of a claim that is either a string or an array of strings.
+func (t *jwtToken) stringsClaim(name string) []string {
+	switch v := t.claims[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+// timeClaim returns the NumericDate value of the given claim, ok is false if the claim is missing.
+func (t *jwtToken) timeClaim(name string) (time.Time, bool, error) {
+	v, found := t.claims[name]
+	if !found {
+		return time.Time{}, false, nil
+	}
+	seconds, ok := v.(float64)
+	if !ok {
+		return time.Time{}, false, fmt.Errorf("claim %s is not a number", name)
+	}
+	return time.Unix(int64(seconds), 0), true, nil
+}
+
+// validateTime checks the exp, nbf and iat claims with the given leeway, the token must not be
+// issued in the future. The changes is when the result changes, i.e. the token expires or becomes
+// valid, zero if it never does.
+func (t *jwtToken) validateTime(now time.Time, leeway time.Duration) (changes time.Time, err error) {
+	exp, hasExp, err := t.timeClaim("exp")
+	if err != nil {
+		return time.Time{}, err
+	}
+	if hasExp && now.After(exp.Add(leeway)) {
+		return time.Time{}, fmt.Errorf("token expired at %s", exp.UTC().Format(time.RFC3339))
+	}
+	nbf, ok, err := t.timeClaim("nbf")
+	if err != nil {
+		return time.Time{}, err
+	}
+	if ok && now.Add(leeway).Before(nbf) {
+		return nbf.Add(-leeway), fmt.Errorf("token not valid before %s", nbf.UTC().Format(time.RFC3339))
+	}
+	iat, ok, err := t.timeClaim("iat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	if ok && now.Add(leeway).Before(iat) {
+		return iat.Add(-leeway), fmt.Errorf("token issued in the future at %s", iat.UTC().Format(time.RFC3339))
+	}
+	if hasExp {
+		changes = exp.Add(leeway)
+	}
+	return changes, nil
+}
+
+// verifyHS256 verifies the HMAC SHA-256 signature of the token.
+func (t *jwtToken) verifyHS256(secret []byte) error {
+	if alg := t.stringHeader("alg"); alg != "HS256" {
+		return fmt.Errorf("unsupported token algorithm %q", alg)
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(t.signingInput))
+	if !hmac.Equal(mac.Sum(nil), t.signature) {
+		return fmt.Errorf("invalid token signature")
+	}
+	return nil
+}
+
+// bearerToken returns the token in the Authorization header, the scheme is case-insensitive.
+func bearerToken(request *checkRequest) (string, bool) {
+	parts := strings.SplitN(request.header("authorization"), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+		return "", false
+	}
+	token := strings.TrimSpace(parts[1])
+	return token, token != ""
+}
+
+// validateJWT validates the bearer token of the request and returns the verified token.
+func (s *ExtAuthzServer) validateJWT(request *checkRequest) (*jwtToken, error) {
+	raw, ok := bearerToken(request)
+	if !ok {
+		return nil, fmt.Errorf("missing bearer token")
+	}
+	token, err := parseJWT(raw)
+	if err != nil {
+		return nil, err
+	}
+	if token.stringHeader("alg") == "HS256" && s.jwtSecret != nil {
+		err = token.verifyHS256(s.jwtSecret)
+	} else if s.jwks != nil {
+		// The span covers the refresh of the JWKS for an unknown kid.
+		ctx, sp := startSpan(request.ctx, "jwks")
+		c := startCallout(ctx, "jwks")
+		err = s.jwks.verify(ctx, token)
+		c.done()
+		sp.finish(err)
+	} else {
+		err = fmt.Errorf("unsupported token algorithm %q", token.stringHeader("alg"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	changes, err := token.validateTime(s.now(), s.jwtClockSkew)
+	if !changes.IsZero() {
+		s.expireDecisionAt(request, changes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(s.jwtIssuers) != 0 && !contains(s.jwtIssuers, token.stringClaim("iss")) {
+		return nil, fmt.Errorf("issuer check failed: %q is not one of %v", token.stringClaim("iss"), s.jwtIssuers)
+	}
+	if len(s.jwtAudiences) != 0 && !intersects(token.stringsClaim("aud"), s.jwtAudiences) {
+		return nil, fmt.Errorf("audience check failed: %v has none of %v", token.stringsClaim("aud"), s.jwtAudiences)
+	}
+	return token, nil
+}
+
+func (s *ExtAuthzServer) jwtEnabled() bool {
+	return s.jwtSecret != nil || s.jwks != nil
+}
+
+// jwtDecision returns the decision for a request in the JWT validation mode.
+func (s *ExtAuthzServer) jwtDecision(request *checkRequest) decision {
+	token, err := s.validateJWT(request)
+	if err != nil {
+		return decision{reason: "invalid JWT: " + err.Error()}
+	}
+	if d, ok := s.scopeDecision(request, token); ok {
+		return d
+	}
+	d := decision{allowed: true, reason: "valid JWT", principal: token.stringClaim("sub")}
+	if sub := token.stringClaim("sub"); sub != "" {
+		d.reason += " for " + sub
+		d.headers = map[string]string{userHeader: sub}
+	}
+	s.addClaimHeaders(&d, token)
+	return d
+}
+
+// intersects returns true if the lists have a common value.
+func intersects(list, values []string) bool {
+	for _, value := range values {
+		if contains(list, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,173 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var jwtTestSecret = []byte("test-secret")
+
+func TestStringsClaim(t *testing.T) {
+	cases := []struct {
+		name string
+		aud  interface{}
+		want []string
+	}{
+		{name: "string", aud: "api", want: []string{"api"}},
+		{name: "array", aud: []interface{}{"api", "web"}, want: []string{"api", "web"}},
+		{name: "array with other values", aud: []interface{}{"api", 1.0, nil}, want: []string{"api"}},
+		{name: "empty array", aud: []interface{}{}},
+		{name: "number", aud: 1.0},
+		{name: "missing"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			token := &jwtToken{claims: map[string]interface{}{}}
+			if tc.aud != nil {
+				token.claims["aud"] = tc.aud
+			}
+			if got := token.stringsClaim("aud"); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidateTime(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	const skew = 30 * time.Second
+	at := func(d time.Duration) float64 { return float64(now.Add(d).Unix()) }
+	cases := []struct {
+		name    string
+		claims  map[string]interface{}
+		skew    time.Duration
+		wantErr string
+		// wantChanges is the Unix time at which the result changes, never if zero.
+		wantChanges float64
+	}{
+		{name: "no time claims"},
+		{name: "exp in the future", claims: map[string]interface{}{"exp": at(time.Minute)}, skew: skew, wantChanges: at(time.Minute + skew)},
+		{name: "exp at the skew", claims: map[string]interface{}{"exp": at(-skew)}, skew: skew, wantChanges: at(0)},
+		{name: "exp past the skew", claims: map[string]interface{}{"exp": at(-skew - time.Second)}, skew: skew,
+			wantErr: "token expired at"},
+		{name: "exp now without skew", claims: map[string]interface{}{"exp": at(0)}, wantChanges: at(0)},
+		{name: "exp before now without skew", claims: map[string]interface{}{"exp": at(-time.Second)}, wantErr: "token expired"},
+		{name: "nbf at the skew", claims: map[string]interface{}{"nbf": at(skew)}, skew: skew},
+		{name: "nbf past the skew", claims: map[string]interface{}{"nbf": at(skew + time.Second)}, skew: skew,
+			wantErr: "token not valid before", wantChanges: at(time.Second)},
+		{name: "iat at the skew", claims: map[string]interface{}{"iat": at(skew)}, skew: skew},
+		{name: "iat past the skew", claims: map[string]interface{}{"iat": at(skew + time.Second)}, skew: skew,
+			wantErr: "token issued in the future", wantChanges: at(time.Second)},
+		{name: "iat in the past", claims: map[string]interface{}{"iat": at(-time.Hour)}},
+		{name: "exp not a number", claims: map[string]interface{}{"exp": "tomorrow"}, wantErr: "claim exp is not a number"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			changes, err := (&jwtToken{claims: tc.claims}).validateTime(now, tc.skew)
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Fatalf("got error %v, want valid", err)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+				t.Fatalf("got error %v, want error containing %q", err, tc.wantErr)
+			}
+			var want time.Time
+			if tc.wantChanges != 0 {
+				want = time.Unix(int64(tc.wantChanges), 0)
+			}
+			if !changes.Equal(want) {
+				t.Fatalf("got changes at %v, want %v", changes, want)
+			}
+		})
+	}
+}
+
+func TestJWTIssuersAndAudiences(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	cases := []struct {
+		name    string
+		claims  map[string]interface{}
+		wantLog string
+	}{
+		{name: "issuer from the list", claims: map[string]interface{}{"iss": "https://a.example.com", "aud": "api"}},
+		{name: "issuer from the single flag", claims: map[string]interface{}{"iss": "https://c.example.com", "aud": "api"}},
+		{name: "unknown issuer", claims: map[string]interface{}{"iss": "https://evil.example.com", "aud": "api"},
+			wantLog: "issuer check failed"},
+		{name: "missing issuer", claims: map[string]interface{}{"aud": "api"}, wantLog: "issuer check failed"},
+		{name: "audience array", claims: map[string]interface{}{"iss": "https://b.example.com", "aud": []string{"other", "web"}}},
+		{name: "audience from the single flag", claims: map[string]interface{}{"iss": "https://b.example.com", "aud": "admin"}},
+		{name: "audience array without an expected one", claims: map[string]interface{}{"iss": "https://b.example.com",
+			"aud": []string{"other", "more"}}, wantLog: "audience check failed"},
+		{name: "unexpected audience string", claims: map[string]interface{}{"iss": "https://b.example.com", "aud": "other"},
+			wantLog: "audience check failed"},
+		{name: "missing audience", claims: map[string]interface{}{"iss": "https://b.example.com"}, wantLog: "audience check failed"},
+		{name: "expired within the skew", claims: map[string]interface{}{"iss": "https://a.example.com", "aud": "api",
+			"exp": now.Add(-10 * time.Second).Unix()}},
+		{name: "expired past the skew", claims: map[string]interface{}{"iss": "https://a.example.com", "aud": "api",
+			"exp": now.Add(-time.Minute).Unix()}, wantLog: "token expired"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			c := DefaultConfig()
+			c.JWTHS256Secret = string(jwtTestSecret)
+			c.JWTIssuers = "https://a.example.com,https://b.example.com"
+			c.JWTIssuer = "https://c.example.com"
+			c.JWTAudiences = "api,web"
+			c.JWTAudience = "admin"
+			c.JWTClockSkew = 30 * time.Second
+			c.Logger = NewTextLogger(&out)
+			s := newTestServer(t, c)
+			defer s.close()
+			s.clock = func() time.Time { return now }
+			token := signJWT(t, "", jwtTestSecret, tc.claims)
+			grpcOK, httpOK := checkBoth(t, s, testRequest{headers: bearer(token)})
+			if want := tc.wantLog == ""; grpcOK != want || httpOK != want {
+				t.Fatalf("got allowed gRPC %v and HTTP %v, want %v", grpcOK, httpOK, want)
+			}
+			if tc.wantLog != "" && strings.Count(out.String(), tc.wantLog) != 2 {
+				t.Fatalf("got log %q, want %q in both decisions", out.String(), tc.wantLog)
+			}
+			if signature := token[strings.LastIndex(token, ".")+1:]; strings.Contains(out.String(), signature) {
+				t.Fatalf("got log %q with the raw token", out.String())
+			}
+		})
+	}
+}
+
+func TestJWTClockSkewValidation(t *testing.T) {
+	cases := []struct {
+		skew    time.Duration
+		wantErr string
+	}{
+		{skew: 0},
+		{skew: time.Minute},
+		{skew: -time.Second, wantErr: "-jwt-clock-skew must not be negative"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.skew.String(), func(t *testing.T) {
+			c := DefaultConfig()
+			c.JWTClockSkew = tc.skew
+			got := newServerError(c)
+			if (tc.wantErr == "") != (got == "") || !strings.Contains(got, tc.wantErr) {
+				t.Fatalf("got error %q, want %q", got, tc.wantErr)
+			}
+		})
+	}
+}
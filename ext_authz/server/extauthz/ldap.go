@@ -0,0 +1,234 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	// ldapMaxIdleConns is the number of connections kept for reuse.
+	ldapMaxIdleConns = 8
+	// ldapMaxNegativeEntries bounds the negative cache, expired entries are pruned once it is reached.
+	ldapMaxNegativeEntries = 10000
+)
+
+var errLDAPInvalidCredentials = errors.New("invalid credentials")
+
+// ldapAuth validates basic auth credentials by searching the user DN and binding as the user.
+type ldapAuth struct {
+	url      string
+	baseDN   string
+	userAttr string
+	// bindDN and bindPassword are used for the search, the search is anonymous if bindDN is empty.
+	bindDN       string
+	bindPassword string
+	startTLS     bool
+	tlsConfig    *tls.Config
+	timeout      time.Duration
+	negativeTTL  time.Duration
+
+	idle chan *ldap.Conn
+
+	mu       sync.Mutex
+	negative map[[sha256.Size]byte]time.Time
+}
+
+func newLDAPAuth(url, baseDN, userAttr, bindDN, bindPassword, caFile string, startTLS bool,
+	timeout, negativeTTL time.Duration) (*ldapAuth, error) {
+	a := &ldapAuth{
+		url:          url,
+		baseDN:       baseDN,
+		userAttr:     userAttr,
+		bindDN:       bindDN,
+		bindPassword: bindPassword,
+		startTLS:     startTLS,
+		tlsConfig:    &tls.Config{},
+		timeout:      timeout,
+		negativeTTL:  negativeTTL,
+		idle:         make(chan *ldap.Conn, ldapMaxIdleConns),
+		negative:     map[[sha256.Size]byte]time.Time{},
+	}
+	if caFile != "" {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read LDAP CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate found in LDAP CA file %s", caFile)
+		}
+		a.tlsConfig.RootCAs = pool
+	}
+	return a, nil
+}
+
+func (a *ldapAuth) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(a.url, ldap.DialWithDialer(&net.Dialer{Timeout: a.timeout}), ldap.DialWithTLSConfig(a.tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(a.timeout)
+	if a.startTLS {
+		if err := conn.StartTLS(a.tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// get returns an idle connection or dials a new one.
+func (a *ldapAuth) get() (*ldap.Conn, error) {
+	for {
+		select {
+		case conn := <-a.idle:
+			if conn.IsClosing() {
+				continue
+			}
+			return conn, nil
+		default:
+			return a.dial()
+		}
+	}
+}
+
+// put keeps the connection for reuse unless there are already enough idle connections.
+func (a *ldapAuth) put(conn *ldap.Conn) {
+	select {
+	case a.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func negativeKey(user, password string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(user + "\x00" + password))
+}
+
+func (a *ldapAuth) recentlyFailed(key [sha256.Size]byte) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	expires, ok := a.negative[key]
+	return ok && time.Now().Before(expires)
+}
+
+func (a *ldapAuth) storeFailure(key [sha256.Size]byte) {
+	if a.negativeTTL <= 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	if len(a.negative) >= ldapMaxNegativeEntries {
+		for k, expires := range a.negative {
+			if now.After(expires) {
+				delete(a.negative, k)
+			}
+		}
+		if len(a.negative) >= ldapMaxNegativeEntries {
+			return
+		}
+	}
+	a.negative[key] = now.Add(a.negativeTTL)
+}
+
+// authenticate returns the DN of the user if the password is valid, errLDAPInvalidCredentials is
+// returned for unknown users and wrong passwords.
+func (a *ldapAuth) authenticate(user, password string) (string, error) {
+	// An empty password would be an unauthenticated bind that most servers accept.
+	if user == "" || password == "" {
+		return "", errLDAPInvalidCredentials
+	}
+	key := negativeKey(user, password)
+	if a.recentlyFailed(key) {
+		return "", errLDAPInvalidCredentials
+	}
+
+	conn, err := a.get()
+	if err != nil {
+		return "", err
+	}
+	dn, err := a.bind(conn, user, password)
+	if err != nil && !errors.Is(err, errLDAPInvalidCredentials) {
+		// The state of the connection is unknown after other errors.
+		conn.Close()
+		return "", err
+	}
+	a.put(conn)
+	if err != nil {
+		a.storeFailure(key)
+		return "", err
+	}
+	return dn, nil
+}
+
+func (a *ldapAuth) bind(conn *ldap.Conn, user, password string) (string, error) {
+	if a.bindDN != "" {
+		if err := conn.Bind(a.bindDN, a.bindPassword); err != nil {
+			return "", fmt.Errorf("failed to bind as %s: %v", a.bindDN, err)
+		}
+	} else if err := conn.UnauthenticatedBind(""); err != nil {
+		return "", fmt.Errorf("failed to bind anonymously: %v", err)
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(a.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(a.timeout.Seconds()), false, fmt.Sprintf("(%s=%s)", a.userAttr, ldap.EscapeFilter(user)),
+		[]string{"dn"}, nil))
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return "", errLDAPInvalidCredentials
+		}
+		return "", fmt.Errorf("failed to search %s: %v", user, err)
+	}
+	if len(result.Entries) != 1 {
+		return "", errLDAPInvalidCredentials
+	}
+	dn := result.Entries[0].DN
+	if err := conn.Bind(dn, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return "", errLDAPInvalidCredentials
+		}
+		return "", fmt.Errorf("failed to bind as %s: %v", dn, err)
+	}
+	return dn, nil
+}
+
+// ldapDecision returns the decision for a request in the LDAP mode.
+func (s *ExtAuthzServer) ldapDecision(request *checkRequest) decision {
+	challenge := map[string]string{"www-authenticate": fmt.Sprintf("Basic realm=%q", s.basicAuthRealm)}
+	user, password, ok := basicCredentials(request)
+	if !ok {
+		return decision{reason: "missing basic auth credentials", headers: challenge, status: http.StatusUnauthorized}
+	}
+	dn, err := s.ldap.authenticate(user, password)
+	if errors.Is(err, errLDAPInvalidCredentials) {
+		return decision{reason: "invalid LDAP credentials for " + user, headers: challenge, status: http.StatusUnauthorized}
+	}
+	if err != nil {
+		return decision{reason: "LDAP failed: " + err.Error()}
+	}
+	return decision{allowed: true, reason: "valid LDAP credentials for " + dn, headers: map[string]string{userHeader: user}}
+}
@@ -0,0 +1,68 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// sizeLimits are the request size guards, a zero limit is disabled.
+type sizeLimits struct {
+	maxHeaderBytesTotal int
+	maxHeaderValueLen   int
+	maxPathLen          int
+}
+
+func (l sizeLimits) enabled() bool {
+	return l.maxHeaderBytesTotal > 0 || l.maxHeaderValueLen > 0 || l.maxPathLen > 0
+}
+
+// sizeDecision returns a denied decision if the request exceeds any size limit, ok is false otherwise.
+func (s *ExtAuthzServer) sizeDecision(request *checkRequest) (decision, bool) {
+	l := s.sizeLimits
+	if l.maxPathLen > 0 && len(request.path) > l.maxPathLen {
+		return decision{
+			reason: fmt.Sprintf("path length %d exceeds -max-path-len %d by %d", len(request.path), l.maxPathLen, len(request.path)-l.maxPathLen),
+			status: http.StatusRequestURITooLong,
+		}, true
+	}
+	total := 0
+	for name, value := range request.headers {
+		if l.maxHeaderValueLen > 0 && len(value) > l.maxHeaderValueLen {
+			return decision{
+				reason: fmt.Sprintf("header %s length %d exceeds -max-header-value-len %d by %d", name, len(value), l.maxHeaderValueLen, len(value)-l.maxHeaderValueLen),
+				status: http.StatusRequestHeaderFieldsTooLarge,
+			}, true
+		}
+		total += len(name) + len(value)
+	}
+	if l.maxHeaderBytesTotal > 0 && total > l.maxHeaderBytesTotal {
+		return decision{
+			reason: fmt.Sprintf("headers size %d exceeds -max-header-bytes-total %d by %d", total, l.maxHeaderBytesTotal, total-l.maxHeaderBytesTotal),
+			status: http.StatusRequestHeaderFieldsTooLarge,
+		}, true
+	}
+	return decision{}, false
+}
+
+// truncateLog formats the value for the decision log, truncated to logMaxLen if set.
+func (s *ExtAuthzServer) truncateLog(value interface{}) string {
+	text := fmt.Sprint(value)
+	if s.logMaxLen > 0 && len(text) > s.logMaxLen {
+		return fmt.Sprintf("%s... (%d bytes truncated)", text[:s.logMaxLen], len(text)-s.logMaxLen)
+	}
+	return text
+}
@@ -0,0 +1,203 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// unixScheme prefixes the Start addresses that listen on a Unix domain socket, e.g.
+// unix:///var/run/ext_authz.sock.
+const unixScheme = "unix://"
+
+const (
+	// Disabled is the Start address of a server that is not started, at least one of the HTTP and
+	// gRPC servers must be enabled.
+	Disabled = "disabled"
+	// DisabledPort is the port of a disabled server.
+	DisabledPort = -1
+)
+
+// listenAddress returns the listen address of the Start address, either a Unix domain socket
+// address, a host:port or a bare port on the bind address.
+func (s *ExtAuthzServer) listenAddress(value string) (string, error) {
+	if value == Disabled || strings.HasPrefix(value, unixScheme) {
+		return value, nil
+	}
+	if isPort(value) {
+		return net.JoinHostPort(s.bindAddress, value), nil
+	}
+	if _, port, err := net.SplitHostPort(value); err != nil || !isPort(port) {
+		return "", fmt.Errorf("invalid listen address %q: must be a port, a host:port like [::1]:9000 or %spath", value, unixScheme)
+	}
+	return value, nil
+}
+
+// listenAddresses returns the listen addresses of the Start addresses.
+func (s *ExtAuthzServer) listenAddresses(httpAddr, grpcAddr string) (string, string, error) {
+	httpAddr, err := s.listenAddress(httpAddr)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid HTTP address: %v", err)
+	}
+	if s.singlePort {
+		if httpAddr == Disabled {
+			return "", "", fmt.Errorf("the HTTP server cannot be disabled in the single port mode, it serves both protocols")
+		}
+	} else {
+		if httpAddr == Disabled && grpcAddr == Disabled {
+			return "", "", fmt.Errorf("the HTTP and gRPC servers are both disabled")
+		}
+		if grpcAddr, err = s.listenAddress(grpcAddr); err != nil {
+			return "", "", fmt.Errorf("invalid gRPC address: %v", err)
+		}
+	}
+	return httpAddr, grpcAddr, nil
+}
+
+// isPort returns true if the value is a TCP port number.
+func isPort(value string) bool {
+	_, err := strconv.ParseUint(value, 10, 16)
+	return err == nil
+}
+
+// parseBindAddress returns the host of the bare ports, empty for all interfaces. An IPv6 literal
+// may be in brackets.
+func parseBindAddress(value string) (string, error) {
+	host := strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+	if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+		return "", fmt.Errorf("%q is neither a host nor an IP address", value)
+	}
+	return host, nil
+}
+
+// listen listens on the TCP or Unix domain socket address. A stale socket file left by a previous
+// run is removed, the socket file is removed again when the listener is closed on shutdown.
+// The TCP listener requires the PROXY protocol header if enabled.
+func (s *ExtAuthzServer) listen(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, unixScheme) {
+		listener, err := net.Listen("tcp", address)
+		if err != nil || !s.proxyProtocol {
+			return listener, err
+		}
+		return newProxyListener(listener, s.logger), nil
+	}
+	path := strings.TrimPrefix(address, unixScheme)
+	if err := removeStaleSocket(path, s.logger); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, s.socketMode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set the mode of socket %s: %v", path, err)
+	}
+	return listener, nil
+}
+
+// removeStaleSocket removes the socket file if no server is accepting connections on it.
+func removeStaleSocket(path string, logger Logger) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("socket %s is in use by another process", path)
+	}
+	logger.Infof("Removing stale socket %s", path)
+	return os.Remove(path)
+}
+
+// listenAddrs are the addresses of the listeners bound by Start.
+type listenAddrs struct {
+	mu   sync.Mutex
+	http net.Addr
+	grpc net.Addr
+	// httpDisabled and grpcDisabled are set if Start skipped the server.
+	httpDisabled bool
+	grpcDisabled bool
+}
+
+func (a *listenAddrs) set(http, grpc net.Addr) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if http != nil {
+		a.http = http
+	}
+	if grpc != nil {
+		a.grpc = grpc
+	}
+}
+
+// HTTPAddr returns the address of the HTTP listener once Start returns, nil before or if disabled.
+// The address is kept after Stop.
+func (s *ExtAuthzServer) HTTPAddr() net.Addr {
+	s.addrs.mu.Lock()
+	defer s.addrs.mu.Unlock()
+	return s.addrs.http
+}
+
+// GRPCAddr returns the address of the gRPC listener once Start returns, nil before or if disabled.
+// It is the HTTP address in the single port mode.
+func (s *ExtAuthzServer) GRPCAddr() net.Addr {
+	s.addrs.mu.Lock()
+	defer s.addrs.mu.Unlock()
+	return s.addrs.grpc
+}
+
+// HTTPPort returns the TCP port of HTTPAddr, 0 for a Unix domain socket or before Start returns
+// and DisabledPort if disabled.
+func (s *ExtAuthzServer) HTTPPort() int {
+	s.addrs.mu.Lock()
+	disabled := s.addrs.httpDisabled
+	s.addrs.mu.Unlock()
+	if disabled {
+		return DisabledPort
+	}
+	return addrPort(s.HTTPAddr())
+}
+
+// GRPCPort returns the TCP port of GRPCAddr, 0 for a Unix domain socket or before Start returns
+// and DisabledPort if disabled.
+func (s *ExtAuthzServer) GRPCPort() int {
+	s.addrs.mu.Lock()
+	disabled := s.addrs.grpcDisabled
+	s.addrs.mu.Unlock()
+	if disabled {
+		return DisabledPort
+	}
+	return addrPort(s.GRPCAddr())
+}
+
+// addrPort returns the port of the TCP address, or 0 for a Unix domain socket or nil.
+func addrPort(addr net.Addr) int {
+	if addr, ok := addr.(*net.TCPAddr); ok {
+		return addr.Port
+	}
+	return 0
+}
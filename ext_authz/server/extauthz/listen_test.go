@@ -0,0 +1,295 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+func TestListenAddress(t *testing.T) {
+	cases := []struct {
+		bind    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{value: "8000", want: ":8000"},
+		{bind: "127.0.0.1", value: "8000", want: "127.0.0.1:8000"},
+		{bind: "::1", value: "9000", want: "[::1]:9000"},
+		{value: "10.0.0.1:9000", want: "10.0.0.1:9000"},
+		{value: "[::1]:9000", want: "[::1]:9000"},
+		{value: "unix:///var/run/ext_authz.sock", want: "unix:///var/run/ext_authz.sock"},
+		{value: Disabled, want: Disabled},
+		{value: "65536", wantErr: true},
+		{value: "localhost", wantErr: true},
+		{value: "localhost:http", wantErr: true},
+		{value: "unix:/var/run/ext_authz.sock", wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.bind+" "+tc.value, func(t *testing.T) {
+			s := &ExtAuthzServer{bindAddress: tc.bind}
+			got, err := s.listenAddress(tc.value)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// unixHTTPClient returns the client that sends the requests to the socket.
+func unixHTTPClient(path string) *http.Client {
+	return &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+}
+
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ext-authz-socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	httpSocket, grpcSocket := filepath.Join(dir, "http.sock"), filepath.Join(dir, "grpc.sock")
+	c := DefaultConfig()
+	c.UnixSocketMode = "0600"
+	s := newTestServer(t, c)
+	if err := s.Start(unixScheme+httpSocket, unixScheme+grpcSocket); err != nil {
+		t.Fatal(err)
+	}
+	stopped := false
+	defer func() {
+		if !stopped {
+			s.Stop()
+		}
+	}()
+	for _, path := range []string{httpSocket, grpcSocket} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+			t.Fatalf("got %s mode %v, want a socket with 0600", path, info.Mode())
+		}
+	}
+	if s.HTTPPort() != 0 || s.GRPCPort() != 0 || s.HTTPAddr().String() != httpSocket || s.GRPCAddr().String() != grpcSocket {
+		t.Fatalf("got ports %d and %d and addresses %v and %v, want 0 and the socket paths",
+			s.HTTPPort(), s.GRPCPort(), s.HTTPAddr(), s.GRPCAddr())
+	}
+
+	dialer := grpc.WithContextDialer(func(ctx context.Context, path string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", path)
+	})
+	cases := []struct {
+		name    string
+		headers map[string]string
+		want    bool
+	}{
+		{name: "allowed", headers: map[string]string{"x-ext-authz": "allow"}, want: true},
+		{name: "denied"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := testRequest{headers: tc.headers}
+			response, err := grpcCheck(s, r, grpc.WithInsecure(), dialer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := grpcAllowed(response); got != tc.want {
+				t.Fatalf("got allowed gRPC %v, want %v", got, tc.want)
+			}
+			request, err := http.NewRequest(http.MethodGet, "http://ext-authz/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, value := range tc.headers {
+				request.Header.Set(name, value)
+			}
+			httpResponse, err := unixHTTPClient(httpSocket).Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			httpResponse.Body.Close()
+			if got := httpResponse.StatusCode == http.StatusOK; got != tc.want {
+				t.Fatalf("got HTTP status %d, want allowed %v", httpResponse.StatusCode, tc.want)
+			}
+		})
+	}
+
+	s.Stop()
+	stopped = true
+	for _, path := range []string{httpSocket, grpcSocket} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("got %s after Stop with error %v, want it removed", path, err)
+		}
+	}
+}
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ext-authz-socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cases := []struct {
+		name        string
+		create      func(path string) (closer func())
+		wantErr     string
+		wantRemoved bool
+	}{
+		{name: "missing", wantRemoved: true},
+		{name: "stale", create: func(path string) func() {
+			listener, err := net.Listen("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The socket file is left behind like by a crashed process.
+			listener.(*net.UnixListener).SetUnlinkOnClose(false)
+			listener.Close()
+			return func() {}
+		}, wantRemoved: true},
+		{name: "in use", create: func(path string) func() {
+			listener, err := net.Listen("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return func() { listener.Close() }
+		}, wantErr: "is in use by another process"},
+		{name: "not a socket", create: func(path string) func() {
+			if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+			return func() {}
+		}, wantErr: "exists and is not a socket"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, strings.Replace(tc.name, " ", "-", -1)+".sock")
+			if tc.create != nil {
+				defer tc.create(path)()
+			}
+			err := removeStaleSocket(path, NewTextLogger(ioutil.Discard))
+			if tc.wantErr == "" && err != nil || tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+				t.Fatalf("got error %v, want %q", err, tc.wantErr)
+			}
+			if _, err := os.Stat(path); os.IsNotExist(err) != tc.wantRemoved {
+				t.Fatalf("got stat error %v, want removed %v", err, tc.wantRemoved)
+			}
+		})
+	}
+}
+
+func TestUnixSocketModeValidation(t *testing.T) {
+	cases := []struct {
+		mode    string
+		wantErr string
+	}{
+		{mode: "0660"},
+		{mode: "600"},
+		{mode: "rw", wantErr: `-unix-socket-mode must be an octal file mode like 0660 but got "rw"`},
+		{mode: "0899", wantErr: "-unix-socket-mode must be an octal file mode"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.mode, func(t *testing.T) {
+			c := DefaultConfig()
+			c.UnixSocketMode = tc.mode
+			got := newServerError(c)
+			if (tc.wantErr == "") != (got == "") || !strings.Contains(got, tc.wantErr) {
+				t.Fatalf("got error %q, want %q", got, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestSingleProtocol(t *testing.T) {
+	allow := testRequest{headers: map[string]string{"x-ext-authz": "allow"}}
+	cases := []struct {
+		name               string
+		singlePort         bool
+		httpAddr, grpcAddr string
+		wantErr            string
+	}{
+		{name: "gRPC only", httpAddr: Disabled, grpcAddr: "127.0.0.1:0"},
+		{name: "HTTP only", httpAddr: "127.0.0.1:0", grpcAddr: Disabled},
+		{name: "both disabled", httpAddr: Disabled, grpcAddr: Disabled, wantErr: "the HTTP and gRPC servers are both disabled"},
+		{name: "HTTP disabled in the single port mode", singlePort: true, httpAddr: Disabled, grpcAddr: Disabled,
+			wantErr: "the HTTP server cannot be disabled in the single port mode"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.AdminPort = "0"
+			c.SinglePort = tc.singlePort
+			s := newTestServer(t, c)
+			err := s.Start(tc.httpAddr, tc.grpcAddr)
+			if tc.wantErr != "" {
+				s.close()
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want error containing %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			grpcEnabled := tc.grpcAddr != Disabled
+			if got := s.GRPCPort() != DisabledPort; got != grpcEnabled {
+				t.Fatalf("got gRPC port %d, want enabled %v", s.GRPCPort(), grpcEnabled)
+			}
+			if got := s.HTTPPort() != DisabledPort; got == grpcEnabled {
+				t.Fatalf("got HTTP port %d, want enabled %v", s.HTTPPort(), !grpcEnabled)
+			}
+			if grpcEnabled {
+				response, err := grpcCheck(s, allow, grpc.WithInsecure())
+				if err != nil || !grpcAllowed(response) {
+					t.Fatalf("got gRPC response %v and error %v, want allowed", response, err)
+				}
+			} else {
+				request, _ := http.NewRequest("GET", "http://"+s.HTTPAddr().String()+"/", nil)
+				request.Header.Set("x-ext-authz", "allow")
+				response, err := http.DefaultClient.Do(request)
+				if err != nil {
+					t.Fatal(err)
+				}
+				response.Body.Close()
+				if response.StatusCode != http.StatusOK {
+					t.Fatalf("got HTTP status %d, want %d", response.StatusCode, http.StatusOK)
+				}
+			}
+			// The readiness only considers the enabled listener.
+			if got := adminRequest(s, http.MethodGet, readyzPath, "", ""); got.Code != http.StatusOK {
+				t.Fatalf("got %s status %d %q, want %d", readyzPath, got.Code, got.Body.String(), http.StatusOK)
+			}
+			s.Stop()
+			if err := s.Wait(); err != nil {
+				t.Fatalf("got Wait error %v, want nil", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,296 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// LogFormatText and LogFormatJSON are the values of -log-format.
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// The levels of -log-level, the decisions are logged at the info level and with the request
+// attributes at the debug level.
+const (
+	levelDebug int32 = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func parseLogLevel(name string) (int32, error) {
+	for level, n := range levelNames {
+		if n == name {
+			return int32(level), nil
+		}
+	}
+	return 0, fmt.Errorf("log level must be one of %s but got %q", strings.Join(levelNames, ", "), name)
+}
+
+// DecisionEntry is the log entry of a decided check request.
+type DecisionEntry struct {
+	Time time.Time
+	// Protocol is grpc, http, ext_proc or tcp.
+	Protocol string
+	// Decision is allowed or denied, and Reason the short machine-readable reason of the decision.
+	Decision  string
+	Reason    string
+	Method    string
+	Host      string
+	Path      string
+	SourceIP  string
+	RequestID string
+	Rule      string
+	Duration  time.Duration
+	// Message is the line of the text format, with the request attributes at the debug level. The
+	// sensitive headers are redacted.
+	Message string
+}
+
+// Logger writes the decisions and the other messages of the server by level, see WithLogger.
+type Logger interface {
+	Decision(entry DecisionEntry)
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// NewTextLogger returns the logger of the text format, it writes the messages to the standard
+// logger of the log package if out is nil. The warnings start with "Warning: ", the other levels
+// are not marked.
+func NewTextLogger(out io.Writer) Logger {
+	if out == nil {
+		return textLogger{std: true}
+	}
+	return textLogger{logger: log.New(out, "", log.LstdFlags)}
+}
+
+type textLogger struct {
+	std    bool
+	logger *log.Logger
+}
+
+func (l textLogger) Decision(entry DecisionEntry) {
+	l.printf("%s", entry.Message)
+}
+
+func (l textLogger) Debugf(format string, args ...interface{}) {
+	l.printf(format, args...)
+}
+
+func (l textLogger) Infof(format string, args ...interface{}) {
+	l.printf(format, args...)
+}
+
+func (l textLogger) Warnf(format string, args ...interface{}) {
+	l.printf("Warning: "+format, args...)
+}
+
+func (l textLogger) Errorf(format string, args ...interface{}) {
+	l.printf(format, args...)
+}
+
+func (l textLogger) printf(format string, args ...interface{}) {
+	if l.std {
+		log.Printf(format, args...)
+		return
+	}
+	l.logger.Printf(format, args...)
+}
+
+// JSONLogger writes one JSON object per line. It is also an io.Writer so that the lines of the
+// standard logger can be redirected to it with log.SetOutput and log.SetFlags(0).
+type JSONLogger struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// NewJSONLogger returns the logger of the JSON format writing to out.
+func NewJSONLogger(out io.Writer) *JSONLogger {
+	return &JSONLogger{out: out}
+}
+
+type jsonDecision struct {
+	Time       string  `json:"ts"`
+	Protocol   string  `json:"protocol"`
+	Decision   string  `json:"decision"`
+	Reason     string  `json:"reason"`
+	Method     string  `json:"method,omitempty"`
+	Host       string  `json:"host,omitempty"`
+	Path       string  `json:"path,omitempty"`
+	SourceIP   string  `json:"source_ip,omitempty"`
+	RequestID  string  `json:"request_id,omitempty"`
+	DurationMS float64 `json:"duration_ms"`
+	Rule       string  `json:"rule,omitempty"`
+}
+
+type jsonMessage struct {
+	Time    string `json:"ts"`
+	Level   string `json:"level"`
+	Message string `json:"msg"`
+}
+
+// Decision writes the fields of the entry without the Message.
+func (l *JSONLogger) Decision(entry DecisionEntry) {
+	l.write(jsonDecision{
+		Time:       entry.Time.UTC().Format(time.RFC3339Nano),
+		Protocol:   entry.Protocol,
+		Decision:   entry.Decision,
+		Reason:     entry.Reason,
+		Method:     entry.Method,
+		Host:       entry.Host,
+		Path:       entry.Path,
+		SourceIP:   entry.SourceIP,
+		RequestID:  entry.RequestID,
+		DurationMS: float64(entry.Duration) / float64(time.Millisecond),
+		Rule:       entry.Rule,
+	})
+}
+
+// Debugf, Infof, Warnf and Errorf write the message as the msg field with the level.
+func (l *JSONLogger) Debugf(format string, args ...interface{}) {
+	l.message(levelDebug, format, args...)
+}
+
+func (l *JSONLogger) Infof(format string, args ...interface{}) {
+	l.message(levelInfo, format, args...)
+}
+
+func (l *JSONLogger) Warnf(format string, args ...interface{}) {
+	l.message(levelWarn, format, args...)
+}
+
+func (l *JSONLogger) Errorf(format string, args ...interface{}) {
+	l.message(levelError, format, args...)
+}
+
+func (l *JSONLogger) message(level int32, format string, args ...interface{}) {
+	l.write(jsonMessage{
+		Time:    time.Now().UTC().Format(time.RFC3339Nano),
+		Level:   levelNames[level],
+		Message: strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"),
+	})
+}
+
+// Write writes each line of p as a message at the info level.
+func (l *JSONLogger) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimSuffix(string(p), "\n"), "\n") {
+		l.Infof("%s", line)
+	}
+	return len(p), nil
+}
+
+func (l *JSONLogger) write(v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(append(data, '\n'))
+}
+
+// leveledLogger drops the messages below the level of the server.
+type leveledLogger struct {
+	Logger
+	s *ExtAuthzServer
+}
+
+func (l leveledLogger) Debugf(format string, args ...interface{}) {
+	if l.s.currentLogLevel() <= levelDebug {
+		l.Logger.Debugf(format, args...)
+	}
+}
+
+func (l leveledLogger) Infof(format string, args ...interface{}) {
+	if l.s.currentLogLevel() <= levelInfo {
+		l.Logger.Infof(format, args...)
+	}
+}
+
+func (l leveledLogger) Warnf(format string, args ...interface{}) {
+	if l.s.currentLogLevel() <= levelWarn {
+		l.Logger.Warnf(format, args...)
+	}
+}
+
+func (l leveledLogger) Errorf(format string, args ...interface{}) {
+	l.Logger.Errorf(format, args...)
+}
+
+func (s *ExtAuthzServer) currentLogLevel() int32 {
+	return atomic.LoadInt32(&s.logLevel)
+}
+
+// setLogLevel changes the level at runtime.
+func (s *ExtAuthzServer) setLogLevel(level int32) {
+	atomic.StoreInt32(&s.logLevel, level)
+}
+
+// decisionsLogged returns true if a line is logged per decision, at the info or debug level.
+func (s *ExtAuthzServer) decisionsLogged() bool {
+	return s.logDecisions && s.currentLogLevel() <= levelInfo
+}
+
+// logDecision counts the decision of the check request in the statistics and StatsD, records it
+// in the history and writes it to the access and audit logs if set, and logs it unless the
+// decisions are not logged.
+// The message returns the line of the text format, it is only called if the decision is logged so
+// that the request attributes are not formatted in vain.
+func (s *ExtAuthzServer) logDecision(protocol string, request *checkRequest, d decision, start time.Time, message func(debug bool) string) {
+	duration := time.Since(start)
+	s.currentStats().observe(protocol, d, duration)
+	s.statsd.observeCheck(protocol, d, duration)
+	s.recordDecision(protocol, request, d, start)
+	s.auditDecision(protocol, request, d, start)
+	if s.accessLog != nil {
+		s.accessLog.write(&accessLogEntry{protocol: protocol, request: request, decision: d, start: start,
+			duration: duration, path: s.redactPath(request.path)})
+	}
+	if !s.decisionsLogged() {
+		return
+	}
+	level := s.currentLogLevel()
+	entry := DecisionEntry{
+		Time:      start,
+		Protocol:  protocol,
+		Decision:  d.result(),
+		Reason:    d.resultDetail(),
+		Method:    request.method,
+		Host:      request.host,
+		Path:      s.redactPath(request.path),
+		RequestID: request.header("x-request-id"),
+		Rule:      d.ruleName(),
+		Duration:  duration,
+		Message:   message(level == levelDebug),
+	}
+	if request.sourceIP != nil {
+		entry.SourceIP = request.sourceIP.String()
+	}
+	s.logger.Decision(entry)
+}
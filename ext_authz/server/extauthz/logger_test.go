@@ -0,0 +1,219 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	rls "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+)
+
+// The logging configurations of the tests and benchmarks, from the most to the least verbose.
+var loggingCases = []struct {
+	name         string
+	level        string
+	logDecisions bool
+	// wantDecision is true if a line is logged per decision.
+	wantDecision bool
+}{
+	{name: "debug", level: "debug", logDecisions: true, wantDecision: true},
+	{name: "info", level: "info", logDecisions: true, wantDecision: true},
+	{name: "warn", level: "warn", logDecisions: true},
+	{name: "decisions off", level: "info", logDecisions: false},
+}
+
+// newLoggingServer returns the server logging to out, the rate limit service is served with the
+// limit if set. The caller closes it.
+func newLoggingServer(tb testing.TB, level string, logDecisions bool, out io.Writer, rateLimit string) *ExtAuthzServer {
+	tb.Helper()
+	c := DefaultConfig()
+	c.LogLevel = level
+	c.LogDecisions = logDecisions
+	c.Logger = NewTextLogger(out)
+	if rateLimit != "" {
+		c.EnableRateLimitService, c.RateLimitServiceLimit = true, rateLimit
+	}
+	s, err := NewExtAuthzServer(WithConfig(c))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return s
+}
+
+// loggingCheckRequest has the attributes of a typical Envoy check request, the debug level formats
+// all of them.
+func loggingCheckRequest() *auth.CheckRequest {
+	headers := map[string]string{
+		":authority": "example.com", ":method": "GET", ":path": "/api/v1/users?page=2", "x-ext-authz": "allow",
+		"user-agent": "curl/7.68.0", "x-request-id": "7b6d2a8e-1f43-4c55-9d4e-3b1e9a2f6c10", "accept": "*/*",
+		"x-forwarded-for": "10.0.0.1", "x-forwarded-proto": "https", "x-envoy-expected-rq-timeout-ms": "15000",
+	}
+	return &auth.CheckRequest{Attributes: &auth.AttributeContext{
+		Source:      &auth.AttributeContext_Peer{Address: &core.Address{}},
+		Destination: &auth.AttributeContext_Peer{Address: &core.Address{}},
+		Request: &auth.AttributeContext_Request{Http: &auth.AttributeContext_HttpRequest{
+			Id: "12345", Method: "GET", Host: "example.com", Path: "/api/v1/users?page=2", Protocol: "HTTP/1.1",
+			Scheme: "https", Headers: headers,
+		}},
+	}}
+}
+
+func TestCheckDecisionLogging(t *testing.T) {
+	for _, tc := range loggingCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			s := newLoggingServer(t, tc.level, tc.logDecisions, &out, "")
+			defer s.close()
+			out.Reset()
+			if _, err := s.Check(context.Background(), loggingCheckRequest()); err != nil {
+				t.Fatal(err)
+			}
+			got := out.String()
+			if gotDecision := strings.Contains(got, "[gRPC][allowed]"); gotDecision != tc.wantDecision {
+				t.Fatalf("got log %q, want decision logged %v", got, tc.wantDecision)
+			}
+			if gotAttributes := strings.Contains(got, "with attributes"); gotAttributes != (tc.level == "debug") {
+				t.Fatalf("got log %q, want attributes logged %v", got, tc.level == "debug")
+			}
+		})
+	}
+}
+
+func TestRateLimitServiceLogging(t *testing.T) {
+	for _, tc := range loggingCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			s := newLoggingServer(t, tc.level, tc.logDecisions, &out, "10/second")
+			defer s.close()
+			out.Reset()
+			if _, err := s.rateLimitService.ShouldRateLimit(context.Background(), rateLimitRequest()); err != nil {
+				t.Fatal(err)
+			}
+			got := out.String()
+			if gotDecision := strings.Contains(got, "[RLS][ok]: envoy|remote_address=10.0.0.1 OK"); gotDecision != tc.wantDecision {
+				t.Fatalf("got log %q, want response logged %v", got, tc.wantDecision)
+			}
+		})
+	}
+}
+
+func TestLeveledLogger(t *testing.T) {
+	cases := []struct {
+		level string
+		want  []string
+	}{
+		{level: "debug", want: []string{"debug message", "info message", "Warning: warn message", "error message"}},
+		{level: "info", want: []string{"info message", "Warning: warn message", "error message"}},
+		{level: "warn", want: []string{"Warning: warn message", "error message"}},
+		{level: "error", want: []string{"error message"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.level, func(t *testing.T) {
+			var out bytes.Buffer
+			s := newLoggingServer(t, tc.level, true, &out, "")
+			defer s.close()
+			out.Reset()
+			s.logger.Debugf("debug %s", "message")
+			s.logger.Infof("info %s", "message")
+			s.logger.Warnf("warn %s", "message")
+			s.logger.Errorf("error %s", "message")
+			var got []string
+			for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+				// The lines start with the date and time of the standard flags.
+				got = append(got, strings.SplitN(line, " ", 3)[2])
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestJSONLoggerLevels(t *testing.T) {
+	cases := []struct {
+		log  func(l *JSONLogger)
+		want string
+	}{
+		{log: func(l *JSONLogger) { l.Debugf("a %d", 1) }, want: `"level":"debug","msg":"a 1"`},
+		{log: func(l *JSONLogger) { l.Infof("b\n") }, want: `"level":"info","msg":"b"`},
+		{log: func(l *JSONLogger) { l.Warnf("c") }, want: `"level":"warn","msg":"c"`},
+		{log: func(l *JSONLogger) { l.Errorf("d") }, want: `"level":"error","msg":"d"`},
+		{log: func(l *JSONLogger) { l.Write([]byte("e\n")) }, want: `"level":"info","msg":"e"`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.want, func(t *testing.T) {
+			var out bytes.Buffer
+			tc.log(NewJSONLogger(&out))
+			if !strings.Contains(out.String(), tc.want) {
+				t.Fatalf("got %q, want %s", out.String(), tc.want)
+			}
+		})
+	}
+}
+
+func rateLimitRequest() *rls.RateLimitRequest {
+	return &rls.RateLimitRequest{Domain: "envoy", Descriptors: []*ratelimitv3.RateLimitDescriptor{{
+		Entries: []*ratelimitv3.RateLimitDescriptor_Entry{{Key: "remote_address", Value: "10.0.0.1"}},
+	}}}
+}
+
+// BenchmarkCheckDecisionLogging measures the cost of the decision logging of a gRPC check request,
+// the attributes are only formatted at the debug level and nothing is formatted if the decisions
+// are not logged.
+func BenchmarkCheckDecisionLogging(b *testing.B) {
+	for _, bc := range loggingCases {
+		b.Run(bc.name, func(b *testing.B) {
+			s := newLoggingServer(b, bc.level, bc.logDecisions, ioutil.Discard, "")
+			defer s.close()
+			request := loggingCheckRequest()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := s.Check(context.Background(), request); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkRateLimitServiceLogging measures the cost of the response logging of the rate limit
+// service, the summary is not formatted if the decisions are not logged.
+func BenchmarkRateLimitServiceLogging(b *testing.B) {
+	for _, bc := range loggingCases {
+		b.Run(bc.name, func(b *testing.B) {
+			// The limit is never reached so that every iteration takes the same path.
+			s := newLoggingServer(b, bc.level, bc.logDecisions, ioutil.Discard, "1000000000/second")
+			defer s.close()
+			request := rateLimitRequest()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := s.rateLimitService.ShouldRateLimit(context.Background(), request); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// maintenancePath is served by the admin server to toggle the maintenance mode, never by the check
+// listeners as any downstream client could deny all requests.
+const maintenancePath = "/admin/maintenance"
+
+func (s *ExtAuthzServer) inMaintenance() bool {
+	return atomic.LoadInt32(&s.maintenanceMode) != 0
+}
+
+func (s *ExtAuthzServer) setMaintenance(on bool) {
+	var value int32
+	if on {
+		value = 1
+	}
+	atomic.StoreInt32(&s.maintenanceMode, value)
+}
+
+// maintenanceDecision returns the decision that denies all requests during the maintenance.
+func (s *ExtAuthzServer) maintenanceDecision() decision {
+	return decision{
+		reason:  "maintenance mode",
+		status:  http.StatusServiceUnavailable,
+		body:    s.maintenanceBody,
+		headers: map[string]string{"retry-after": fmt.Sprint(int(math.Ceil(s.maintenanceRetryAfter.Seconds())))},
+	}
+}
+
+// handleMaintenance toggles the maintenance mode with POST /admin/maintenance?on=true|false and
+// returns the current mode for GET.
+func (s *ExtAuthzServer) handleMaintenance(response http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		on, err := strconv.ParseBool(request.URL.Query().Get("on"))
+		if err != nil {
+			http.Error(response, "query parameter on must be true or false", http.StatusBadRequest)
+			return
+		}
+		s.setMaintenance(on)
+		s.logger.Infof("Maintenance mode is set to %v by %s", on, request.RemoteAddr)
+	default:
+		response.Header().Set("Allow", "GET, POST")
+		http.Error(response, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fmt.Fprintf(response, "maintenance: %v\n", s.inMaintenance())
+}
@@ -0,0 +1,48 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"time"
+
+	structpb "github.com/golang/protobuf/ptypes/struct"
+)
+
+// dynamicMetadata returns the flat struct emitted in the check response, Envoy logs it with
+// %DYNAMIC_METADATA(envoy.filters.http.ext_authz:decision)% etc. For example:
+//
+//	{"decision": "allowed", "rule": "allow-get", "principal": "alice", "duration_ms": 0.12}
+//
+// The rule and principal are omitted if the decision has none.
+func (s *ExtAuthzServer) dynamicMetadata(d decision, duration time.Duration) *structpb.Struct {
+	if !s.emitDynamicMetadata {
+		return nil
+	}
+	fields := map[string]*structpb.Value{
+		"decision":    stringValue(d.result()),
+		"duration_ms": {Kind: &structpb.Value_NumberValue{NumberValue: float64(duration) / float64(time.Millisecond)}},
+	}
+	if d.rule != "" {
+		fields["rule"] = stringValue(d.rule)
+	}
+	if d.principal != "" {
+		fields["principal"] = stringValue(d.principal)
+	}
+	return &structpb.Struct{Fields: fields}
+}
+
+func stringValue(s string) *structpb.Value {
+	return &structpb.Value{Kind: &structpb.Value_StringValue{StringValue: s}}
+}
@@ -0,0 +1,102 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+)
+
+func numberValue(n float64) *structpb.Value {
+	return &structpb.Value{Kind: &structpb.Value_NumberValue{NumberValue: n}}
+}
+
+func TestDynamicMetadata(t *testing.T) {
+	cases := []struct {
+		name     string
+		disabled bool
+		decision decision
+		want     *structpb.Struct
+	}{
+		{name: "allowed", decision: decision{allowed: true, rule: "allow-get", principal: "alice"},
+			want: &structpb.Struct{Fields: map[string]*structpb.Value{
+				"decision":    stringValue("allowed"),
+				"rule":        stringValue("allow-get"),
+				"principal":   stringValue("alice"),
+				"duration_ms": numberValue(1.5),
+			}}},
+		{name: "denied without rule and principal", decision: decision{reason: "missing header"},
+			want: &structpb.Struct{Fields: map[string]*structpb.Value{
+				"decision":    stringValue("denied"),
+				"duration_ms": numberValue(1.5),
+			}}},
+		{name: "allowed by sampling", decision: decision{allowed: true, sampled: true, rule: "deny-all"},
+			want: &structpb.Struct{Fields: map[string]*structpb.Value{
+				"decision":    stringValue("allowed-by-sampling"),
+				"rule":        stringValue("deny-all"),
+				"duration_ms": numberValue(1.5),
+			}}},
+		{name: "disabled", disabled: true, decision: decision{allowed: true}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.EmitDynamicMetadata = !tc.disabled
+			s := newTestServer(t, c)
+			defer s.close()
+			got := s.dynamicMetadata(tc.decision, 1500*time.Microsecond)
+			if !proto.Equal(got, tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCheckDynamicMetadata(t *testing.T) {
+	file := writeTestFile(t, "rules:\n- name: allow-api\n  path_prefix: /api\n  action: allow\n- name: deny-all\n  action: deny\n")
+	defer os.Remove(file)
+	cases := []struct {
+		name string
+		path string
+		want map[string]string
+	}{
+		{name: "allowed", path: "/api", want: map[string]string{"decision": "allowed", "rule": "allow-api"}},
+		{name: "denied", path: "/admin", want: map[string]string{"decision": "denied", "rule": "deny-all"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.PolicyFile = file
+			s := newTestServer(t, c)
+			defer s.close()
+			fields := checkGRPC(t, s, testRequest{path: tc.path}).GetDynamicMetadata().GetFields()
+			if len(fields) != len(tc.want)+1 {
+				t.Fatalf("got metadata %v, want %v and duration_ms", fields, tc.want)
+			}
+			for name, value := range tc.want {
+				if got := fields[name].GetStringValue(); got != value {
+					t.Fatalf("got %s %q, want %q", name, got, value)
+				}
+			}
+			if duration := fields["duration_ms"].GetNumberValue(); duration <= 0 {
+				t.Fatalf("got duration_ms %v, want positive", duration)
+			}
+		})
+	}
+}
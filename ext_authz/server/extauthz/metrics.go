@@ -0,0 +1,290 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	grpcstatus "google.golang.org/grpc/status"
+)
+
+const (
+	metricsPath = "/metrics"
+	// metricsAdmin serves the metrics on the admin server, the only listener of -metrics.
+	metricsAdmin = "admin"
+)
+
+// durationBuckets are the upper bounds in seconds of the duration histograms, the checks are
+// expected to take well below a millisecond unless they call out to a dependency.
+var durationBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+type histogram struct {
+	// counts are the observations per bucket, not cumulative.
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(seconds float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(durationBuckets))
+	}
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// metrics are the Prometheus metrics of a server. Every server keeps its own so that the servers
+// embedded in a process don't collide in a global registry.
+type metrics struct {
+	mu sync.Mutex
+	// checks is keyed by protocol, decision and reason.
+	checks         map[[3]string]uint64
+	checkDurations map[string]*histogram
+	// stageDurations is keyed by protocol and stage.
+	stageDurations map[[2]string]*histogram
+	// grpcHandled is keyed by service, method and code, grpcDurations by service and method.
+	grpcHandled   map[[3]string]uint64
+	grpcDurations map[[2]string]*histogram
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		checks:         map[[3]string]uint64{},
+		checkDurations: map[string]*histogram{},
+		stageDurations: map[[2]string]*histogram{},
+		grpcHandled:    map[[3]string]uint64{},
+		grpcDurations:  map[[2]string]*histogram{},
+	}
+}
+
+// observeCheck counts the decision of a check request of the protocol, it does nothing if the
+// metrics are disabled.
+func (m *metrics) observeCheck(protocol string, d decision, start time.Time) {
+	if m == nil {
+		return
+	}
+	elapsed := time.Since(start).Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checks[[3]string{protocol, d.result(), d.resultDetail()}]++
+	h, ok := m.checkDurations[protocol]
+	if !ok {
+		h = &histogram{}
+		m.checkDurations[protocol] = h
+	}
+	h.observe(elapsed)
+}
+
+// observeStages observes the stages of a check request that ran, it does nothing if the metrics
+// are disabled.
+func (m *metrics) observeStages(protocol string, st *stageTimes) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for stage, name := range stageNames {
+		if !st.ran[stage] {
+			continue
+		}
+		key := [2]string{protocol, name}
+		h, ok := m.stageDurations[key]
+		if !ok {
+			h = &histogram{}
+			m.stageDurations[key] = h
+		}
+		h.observe(st.durations[stage].Seconds())
+	}
+}
+
+func (m *metrics) observeRPC(fullMethod string, err error, start time.Time) {
+	elapsed := time.Since(start).Seconds()
+	service, method := "unknown", fullMethod
+	if i := strings.LastIndex(fullMethod, "/"); i > 0 {
+		service, method = strings.TrimPrefix(fullMethod[:i], "/"), fullMethod[i+1:]
+	}
+	code := grpcstatus.Code(err).String()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.grpcHandled[[3]string{service, method, code}]++
+	key := [2]string{service, method}
+	h, ok := m.grpcDurations[key]
+	if !ok {
+		h = &histogram{}
+		m.grpcDurations[key] = h
+	}
+	h.observe(elapsed)
+}
+
+func (m *metrics) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	m.observeRPC(info.FullMethod, err, start)
+	return resp, err
+}
+
+func (m *metrics) streamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, stream)
+	m.observeRPC(info.FullMethod, err, start)
+	return err
+}
+
+// serverOptions returns the interceptors of the gRPC server metrics, none if disabled.
+func (m *metrics) serverOptions() []grpc.ServerOption {
+	if m == nil {
+		return nil
+	}
+	return []grpc.ServerOption{grpc.UnaryInterceptor(m.unaryInterceptor), grpc.StreamInterceptor(m.streamInterceptor)}
+}
+
+// labelEscaper escapes the label values of the text format.
+var labelEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+// labels formats the label pairs of the names and values.
+func labels(names []string, values ...string) string {
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=\"" + labelEscaper.Replace(values[i]) + "\""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func writeHistogram(w io.Writer, name string, labelNames []string, labelValues []string, h *histogram) {
+	var cumulative uint64
+	bucketNames := append(append([]string(nil), labelNames...), "le")
+	for i, bound := range durationBuckets {
+		cumulative += h.counts[i]
+		le := strconv.FormatFloat(bound, 'g', -1, 64)
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, labels(bucketNames, append(append([]string(nil), labelValues...), le)...), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket%s %d\n", name, labels(bucketNames, append(append([]string(nil), labelValues...), "+Inf")...), h.count)
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, labels(labelNames, labelValues...), h.sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels(labelNames, labelValues...), h.count)
+}
+
+// writeMetrics writes the metrics in the Prometheus text format, the series are sorted by labels.
+func (s *ExtAuthzServer) writeMetrics(out io.Writer) error {
+	w := bufio.NewWriter(out)
+	m := s.metrics
+	m.mu.Lock()
+	checkKeys := make([][3]string, 0, len(m.checks))
+	for key := range m.checks {
+		checkKeys = append(checkKeys, key)
+	}
+	sort.Slice(checkKeys, func(i, j int) bool { return less(checkKeys[i][:], checkKeys[j][:]) })
+	fmt.Fprintf(w, "# HELP extauthz_checks_total Check requests by protocol, decision and reason.\n# TYPE extauthz_checks_total counter\n")
+	for _, key := range checkKeys {
+		fmt.Fprintf(w, "extauthz_checks_total%s %d\n", labels([]string{"protocol", "decision", "reason"}, key[:]...), m.checks[key])
+	}
+	protocols := make([]string, 0, len(m.checkDurations))
+	for protocol := range m.checkDurations {
+		protocols = append(protocols, protocol)
+	}
+	sort.Strings(protocols)
+	fmt.Fprintf(w, "# HELP extauthz_check_duration_seconds Time to decide the check requests by protocol.\n# TYPE extauthz_check_duration_seconds histogram\n")
+	for _, protocol := range protocols {
+		writeHistogram(w, "extauthz_check_duration_seconds", []string{"protocol"}, []string{protocol}, m.checkDurations[protocol])
+	}
+	stageKeys := make([][2]string, 0, len(m.stageDurations))
+	for key := range m.stageDurations {
+		stageKeys = append(stageKeys, key)
+	}
+	sort.Slice(stageKeys, func(i, j int) bool { return less(stageKeys[i][:], stageKeys[j][:]) })
+	fmt.Fprintf(w, "# HELP extauthz_check_stage_duration_seconds Time in the stages of the check requests by protocol and stage.\n# TYPE extauthz_check_stage_duration_seconds histogram\n")
+	for _, key := range stageKeys {
+		writeHistogram(w, "extauthz_check_stage_duration_seconds", []string{"protocol", "stage"}, key[:], m.stageDurations[key])
+	}
+	handledKeys := make([][3]string, 0, len(m.grpcHandled))
+	for key := range m.grpcHandled {
+		handledKeys = append(handledKeys, key)
+	}
+	sort.Slice(handledKeys, func(i, j int) bool { return less(handledKeys[i][:], handledKeys[j][:]) })
+	fmt.Fprintf(w, "# HELP grpc_server_handled_total RPCs completed on the gRPC server by service, method and code.\n# TYPE grpc_server_handled_total counter\n")
+	for _, key := range handledKeys {
+		fmt.Fprintf(w, "grpc_server_handled_total%s %d\n", labels([]string{"grpc_service", "grpc_method", "grpc_code"}, key[:]...), m.grpcHandled[key])
+	}
+	methodKeys := make([][2]string, 0, len(m.grpcDurations))
+	for key := range m.grpcDurations {
+		methodKeys = append(methodKeys, key)
+	}
+	sort.Slice(methodKeys, func(i, j int) bool { return less(methodKeys[i][:], methodKeys[j][:]) })
+	fmt.Fprintf(w, "# HELP grpc_server_handling_seconds Time to complete the RPCs on the gRPC server by service and method.\n# TYPE grpc_server_handling_seconds histogram\n")
+	for _, key := range methodKeys {
+		writeHistogram(w, "grpc_server_handling_seconds", []string{"grpc_service", "grpc_method"}, key[:], m.grpcDurations[key])
+	}
+	m.mu.Unlock()
+
+	if s.decisionCache != nil {
+		hits, misses := s.decisionCache.stats()
+		fmt.Fprintf(w, "# HELP extauthz_cache_entries Decisions in the decision cache.\n# TYPE extauthz_cache_entries gauge\nextauthz_cache_entries %d\n", s.decisionCache.size())
+		fmt.Fprintf(w, "# HELP extauthz_cache_hits_total Check requests decided from the decision cache.\n# TYPE extauthz_cache_hits_total counter\nextauthz_cache_hits_total %d\n", hits)
+		fmt.Fprintf(w, "# HELP extauthz_cache_misses_total Check requests not found in the decision cache.\n# TYPE extauthz_cache_misses_total counter\nextauthz_cache_misses_total %d\n", misses)
+	}
+	if s.statsd != nil {
+		fmt.Fprintf(w, "# HELP extauthz_statsd_dropped_total StatsD metrics dropped for the full queue.\n# TYPE extauthz_statsd_dropped_total counter\nextauthz_statsd_dropped_total %d\n", s.statsd.droppedMetrics())
+	}
+	if s.auditLog != nil {
+		fmt.Fprintf(w, "# HELP extauthz_audit_dropped_total Audit records dropped for the full queue.\n# TYPE extauthz_audit_dropped_total counter\nextauthz_audit_dropped_total %d\n", s.auditLog.droppedRecords())
+	}
+	if limiter, ok := s.rateLimiter.(*localRateLimiter); ok {
+		fmt.Fprintf(w, "# HELP extauthz_rate_limit_keys Keys tracked by the local rate limiter.\n# TYPE extauthz_rate_limit_keys gauge\nextauthz_rate_limit_keys %d\n", limiter.tracked())
+	}
+	files := s.files.files()
+	fmt.Fprintf(w, "# HELP extauthz_config_generation Generation of the reloaded configuration files.\n# TYPE extauthz_config_generation gauge\nextauthz_config_generation %d\n", files.generation)
+	info := GetBuildInfo()
+	fmt.Fprintf(w, "# HELP extauthz_build_info Build of the server.\n# TYPE extauthz_build_info gauge\nextauthz_build_info%s 1\n",
+		labels([]string{"version", "commit", "go_version"}, info.Version, info.Commit, info.GoVersion))
+	return w.Flush()
+}
+
+// less orders the label values lexicographically.
+func less(a, b []string) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// serveMetrics serves the metrics on GET /metrics.
+func (s *ExtAuthzServer) serveMetrics(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		response.Header().Set("Allow", "GET")
+		http.Error(response, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	response.Header().Set("content-type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := s.writeMetrics(response); err != nil {
+		s.logger.Errorf("Failed to write the metrics: %v", err)
+	}
+}
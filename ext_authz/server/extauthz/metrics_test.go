@@ -0,0 +1,168 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// scrapeMetrics returns the values of the series scraped from /metrics of the admin server, keyed
+// by the name and labels.
+func scrapeMetrics(t *testing.T, s *ExtAuthzServer) map[string]string {
+	t.Helper()
+	recorder := adminRequest(s, http.MethodGet, metricsPath, "", "")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got %s status %d, want %d", metricsPath, recorder.Code, http.StatusOK)
+	}
+	series := map[string]string{}
+	scanner := bufio.NewScanner(recorder.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if i := strings.LastIndex(line, " "); i > 0 {
+			series[line[:i]] = line[i+1:]
+		}
+	}
+	return series
+}
+
+func TestMetrics(t *testing.T) {
+	allow := testRequest{headers: map[string]string{"x-ext-authz": "allow"}}
+	deny := testRequest{headers: map[string]string{"x-ext-authz": "deny"}}
+	c := DefaultConfig()
+	c.AdminPort = "0"
+	c.Metrics = metricsAdmin
+	s := startTLSServer(t, c)
+	defer s.Stop()
+	// The gRPC checks are sent to the listener so that the interceptors observe them.
+	for _, r := range []testRequest{allow, allow, deny} {
+		if _, err := grpcCheck(s, r, grpc.WithInsecure()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, r := range []testRequest{allow, deny, deny} {
+		checkHTTP(s, r)
+	}
+	series := scrapeMetrics(t, s)
+	cases := []struct {
+		series string
+		want   string
+	}{
+		{series: `extauthz_checks_total{protocol="grpc",decision="allowed",reason="allowed-value"}`, want: "2"},
+		{series: `extauthz_checks_total{protocol="grpc",decision="denied",reason="bad-header-value"}`, want: "1"},
+		{series: `extauthz_checks_total{protocol="http",decision="allowed",reason="allowed-value"}`, want: "1"},
+		{series: `extauthz_checks_total{protocol="http",decision="denied",reason="bad-header-value"}`, want: "2"},
+		{series: `extauthz_check_duration_seconds_count{protocol="grpc"}`, want: "3"},
+		{series: `extauthz_check_duration_seconds_bucket{protocol="http",le="+Inf"}`, want: "3"},
+		{series: `grpc_server_handled_total{grpc_service="envoy.service.auth.v3.Authorization",grpc_method="Check",grpc_code="OK"}`, want: "3"},
+		{series: `grpc_server_handling_seconds_count{grpc_service="envoy.service.auth.v3.Authorization",grpc_method="Check"}`, want: "3"},
+		{series: `extauthz_config_generation`, want: "1"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.series, func(t *testing.T) {
+			if got := series[tc.series]; got != tc.want {
+				t.Fatalf("got %q, want %q in %v", got, tc.want, series)
+			}
+		})
+	}
+}
+
+func TestMetricsPerServer(t *testing.T) {
+	c := DefaultConfig()
+	c.AdminPort = "0"
+	c.Metrics = metricsAdmin
+	first, second := newTestServer(t, c), newTestServer(t, c)
+	defer first.close()
+	defer second.close()
+	checkGRPC(t, first, testRequest{})
+	const denied = `extauthz_checks_total{protocol="grpc",decision="denied",reason="missing-header"}`
+	cases := []struct {
+		name string
+		s    *ExtAuthzServer
+		want string
+	}{
+		{name: "checked server", s: first, want: "1"},
+		{name: "other server", s: second},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := scrapeMetrics(t, tc.s)[denied]; got != tc.want {
+				t.Fatalf("got %s %q, want %q", denied, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMetricsGauges(t *testing.T) {
+	cases := []struct {
+		name   string
+		config func(c *Config)
+		series string
+		want   string
+	}{
+		{name: "cache entries", config: func(c *Config) { c.CacheTTL = time.Minute }, series: "extauthz_cache_entries", want: "1"},
+		{name: "rate limit keys", config: func(c *Config) { c.RateLimitQPS, c.RateLimitBurst = 100, 100 }, series: "extauthz_rate_limit_keys", want: "1"},
+		{name: "no cache", series: "extauthz_cache_entries"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.AdminPort = "0"
+			c.Metrics = metricsAdmin
+			if tc.config != nil {
+				tc.config(&c)
+			}
+			s := newTestServer(t, c)
+			defer s.close()
+			checkGRPC(t, s, testRequest{headers: map[string]string{"x-ext-authz": "allow"}})
+			if got := scrapeMetrics(t, s)[tc.series]; got != tc.want {
+				t.Fatalf("got %s %q, want %q", tc.series, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMetricsValidation(t *testing.T) {
+	cases := []struct {
+		name      string
+		metrics   string
+		adminPort string
+		wantErr   string
+	}{
+		{name: "admin", metrics: metricsAdmin, adminPort: "0"},
+		{name: "disabled", adminPort: "0"},
+		{name: "admin without the admin server", metrics: metricsAdmin, wantErr: "-metrics=admin requires -admin-port"},
+		{name: "http listener", metrics: "http", adminPort: "0", wantErr: `-metrics must be admin or empty but got "http"`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.Metrics = tc.metrics
+			c.AdminPort = tc.adminPort
+			got := newServerError(c)
+			if (tc.wantErr == "") != (got == "") || !strings.Contains(got, tc.wantErr) {
+				t.Fatalf("got error %q, want %q", got, tc.wantErr)
+			}
+		})
+	}
+}
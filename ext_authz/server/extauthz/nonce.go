@@ -0,0 +1,110 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"sync"
+	"time"
+)
+
+// nonceBuckets is the number of time buckets in the window, a nonce is remembered for at least
+// (nonceBuckets-1)/nonceBuckets of the window.
+const nonceBuckets = 8
+
+// nonceCache remembers the seen nonces in a ring of time buckets covering the window, the oldest
+// bucket is dropped when the window moves on or maxEntries is reached.
+type nonceCache struct {
+	bucketSize time.Duration
+	maxEntries int
+	logger     Logger
+
+	mu      sync.Mutex
+	buckets [nonceBuckets]map[string]struct{}
+	// current is the index of the bucket that started at currentStart.
+	current      int
+	currentStart time.Time
+	entries      int
+}
+
+func newNonceCache(window time.Duration, maxEntries int, logger Logger) *nonceCache {
+	c := &nonceCache{bucketSize: window / nonceBuckets, maxEntries: maxEntries, logger: logger}
+	for i := range c.buckets {
+		c.buckets[i] = map[string]struct{}{}
+	}
+	return c
+}
+
+// rotate starts a new bucket, dropping the oldest one.
+func (c *nonceCache) rotate(start time.Time) {
+	c.current = (c.current + 1) % nonceBuckets
+	c.entries -= len(c.buckets[c.current])
+	c.buckets[c.current] = map[string]struct{}{}
+	c.currentStart = start
+}
+
+// seen records the nonce and returns true if it was already seen in the window.
+func (c *nonceCache) seen(nonce string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.currentStart.IsZero() {
+		c.currentStart = now
+	}
+	for i := 0; i < nonceBuckets && now.Sub(c.currentStart) >= c.bucketSize; i++ {
+		c.rotate(c.currentStart.Add(c.bucketSize))
+	}
+	if now.Sub(c.currentStart) >= c.bucketSize {
+		// The cache has been idle for more than the window.
+		c.currentStart = now
+	}
+
+	for _, bucket := range c.buckets {
+		if _, ok := bucket[nonce]; ok {
+			return true
+		}
+	}
+	if c.entries >= c.maxEntries {
+		c.logger.Warnf("nonce cache reached %d entries, dropping the oldest nonces before the window ends", c.maxEntries)
+		for c.entries >= c.maxEntries {
+			c.rotate(now)
+		}
+	}
+	c.buckets[c.current][nonce] = struct{}{}
+	c.entries++
+	return false
+}
+
+// nonceDecision returns a denied decision if the nonce is missing, ok is false otherwise. The nonce
+// is only recorded by replayDecision once the request is allowed.
+func (s *ExtAuthzServer) nonceDecision(request *checkRequest) (decision, bool) {
+	if request.header(NonceHeader) == "" {
+		return decision{reason: "missing " + NonceHeader + " header"}, true
+	}
+	return decision{}, false
+}
+
+// replayDecision records the nonce of the allowed request and returns a denied decision if it was
+// already used, ok is false otherwise. The denied requests do not use up their nonce, so a request
+// failing the credential checks cannot deny the later requests with the same nonce.
+func (s *ExtAuthzServer) replayDecision(request *checkRequest) (decision, bool) {
+	nonce := request.header(NonceHeader)
+	// The requests allowed before the nonce is required, e.g. the bypassed ones, may carry none.
+	if nonce == "" {
+		return decision{}, false
+	}
+	if s.nonces.seen(nonce, s.now()) {
+		return decision{reason: "replay detected, " + NonceHeader + " " + nonce + " was already used"}, true
+	}
+	return decision{}, false
+}
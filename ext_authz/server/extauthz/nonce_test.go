@@ -0,0 +1,229 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/code"
+)
+
+func nonceRequest(nonce string) testRequest {
+	headers := map[string]string{"x-ext-authz": "allow"}
+	if nonce != "" {
+		headers[NonceHeader] = nonce
+	}
+	return testRequest{headers: headers}
+}
+
+func TestNonceReplay(t *testing.T) {
+	const window = time.Minute
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	steps := []struct {
+		name  string
+		at    time.Duration
+		nonce string
+		want  bool
+	}{
+		{name: "first use", nonce: "n1", want: true},
+		{name: "replay", at: time.Second, nonce: "n1"},
+		{name: "other nonce", at: time.Second, nonce: "n2", want: true},
+		{name: "replay within the window", at: window / 2, nonce: "n1"},
+		{name: "missing nonce", at: window / 2},
+		{name: "reuse after the window", at: window + window/nonceBuckets, nonce: "n1", want: true},
+		{name: "replay of the reuse", at: window + window/nonceBuckets, nonce: "n1"},
+		{name: "reuse after an idle period", at: 10 * window, nonce: "n2", want: true},
+	}
+	var out bytes.Buffer
+	c := DefaultConfig()
+	c.RequireNonce = true
+	c.NonceWindow = window
+	c.Logger = NewTextLogger(&out)
+	s := newTestServer(t, c)
+	defer s.close()
+	var now time.Time
+	s.clock = func() time.Time { return now }
+	for _, step := range steps {
+		now = start.Add(step.at)
+		out.Reset()
+		response := checkGRPC(t, s, nonceRequest(step.nonce))
+		if got := grpcAllowed(response); got != step.want {
+			t.Fatalf("%s: got allowed %v, want %v", step.name, got, step.want)
+		}
+		if step.want {
+			continue
+		}
+		if got := response.GetStatus().GetCode(); got != int32(code.Code_PERMISSION_DENIED) {
+			t.Fatalf("%s: got code %v, want PERMISSION_DENIED", step.name, code.Code(got))
+		}
+		wantReason := "replay detected"
+		if step.nonce == "" {
+			wantReason = "missing x-nonce header"
+		}
+		if !strings.Contains(out.String(), wantReason) {
+			t.Fatalf("%s: got log %q, want %q", step.name, out.String(), wantReason)
+		}
+	}
+}
+
+func TestNonceReplayAcrossProtocols(t *testing.T) {
+	c := DefaultConfig()
+	c.RequireNonce = true
+	s := newTestServer(t, c)
+	defer s.close()
+	// The gRPC and HTTP check requests share the nonces.
+	steps := []struct {
+		name  string
+		check func() bool
+		want  bool
+	}{
+		{name: "HTTP first use", check: func() bool { return checkHTTP(s, nonceRequest("n1")).Code == http.StatusOK }, want: true},
+		{name: "gRPC replay", check: func() bool { return grpcAllowed(checkGRPC(t, s, nonceRequest("n1"))) }},
+		{name: "HTTP replay", check: func() bool { return checkHTTP(s, nonceRequest("n1")).Code == http.StatusOK }},
+	}
+	for _, step := range steps {
+		if got := step.check(); got != step.want {
+			t.Fatalf("%s: got allowed %v, want %v", step.name, got, step.want)
+		}
+	}
+}
+
+func TestNonceConcurrentReplays(t *testing.T) {
+	c := DefaultConfig()
+	c.RequireNonce = true
+	s := newTestServer(t, c)
+	defer s.close()
+	var allowed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response, err := s.Check(context.Background(), nonceRequest("shared").grpc())
+			if err == nil && grpcAllowed(response) {
+				atomic.AddInt32(&allowed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != 1 {
+		t.Fatalf("got %d allowed concurrent uses of the nonce, want 1", allowed)
+	}
+}
+
+func TestNonceCacheMaxEntries(t *testing.T) {
+	cases := []struct {
+		maxEntries int
+		nonces     int
+		// wantSeen is true if the first nonce is still remembered after all nonces were seen.
+		wantSeen bool
+	}{
+		{maxEntries: 100, nonces: 50, wantSeen: true},
+		{maxEntries: 10, nonces: 50},
+	}
+	for _, tc := range cases {
+		t.Run(fmt.Sprint(tc.maxEntries), func(t *testing.T) {
+			cache := newNonceCache(time.Minute, tc.maxEntries, NewTextLogger(ioutil.Discard))
+			now := time.Now()
+			for i := 0; i < tc.nonces; i++ {
+				if cache.seen(fmt.Sprint("n", i), now) {
+					t.Fatalf("got nonce %d seen, want new", i)
+				}
+			}
+			if cache.entries > tc.maxEntries {
+				t.Fatalf("got %d entries, want at most %d", cache.entries, tc.maxEntries)
+			}
+			if got := cache.seen("n0", now); got != tc.wantSeen {
+				t.Fatalf("got first nonce seen %v, want %v", got, tc.wantSeen)
+			}
+		})
+	}
+}
+
+// signedNonceRequest returns the GET request of /items signed at the timestamp with the nonce.
+func signedNonceRequest(secret []byte, timestamp, signedNonce, nonce string) testRequest {
+	return testRequest{path: "/items", headers: map[string]string{
+		SignatureHeader: Signature(secret, "GET", "/items", timestamp, signedNonce),
+		TimestampHeader: timestamp,
+		NonceHeader:     nonce,
+	}}
+}
+
+func TestNonceSignature(t *testing.T) {
+	secret := []byte("s3cret")
+	c := DefaultConfig()
+	c.HMACSecret = string(secret)
+	c.RequireNonce = true
+	var out bytes.Buffer
+	c.Logger = NewTextLogger(&out)
+	s := newTestServer(t, c)
+	defer s.close()
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	steps := []struct {
+		name       string
+		request    testRequest
+		want       bool
+		wantReason string
+	}{
+		{name: "bad signature", request: signedNonceRequest([]byte("other"), timestamp, "n1", "n1"),
+			wantReason: "invalid signature"},
+		// The denied request does not use up the nonce.
+		{name: "signed nonce", request: signedNonceRequest(secret, timestamp, "n1", "n1"), want: true},
+		{name: "replay", request: signedNonceRequest(secret, timestamp, "n1", "n1"), wantReason: "replay detected"},
+		{name: "replay with a new nonce", request: signedNonceRequest(secret, timestamp, "n1", "n2"),
+			wantReason: "invalid signature"},
+		{name: "unsigned nonce", request: signedNonceRequest(secret, timestamp, "", "n3"), wantReason: "invalid signature"},
+		{name: "missing nonce", request: signedNonceRequest(secret, timestamp, "", ""), wantReason: "missing x-nonce header"},
+	}
+	for _, step := range steps {
+		out.Reset()
+		if got := grpcAllowed(checkGRPC(t, s, step.request)); got != step.want {
+			t.Fatalf("%s: got allowed %v, want %v", step.name, got, step.want)
+		}
+		if !strings.Contains(out.String(), step.wantReason) {
+			t.Fatalf("%s: got log %q, want %q", step.name, out.String(), step.wantReason)
+		}
+	}
+	// The nonce of the denied signature is still unused.
+	if got := grpcAllowed(checkGRPC(t, s, signedNonceRequest(secret, timestamp, "n2", "n2"))); !got {
+		t.Fatal("got the nonce of the denied replay used up")
+	}
+}
+
+func TestSignatureWithoutNonce(t *testing.T) {
+	secret := []byte("s3cret")
+	c := DefaultConfig()
+	c.HMACSecret = string(secret)
+	s := newTestServer(t, c)
+	defer s.close()
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	// The nonce is neither required nor signed.
+	if !grpcAllowed(checkGRPC(t, s, signedNonceRequest(secret, timestamp, "", "n1"))) {
+		t.Fatal("got the signature without the nonce denied")
+	}
+	if grpcAllowed(checkGRPC(t, s, signedNonceRequest(secret, timestamp, "n1", "n1"))) {
+		t.Fatal("got the signature with the nonce allowed")
+	}
+}
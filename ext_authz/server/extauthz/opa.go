@@ -0,0 +1,159 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// opaMaxCacheEntries bounds the cache, expired entries are pruned once it is reached.
+	opaMaxCacheEntries = 10000
+	opaMaxBytes        = 1 << 20
+)
+
+// opa delegates the decision to the data API of an OPA server, e.g. http://opa:8181/v1/data/authz/allow.
+type opa struct {
+	url      string
+	timeout  time.Duration
+	failOpen bool
+	cacheTTL time.Duration
+	client   *http.Client
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]opaEntry
+}
+
+// opaInput is the input document sent to OPA, header names are lowercase.
+type opaInput struct {
+	Method   string            `json:"method"`
+	Host     string            `json:"host"`
+	Path     string            `json:"path"`
+	Headers  map[string]string `json:"headers"`
+	SourceIP string            `json:"source_ip,omitempty"`
+}
+
+type opaEntry struct {
+	allowed bool
+	expires time.Time
+}
+
+func (o *opa) cached(key [sha256.Size]byte) (bool, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	entry, ok := o.cache[key]
+	if !ok || time.Now().After(entry.expires) {
+		return false, false
+	}
+	return entry.allowed, true
+}
+
+func (o *opa) store(key [sha256.Size]byte, allowed bool) {
+	if o.cacheTTL <= 0 {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := time.Now()
+	if o.cache == nil {
+		o.cache = map[[sha256.Size]byte]opaEntry{}
+	}
+	if len(o.cache) >= opaMaxCacheEntries {
+		for k, entry := range o.cache {
+			if now.After(entry.expires) {
+				delete(o.cache, k)
+			}
+		}
+		if len(o.cache) >= opaMaxCacheEntries {
+			return
+		}
+	}
+	o.cache[key] = opaEntry{allowed: allowed, expires: now.Add(o.cacheTTL)}
+}
+
+// query returns true if OPA evaluates the input to true, an undefined or non-bool result denies.
+// The call is bounded by both the configured timeout and the deadline of the context.
+func (o *opa) query(ctx context.Context, input opaInput) (bool, error) {
+	data, err := json.Marshal(map[string]interface{}{"input": input})
+	if err != nil {
+		return false, err
+	}
+	key := sha256.Sum256(data)
+	if allowed, ok := o.cached(key); ok {
+		return allowed, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, o.timeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPost, o.url, bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	injectTraceContext(ctx, req.Header)
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("OPA returned status %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, opaMaxBytes))
+	if err != nil {
+		return false, err
+	}
+	var result struct {
+		Result interface{} `json:"result"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return false, fmt.Errorf("invalid OPA response: %v", err)
+	}
+	allowed, _ := result.Result.(bool)
+	o.store(key, allowed)
+	return allowed, nil
+}
+
+// opaDecision returns the decision of the OPA server for the request.
+func (s *ExtAuthzServer) opaDecision(request *checkRequest) decision {
+	input := opaInput{Method: request.method, Host: request.host, Path: request.path, Headers: request.headers}
+	if request.sourceIP != nil {
+		input.SourceIP = request.sourceIP.String()
+	}
+	ctx, sp := startSpan(request.ctx, "opa")
+	c := startCallout(request.ctx, "opa")
+	allowed, err := s.opa.query(ctx, input)
+	c.done()
+	sp.finish(err)
+	if err != nil {
+		if s.opa.failOpen {
+			return decision{allowed: true, reason: "OPA failed, fail open: " + err.Error()}
+		}
+		return decision{reason: "OPA failed: " + err.Error()}
+	}
+	if allowed {
+		return decision{allowed: true, reason: "allowed by OPA"}
+	}
+	return decision{reason: "denied by OPA"}
+}
@@ -0,0 +1,201 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeOPA answers the data API with the status and body, and records the input documents.
+type fakeOPA struct {
+	status int
+	body   string
+	delay  time.Duration
+
+	mu     sync.Mutex
+	inputs []opaInput
+}
+
+func (f *fakeOPA) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	var document struct {
+		Input opaInput `json:"input"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&document); err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	f.inputs = append(f.inputs, document.Input)
+	f.mu.Unlock()
+	select {
+	case <-time.After(f.delay):
+	case <-request.Context().Done():
+		return
+	}
+	response.WriteHeader(f.status)
+	response.Write([]byte(f.body))
+}
+
+func (f *fakeOPA) calls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.inputs)
+}
+
+func newOPAServer(t *testing.T, fake *fakeOPA, configure func(c *Config)) (*ExtAuthzServer, func()) {
+	t.Helper()
+	opa := httptest.NewServer(fake)
+	c := DefaultConfig()
+	c.OPAURL = opa.URL
+	if configure != nil {
+		configure(&c)
+	}
+	s := newTestServer(t, c)
+	return s, func() {
+		s.close()
+		opa.Close()
+	}
+}
+
+func TestOPADecision(t *testing.T) {
+	cases := []struct {
+		name     string
+		status   int
+		body     string
+		failOpen bool
+		want     bool
+	}{
+		{name: "true", status: http.StatusOK, body: `{"result": true}`, want: true},
+		{name: "false", status: http.StatusOK, body: `{"result": false}`},
+		{name: "undefined", status: http.StatusOK, body: `{}`},
+		{name: "not a bool", status: http.StatusOK, body: `{"result": "true"}`},
+		{name: "invalid response", status: http.StatusOK, body: `not json`},
+		{name: "error status fails closed", status: http.StatusInternalServerError, body: `{"result": true}`},
+		{name: "error status fails open", status: http.StatusInternalServerError, failOpen: true, want: true},
+		{name: "undefined with fail open", status: http.StatusOK, body: `{}`, failOpen: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, done := newOPAServer(t, &fakeOPA{status: tc.status, body: tc.body}, func(c *Config) {
+				c.OPAFailOpen = tc.failOpen
+				c.OPACacheTTL = 0
+			})
+			defer done()
+			grpcOK, httpOK := checkBoth(t, s, testRequest{})
+			if grpcOK != tc.want || httpOK != tc.want {
+				t.Fatalf("got allowed gRPC %v and HTTP %v, want %v", grpcOK, httpOK, tc.want)
+			}
+		})
+	}
+}
+
+func TestOPAInput(t *testing.T) {
+	fake := &fakeOPA{status: http.StatusOK, body: `{"result": true}`}
+	s, done := newOPAServer(t, fake, func(c *Config) { c.OPACacheTTL = 0 })
+	defer done()
+	r := testRequest{method: "POST", host: "api.example.com", path: "/v1/orders?id=1",
+		headers: map[string]string{"X-Role": "admin"}, sourceIP: "10.1.2.3"}
+	checkGRPC(t, s, r)
+	checkHTTP(s, r)
+	if len(fake.inputs) != 2 {
+		t.Fatalf("got %d OPA calls, want 2", len(fake.inputs))
+	}
+	for i, protocol := range []string{"gRPC", "HTTP"} {
+		input := fake.inputs[i]
+		if input.Method != "POST" || input.Host != "api.example.com" || input.Path != "/v1/orders?id=1" ||
+			input.SourceIP != "10.1.2.3" || input.Headers["x-role"] != "admin" {
+			t.Errorf("%s: got input %+v", protocol, input)
+		}
+	}
+}
+
+func TestOPACache(t *testing.T) {
+	cases := []struct {
+		name      string
+		ttl       time.Duration
+		requests  []testRequest
+		wantCalls int
+	}{
+		{name: "same input is cached", ttl: time.Minute, requests: []testRequest{{path: "/a"}, {path: "/a"}}, wantCalls: 1},
+		{name: "other input is not", ttl: time.Minute, requests: []testRequest{{path: "/a"}, {path: "/b"}}, wantCalls: 2},
+		{name: "other header is not", ttl: time.Minute, requests: []testRequest{{path: "/a"},
+			{path: "/a", headers: map[string]string{"x-role": "admin"}}}, wantCalls: 2},
+		{name: "disabled", ttl: 0, requests: []testRequest{{path: "/a"}, {path: "/a"}}, wantCalls: 2},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := &fakeOPA{status: http.StatusOK, body: `{"result": true}`}
+			s, done := newOPAServer(t, fake, func(c *Config) { c.OPACacheTTL = tc.ttl })
+			defer done()
+			for _, r := range tc.requests {
+				if !grpcAllowed(checkGRPC(t, s, r)) {
+					t.Fatal("got denied, want allowed")
+				}
+			}
+			if got := fake.calls(); got != tc.wantCalls {
+				t.Fatalf("got %d OPA calls, want %d", got, tc.wantCalls)
+			}
+		})
+	}
+}
+
+func TestOPATimeout(t *testing.T) {
+	cases := []struct {
+		name     string
+		failOpen bool
+		want     bool
+	}{
+		{name: "fails closed"},
+		{name: "fails open", failOpen: true, want: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := &fakeOPA{status: http.StatusOK, body: `{"result": true}`, delay: 5 * time.Second}
+			s, done := newOPAServer(t, fake, func(c *Config) {
+				c.OPATimeout = 50 * time.Millisecond
+				c.OPAFailOpen = tc.failOpen
+			})
+			defer done()
+			start := time.Now()
+			if got := grpcAllowed(checkGRPC(t, s, testRequest{})); got != tc.want {
+				t.Fatalf("got allowed %v, want %v", got, tc.want)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Fatalf("got the check after %v, want it bounded by the timeout", elapsed)
+			}
+		})
+	}
+}
+
+func TestOPAHonorsCheckContext(t *testing.T) {
+	fake := &fakeOPA{status: http.StatusOK, body: `{"result": true}`, delay: 5 * time.Second}
+	s, done := newOPAServer(t, fake, func(c *Config) { c.OPATimeout = time.Minute })
+	defer done()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	response, err := s.Check(ctx, testRequest{}.grpc())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grpcAllowed(response) {
+		t.Fatal("got allowed, want denied once the check request is cancelled")
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// parsePathPrefix validates the -path-prefix, the trailing slash is dropped as Envoy prepends
+// the path_prefix to the original path that starts with a slash.
+func parsePathPrefix(prefix string) (string, error) {
+	if prefix == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(prefix, "/") || strings.ContainsAny(prefix, "?#") {
+		return "", fmt.Errorf("must be a path starting with / but got %q", prefix)
+	}
+	return strings.TrimSuffix(prefix, "/"), nil
+}
+
+// trimPathPrefix returns the path without the prefix, the prefix must match whole segments and
+// the prefix alone is the original path /.
+func trimPathPrefix(path, prefix string) (string, bool) {
+	if !strings.HasPrefix(path, prefix) {
+		return "", false
+	}
+	rest := path[len(prefix):]
+	if rest == "" {
+		return "/", true
+	}
+	if !strings.HasPrefix(rest, "/") {
+		return "", false
+	}
+	return rest, true
+}
+
+// stripPathPrefix returns the HTTP check request with the original path of the Envoy
+// path_prefix, ok is false if the request doesn't start with the prefix.
+func (s *ExtAuthzServer) stripPathPrefix(request *http.Request) (*http.Request, bool) {
+	path, ok := trimPathPrefix(request.URL.Path, s.pathPrefix)
+	if !ok {
+		return nil, false
+	}
+	stripped := request.Clone(request.Context())
+	stripped.URL.Path = path
+	stripped.URL.RawPath, _ = trimPathPrefix(request.URL.RawPath, s.pathPrefix)
+	return stripped, true
+}
@@ -0,0 +1,327 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/yangminzhu/playground/ext_authz/server/rules"
+
+	"golang.org/x/net/http/httpguts"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	actionAllow = "allow"
+	actionDeny  = "deny"
+)
+
+// policy is an ordered list of rules loaded from the policy file, the first matched rule wins.
+//
+// Example:
+//
+//	rules:
+//	- name: deny-admin
+//	  path_prefix: /admin
+//	  action: deny
+//	- name: allow-get
+//	  method: GET
+//	  host: httpbin.example.com
+//	  action: allow
+//	- name: allow-business-hours-writes
+//	  methods: [POST, PUT, DELETE]
+//	  time_window: Mon-Fri 09:00-17:00
+//	  timezone: Europe/Berlin
+//	  action: allow
+//	- name: deny-writes
+//	  methods: [POST, PUT, DELETE]
+//	  action: deny
+//	- name: deny-internal
+//	  host: "*.internal.example.com"
+//	  action: deny
+//	- name: allow-admin
+//	  cel: request.http.headers['x-role'] == 'admin'
+//	  action: allow
+//	- name: allow-read
+//	  methods: [GET, HEAD]
+//	  strip_headers: [x-user-id]
+//	  add_headers: {x-authz-rule: allow-read, x-authz-time: "%DECISION_TIME%"}
+//	  set_query: {authz: ok}
+//	  remove_query: [token]
+//	  header:
+//	    name: x-user
+//	    value: alice
+//	  action: allow
+//	- name: allow-admins-or-internal
+//	  priority: 10
+//	  any_of:
+//	  - all_of:
+//	    - path_prefix: /admin
+//	    - header: {name: x-role, value: admin}
+//	  - source_cidr: 10.0.0.0/8
+//	  action: allow
+//	- name: deny-grpc-admin
+//	  grpc_service: helloworld.Admin
+//	  action: deny
+//	- name: allow-say-hello
+//	  grpc_service: helloworld.Greeter
+//	  grpc_method: SayHello
+//	  action: allow
+//	scopes:
+//	- path_prefix: /admin/
+//	  scopes: [admin:write]
+//	policies:
+//	  public:
+//	    rules:
+//	    - path_prefix: /
+//	      action: allow
+//
+// The scopes are required from the JWT of the requests, see scopeRequirement.
+// The named policies are selected per route by the "policy" key of the Envoy context_extensions,
+// requests without it use the top-level rules.
+type policy struct {
+	Rules    []*rule             `yaml:"rules"`
+	Scopes   []*scopeRequirement `yaml:"scopes"`
+	Policies map[string]*policy  `yaml:"policies"`
+}
+
+// rule matches a request if all of its non-empty matchers match.
+type rule struct {
+	Name       string         `yaml:"name"`
+	PathPrefix string         `yaml:"path_prefix"`
+	Method     string         `yaml:"method"`
+	Methods    []string       `yaml:"methods"`
+	Host       string         `yaml:"host"`
+	Header     *headerMatcher `yaml:"header"`
+	// GRPCService and GRPCMethod match the /package.Service/Method path of gRPC requests.
+	GRPCService string `yaml:"grpc_service"`
+	GRPCMethod  string `yaml:"grpc_method"`
+	// CEL is an expression that must be true, see celExpression.
+	CEL string `yaml:"cel"`
+	// TimeWindow limits the rule to the time window in the timezone (UTC by default), see timeWindow.
+	TimeWindow string `yaml:"time_window"`
+	Timezone   string `yaml:"timezone"`
+	// AllOf, AnyOf and Not combine the conditions of the rules package.
+	AllOf []*rules.Condition `yaml:"all_of"`
+	AnyOf []*rules.Condition `yaml:"any_of"`
+	Not   *rules.Condition   `yaml:"not"`
+	// StripHeaders are removed from the upstream request if the rule allows it, only supported by gRPC.
+	StripHeaders []string `yaml:"strip_headers"`
+	// AddHeaders are added to the upstream request if the rule allows it, see headerTemplate.
+	AddHeaders map[string]string `yaml:"add_headers"`
+	// SetQuery and RemoveQuery mutate the query of the upstream request if the rule allows it, only
+	// supported by gRPC.
+	SetQuery    map[string]string `yaml:"set_query"`
+	RemoveQuery []string          `yaml:"remove_query"`
+	// Priority orders the rules, higher first, rules with the same priority keep the file order.
+	Priority int    `yaml:"priority"`
+	Action   string `yaml:"action"`
+
+	addHeaders []headerTemplate
+	setQuery   []queryRequirement
+	cel        *celExpression
+	window     *timeWindow
+	condition  rules.Matcher
+}
+
+type headerMatcher struct {
+	Name  string `yaml:"name"`
+	Value string `yaml:"value"`
+}
+
+func loadPolicy(file string) (*policy, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file: %v", err)
+	}
+	p := &policy{}
+	if err := yaml.UnmarshalStrict(data, p); err != nil {
+		return nil, fmt.Errorf("failed to parse policy file %s: %v", file, err)
+	}
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %v", file, err)
+	}
+	return p, nil
+}
+
+func (p *policy) validate() error {
+	for name, named := range p.Policies {
+		if named == nil {
+			return fmt.Errorf("policy %s: must have rules", name)
+		}
+		if len(named.Policies) != 0 {
+			return fmt.Errorf("policy %s: policies cannot be nested", name)
+		}
+		if err := named.validate(); err != nil {
+			return fmt.Errorf("policy %s: %v", name, err)
+		}
+	}
+	for _, r := range p.Scopes {
+		if err := r.validate(); err != nil {
+			return err
+		}
+	}
+	for i, r := range p.Rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule-%d", i)
+		}
+		if r.Action != actionAllow && r.Action != actionDeny {
+			return fmt.Errorf("rule %s: action must be %q or %q but got %q", r.Name, actionAllow, actionDeny, r.Action)
+		}
+		if r.Host != "" {
+			host, err := parseHostPattern(r.Host)
+			if err != nil {
+				return fmt.Errorf("rule %s: %v", r.Name, err)
+			}
+			r.Host = host
+		}
+		if r.Header != nil && !httpguts.ValidHeaderFieldName(r.Header.Name) {
+			return fmt.Errorf("rule %s: invalid header name %q", r.Name, r.Header.Name)
+		}
+		for i, name := range r.StripHeaders {
+			if !httpguts.ValidHeaderFieldName(name) {
+				return fmt.Errorf("rule %s: invalid strip header name %q", r.Name, name)
+			}
+			r.StripHeaders[i] = strings.ToLower(name)
+		}
+		addHeaders, err := headerTemplates(r.AddHeaders)
+		if err != nil {
+			return fmt.Errorf("rule %s: add_headers: %v", r.Name, err)
+		}
+		r.addHeaders = addHeaders
+		names := make([]string, 0, len(r.SetQuery))
+		for name := range r.SetQuery {
+			if name == "" {
+				return fmt.Errorf("rule %s: set_query name must not be empty", r.Name)
+			}
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		r.setQuery = nil
+		for _, name := range names {
+			r.setQuery = append(r.setQuery, queryRequirement{name: name, value: r.SetQuery[name]})
+		}
+		if r.CEL != "" {
+			expr, err := compileCEL(r.CEL)
+			if err != nil {
+				return fmt.Errorf("rule %s: %v", r.Name, err)
+			}
+			r.cel = expr
+		}
+		if r.TimeWindow != "" {
+			window, err := parseTimeWindow(r.TimeWindow, r.Timezone)
+			if err != nil {
+				return fmt.Errorf("rule %s: %v", r.Name, err)
+			}
+			r.window = window
+		} else if r.Timezone != "" {
+			return fmt.Errorf("rule %s: timezone requires time_window", r.Name)
+		}
+		if len(r.AllOf) != 0 || len(r.AnyOf) != 0 || r.Not != nil {
+			condition, err := (&rules.Condition{AllOf: r.AllOf, AnyOf: r.AnyOf, Not: r.Not}).Compile()
+			if err != nil {
+				return fmt.Errorf("rule %s: %v", r.Name, err)
+			}
+			r.condition = condition
+		}
+	}
+	sort.SliceStable(p.Rules, func(i, j int) bool {
+		return p.Rules[i].Priority > p.Rules[j].Priority
+	})
+	return nil
+}
+
+// selected returns the named policy, or the policy itself if the name is empty.
+func (p *policy) selected(name string) (*policy, bool) {
+	if name == "" {
+		return p, true
+	}
+	named, ok := p.Policies[name]
+	return named, ok
+}
+
+// match returns the first rule that matches the request at the time, or nil if none matches.
+// outside is the first rule skipped only because the time is outside of its time window, timed is
+// true if the result depends on the time window of a matching rule. The CEL evaluation errors are
+// logged to the logger.
+func (p *policy) match(request *checkRequest, now time.Time, logger Logger) (matched, outside *rule, timed bool) {
+	for _, r := range p.Rules {
+		if !r.matches(request, logger) {
+			continue
+		}
+		if r.window == nil {
+			return r, outside, timed
+		}
+		timed = true
+		if r.window.contains(now) {
+			return r, outside, timed
+		}
+		if outside == nil {
+			outside = r
+		}
+	}
+	return nil, outside, timed
+}
+
+func (r *rule) matches(request *checkRequest, logger Logger) bool {
+	if r.PathPrefix != "" && !strings.HasPrefix(request.path, r.PathPrefix) {
+		return false
+	}
+	if r.Method != "" && !strings.EqualFold(r.Method, request.method) {
+		return false
+	}
+	if len(r.Methods) != 0 && !containsFold(r.Methods, request.method) {
+		return false
+	}
+	if r.Host != "" && !hostMatches(r.Host, request.host) {
+		return false
+	}
+	if r.Header != nil && request.header(r.Header.Name) != r.Header.Value {
+		return false
+	}
+	if r.GRPCService != "" || r.GRPCMethod != "" {
+		service, method, ok := request.grpcMethod()
+		if !ok || (r.GRPCService != "" && r.GRPCService != service) || (r.GRPCMethod != "" && r.GRPCMethod != method) {
+			return false
+		}
+	}
+	if r.condition != nil && !r.condition.Match(request.rulesRequest()) {
+		return false
+	}
+	if r.cel != nil {
+		matched, err := r.cel.eval(request)
+		if err != nil {
+			// A rule that cannot be evaluated never matches, an allow rule must not allow by accident.
+			logger.Errorf("Failed to evaluate CEL of rule %s: %v", r.Name, err)
+			return r.Action == actionDeny
+		}
+		return matched
+	}
+	return true
+}
+
+// containsFold returns true if the list contains the value, compared case-insensitively.
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,294 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestFile writes the content to a new temporary file, the caller removes it.
+func writeTestFile(t testing.TB, content string) string {
+	t.Helper()
+	file, err := ioutil.TempFile("", "ext-authz-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
+// loadTestPolicy loads the policy of the YAML like the -policy-file.
+func loadTestPolicy(t testing.TB, text string) (*policy, error) {
+	t.Helper()
+	file := writeTestFile(t, text)
+	defer os.Remove(file)
+	return loadPolicy(file)
+}
+
+// policyRequest returns the check request evaluated by the policy.
+func policyRequest(method, host, path string, headers map[string]string) *checkRequest {
+	if headers == nil {
+		headers = map[string]string{}
+	}
+	r := &checkRequest{method: method, host: host, path: path, headers: headers}
+	r.parsePath()
+	return r
+}
+
+const orderedPolicy = `
+rules:
+- name: deny-admin
+  path_prefix: /admin
+  action: deny
+- name: allow-admin-header
+  path_prefix: /admin
+  header: {name: x-role, value: admin}
+  action: allow
+- name: allow-get
+  method: GET
+  action: allow
+- name: deny-all
+  action: deny
+`
+
+func TestPolicyFirstMatchWins(t *testing.T) {
+	p, err := loadTestPolicy(t, orderedPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name    string
+		request *checkRequest
+		want    string
+	}{
+		{name: "earlier deny shadows a later allow", request: policyRequest("GET", "example.com", "/admin/users",
+			map[string]string{"x-role": "admin"}), want: "deny-admin"},
+		{name: "path prefix", request: policyRequest("GET", "example.com", "/admin", nil), want: "deny-admin"},
+		{name: "method", request: policyRequest("GET", "example.com", "/api", nil), want: "allow-get"},
+		{name: "method is case-insensitive", request: policyRequest("get", "example.com", "/api", nil), want: "allow-get"},
+		{name: "catch-all", request: policyRequest("POST", "example.com", "/api", nil), want: "deny-all"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			matched, _, _ := p.match(tc.request, time.Now(), NewTextLogger(ioutil.Discard))
+			if matched == nil || matched.Name != tc.want {
+				t.Fatalf("got rule %v, want %s", matched, tc.want)
+			}
+		})
+	}
+}
+
+func TestPolicyPriority(t *testing.T) {
+	p, err := loadTestPolicy(t, `
+rules:
+- name: deny-admin
+  path_prefix: /admin
+  action: deny
+- name: allow-get
+  method: GET
+  action: allow
+- name: allow-admin
+  priority: 10
+  header: {name: x-role, value: admin}
+  action: allow
+- name: deny-delete
+  priority: 10
+  method: DELETE
+  action: deny
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range p.Rules {
+		got = append(got, r.Name)
+	}
+	// The higher priority comes first, the same priority keeps the file order.
+	if want := "allow-admin,deny-delete,deny-admin,allow-get"; strings.Join(got, ",") != want {
+		t.Fatalf("got order %v, want %s", got, want)
+	}
+}
+
+func TestPolicyNoMatch(t *testing.T) {
+	p, err := loadTestPolicy(t, "rules:\n- name: allow-get\n  method: GET\n  action: allow\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matched, _, _ := p.match(policyRequest("POST", "example.com", "/", nil), time.Now(), NewTextLogger(ioutil.Discard)); matched != nil {
+		t.Fatalf("got rule %s, want none", matched.Name)
+	}
+}
+
+func TestLoadPolicyErrors(t *testing.T) {
+	cases := []struct {
+		name    string
+		text    string
+		wantErr string
+	}{
+		{name: "invalid YAML", text: "rules: [", wantErr: "failed to parse policy file"},
+		{name: "unknown field", text: "rules:\n- name: a\n  pathprefix: /\n  action: allow\n", wantErr: "field pathprefix not found"},
+		{name: "missing action", text: "rules:\n- name: a\n", wantErr: `rule a: action must be "allow" or "deny" but got ""`},
+		{name: "invalid header name", text: "rules:\n- header: {name: x role, value: a}\n  action: allow\n", wantErr: `rule rule-0: invalid header name "x role"`},
+		{name: "invalid strip header", text: "rules:\n- name: a\n  strip_headers: [x user]\n  action: allow\n",
+			wantErr: `rule a: invalid strip header name "x user"`},
+		{name: "timezone without window", text: "rules:\n- timezone: UTC\n  action: allow\n", wantErr: "timezone requires time_window"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := loadTestPolicy(t, tc.text)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("got error %v, want error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestPolicyFileDecisions(t *testing.T) {
+	file := writeTestFile(t, orderedPolicy)
+	defer os.Remove(file)
+	cases := []struct {
+		name    string
+		request testRequest
+		want    bool
+		rule    string
+	}{
+		{name: "deny rule", request: testRequest{path: "/admin"}, rule: "deny-admin"},
+		{name: "allow rule", request: testRequest{path: "/api"}, want: true, rule: "allow-get"},
+		{name: "check header is not consulted", request: testRequest{method: "POST", headers: map[string]string{"x-ext-authz": "allow"}},
+			rule: "deny-all"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			c := DefaultConfig()
+			c.PolicyFile = file
+			c.Logger = NewTextLogger(&out)
+			s := newTestServer(t, c)
+			defer s.close()
+			out.Reset()
+			grpcOK, httpOK := checkBoth(t, s, tc.request)
+			if grpcOK != tc.want || httpOK != tc.want {
+				t.Fatalf("got allowed gRPC %v and HTTP %v, want %v", grpcOK, httpOK, tc.want)
+			}
+			// Both decision lines name the matched rule.
+			if got := strings.Count(out.String(), "rule="+tc.rule+"\n"); got != 2 {
+				t.Fatalf("got log %q, want rule=%s in both decisions", out.String(), tc.rule)
+			}
+		})
+	}
+}
+
+func TestPolicyConditions(t *testing.T) {
+	file := writeTestFile(t, `
+rules:
+- name: deny-all
+  action: deny
+- name: allow-admins-or-internal
+  priority: 10
+  any_of:
+  - all_of:
+    - path_prefix: /admin
+    - header: {name: x-role, value: admin}
+  - source_cidr: 10.0.0.0/8
+  action: allow
+- name: deny-internal-writes
+  priority: 20
+  method: POST
+  all_of:
+  - source_cidr: 10.0.0.0/8
+  - not: {path_prefix: /public}
+  action: deny
+`)
+	defer os.Remove(file)
+	cases := []struct {
+		name    string
+		request testRequest
+		want    bool
+	}{
+		{name: "admin with the role", request: testRequest{path: "/admin/users", headers: map[string]string{"x-role": "admin"},
+			sourceIP: "192.168.1.1"}, want: true},
+		{name: "admin without the role", request: testRequest{path: "/admin/users", sourceIP: "192.168.1.1"}},
+		{name: "internal read", request: testRequest{path: "/api", sourceIP: "10.1.2.3"}, want: true},
+		{name: "internal write is denied first", request: testRequest{method: "POST", path: "/api", sourceIP: "10.1.2.3"}},
+		{name: "internal public write", request: testRequest{method: "POST", path: "/public/form", sourceIP: "10.1.2.3"}, want: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.PolicyFile = file
+			s := newTestServer(t, c)
+			defer s.close()
+			grpcOK, httpOK := checkBoth(t, s, tc.request)
+			if grpcOK != tc.want || httpOK != tc.want {
+				t.Fatalf("got allowed gRPC %v and HTTP %v, want %v", grpcOK, httpOK, tc.want)
+			}
+		})
+	}
+}
+
+func TestExposeRuleHeader(t *testing.T) {
+	file := writeTestFile(t, orderedPolicy)
+	defer os.Remove(file)
+	cases := []struct {
+		name    string
+		policy  bool
+		expose  bool
+		request testRequest
+		rule    string
+	}{
+		{name: "allowed by a rule", policy: true, expose: true, request: testRequest{path: "/api"}, rule: "allow-get"},
+		{name: "denied by a rule", policy: true, expose: true, request: testRequest{path: "/admin"}, rule: "deny-admin"},
+		{name: "default decision", expose: true, request: testRequest{headers: map[string]string{"x-ext-authz": "allow"}},
+			rule: "default"},
+		{name: "not exposed", policy: true, request: testRequest{path: "/api"}, rule: "allow-get"},
+		{name: "not exposed when denied", policy: true, request: testRequest{path: "/admin"}, rule: "deny-admin"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			c := DefaultConfig()
+			if tc.policy {
+				c.PolicyFile = file
+			}
+			c.ExposeRuleHeader = tc.expose
+			c.Logger = NewTextLogger(&out)
+			s := newTestServer(t, c)
+			defer s.close()
+			out.Reset()
+			want := ""
+			if tc.expose {
+				want = tc.rule
+			}
+			if got := grpcHeader(checkGRPC(t, s, tc.request), ruleHeader); got != want {
+				t.Fatalf("got gRPC %s %q, want %q", ruleHeader, got, want)
+			}
+			if got := checkHTTP(s, tc.request).Header().Get(ruleHeader); got != want {
+				t.Fatalf("got HTTP %s %q, want %q", ruleHeader, got, want)
+			}
+			// The decision logs name the rule whether or not the header is exposed.
+			if got := strings.Count(out.String(), "rule="+tc.rule+"\n"); got != 2 {
+				t.Fatalf("got log %q, want rule=%s in both decisions", out.String(), tc.rule)
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// proxyHeaderTimeout bounds the time to receive the PROXY protocol header of a connection.
+	proxyHeaderTimeout = 5 * time.Second
+	// proxyV1MaxLen is the maximum length of a v1 header including the CRLF.
+	proxyV1MaxLen = 107
+)
+
+// proxyV2Signature starts the binary PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyListener reads the PROXY protocol v1 or v2 header of the accepted connections, the remote
+// address of the connection is the client address in the header. Connections without a valid
+// header are logged and closed. The headers are read concurrently so that a slow client doesn't
+// block the accept loop.
+type proxyListener struct {
+	net.Listener
+	logger Logger
+	conns  chan net.Conn
+	err    chan error
+	done   chan struct{}
+}
+
+func newProxyListener(listener net.Listener, logger Logger) *proxyListener {
+	l := &proxyListener{Listener: listener, logger: logger, conns: make(chan net.Conn), err: make(chan error, 1), done: make(chan struct{})}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *proxyListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			l.err <- err
+			return
+		}
+		go l.handshake(conn)
+	}
+}
+
+func (l *proxyListener) handshake(conn net.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	reader := bufio.NewReader(conn)
+	remote, err := readProxyHeader(reader)
+	if err != nil {
+		l.logger.Infof("Rejected connection from %s without a valid PROXY protocol header: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	if remote == nil {
+		// The LOCAL command and the UNKNOWN or unspecified protocol keep the connection address.
+		remote = conn.RemoteAddr()
+	}
+	select {
+	case l.conns <- &proxyConn{Conn: conn, reader: reader, remote: remote}:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// Accept returns the next connection with a valid PROXY protocol header.
+func (l *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.err:
+		// Keep the error for the following calls.
+		l.err <- err
+		return nil, err
+	}
+}
+
+func (l *proxyListener) Close() error {
+	select {
+	case <-l.done:
+	default:
+		close(l.done)
+	}
+	return l.Listener.Close()
+}
+
+// proxyConn is a connection whose header is consumed, the buffered bytes are read first.
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// readProxyHeader reads the v1 or v2 header and returns the client address, nil if the header
+// doesn't carry one.
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+	signature, err := reader.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(signature, proxyV2Signature) {
+		return readProxyV2(reader)
+	}
+	if bytes.HasPrefix(signature, []byte("PROXY ")) {
+		return readProxyV1(reader)
+	}
+	return nil, fmt.Errorf("missing PROXY protocol signature")
+}
+
+// readProxyV1 reads the text header, e.g. "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+func readProxyV1(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLen {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("v1 header is not terminated by CRLF within %d bytes", proxyV1MaxLen)
+	}
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("invalid v1 source address in %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads the binary header, only the TCP over IPv4 and IPv6 addresses are used.
+func readProxyV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if version := header[12] >> 4; version != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", version)
+	}
+	command := header[12] & 0x0f
+	if command > 1 {
+		return nil, fmt.Errorf("unsupported v2 command %d", command)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+	if command == 0 {
+		// LOCAL, e.g. a health check of the load balancer.
+		return nil, nil
+	}
+	switch header[13] {
+	case 0x11:
+		// TCP over IPv4: source and destination addresses (4 bytes each) and ports.
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("short v2 IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21:
+		// TCP over IPv6: source and destination addresses (16 bytes each) and ports.
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("short v2 IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default:
+		return nil, nil
+	}
+}
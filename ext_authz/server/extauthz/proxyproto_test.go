@@ -0,0 +1,237 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// proxyV2Header returns the v2 header of the command (0 for LOCAL, 1 for PROXY) with the TCP source
+// and destination addresses, the address family follows the source IP.
+func proxyV2Header(command byte, source, destination *net.TCPAddr) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	var addresses []byte
+	family := byte(0x11)
+	if ip := source.IP.To4(); ip != nil {
+		addresses = append(append(addresses, ip...), destination.IP.To4()...)
+	} else {
+		family = 0x21
+		addresses = append(append(addresses, source.IP.To16()...), destination.IP.To16()...)
+	}
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports[0:2], uint16(source.Port))
+	binary.BigEndian.PutUint16(ports[2:4], uint16(destination.Port))
+	addresses = append(addresses, ports...)
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(addresses)))
+	header = append(header, 0x20|command, family)
+	header = append(header, length...)
+	return append(header, addresses...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	v6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	destination4 := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}
+	destination6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+	cases := []struct {
+		name    string
+		header  string
+		want    string
+		wantErr string
+	}{
+		{name: "v1 TCP4", header: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", want: "192.0.2.1:56324"},
+		{name: "v1 TCP6", header: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", want: "[2001:db8::1]:56324"},
+		{name: "v1 UNKNOWN", header: "PROXY UNKNOWN\r\n"},
+		{name: "v2 IPv4", header: string(proxyV2Header(1, v4, destination4)), want: "192.0.2.1:56324"},
+		{name: "v2 IPv6", header: string(proxyV2Header(1, v6, destination6)), want: "[2001:db8::1]:56324"},
+		{name: "v2 LOCAL", header: string(proxyV2Header(0, v4, destination4))},
+		{name: "no header", header: "GET / HTTP/1.1\r\n\r\n", wantErr: "missing PROXY protocol signature"},
+		{name: "v1 without CRLF", header: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n",
+			wantErr: "not terminated by CRLF"},
+		{name: "v1 too long", header: "PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n", wantErr: "not terminated by CRLF"},
+		{name: "v1 missing fields", header: "PROXY TCP4 192.0.2.1 198.51.100.1\r\n", wantErr: "invalid v1 header"},
+		{name: "v1 UDP", header: "PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n", wantErr: "invalid v1 header"},
+		{name: "v1 invalid IP", header: "PROXY TCP4 192.0.2 198.51.100.1 56324 443\r\n", wantErr: "invalid v1 source address"},
+		{name: "v1 invalid port", header: "PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n", wantErr: "invalid v1 source address"},
+		{name: "v2 version 1", header: string(append(append([]byte{}, proxyV2Signature...), 0x11, 0x11, 0, 0)),
+			wantErr: "unsupported v2 version 1"},
+		{name: "v2 unknown command", header: string(proxyV2Header(2, v4, destination4)), wantErr: "unsupported v2 command 2"},
+		{name: "v2 short IPv4 block", header: string(append(append([]byte{}, proxyV2Signature...), 0x21, 0x11, 0, 4, 192, 0, 2, 1)),
+			wantErr: "short v2 IPv4 address block"},
+		{name: "v2 truncated", header: string(proxyV2Header(1, v4, destination4)[:20]), wantErr: "EOF"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// The bytes following the header are the payload of the connection.
+			reader := bufio.NewReader(strings.NewReader(tc.header + "payload"))
+			got, err := readProxyHeader(reader)
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Fatalf("got error %v, want valid", err)
+			case tc.wantErr != "":
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want error containing %q", err, tc.wantErr)
+				}
+				return
+			}
+			if (got == nil && tc.want != "") || (got != nil && got.String() != tc.want) {
+				t.Fatalf("got address %v, want %q", got, tc.want)
+			}
+			if rest, _ := ioutil.ReadAll(reader); string(rest) != "payload" {
+				t.Fatalf("got payload %q after the header, want %q", rest, "payload")
+			}
+		})
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	source := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	destination := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}
+	cases := []struct {
+		name       string
+		header     []byte
+		wantRemote string
+	}{
+		{name: "v1", header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"), wantRemote: "192.0.2.1:56324"},
+		{name: "v2", header: proxyV2Header(1, source, destination), wantRemote: "192.0.2.1:56324"},
+		// The LOCAL command keeps the address of the load balancer.
+		{name: "v2 LOCAL", header: proxyV2Header(0, source, destination), wantRemote: "127.0.0.1"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tcp, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			listener := newProxyListener(tcp, NewTextLogger(ioutil.Discard))
+			defer listener.Close()
+			client, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			if _, err := client.Write(append(tc.header, "payload"...)); err != nil {
+				t.Fatal(err)
+			}
+			conn, err := listener.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if got := conn.RemoteAddr().String(); !strings.HasPrefix(got, tc.wantRemote) {
+				t.Fatalf("got remote address %q, want %q", got, tc.wantRemote)
+			}
+			payload := make([]byte, len("payload"))
+			if _, err := conn.Read(payload); err != nil || string(payload) != "payload" {
+				t.Fatalf("got payload %q and error %v, want %q", payload, err, "payload")
+			}
+		})
+	}
+}
+
+// proxyHTTPStatus sends the HTTP check request on a connection that starts with the header, it
+// returns the error if the server closes the connection.
+func proxyHTTPStatus(s *ExtAuthzServer, header []byte) (int, error) {
+	conn, err := net.Dial("tcp", s.HTTPAddr().String())
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	request := "GET /check HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n"
+	if _, err := conn.Write(append(header, request...)); err != nil {
+		return 0, err
+	}
+	response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return 0, err
+	}
+	response.Body.Close()
+	return response.StatusCode, nil
+}
+
+func TestProxyProtocolListeners(t *testing.T) {
+	allowed := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	other := &net.TCPAddr{IP: net.ParseIP("203.0.113.1"), Port: 56324}
+	destination := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}
+	cases := []struct {
+		name       string
+		header     []byte
+		wantStatus int
+	}{
+		{name: "v1 allowed peer", header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"), wantStatus: http.StatusOK},
+		{name: "v2 allowed peer", header: proxyV2Header(1, allowed, destination), wantStatus: http.StatusOK},
+		{name: "v2 other peer", header: proxyV2Header(1, other, destination), wantStatus: http.StatusForbidden},
+		// The connection address 127.0.0.1 is not in the allowed CIDRs.
+		{name: "v2 LOCAL", header: proxyV2Header(0, allowed, destination), wantStatus: http.StatusForbidden},
+		{name: "no header is rejected"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			out := &syncBuffer{}
+			c := DefaultConfig()
+			c.ProxyProtocol = true
+			c.AllowedCIDRs = "192.0.2.0/24"
+			c.Logger = NewTextLogger(out)
+			s := startTLSServer(t, c)
+			defer s.Stop()
+
+			status, err := proxyHTTPStatus(s, tc.header)
+			if tc.wantStatus == 0 {
+				if err == nil {
+					t.Fatalf("got HTTP status %d, want the connection closed", status)
+				}
+			} else if err != nil || status != tc.wantStatus {
+				t.Fatalf("got HTTP status %d and error %v, want %d", status, err, tc.wantStatus)
+			}
+
+			dialer := grpc.WithContextDialer(func(ctx context.Context, address string) (net.Conn, error) {
+				conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", address)
+				if err != nil {
+					return nil, err
+				}
+				if _, err := conn.Write(tc.header); err != nil {
+					conn.Close()
+					return nil, err
+				}
+				return conn, nil
+			})
+			response, err := grpcCheck(s, testRequest{headers: map[string]string{"x-ext-authz": "allow"}}, grpc.WithInsecure(), dialer)
+			if tc.header == nil {
+				if err == nil {
+					t.Fatal("got gRPC check succeeded, want the connection closed")
+				}
+				if got := strings.Count(out.String(), "without a valid PROXY protocol header"); got < 2 {
+					t.Fatalf("got %d rejected connections in the log %q, want both listeners", got, out.String())
+				}
+				return
+			}
+			if err != nil || !grpcAllowed(response) {
+				t.Fatalf("got gRPC response %v and error %v, want allowed", response, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"fmt"
+	"strings"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+)
+
+// queryRequirement allows the request if the query parameter has the value.
+type queryRequirement struct {
+	name  string
+	value string
+}
+
+// parseQueryRequirements parses the comma-separated name=value pairs of the required-query flag.
+func parseQueryRequirements(value string) ([]queryRequirement, error) {
+	var requirements []queryRequirement
+	for _, pair := range parseList(value) {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid query requirement %q, expected name=value", pair)
+		}
+		requirements = append(requirements, queryRequirement{name: kv[0], value: kv[1]})
+	}
+	return requirements, nil
+}
+
+// queryAllowed returns the name of the matched query parameter, any of the repeated values can match.
+func (s *ExtAuthzServer) queryAllowed(request *checkRequest) (string, bool) {
+	for _, r := range s.requiredQuery {
+		for _, v := range request.query[r.name] {
+			if v == r.value {
+				return r.name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// queryMutations adds the query parameters to set and remove from the allowed upstream request,
+// the values of the rule take precedence over the flags. Only the gRPC check response of Envoy
+// 1.21 or later supports them, older versions ignore the fields.
+func (s *ExtAuthzServer) queryMutations(request *checkRequest, d *decision) {
+	seen := map[string]bool{}
+	var set []queryRequirement
+	for _, p := range append(d.querySet, s.setQuery...) {
+		if !seen[p.name] {
+			seen[p.name] = true
+			set = append(set, p)
+		}
+	}
+	var remove []string
+	for _, name := range append(d.queryRemove, s.removeQuery...) {
+		// A parameter that is set is never removed.
+		if !seen[name] {
+			seen[name] = true
+			remove = append(remove, name)
+		}
+	}
+	d.querySet, d.queryRemove = set, remove
+
+	var mutations []string
+	for _, p := range set {
+		if n := len(request.query[p.name]); n > 1 {
+			mutations = append(mutations, fmt.Sprintf("set query %s=%s replacing %d values", p.name, p.value, n))
+		} else {
+			mutations = append(mutations, "set query "+p.name+"="+p.value)
+		}
+	}
+	for _, name := range remove {
+		if n := len(request.query[name]); n > 0 {
+			mutations = append(mutations, fmt.Sprintf("removed query %s x%d", name, n))
+		}
+	}
+	if len(mutations) != 0 {
+		d.reason += ", " + strings.Join(mutations, ", ")
+	}
+}
+
+func queryParameters(params []queryRequirement) []*core.QueryParameter {
+	var result []*core.QueryParameter
+	for _, p := range params {
+		result = append(result, &core.QueryParameter{Key: p.name, Value: p.value})
+	}
+	return result
+}
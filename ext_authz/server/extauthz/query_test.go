@@ -0,0 +1,86 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const queryPolicy = `
+rules:
+- name: allow-items
+  path_prefix: /items
+  set_query: {tenant: a}
+  remove_query: [debug, authz]
+  action: allow
+`
+
+func TestQueryMutations(t *testing.T) {
+	file := writeTestFile(t, queryPolicy)
+	defer os.Remove(file)
+	cases := []struct {
+		name        string
+		policyFile  string
+		setQuery    string
+		removeQuery string
+		path        string
+		// wantSet are the name=value parameters to set, nil if the field is not set.
+		wantSet    []string
+		wantRemove []string
+		wantReason string
+	}{
+		{name: "empty config", path: "/items?token=a"},
+		{name: "repeated parameter removed", removeQuery: "token", path: "/items?token=a&token=b",
+			wantRemove: []string{"token"}, wantReason: "removed query token x2"},
+		{name: "set wins over remove", setQuery: "token=redacted", removeQuery: "token", path: "/items?token=a&token=b",
+			wantSet: []string{"token=redacted"}, wantReason: "set query token=redacted replacing 2 values"},
+		{name: "rule takes precedence over flags", policyFile: file, setQuery: "tenant=b,authz=ok", removeQuery: "debug,trace",
+			path: "/items?tenant=c&debug=1", wantSet: []string{"tenant=a", "authz=ok"}, wantRemove: []string{"debug", "trace"},
+			wantReason: "matched rule allow-items, set query tenant=a, set query authz=ok, removed query debug x1"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			c := DefaultConfig()
+			c.PolicyFile = tc.policyFile
+			c.SetQuery = tc.setQuery
+			c.RemoveQuery = tc.removeQuery
+			c.Logger = NewTextLogger(&out)
+			s := newTestServer(t, c)
+			defer s.close()
+			response := checkGRPC(t, s, testRequest{path: tc.path, headers: map[string]string{"x-ext-authz": "allow"}})
+			if !grpcAllowed(response) {
+				t.Fatalf("got response %v, want allowed", response)
+			}
+			var gotSet []string
+			for _, p := range response.GetOkResponse().GetQueryParametersToSet() {
+				gotSet = append(gotSet, p.GetKey()+"="+p.GetValue())
+			}
+			if !reflect.DeepEqual(gotSet, tc.wantSet) {
+				t.Fatalf("got query parameters to set %q, want %q", gotSet, tc.wantSet)
+			}
+			if got := response.GetOkResponse().GetQueryParametersToRemove(); !reflect.DeepEqual(got, tc.wantRemove) {
+				t.Fatalf("got query parameters to remove %q, want %q", got, tc.wantRemove)
+			}
+			if tc.wantReason != "" && !strings.Contains(out.String(), tc.wantReason) {
+				t.Fatalf("got log %q, want reason %q", out.String(), tc.wantReason)
+			}
+		})
+	}
+}
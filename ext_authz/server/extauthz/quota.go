@@ -0,0 +1,108 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+const quotaRemainingHeader = "x-quota-remaining"
+
+// quotaCounter counts the requests per API key and UTC day. The counters are keyed by the hash of
+// the API key and kept outside of the apiKeyStore so that reloading the keys file keeps them.
+type quotaCounter interface {
+	// increment returns the count of the key in the day including this request.
+	increment(ctx context.Context, key string, day time.Time) (int64, error)
+}
+
+// localQuotaCounter keeps the counters of the current day in memory.
+type localQuotaCounter struct {
+	mu     sync.Mutex
+	day    time.Time
+	counts map[string]int64
+}
+
+func (c *localQuotaCounter) increment(_ context.Context, key string, day time.Time) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.day.Equal(day) {
+		// The counters roll over at midnight UTC.
+		c.day, c.counts = day, map[string]int64{}
+	}
+	c.counts[key]++
+	return c.counts[key], nil
+}
+
+// redisQuotaCounter shares the counters between replicas, each counter expires an hour after its day.
+type redisQuotaCounter struct {
+	client  *redis.Client
+	timeout time.Duration
+}
+
+func (c *redisQuotaCounter) increment(ctx context.Context, key string, day time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	redisKey := redisKeyPrefix + "quota:" + day.Format("2006-01-02") + ":" + key
+	pipe := c.client.WithContext(ctx).TxPipeline()
+	count := pipe.Incr(redisKey)
+	pipe.ExpireAt(redisKey, day.Add(25*time.Hour))
+	if _, err := pipe.Exec(); err != nil {
+		return 0, err
+	}
+	return count.Val(), nil
+}
+
+// quotaDecision counts the request against the daily quota of the API key, ok is false if the
+// request does not exceed the quota and remaining is the quota left after this request.
+func (s *ExtAuthzServer) quotaDecision(request *checkRequest, key string, meta *apiKey) (d decision, remaining int64, ok bool) {
+	hash := sha256.Sum256([]byte(key))
+	now := s.now().UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	ctx := request.ctx
+	var sp *span
+	var c callout
+	if _, ok := s.quotas.(*redisQuotaCounter); ok {
+		ctx, sp = startSpan(ctx, "redis quota")
+		c = startCallout(ctx, "redis quota")
+	}
+	count, err := s.quotas.increment(ctx, hex.EncodeToString(hash[:]), day)
+	c.done()
+	sp.finish(err)
+	if err != nil {
+		if s.rateLimiterFailOpen {
+			s.logger.Warnf("quota counter failed for %s, fail open: %v", meta.Owner, err)
+			return decision{}, -1, false
+		}
+		return decision{reason: "quota counter failed: " + err.Error(), status: http.StatusServiceUnavailable,
+			detail: "quota-error"}, 0, true
+	}
+	if count > meta.DailyQuota {
+		return decision{
+			reason:  fmt.Sprintf("daily quota %d of %s is exhausted", meta.DailyQuota, meta.Owner),
+			status:  http.StatusTooManyRequests,
+			headers: map[string]string{quotaRemainingHeader: "0"},
+			detail:  "quota-exceeded",
+		}, 0, true
+	}
+	return decision{}, meta.DailyQuota - count, false
+}
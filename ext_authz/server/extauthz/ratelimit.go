@@ -0,0 +1,188 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	rateLimitKeySourceIP = "source-ip"
+	// rateLimitIdleTimeout is how long a key is kept without requests before its bucket is removed.
+	rateLimitIdleTimeout = 3 * time.Minute
+)
+
+// rateLimiter limits the rate of requests per key.
+type rateLimiter interface {
+	// allow returns true and the remaining requests that would be allowed right after if the request is
+	// allowed, otherwise retryAfter is the time until the next request with the same key could be allowed.
+	allow(ctx context.Context, key string) (allowed bool, remaining int, retryAfter time.Duration, err error)
+}
+
+// localRateLimiter keeps an in-memory token bucket per key, idle buckets are removed periodically.
+type localRateLimiter struct {
+	limit  rate.Limit
+	burst  int
+	logger Logger
+	// stop ends the removal of the idle buckets.
+	stop chan struct{}
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	// mu makes the reservation and the remaining tokens probe atomic.
+	mu       sync.Mutex
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newLocalRateLimiter(qps float64, burst int, logger Logger) *localRateLimiter {
+	return &localRateLimiter{limit: rate.Limit(qps), burst: burst, logger: logger, buckets: map[string]*bucket{},
+		stop: make(chan struct{})}
+}
+
+// start removes the idle buckets periodically.
+func (l *localRateLimiter) start() {
+	go l.removeIdlePeriodically()
+}
+
+// removeIdlePeriodically removes the idle buckets until the limiter is closed.
+func (l *localRateLimiter) removeIdlePeriodically() {
+	ticker := time.NewTicker(rateLimitIdleTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if removed, tracked := l.removeIdle(now); removed != 0 {
+				l.logger.Infof("Rate limiter is tracking %d keys, removed %d idle keys", tracked, removed)
+			}
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// close stops the removal of the idle buckets.
+func (l *localRateLimiter) close() {
+	close(l.stop)
+}
+
+func (l *localRateLimiter) allow(_ context.Context, key string) (bool, int, time.Duration, error) {
+	now := time.Now()
+	l.mu.Lock()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.buckets[key] = b
+	}
+	b.lastSeen = now
+	l.mu.Unlock()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r := b.limiter.ReserveN(now, 1)
+	if !r.OK() {
+		return false, 0, time.Second, nil
+	}
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		return false, 0, delay, nil
+	}
+	// The limiter doesn't expose its tokens, they are derived from the delay of a full burst that
+	// is cancelled right away.
+	probe := b.limiter.ReserveN(now, l.burst)
+	if !probe.OK() {
+		return true, 0, 0, nil
+	}
+	remaining := int(math.Floor(float64(l.burst) - probe.DelayFrom(now).Seconds()*float64(l.limit)))
+	probe.CancelAt(now)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return true, remaining, 0, nil
+}
+
+// tracked returns the number of keys with a bucket.
+func (l *localRateLimiter) tracked() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+func (l *localRateLimiter) removeIdle(now time.Time) (removed, tracked int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, b := range l.buckets {
+		if now.Sub(b.lastSeen) > rateLimitIdleTimeout {
+			delete(l.buckets, key)
+			removed++
+		}
+	}
+	return removed, len(l.buckets)
+}
+
+// rateLimitKey returns the key of the request used by the rate limiter. The requests without the
+// source IP or the header all share the bucket of the empty key, so they are limited together
+// instead of not at all.
+func (s *ExtAuthzServer) rateLimitKey(request *checkRequest) string {
+	if s.rateLimitKeyName == rateLimitKeySourceIP {
+		if request.sourceIP == nil {
+			return ""
+		}
+		return request.sourceIP.String()
+	}
+	return request.header(s.rateLimitKeyName)
+}
+
+// rateLimitDecision returns a denied decision if the request is rate limited, ok is false otherwise.
+func (s *ExtAuthzServer) rateLimitDecision(request *checkRequest) (decision, bool) {
+	key := s.rateLimitKey(request)
+	ctx := request.ctx
+	var sp *span
+	var c callout
+	if _, ok := s.rateLimiter.(*redisRateLimiter); ok {
+		ctx, sp = startSpan(ctx, "redis rate limit")
+		c = startCallout(ctx, "redis rate limit")
+	}
+	allowed, _, retryAfter, err := s.rateLimiter.allow(ctx, key)
+	c.done()
+	sp.finish(err)
+	if err != nil {
+		if s.rateLimiterFailOpen {
+			s.logger.Warnf("rate limiter failed for key %q, fail open: %v", key, err)
+			return decision{}, false
+		}
+		return decision{reason: "rate limiter failed: " + err.Error(), status: http.StatusServiceUnavailable,
+			detail: "rate-limiter-error"}, true
+	}
+	if allowed {
+		return decision{}, false
+	}
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	return decision{
+		reason:  fmt.Sprintf("rate limited %s %q, retry after %ds", s.rateLimitKeyName, key, seconds),
+		status:  http.StatusTooManyRequests,
+		headers: map[string]string{"retry-after": fmt.Sprint(seconds)},
+	}, true
+}
@@ -0,0 +1,89 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/golang/protobuf/proto"
+)
+
+const redacted = "REDACTED"
+
+// sensitiveHeaders are never logged with their values.
+var sensitiveHeaders = map[string]bool{
+	"authorization": true,
+	// cookie carries the session cookies.
+	"cookie": true,
+}
+
+// redactPath redacts the values of the required query parameters in the path for logging.
+func (s *ExtAuthzServer) redactPath(path string) string {
+	i := strings.Index(path, "?")
+	if len(s.requiredQuery) == 0 || i == -1 {
+		return path
+	}
+	params := strings.Split(path[i+1:], "&")
+	for j, param := range params {
+		name := strings.SplitN(param, "=", 2)[0]
+		if decoded, err := url.QueryUnescape(name); err == nil {
+			name = decoded
+		}
+		for _, r := range s.requiredQuery {
+			if r.name == name {
+				params[j] = name + "=" + redacted
+				break
+			}
+		}
+	}
+	return path[:i+1] + strings.Join(params, "&")
+}
+
+// redactAttributes returns the attributes for logging with the sensitive query values and headers redacted.
+func (s *ExtAuthzServer) redactAttributes(attrs *auth.AttributeContext) *auth.AttributeContext {
+	httpAttrs := attrs.GetRequest().GetHttp()
+	path := s.redactPath(httpAttrs.GetPath())
+	sensitive := false
+	for name := range httpAttrs.GetHeaders() {
+		sensitive = sensitive || sensitiveHeaders[strings.ToLower(name)]
+	}
+	if path == httpAttrs.GetPath() && !sensitive {
+		return attrs
+	}
+
+	attrs = proto.Clone(attrs).(*auth.AttributeContext)
+	attrs.Request.Http.Path = path
+	for name := range attrs.Request.Http.Headers {
+		if sensitiveHeaders[strings.ToLower(name)] {
+			attrs.Request.Http.Headers[name] = redacted
+		}
+	}
+	return attrs
+}
+
+// redactHeaders returns a copy of the HTTP headers for logging with the sensitive headers redacted.
+func redactHeaders(headers http.Header) http.Header {
+	redactedHeaders := make(http.Header, len(headers))
+	for name, values := range headers {
+		if sensitiveHeaders[strings.ToLower(name)] {
+			values = []string{redacted}
+		}
+		redactedHeaders[name] = values
+	}
+	return redactedHeaders
+}
@@ -0,0 +1,75 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// parseRedirectURL parses the -redirect-on-deny-url, it must be an absolute URL or a path.
+func parseRedirectURL(value string) (*url.URL, error) {
+	if value == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return nil, err
+	}
+	if !(u.IsAbs() && u.Host != "") && !strings.HasPrefix(u.Path, "/") {
+		return nil, fmt.Errorf("%q must be an absolute URL or a path", value)
+	}
+	return u, nil
+}
+
+// isBrowser returns true if the request accepts HTML.
+func isBrowser(request *checkRequest) bool {
+	return strings.Contains(strings.ToLower(request.header("accept")), "text/html")
+}
+
+// redirectLocation returns the login URL with the original path and query in the redirect_uri.
+// Only a path is echoed so that the redirect_uri never points to a client-supplied host.
+func (s *ExtAuthzServer) redirectLocation(request *checkRequest) string {
+	original := request.path
+	if !strings.HasPrefix(original, "/") || strings.HasPrefix(original, "//") || strings.HasPrefix(original, "/\\") {
+		original = "/"
+	}
+	u := *s.redirectOnDeny
+	query := u.Query()
+	query.Set("redirect_uri", original)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// redirected returns the redirect decision of an unauthenticated browser request, ok is false if
+// the request keeps the denied decision.
+func (s *ExtAuthzServer) redirected(request *checkRequest, d decision) (decision, bool) {
+	if s.redirectOnDeny == nil || d.allowed || !d.unauthenticated || !isBrowser(request) {
+		return d, false
+	}
+	headers := map[string]string{"location": s.redirectLocation(request)}
+	for k, v := range d.headers {
+		if k != challengeHeader {
+			headers[k] = v
+		}
+	}
+	d.headers = headers
+	d.status = http.StatusFound
+	d.body = ""
+	d.reason += ", redirected to " + s.redirectOnDeny.String()
+	return d, true
+}
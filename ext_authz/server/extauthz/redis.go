@@ -0,0 +1,86 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+const redisKeyPrefix = "ext-authz:"
+
+// fixedWindowScript increments the counter of the window and sets its expiry on the first request,
+// it returns the count and the remaining time of the window in milliseconds.
+var fixedWindowScript = redis.NewScript(`
+local count = redis.call("INCR", KEYS[1])
+if count == 1 then
+  redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return {count, redis.call("PTTL", KEYS[1])}
+`)
+
+func newRedisClient(addr string, timeout time.Duration) *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr:         addr,
+		DialTimeout:  timeout,
+		ReadTimeout:  timeout,
+		WriteTimeout: timeout,
+		// The commands are bounded by the check deadline, retries would exceed it.
+		MaxRetries: 0,
+	})
+}
+
+// redisRateLimiter counts the requests per key in fixed windows shared by all replicas. The window
+// of burst/qps seconds allows burst requests, so that the average rate is qps.
+type redisRateLimiter struct {
+	client  *redis.Client
+	window  time.Duration
+	limit   int64
+	timeout time.Duration
+}
+
+func newRedisRateLimiter(client *redis.Client, qps float64, burst int, timeout time.Duration) *redisRateLimiter {
+	window := time.Duration(float64(burst) / qps * float64(time.Second))
+	if window < time.Millisecond {
+		window = time.Millisecond
+	}
+	return &redisRateLimiter{client: client, window: window, limit: int64(burst), timeout: timeout}
+}
+
+func (l *redisRateLimiter) allow(ctx context.Context, key string) (bool, int, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, l.timeout)
+	defer cancel()
+	result, err := fixedWindowScript.Run(l.client.WithContext(ctx), []string{redisKeyPrefix + "rl:" + key},
+		l.window.Milliseconds()).Result()
+	if err != nil {
+		return false, 0, 0, err
+	}
+	values, ok := result.([]interface{})
+	if !ok || len(values) != 2 {
+		return false, 0, 0, fmt.Errorf("unexpected script result %v", result)
+	}
+	count, _ := values[0].(int64)
+	ttl, _ := values[1].(int64)
+	if count <= l.limit {
+		return true, int(l.limit - count), 0, nil
+	}
+	if ttl < 0 {
+		ttl = l.window.Milliseconds()
+	}
+	return false, 0, time.Duration(ttl) * time.Millisecond, nil
+}
@@ -0,0 +1,176 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func newTestRedis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mr
+}
+
+func TestRedisRateLimiter(t *testing.T) {
+	mr := newTestRedis(t)
+	defer mr.Close()
+	client := newRedisClient(mr.Addr(), time.Second)
+	defer client.Close()
+	// The window of 2 requests at 1 qps is 2 seconds.
+	l := newRedisRateLimiter(client, 1, 2, time.Second)
+	steps := []struct {
+		name          string
+		forward       time.Duration
+		key           string
+		want          bool
+		wantRemaining int
+	}{
+		{name: "first request", key: "a", want: true, wantRemaining: 1},
+		{name: "burst", key: "a", want: true},
+		{name: "over the limit", key: "a"},
+		{name: "other key", key: "b", want: true, wantRemaining: 1},
+		{name: "within the window", forward: time.Second, key: "a"},
+		{name: "next window", forward: time.Second, key: "a", want: true, wantRemaining: 1},
+	}
+	for _, step := range steps {
+		mr.FastForward(step.forward)
+		allowed, remaining, retryAfter, err := l.allow(context.Background(), step.key)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if allowed != step.want || remaining != step.wantRemaining {
+			t.Fatalf("%s: got allowed %v with %d remaining, want %v with %d", step.name, allowed, remaining,
+				step.want, step.wantRemaining)
+		}
+		if !allowed && (retryAfter <= 0 || retryAfter > 2*time.Second) {
+			t.Fatalf("%s: got retry after %v, want the rest of the window", step.name, retryAfter)
+		}
+	}
+	if !mr.Exists(redisKeyPrefix + "rl:a") {
+		t.Fatalf("got keys %v, want the counter of a", mr.Keys())
+	}
+}
+
+func TestRedisRateLimitSharedByReplicas(t *testing.T) {
+	mr := newTestRedis(t)
+	defer mr.Close()
+	c := DefaultConfig()
+	c.DefaultAction = actionAllow
+	c.RedisAddr = mr.Addr()
+	c.RateLimitQPS = 1
+	c.RateLimitBurst = 3
+	replicas := []*ExtAuthzServer{newTestServer(t, c), newTestServer(t, c)}
+	for _, s := range replicas {
+		defer s.close()
+	}
+	r := testRequest{sourceIP: "10.0.0.1"}
+	// The replicas and the gRPC and HTTP check requests all count against the same window.
+	steps := []struct {
+		replica int
+		http    bool
+		want    bool
+	}{
+		{replica: 0, want: true},
+		{replica: 1, http: true, want: true},
+		{replica: 1, want: true},
+		{replica: 0, http: true},
+		{replica: 1},
+	}
+	for i, step := range steps {
+		s := replicas[step.replica]
+		var got bool
+		if step.http {
+			response := checkHTTP(s, r)
+			got = response.Code == http.StatusOK
+			if !got && (response.Code != http.StatusTooManyRequests || response.Header().Get("retry-after") == "") {
+				t.Fatalf("request %d: got status %d with headers %v, want 429 with retry-after", i, response.Code, response.Header())
+			}
+		} else {
+			got = grpcAllowed(checkGRPC(t, s, r))
+		}
+		if got != step.want {
+			t.Fatalf("request %d to replica %d: got allowed %v, want %v", i, step.replica, got, step.want)
+		}
+	}
+	if got := checkHTTP(replicas[0], testRequest{sourceIP: "10.0.0.2"}).Code; got != http.StatusOK {
+		t.Fatalf("got status %d for another source IP, want 200", got)
+	}
+}
+
+func TestRedisUnavailable(t *testing.T) {
+	cases := []struct {
+		name     string
+		failOpen bool
+		want     int
+	}{
+		{name: "fails open", failOpen: true, want: http.StatusOK},
+		{name: "fails closed", want: http.StatusServiceUnavailable},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mr := newTestRedis(t)
+			c := DefaultConfig()
+			c.DefaultAction = actionAllow
+			c.RedisAddr = mr.Addr()
+			c.RedisTimeout = 50 * time.Millisecond
+			c.RateLimitQPS = 1
+			c.LimiterFailOpen = tc.failOpen
+			s := newTestServer(t, c)
+			defer s.close()
+			mr.Close()
+			start := time.Now()
+			if got := checkHTTP(s, testRequest{sourceIP: "10.0.0.1"}).Code; got != tc.want {
+				t.Fatalf("got status %d, want %d", got, tc.want)
+			}
+			if got := grpcAllowed(checkGRPC(t, s, testRequest{sourceIP: "10.0.0.1"})); got != tc.failOpen {
+				t.Fatalf("got allowed gRPC %v, want %v", got, tc.failOpen)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Fatalf("got the checks after %v, want them bounded by the Redis timeout", elapsed)
+			}
+		})
+	}
+}
+
+func TestRedisClientCreatedByOpen(t *testing.T) {
+	c := DefaultConfig()
+	c.RedisAddr = "127.0.0.1:6379"
+	c.RateLimitQPS = 1
+	c.EnableRateLimitService = true
+	s, err := newServer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	// The client starts a goroutine, ValidateConfig only calls newServer.
+	if s.redis != nil || s.rateLimiter.(*redisRateLimiter).client != nil || s.rateLimitService.redis != nil {
+		t.Fatal("got the Redis client created before open")
+	}
+	if err := s.open(false); err != nil {
+		t.Fatal(err)
+	}
+	if s.redis == nil || s.rateLimiter.(*redisRateLimiter).client != s.redis || s.rateLimitService.redis != s.redis {
+		t.Fatal("got the Redis client not shared by the Redis backed stores after open")
+	}
+}
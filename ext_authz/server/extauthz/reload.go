@@ -0,0 +1,184 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadDelay batches the file events of an update, e.g. the symlink swap of a ConfigMap.
+const reloadDelay = 100 * time.Millisecond
+
+// reloadedFiles are the policy, API keys and htpasswd files, they are swapped as a whole on reload
+// and a check request uses the files loaded when it started.
+type reloadedFiles struct {
+	// generation is 1 for the files loaded at startup and incremented by each successful reload.
+	generation int
+	policy     *policy
+	apiKeys    *apiKeyStore
+	htpasswd   *htpasswd
+}
+
+// fileReloader re-reads the -policy-file, -api-keys-file and -htpasswd-file on SIGHUP or when they
+// change if watch is set. A failed reload keeps the previous files.
+type fileReloader struct {
+	policyFile   string
+	apiKeysFile  string
+	htpasswdFile string
+	logger       Logger
+
+	// current holds the *reloadedFiles.
+	current atomic.Value
+	// mu serializes the reloads.
+	mu sync.Mutex
+	// stop ends the watch of the files, nil if not watched.
+	stop chan struct{}
+}
+
+// close stops the watch of the files, it does nothing if not watched.
+func (r *fileReloader) close() {
+	if r.stop != nil {
+		close(r.stop)
+	}
+}
+
+// paths returns the configured files.
+func (r *fileReloader) paths() []string {
+	var paths []string
+	for _, path := range []string{r.policyFile, r.apiKeysFile, r.htpasswdFile} {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// load reads and validates all configured files.
+func (r *fileReloader) load(generation int) (*reloadedFiles, error) {
+	files := &reloadedFiles{generation: generation}
+	var err error
+	if r.policyFile != "" {
+		if files.policy, err = loadPolicy(r.policyFile); err != nil {
+			return nil, err
+		}
+	}
+	if r.apiKeysFile != "" {
+		if files.apiKeys, err = loadAPIKeys(r.apiKeysFile); err != nil {
+			return nil, err
+		}
+	}
+	if r.htpasswdFile != "" {
+		if files.htpasswd, err = newHtpasswd(r.htpasswdFile, r.logger); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+func (r *fileReloader) files() *reloadedFiles {
+	return r.current.Load().(*reloadedFiles)
+}
+
+// reload swaps in the files if they are all valid.
+func (r *fileReloader) reload() (*reloadedFiles, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	files, err := r.load(r.files().generation + 1)
+	if err != nil {
+		return nil, err
+	}
+	r.current.Store(files)
+	return files, nil
+}
+
+// reloadFiles reloads the files and clears the decisions cached with the previous files.
+func (s *ExtAuthzServer) reloadFiles(cause string) {
+	files, err := s.files.reload()
+	if err != nil {
+		s.logger.Errorf("Failed to reload the configuration files on %s, keeping generation %d: %v", cause, s.files.files().generation, err)
+		return
+	}
+	if s.decisionCache != nil {
+		s.decisionCache.clear()
+	}
+	s.logger.Infof("Reloaded the configuration files %v on %s, generation %d", s.files.paths(), cause, files.generation)
+}
+
+// watchFiles reloads the files on SIGHUP, and also when their directory changes if watch is set.
+// The directories are watched instead of the files to follow the files replaced by a rename.
+func (s *ExtAuthzServer) watchFiles(watch bool) error {
+	var watcher *fsnotify.Watcher
+	var events chan fsnotify.Event
+	var errs chan error
+	watched := map[string]bool{}
+	if watch {
+		var err error
+		if watcher, err = fsnotify.NewWatcher(); err != nil {
+			return fmt.Errorf("failed to watch the configuration files: %v", err)
+		}
+		dirs := map[string]bool{}
+		for _, path := range s.files.paths() {
+			path = filepath.Clean(path)
+			watched[path] = true
+			dirs[filepath.Dir(path)] = true
+		}
+		for dir := range dirs {
+			if err := watcher.Add(dir); err != nil {
+				watcher.Close()
+				return fmt.Errorf("failed to watch the configuration files in %s: %v", dir, err)
+			}
+		}
+		events, errs = watcher.Events, watcher.Errors
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	stop := make(chan struct{})
+	s.files.stop = stop
+	go func() {
+		defer signal.Stop(signals)
+		if watcher != nil {
+			defer watcher.Close()
+		}
+		var changed <-chan time.Time
+		for {
+			select {
+			case <-stop:
+				return
+			case <-signals:
+				s.reloadFiles("SIGHUP")
+			case event := <-events:
+				// Kubernetes swaps the ..data symlink of a ConfigMap volume.
+				if watched[filepath.Clean(event.Name)] || filepath.Base(event.Name) == "..data" {
+					changed = time.After(reloadDelay)
+				}
+			case err := <-errs:
+				s.logger.Warnf("failed to watch the configuration files: %v", err)
+			case <-changed:
+				changed = nil
+				s.reloadFiles("file change")
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,544 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/yangminzhu/playground/ext_authz/server/rules"
+)
+
+const (
+	// policyExtension is the context_extensions key that selects a named policy.
+	policyExtension = "policy"
+	policyHeader    = "x-ext-authz-policy"
+	ruleHeader      = "x-ext-authz-rule"
+)
+
+// checkRequest is the protocol independent view of a check request, shared by the gRPC and HTTP handlers.
+type checkRequest struct {
+	// ctx is cancelled when the check request is cancelled or its deadline is exceeded.
+	ctx    context.Context
+	method string
+	host   string
+	// path is the original request path including the query string.
+	path string
+	// urlPath is the path without the query string.
+	urlPath string
+	query   url.Values
+	// queryErr is set if the query string cannot be parsed.
+	queryErr error
+	// headers is keyed by the lowercase header name.
+	headers map[string]string
+	// sourceIP is the evaluated peer IP, nil if it cannot be parsed.
+	sourceIP net.IP
+	// body is only read if the body rules are enabled.
+	body          []byte
+	bodyTruncated bool
+	// policyName selects a named policy of the policy file, set from the Envoy context_extensions.
+	policyName string
+	// outsideWindow is the policy rule skipped because the request is outside of its time window.
+	outsideWindow *rule
+	// timed is true if the decision depends on the time window of a policy rule.
+	timed bool
+	// expires is when the decision of a time-dependent credential changes, e.g. at the exp claim
+	// of the token, zero if it never does. It caps the lifetime of the cached decision.
+	expires time.Time
+	// files are the reloaded files used by the whole decision.
+	files *reloadedFiles
+	// attributes are the Envoy attributes of the gRPC check request for the audit log, nil for the
+	// other protocols.
+	attributes *auth.AttributeContext
+}
+
+// rulesRequest returns the request matched by the conditions of the rules package.
+func (r *checkRequest) rulesRequest() *rules.Request {
+	return &rules.Request{Method: r.method, Path: r.path, Headers: r.headers, SourceIP: r.sourceIP}
+}
+
+// header returns the value of the given header, the name is case-insensitive.
+func (r *checkRequest) header(name string) string {
+	return r.headers[strings.ToLower(name)]
+}
+
+// expireAt caps the lifetime of the cached decision at the time of time.Now, the earliest is kept.
+func (r *checkRequest) expireAt(t time.Time) {
+	if r.expires.IsZero() || t.Before(r.expires) {
+		r.expires = t
+	}
+}
+
+// expireDecisionAt caps the lifetime of the cached decision at the deadline of the decision clock,
+// which is converted to time.Now used by the cache.
+func (s *ExtAuthzServer) expireDecisionAt(request *checkRequest, deadline time.Time) {
+	request.expireAt(time.Now().Add(deadline.Sub(s.now())))
+}
+
+func (s *ExtAuthzServer) newGRPCCheckRequest(ctx context.Context, request *auth.CheckRequest) *checkRequest {
+	httpAttrs := request.GetAttributes().GetRequest().GetHttp()
+	headers := make(map[string]string, len(httpAttrs.GetHeaders()))
+	for k, v := range httpAttrs.GetHeaders() {
+		headers[strings.ToLower(k)] = v
+	}
+	r := &checkRequest{
+		ctx:      ctx,
+		method:   httpAttrs.GetMethod(),
+		host:     httpAttrs.GetHost(),
+		path:     httpAttrs.GetPath(),
+		headers:  headers,
+		sourceIP: parseIP(request.GetAttributes().GetSource().GetAddress().GetSocketAddress().GetAddress()),
+		// The key is set per route in the Envoy ext_authz filter config.
+		policyName: request.GetAttributes().GetContextExtensions()[policyExtension],
+		attributes: request.GetAttributes(),
+	}
+	if s.bodyRulesEnabled() {
+		r.body, r.bodyTruncated = s.grpcBody(httpAttrs)
+	}
+	r.parsePath()
+	return r
+}
+
+// parsePath sets the urlPath and query of the path that includes the query string.
+func (r *checkRequest) parsePath() {
+	parts := strings.SplitN(r.path, "?", 2)
+	r.urlPath = parts[0]
+	if len(parts) == 2 {
+		if r.query, r.queryErr = url.ParseQuery(parts[1]); r.queryErr != nil {
+			r.query = nil
+		}
+	}
+}
+
+func (s *ExtAuthzServer) newHTTPCheckRequest(request *http.Request) *checkRequest {
+	headers := make(map[string]string, len(request.Header))
+	for k, v := range request.Header {
+		// Envoy also joins multiple values of the same header with comma in the gRPC check request.
+		headers[strings.ToLower(k)] = strings.Join(v, ",")
+	}
+	r := &checkRequest{
+		ctx:      request.Context(),
+		method:   request.Method,
+		host:     request.Host,
+		path:     request.URL.RequestURI(),
+		urlPath:  request.URL.Path,
+		query:    request.URL.Query(),
+		headers:  headers,
+		sourceIP: httpPeerIP(request, s.xffTrustedHops),
+	}
+	if s.bodyRulesEnabled() {
+		r.body, r.bodyTruncated = s.httpBody(request)
+	}
+	return r
+}
+
+// decision is the result of evaluating a check request.
+type decision struct {
+	allowed bool
+	// bypass is true if the request is allowed by the bypass paths.
+	bypass bool
+	// sampled is true if the denied request is allowed by the sampler.
+	sampled bool
+	// reason explains the decision and is included in the decision log.
+	reason string
+	// headers are added to the upstream request if allowed, or to the denied response otherwise.
+	headers map[string]string
+	// status is the HTTP status of the denied response, 403 is used if not set.
+	status int
+	// body is the body of the denied response.
+	body string
+	// headersToRemove are removed from the upstream request if allowed, only supported by gRPC.
+	headersToRemove []string
+	// addHeaders are the headers of the matched rule added to the upstream request if allowed.
+	addHeaders []headerTemplate
+	// querySet and queryRemove are the query parameters mutated in the upstream request if allowed,
+	// only supported by gRPC.
+	querySet    []queryRequirement
+	queryRemove []string
+	// unauthenticated is true if the request is denied for missing or invalid credentials.
+	unauthenticated bool
+	// detail is the short machine-readable reason, e.g. missing-header or rule:deny-admin.
+	detail string
+	// rule is the name of the matched policy rule and principal is the authenticated identity, both
+	// are emitted in the dynamic metadata.
+	rule      string
+	principal string
+	// overwrite are the headers that always replace the values of the upstream request, even if
+	// they are in the -append-headers.
+	overwrite map[string]bool
+}
+
+// withDetail sets the detail if the decision has none yet.
+func (d decision) withDetail(detail string) decision {
+	if d.detail == "" {
+		d.detail = detail
+	}
+	return d
+}
+
+// resultDetail returns the detail of the decision, or the result if it has none.
+func (d decision) resultDetail() string {
+	if d.sampled {
+		return "sampled"
+	}
+	if d.detail != "" {
+		return d.detail
+	}
+	return d.result()
+}
+
+func (d decision) deniedStatus() int {
+	if d.status != 0 {
+		return d.status
+	}
+	return http.StatusForbidden
+}
+
+// headerNames returns the names of the decision headers in a stable order.
+func (d decision) headerNames() []string {
+	names := make([]string, 0, len(d.headers))
+	for name := range d.headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ruleName returns the name of the matched policy rule, or "default" if no rule matched.
+func (d decision) ruleName() string {
+	if d.rule != "" {
+		return d.rule
+	}
+	return "default"
+}
+
+// tag returns the decision tag used in the log.
+func (d decision) tag() string {
+	switch {
+	case d.bypass:
+		return "bypass"
+	case d.sampled:
+		return "sampled"
+	case d.allowed:
+		return "allowed"
+	default:
+		return " denied"
+	}
+}
+
+// result returns the value of the result header.
+func (d decision) result() string {
+	switch {
+	case d.sampled:
+		return "allowed-by-sampling"
+	case d.allowed:
+		return "allowed"
+	default:
+		return "denied"
+	}
+}
+
+// decide evaluates the check request and annotates the decision for logging.
+func (s *ExtAuthzServer) decide(request *checkRequest) decision {
+	var sp *span
+	request.ctx, sp = s.tracer.startCheckSpan(request.ctx, request.header)
+	request.files = s.files.files()
+	d := s.cachedEvaluate(request)
+	// The nonce is only used up once the credentials are checked.
+	if d.allowed && s.nonces != nil {
+		if replay, denied := s.replayDecision(request); denied {
+			d = replay.withDetail("bad-nonce")
+		}
+	}
+	// The maintenance mode denies all requests regardless of the sampling.
+	if !d.allowed && s.sampler != nil && !s.inMaintenance() && s.sampler.sample() {
+		// The headers of the denied response must not be added to the upstream request.
+		d = decision{allowed: true, sampled: true, rule: d.rule,
+			reason: fmt.Sprintf("allowed by sampling %v%% instead of: %s", s.sampler.percentage, d.reason)}
+	}
+	if !d.allowed && request.outsideWindow != nil {
+		d.reason += fmt.Sprintf(", outside time window %s of rule %s", request.outsideWindow.window.text, request.outsideWindow.Name)
+	}
+	if d.allowed {
+		if s.stripHeaders {
+			if present := presentHeaders(request, s.forbiddenHeaders); len(present) != 0 {
+				d.headersToRemove = append(d.headersToRemove, present...)
+				d.reason += ", removed headers " + strings.Join(present, ",")
+			}
+		}
+		s.injectHeaders(request, &d)
+		d.headersToRemove = headersToRemove(append(d.headersToRemove, s.stripRequestHeaders...), d.headers)
+		s.queryMutations(request, &d)
+	}
+	if request.policyName != "" {
+		d.reason += ", policy " + request.policyName
+		if d.allowed {
+			if d.headers == nil {
+				d.headers = map[string]string{}
+			}
+			d.headers[policyHeader] = request.policyName
+		}
+	}
+	if len(s.allowedCIDRs) != 0 {
+		d.reason += fmt.Sprintf(", peer IP %v", request.sourceIP)
+	}
+	if len(s.files.paths()) != 0 {
+		d.reason += fmt.Sprintf(", config generation %d", request.files.generation)
+	}
+	if s.exposeRuleHeader {
+		headers := map[string]string{ruleHeader: d.ruleName()}
+		for k, v := range d.headers {
+			headers[k] = v
+		}
+		d.headers = headers
+	}
+	if s.echoRequestInfo {
+		s.echoReceived(request, &d)
+	}
+	if sp != nil {
+		sp.set("http.request.method", request.method)
+		sp.set("server.address", request.host)
+		sp.set("url.path", s.redactPath(request.urlPath))
+		sp.set("ext_authz.decision", d.result())
+		sp.set("ext_authz.reason", d.resultDetail())
+		sp.set("ext_authz.rule", d.ruleName())
+		sp.finish(nil)
+	}
+	return d
+}
+
+// evaluate evaluates the check request against the policy, falling back to the check header.
+func (s *ExtAuthzServer) evaluate(request *checkRequest) decision {
+	if prefix, ok := s.bypassed(request.urlPath); ok {
+		return decision{allowed: true, bypass: true, reason: "bypass path " + prefix, detail: "bypass"}
+	}
+	if s.inMaintenance() {
+		return s.maintenanceDecision().withDetail("maintenance")
+	}
+	if d, ok := s.forcedDecision(); ok {
+		return d
+	}
+	if s.detectPathTraversal {
+		// The raw path is checked as the HTTP urlPath is already decoded.
+		if reason, found := pathTraversal(request.path); found {
+			return decision{reason: reason, status: http.StatusBadRequest, detail: "path-traversal"}
+		}
+	}
+	if s.sizeLimits.enabled() {
+		if d, denied := s.sizeDecision(request); denied {
+			return d.withDetail("too-large")
+		}
+	}
+	if s.rateLimiter != nil {
+		if d, limited := s.rateLimitDecision(request); limited {
+			return d.withDetail("rate-limited")
+		}
+	}
+	if s.nonces != nil {
+		if d, denied := s.nonceDecision(request); denied {
+			return d.withDetail("bad-nonce")
+		}
+	}
+	for _, pattern := range s.deniedHosts {
+		if hostMatches(pattern, request.host) {
+			return decision{reason: "denied host " + pattern, detail: "denied-host"}
+		}
+	}
+	if !s.stripHeaders {
+		if present := presentHeaders(request, s.forbiddenHeaders); len(present) != 0 {
+			return decision{reason: "forbidden header " + strings.Join(present, ","), detail: "forbidden-header"}
+		}
+	}
+	if len(s.allowedContentTypes) != 0 || s.requireContentType {
+		if d, denied := s.contentTypeDecision(request); denied {
+			return d.withDetail("bad-content-type")
+		}
+	}
+	if s.bodyRulesEnabled() {
+		if d, denied := s.bodyDecision(request); denied {
+			return d.withDetail("bad-body")
+		}
+	}
+	if request.policyName != "" && request.files.policy == nil {
+		s.logger.Infof("Unknown policy %q in context extensions, no policy file is loaded", request.policyName)
+		return decision{reason: "unknown policy " + request.policyName, detail: "unknown-policy"}
+	}
+	if request.files.policy != nil {
+		p, ok := request.files.policy.selected(request.policyName)
+		if !ok {
+			s.logger.Infof("Unknown policy %q in context extensions", request.policyName)
+			return decision{reason: "unknown policy " + request.policyName, detail: "unknown-policy"}
+		}
+		rule, outside, timed := p.match(request, s.now(), s.logger)
+		request.outsideWindow, request.timed = outside, timed
+		if rule != nil {
+			d := decision{allowed: rule.Action == actionAllow, reason: "matched rule " + rule.Name, rule: rule.Name,
+				detail: "rule:" + rule.Name}
+			if d.allowed {
+				d.headersToRemove = append([]string(nil), rule.StripHeaders...)
+				// The slices are copied, the mutations append to them and the rule is shared by the
+				// concurrent check requests.
+				d.querySet, d.queryRemove = append([]queryRequirement(nil), rule.setQuery...), append([]string(nil), rule.RemoveQuery...)
+				d.addHeaders = append([]headerTemplate(nil), rule.addHeaders...)
+			}
+			return d
+		}
+	}
+
+	if len(s.deniedUserAgents) != 0 || len(s.allowedUserAgents) != 0 {
+		if d, ok := s.userAgentDecision(request); ok {
+			return d.withDetail("user-agent")
+		}
+	}
+
+	if s.methodAllowed(request.method) {
+		return decision{allowed: true, reason: "allowed method " + request.method, detail: "allowed-method"}
+	}
+
+	if cidr, ok := matchCIDRs(s.allowedCIDRs, request.sourceIP); ok {
+		return decision{allowed: true, reason: "allowed CIDR " + cidr.String(), detail: "allowed-cidr"}
+	}
+
+	if len(s.requiredQuery) != 0 {
+		if request.queryErr != nil {
+			s.logger.Infof("Ignored malformed query in %s: %v", s.redactPath(request.path), request.queryErr)
+		} else if name, ok := s.queryAllowed(request); ok {
+			return decision{allowed: true, reason: "matched query " + name, detail: "allowed-query"}
+		}
+	}
+
+	if token, ok := bearerToken(request); ok && len(s.allowedTokens) != 0 {
+		if s.tokenAllowed(token) {
+			return decision{allowed: true, reason: "allowed bearer token " + tokenFingerprint(token), detail: "allowed-token"}
+		}
+		s.logger.Infof("Bearer token %s is not in the allowed tokens", tokenFingerprint(token))
+	}
+
+	if d, ok := s.credentialDecision(request); ok {
+		return d
+	}
+
+	if s.celPolicy != nil {
+		return s.celDecision(request).withDetail("cel")
+	}
+
+	if s.opa != nil {
+		return s.opaDecision(request).withDetail("opa")
+	}
+
+	if s.delegate != nil {
+		return s.delegateDecision(request).withDetail("webhook")
+	}
+
+	if s.sessions != nil && s.sessionAllowed(request) {
+		return decision{allowed: true, reason: "valid session cookie " + s.sessions.cookieName, detail: "valid-session"}
+	}
+
+	if len(s.requiredHeaders) != 0 {
+		d := s.requiredHeadersDecision(request)
+		if d.allowed {
+			return d.withDetail("required-headers")
+		}
+		d.unauthenticated = true
+		return d.withDetail("missing-header")
+	}
+
+	value := request.header(s.checkHeader)
+	if s.isAllowedValue(value) {
+		if normalized := s.normalizeValue(value); normalized != value {
+			return decision{allowed: true, reason: fmt.Sprintf("matched %s: %q normalized to %q", s.checkHeader, value, normalized),
+				detail: "allowed-value"}
+		}
+		return decision{allowed: true, reason: "matched " + s.checkHeader + ": " + value, detail: "allowed-value"}
+	}
+	if s.currentDefaultAction() == actionAllow {
+		if value == deniedValue {
+			return decision{reason: "matched " + s.checkHeader + ": " + value, detail: "denied-value"}
+		}
+		return decision{allowed: true, reason: "default action allow", detail: "default-allow"}
+	}
+	reason := "expected " + s.checkHeader + ": " + s.expectedValues()
+	if miss, ok := s.nearMiss(value); ok {
+		reason += ", " + miss
+	}
+	if _, ok := request.headers[strings.ToLower(s.checkHeader)]; !ok {
+		return decision{reason: reason, detail: "missing-header", unauthenticated: true}
+	}
+	return decision{reason: reason, detail: "bad-header-value", unauthenticated: true}
+}
+
+// presentHeaders returns the names of the headers present in the request.
+func presentHeaders(request *checkRequest, names []string) []string {
+	var present []string
+	for _, name := range names {
+		if _, ok := request.headers[name]; ok {
+			present = append(present, name)
+		}
+	}
+	return present
+}
+
+// headersToRemove returns the lowercase names without duplicates, in the order of the first
+// occurrence. The headers added by the decision are kept as Envoy removes headers after adding them.
+func headersToRemove(names []string, added map[string]string) []string {
+	var result []string
+	seen := map[string]bool{}
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if _, ok := added[name]; ok || seen[name] {
+			continue
+		}
+		seen[name] = true
+		result = append(result, name)
+	}
+	return result
+}
+
+// bypassed returns the matched bypass path prefix, trailing slashes are ignored.
+func (s *ExtAuthzServer) bypassed(path string) (string, bool) {
+	path = strings.TrimRight(path, "/")
+	for _, prefix := range s.bypassPaths {
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			if prefix == "" {
+				return "/", true
+			}
+			return prefix, true
+		}
+	}
+	return "", false
+}
+
+// readOnlyMethods are the methods allowed by the read-only-allow flag.
+var readOnlyMethods = map[string]bool{
+	http.MethodGet:  true,
+	http.MethodHead: true,
+}
+
+// methodAllowed returns true if the request method is allowed without the check header.
+// CONNECT and custom methods are never allowed here and always fall back to the check header.
+func (s *ExtAuthzServer) methodAllowed(method string) bool {
+	method = strings.ToUpper(method)
+	if s.readOnlyAllow && readOnlyMethods[method] {
+		return true
+	}
+	return s.optionsAllow && method == http.MethodOptions
+}
@@ -0,0 +1,125 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHeadersToRemove(t *testing.T) {
+	cases := []struct {
+		name  string
+		names []string
+		added map[string]string
+		want  []string
+	}{
+		{name: "lowercase", names: []string{"X-User-ID", "x-groups"}, want: []string{"x-user-id", "x-groups"}},
+		{name: "duplicates keep the first position", names: []string{"x-user-id", "x-groups", "X-USER-ID", "x-groups"},
+			want: []string{"x-user-id", "x-groups"}},
+		{name: "added headers are kept", names: []string{"x-ext-authz-user", "x-user-id"},
+			added: map[string]string{"x-ext-authz-user": "alice"}, want: []string{"x-user-id"}},
+		{name: "none"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := headersToRemove(tc.names, tc.added); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestStripRequestHeaders(t *testing.T) {
+	policy := writeTestFile(t, `
+rules:
+- name: allow-api
+  path_prefix: /api
+  strip_headers: [X-Groups, x-user-id]
+  action: allow
+- name: allow-all
+  action: allow
+`)
+	defer os.Remove(policy)
+	cases := []struct {
+		name   string
+		config func(c *Config)
+		path   string
+		want   []string
+	}{
+		{name: "flag", config: func(c *Config) { c.StripRequestHeaders = "X-User-ID, x-tenant,x-user-id" },
+			want: []string{"x-user-id", "x-tenant"}},
+		{name: "rule", config: func(c *Config) { c.PolicyFile = policy }, path: "/api/orders", want: []string{"x-groups", "x-user-id"}},
+		{name: "rule without strip headers", config: func(c *Config) { c.PolicyFile = policy }, path: "/other"},
+		{name: "rule and flag", config: func(c *Config) {
+			c.PolicyFile = policy
+			c.StripRequestHeaders = "x-user-id,x-tenant"
+		}, path: "/api", want: []string{"x-groups", "x-user-id", "x-tenant"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.DefaultAction = actionAllow
+			tc.config(&c)
+			s := newTestServer(t, c)
+			defer s.close()
+			response := checkGRPC(t, s, testRequest{path: tc.path, headers: map[string]string{"x-user-id": "spoofed"}})
+			if !grpcAllowed(response) {
+				t.Fatal("got denied, want allowed")
+			}
+			if got := response.GetOkResponse().GetHeadersToRemove(); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got headers to remove %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestStripRequestHeadersConfig(t *testing.T) {
+	cases := []struct {
+		name    string
+		strip   string
+		wantErr string
+		wantLog string
+	}{
+		{name: "valid", strip: "x-user-id", wantLog: "the HTTP check response cannot remove headers"},
+		{name: "invalid header", strip: "x user", wantErr: `invalid -strip-request-headers: invalid header name "x user"`},
+		{name: "not set"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			c := DefaultConfig()
+			c.StripRequestHeaders = tc.strip
+			c.Logger = NewTextLogger(&out)
+			s, err := NewExtAuthzServer(WithConfig(c))
+			if err != nil {
+				if tc.wantErr == "" || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			s.close()
+			if tc.wantErr != "" {
+				t.Fatalf("got no error, want %q", tc.wantErr)
+			}
+			if tc.wantLog != "" && !strings.Contains(out.String(), tc.wantLog) {
+				t.Fatalf("got log %q, want %q", out.String(), tc.wantLog)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// missingHeader lists the names of the failed header requirements in the denied response.
+const missingHeader = "x-ext-authz-missing"
+
+// listFlag is a flag of comma-separated values that can also be repeated.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, parseList(value)...)
+	return nil
+}
+
+// headerRequirement requires the header to have the value.
+type headerRequirement struct {
+	name  string
+	value string
+}
+
+// parseHeaderRequirements parses the name=value pairs of the required-headers flag.
+func parseHeaderRequirements(pairs []string) ([]headerRequirement, error) {
+	var requirements []headerRequirement
+	for _, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || !httpguts.ValidHeaderFieldName(kv[0]) {
+			return nil, fmt.Errorf("invalid header requirement %q, expected name=value", pair)
+		}
+		requirements = append(requirements, headerRequirement{name: strings.ToLower(kv[0]), value: kv[1]})
+	}
+	return requirements, nil
+}
+
+// requiredHeadersDecision allows the request only if all required headers have the expected values.
+func (s *ExtAuthzServer) requiredHeadersDecision(request *checkRequest) decision {
+	var missing, mismatched []string
+	for _, r := range s.requiredHeaders {
+		value, ok := request.headers[r.name]
+		switch {
+		case !ok:
+			missing = append(missing, r.name)
+		case value != r.value:
+			mismatched = append(mismatched, r.name)
+		}
+	}
+	if len(missing) == 0 && len(mismatched) == 0 {
+		return decision{allowed: true, reason: fmt.Sprintf("matched %d required headers", len(s.requiredHeaders))}
+	}
+	var reasons []string
+	if len(missing) != 0 {
+		reasons = append(reasons, "missing headers "+strings.Join(missing, ","))
+	}
+	if len(mismatched) != 0 {
+		reasons = append(reasons, "mismatched headers "+strings.Join(mismatched, ","))
+	}
+	// Only the names are returned, the expected values must not leak to the client.
+	return decision{
+		reason:  strings.Join(reasons, ", "),
+		headers: map[string]string{missingHeader: strings.Join(append(missing, mismatched...), ",")},
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rls "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/go-redis/redis/v7"
+	"github.com/golang/protobuf/ptypes"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+)
+
+const (
+	rateLimitLimitHeader     = "x-ratelimit-limit"
+	rateLimitRemainingHeader = "x-ratelimit-remaining"
+)
+
+var rateLimitUnits = map[string]typev3.RateLimitUnit{
+	"second": typev3.RateLimitUnit_SECOND,
+	"minute": typev3.RateLimitUnit_MINUTE,
+	"hour":   typev3.RateLimitUnit_HOUR,
+	"day":    typev3.RateLimitUnit_DAY,
+}
+
+var rateLimitUnitDurations = map[typev3.RateLimitUnit]time.Duration{
+	typev3.RateLimitUnit_SECOND: time.Second,
+	typev3.RateLimitUnit_MINUTE: time.Minute,
+	typev3.RateLimitUnit_HOUR:   time.Hour,
+	typev3.RateLimitUnit_DAY:    24 * time.Hour,
+}
+
+// requestsPerUnit is the limit of a descriptor in the model of the Envoy rate limit service.
+type requestsPerUnit struct {
+	requests uint32
+	unit     typev3.RateLimitUnit
+}
+
+// parseRequestsPerUnit parses a limit like 100/minute.
+func parseRequestsPerUnit(value string) (requestsPerUnit, error) {
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return requestsPerUnit{}, fmt.Errorf("must be requests/unit like 100/minute but got %q", value)
+	}
+	requests, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil || requests == 0 {
+		return requestsPerUnit{}, fmt.Errorf("invalid number of requests %q", parts[0])
+	}
+	unit, ok := rateLimitUnits[strings.ToLower(parts[1])]
+	if !ok {
+		return requestsPerUnit{}, fmt.Errorf("invalid unit %q: must be second, minute, hour or day", parts[1])
+	}
+	return requestsPerUnit{requests: uint32(requests), unit: unit}, nil
+}
+
+func (l requestsPerUnit) String() string {
+	return fmt.Sprintf("%d/%s", l.requests, strings.ToLower(l.unit.String()))
+}
+
+// rateLimitService implements the Envoy RateLimitService with the token buckets of the ext_authz
+// rate limiter, or the Redis fixed windows if Redis is configured. Each descriptor is limited
+// separately by its domain and entries, one hit is counted per call.
+type rateLimitService struct {
+	defaultLimit requestsPerUnit
+	redis        *redis.Client
+	redisTimeout time.Duration
+	failOpen     bool
+	logger       Logger
+	// decisionsLogged returns true if a line is logged per response, see -log-decisions.
+	decisionsLogged func() bool
+
+	mu sync.Mutex
+	// limiters is keyed by the limit as the descriptors may override the default limit.
+	limiters map[requestsPerUnit]rateLimiter
+}
+
+func newRateLimitService(defaultLimit requestsPerUnit, client *redis.Client, redisTimeout time.Duration, failOpen bool, logger Logger,
+	decisionsLogged func() bool) *rateLimitService {
+	return &rateLimitService{
+		defaultLimit:    defaultLimit,
+		redis:           client,
+		redisTimeout:    redisTimeout,
+		failOpen:        failOpen,
+		logger:          logger,
+		decisionsLogged: decisionsLogged,
+		limiters:        map[requestsPerUnit]rateLimiter{},
+	}
+}
+
+// close stops the local limiters, it does nothing if nil.
+func (r *rateLimitService) close() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, l := range r.limiters {
+		if l, ok := l.(*localRateLimiter); ok {
+			l.close()
+		}
+	}
+}
+
+func (r *rateLimitService) limiter(limit requestsPerUnit) rateLimiter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if l, ok := r.limiters[limit]; ok {
+		return l
+	}
+	qps := float64(limit.requests) / rateLimitUnitDurations[limit.unit].Seconds()
+	var l rateLimiter
+	if r.redis != nil {
+		l = newRedisRateLimiter(r.redis, qps, int(limit.requests), r.redisTimeout)
+	} else {
+		local := newLocalRateLimiter(qps, int(limit.requests), r.logger)
+		local.start()
+		l = local
+	}
+	r.limiters[limit] = l
+	return l
+}
+
+// descriptorLimit returns the limit override of the descriptor, or the default limit.
+func (r *rateLimitService) descriptorLimit(descriptor *ratelimitv3.RateLimitDescriptor) requestsPerUnit {
+	override := descriptor.GetLimit()
+	if _, ok := rateLimitUnitDurations[override.GetUnit()]; !ok || override.GetRequestsPerUnit() == 0 {
+		return r.defaultLimit
+	}
+	return requestsPerUnit{requests: override.GetRequestsPerUnit(), unit: override.GetUnit()}
+}
+
+// descriptorKey returns the rate limit key of the descriptor, e.g. "domain|remote_address=10.0.0.1".
+func descriptorKey(domain string, descriptor *ratelimitv3.RateLimitDescriptor) string {
+	var entries []string
+	for _, entry := range descriptor.GetEntries() {
+		entries = append(entries, entry.GetKey()+"="+entry.GetValue())
+	}
+	return domain + "|" + strings.Join(entries, ",")
+}
+
+// ShouldRateLimit implements the Envoy rate limit check, the response is OVER_LIMIT if any
+// descriptor is over its limit. The response is logged like the check decisions, the summary is
+// not formatted if the decisions are not logged.
+func (r *rateLimitService) ShouldRateLimit(ctx context.Context, request *rls.RateLimitRequest) (*rls.RateLimitResponse, error) {
+	response := &rls.RateLimitResponse{OverallCode: rls.RateLimitResponse_OK}
+	logged := r.decisionsLogged()
+	var summary []string
+	var minRemaining int
+	var minLimit requestsPerUnit
+	for i, descriptor := range request.GetDescriptors() {
+		limit := r.descriptorLimit(descriptor)
+		key := descriptorKey(request.GetDomain(), descriptor)
+		status := &rls.RateLimitResponse_DescriptorStatus{
+			Code: rls.RateLimitResponse_OK,
+			CurrentLimit: &rls.RateLimitResponse_RateLimit{
+				RequestsPerUnit: limit.requests,
+				Unit:            rls.RateLimitResponse_RateLimit_Unit(limit.unit),
+			},
+		}
+		allowed, remaining, retryAfter, err := r.limiter(limit).allow(ctx, key)
+		if err != nil {
+			if !r.failOpen {
+				return nil, grpcstatus.Errorf(codes.Unavailable, "rate limiter failed: %v", err)
+			}
+			r.logger.Warnf("rate limiter failed for descriptor %q, fail open: %v", key, err)
+			allowed, remaining = true, int(limit.requests)
+		}
+		status.LimitRemaining = uint32(remaining)
+		if !allowed {
+			status.Code = rls.RateLimitResponse_OVER_LIMIT
+			status.DurationUntilReset = ptypes.DurationProto(retryAfter)
+			response.OverallCode = rls.RateLimitResponse_OVER_LIMIT
+		}
+		response.Statuses = append(response.Statuses, status)
+		if i == 0 || remaining < minRemaining {
+			minRemaining, minLimit = remaining, limit
+		}
+		if logged {
+			summary = append(summary, fmt.Sprintf("%s %s (%s, remaining %d)", key, status.Code, limit, remaining))
+		}
+	}
+	if len(response.Statuses) > 0 {
+		// The headers describe the most restrictive descriptor.
+		response.ResponseHeadersToAdd = []*core.HeaderValue{
+			{Key: rateLimitLimitHeader, Value: strconv.FormatUint(uint64(minLimit.requests), 10)},
+			{Key: rateLimitRemainingHeader, Value: strconv.Itoa(minRemaining)},
+		}
+	}
+	if logged {
+		r.logger.Infof("[RLS][%s]: %s", strings.ToLower(response.OverallCode.String()), strings.Join(summary, ", "))
+	}
+	return response, nil
+}
@@ -0,0 +1,305 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rls "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+)
+
+// descriptor returns the descriptor of the key and value pairs, limited by the limit if set.
+func descriptor(limit *ratelimitv3.RateLimitDescriptor_RateLimitOverride, entries ...string) *ratelimitv3.RateLimitDescriptor {
+	d := &ratelimitv3.RateLimitDescriptor{Limit: limit}
+	for i := 0; i+1 < len(entries); i += 2 {
+		d.Entries = append(d.Entries, &ratelimitv3.RateLimitDescriptor_Entry{Key: entries[i], Value: entries[i+1]})
+	}
+	return d
+}
+
+func perMinute(requests uint32) *ratelimitv3.RateLimitDescriptor_RateLimitOverride {
+	return &ratelimitv3.RateLimitDescriptor_RateLimitOverride{RequestsPerUnit: requests, Unit: typev3.RateLimitUnit_MINUTE}
+}
+
+func TestParseRequestsPerUnit(t *testing.T) {
+	cases := []struct {
+		value   string
+		want    requestsPerUnit
+		wantErr string
+	}{
+		{value: "100/minute", want: requestsPerUnit{requests: 100, unit: typev3.RateLimitUnit_MINUTE}},
+		{value: "1/Second", want: requestsPerUnit{requests: 1, unit: typev3.RateLimitUnit_SECOND}},
+		{value: "5/day", want: requestsPerUnit{requests: 5, unit: typev3.RateLimitUnit_DAY}},
+		{value: "100", wantErr: "must be requests/unit"},
+		{value: "0/minute", wantErr: `invalid number of requests "0"`},
+		{value: "-1/minute", wantErr: `invalid number of requests "-1"`},
+		{value: "4294967296/minute", wantErr: "invalid number of requests"},
+		{value: "10/week", wantErr: `invalid unit "week"`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.value, func(t *testing.T) {
+			got, err := parseRequestsPerUnit(tc.value)
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Fatalf("got error %v, want valid", err)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+				t.Fatalf("got error %v, want error containing %q", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestShouldRateLimit(t *testing.T) {
+	type wantStatus struct {
+		code      rls.RateLimitResponse_Code
+		limit     uint32
+		remaining uint32
+	}
+	cases := []struct {
+		name string
+		// before are sent first, the response of the request is checked.
+		before        []*rls.RateLimitRequest
+		request       *rls.RateLimitRequest
+		wantCode      rls.RateLimitResponse_Code
+		wantStatuses  []wantStatus
+		wantLimit     string
+		wantRemaining string
+	}{
+		{
+			name: "multiple descriptors under the limit",
+			request: &rls.RateLimitRequest{Domain: "envoy", Descriptors: []*ratelimitv3.RateLimitDescriptor{
+				descriptor(nil, "remote_address", "10.0.0.1"),
+				descriptor(nil, "path", "/api"),
+			}},
+			wantCode: rls.RateLimitResponse_OK,
+			wantStatuses: []wantStatus{
+				{code: rls.RateLimitResponse_OK, limit: 3, remaining: 2},
+				{code: rls.RateLimitResponse_OK, limit: 3, remaining: 2},
+			},
+			wantLimit: "3", wantRemaining: "2",
+		},
+		{
+			name: "over-limit descriptor alongside an under-limit one",
+			before: []*rls.RateLimitRequest{{Domain: "envoy", Descriptors: []*ratelimitv3.RateLimitDescriptor{
+				descriptor(perMinute(1), "user", "alice"),
+			}}},
+			request: &rls.RateLimitRequest{Domain: "envoy", Descriptors: []*ratelimitv3.RateLimitDescriptor{
+				descriptor(nil, "remote_address", "10.0.0.1"),
+				descriptor(perMinute(1), "user", "alice"),
+			}},
+			wantCode: rls.RateLimitResponse_OVER_LIMIT,
+			wantStatuses: []wantStatus{
+				{code: rls.RateLimitResponse_OK, limit: 3, remaining: 2},
+				{code: rls.RateLimitResponse_OVER_LIMIT, limit: 1, remaining: 0},
+			},
+			// The headers describe the most restrictive descriptor.
+			wantLimit: "1", wantRemaining: "0",
+		},
+		{
+			name: "descriptors are keyed by all entries",
+			before: []*rls.RateLimitRequest{{Domain: "envoy", Descriptors: []*ratelimitv3.RateLimitDescriptor{
+				descriptor(perMinute(1), "user", "alice"),
+			}}},
+			request: &rls.RateLimitRequest{Domain: "envoy", Descriptors: []*ratelimitv3.RateLimitDescriptor{
+				descriptor(perMinute(1), "user", "alice", "path", "/api"),
+			}},
+			wantCode:     rls.RateLimitResponse_OK,
+			wantStatuses: []wantStatus{{code: rls.RateLimitResponse_OK, limit: 1, remaining: 0}},
+			wantLimit:    "1", wantRemaining: "0",
+		},
+		{
+			name: "descriptors are keyed by the domain",
+			before: []*rls.RateLimitRequest{{Domain: "envoy", Descriptors: []*ratelimitv3.RateLimitDescriptor{
+				descriptor(perMinute(1), "user", "alice"),
+			}}},
+			request: &rls.RateLimitRequest{Domain: "other", Descriptors: []*ratelimitv3.RateLimitDescriptor{
+				descriptor(perMinute(1), "user", "alice"),
+			}},
+			wantCode:     rls.RateLimitResponse_OK,
+			wantStatuses: []wantStatus{{code: rls.RateLimitResponse_OK, limit: 1, remaining: 0}},
+			wantLimit:    "1", wantRemaining: "0",
+		},
+		{
+			name: "default limit is exhausted",
+			before: []*rls.RateLimitRequest{
+				{Domain: "envoy", Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor(nil, "user", "bob")}},
+				{Domain: "envoy", Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor(nil, "user", "bob")}},
+				{Domain: "envoy", Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor(nil, "user", "bob")}},
+			},
+			request:      &rls.RateLimitRequest{Domain: "envoy", Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor(nil, "user", "bob")}},
+			wantCode:     rls.RateLimitResponse_OVER_LIMIT,
+			wantStatuses: []wantStatus{{code: rls.RateLimitResponse_OVER_LIMIT, limit: 3, remaining: 0}},
+			wantLimit:    "3", wantRemaining: "0",
+		},
+		{
+			name:     "no descriptors",
+			request:  &rls.RateLimitRequest{Domain: "envoy"},
+			wantCode: rls.RateLimitResponse_OK,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newRateLimitService(requestsPerUnit{requests: 3, unit: typev3.RateLimitUnit_MINUTE}, nil, time.Second, false,
+				NewTextLogger(ioutil.Discard), func() bool { return true })
+			defer r.close()
+			for _, request := range tc.before {
+				if _, err := r.ShouldRateLimit(context.Background(), request); err != nil {
+					t.Fatal(err)
+				}
+			}
+			response, err := r.ShouldRateLimit(context.Background(), tc.request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.GetOverallCode() != tc.wantCode {
+				t.Fatalf("got overall code %v, want %v", response.GetOverallCode(), tc.wantCode)
+			}
+			if len(response.GetStatuses()) != len(tc.wantStatuses) {
+				t.Fatalf("got %d statuses, want %d", len(response.GetStatuses()), len(tc.wantStatuses))
+			}
+			for i, want := range tc.wantStatuses {
+				got := response.GetStatuses()[i]
+				if got.GetCode() != want.code || got.GetCurrentLimit().GetRequestsPerUnit() != want.limit ||
+					got.GetCurrentLimit().GetUnit() != rls.RateLimitResponse_RateLimit_MINUTE || got.GetLimitRemaining() != want.remaining {
+					t.Errorf("status %d: got %v, want %+v", i, got, want)
+				}
+				if over := want.code == rls.RateLimitResponse_OVER_LIMIT; over != (got.GetDurationUntilReset() != nil) {
+					t.Errorf("status %d: got duration until reset %v, want it set %v", i, got.GetDurationUntilReset(), over)
+				}
+			}
+			headers := map[string]string{}
+			for _, h := range response.GetResponseHeadersToAdd() {
+				headers[h.GetKey()] = h.GetValue()
+			}
+			if headers[rateLimitLimitHeader] != tc.wantLimit || headers[rateLimitRemainingHeader] != tc.wantRemaining {
+				t.Fatalf("got headers %v, want limit %q and remaining %q", headers, tc.wantLimit, tc.wantRemaining)
+			}
+		})
+	}
+}
+
+func TestShouldRateLimitRedis(t *testing.T) {
+	request := &rls.RateLimitRequest{Domain: "envoy", Descriptors: []*ratelimitv3.RateLimitDescriptor{
+		descriptor(perMinute(2), "remote_address", "10.0.0.1"),
+	}}
+	cases := []struct {
+		name     string
+		down     bool
+		failOpen bool
+		// want are the codes of the requests sent alternately to the replicas.
+		want     []rls.RateLimitResponse_Code
+		wantCode codes.Code
+	}{
+		{name: "replicas share the counters", want: []rls.RateLimitResponse_Code{
+			rls.RateLimitResponse_OK, rls.RateLimitResponse_OK, rls.RateLimitResponse_OVER_LIMIT, rls.RateLimitResponse_OVER_LIMIT,
+		}},
+		{name: "unavailable fails closed", down: true, wantCode: codes.Unavailable},
+		{name: "unavailable fails open", down: true, failOpen: true, want: []rls.RateLimitResponse_Code{
+			rls.RateLimitResponse_OK, rls.RateLimitResponse_OK, rls.RateLimitResponse_OK,
+		}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mr := newTestRedis(t)
+			defer mr.Close()
+			var replicas []*rateLimitService
+			for i := 0; i < 2; i++ {
+				client := newRedisClient(mr.Addr(), 100*time.Millisecond)
+				defer client.Close()
+				r := newRateLimitService(requestsPerUnit{requests: 10, unit: typev3.RateLimitUnit_MINUTE}, client, 100*time.Millisecond,
+					tc.failOpen, NewTextLogger(ioutil.Discard), func() bool { return false })
+				defer r.close()
+				replicas = append(replicas, r)
+			}
+			if tc.down {
+				mr.Close()
+			}
+			if tc.wantCode != codes.OK {
+				_, err := replicas[0].ShouldRateLimit(context.Background(), request)
+				if got := grpcstatus.Code(err); got != tc.wantCode {
+					t.Fatalf("got error %v, want code %v", err, tc.wantCode)
+				}
+				return
+			}
+			for i, want := range tc.want {
+				response, err := replicas[i%2].ShouldRateLimit(context.Background(), request)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := response.GetOverallCode(); got != want {
+					t.Fatalf("request %d: got %v, want %v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitServiceRegistered(t *testing.T) {
+	cases := []struct {
+		name     string
+		enabled  bool
+		limit    string
+		want     rls.RateLimitResponse_Code
+		wantCode codes.Code
+		wantErr  string
+	}{
+		{name: "enabled", enabled: true, limit: "1/minute", want: rls.RateLimitResponse_OK},
+		{name: "disabled", wantCode: codes.Unimplemented},
+		{name: "invalid limit", enabled: true, limit: "1/week", wantErr: "invalid -ratelimit-service-limit"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.EnableRateLimitService = tc.enabled
+			if tc.limit != "" {
+				c.RateLimitServiceLimit = tc.limit
+			}
+			if tc.wantErr != "" {
+				if got := newServerError(c); !strings.Contains(got, tc.wantErr) {
+					t.Fatalf("got error %q, want %q", got, tc.wantErr)
+				}
+				return
+			}
+			s := startTLSServer(t, c)
+			defer s.Stop()
+			conn, err := grpc.Dial(s.GRPCAddr().String(), grpc.WithInsecure())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			response, err := rls.NewRateLimitServiceClient(conn).ShouldRateLimit(ctx, rateLimitRequest())
+			if got := grpcstatus.Code(err); got != tc.wantCode {
+				t.Fatalf("got error %v, want code %v", err, tc.wantCode)
+			}
+			if err == nil && response.GetOverallCode() != tc.want {
+				t.Fatalf("got overall code %v, want %v", response.GetOverallCode(), tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// sampler allows a percentage of the denied requests, shared by the gRPC and HTTP handlers.
+type sampler struct {
+	percentage float64
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+func newSampler(percentage float64, seed int64) *sampler {
+	return &sampler{percentage: percentage, rnd: rand.New(rand.NewSource(seed))}
+}
+
+// sample returns true for the configured percentage of the calls.
+func (s *sampler) sample() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rnd.Float64()*100 < s.percentage
+}
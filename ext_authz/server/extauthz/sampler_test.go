@@ -0,0 +1,134 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// samples returns the first n results of the sampler.
+func samples(s *sampler, n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		if s.sample() {
+			b.WriteByte('1')
+		} else {
+			b.WriteByte('0')
+		}
+	}
+	return b.String()
+}
+
+func TestSamplerSeed(t *testing.T) {
+	cases := []struct {
+		name      string
+		seed      int64
+		otherSeed int64
+		wantSame  bool
+	}{
+		{name: "same seed", seed: 42, otherSeed: 42, wantSame: true},
+		{name: "other seed", seed: 42, otherSeed: 43},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, other := samples(newSampler(50, tc.seed), 64), samples(newSampler(50, tc.otherSeed), 64)
+			if (got == other) != tc.wantSame {
+				t.Fatalf("got %s and %s, want same %v", got, other, tc.wantSame)
+			}
+		})
+	}
+}
+
+func TestSamplerPercentage(t *testing.T) {
+	const n = 10000
+	cases := []struct {
+		percentage float64
+		min, max   int
+	}{
+		{percentage: 0, min: 0, max: 0},
+		{percentage: 100, min: n, max: n},
+		{percentage: 30, min: 2800, max: 3200},
+		{percentage: 0.5, min: 20, max: 80},
+	}
+	for _, tc := range cases {
+		t.Run(fmt.Sprint(tc.percentage), func(t *testing.T) {
+			got := strings.Count(samples(newSampler(tc.percentage, 1), n), "1")
+			if got < tc.min || got > tc.max {
+				t.Fatalf("got %d of %d sampled, want between %d and %d", got, n, tc.min, tc.max)
+			}
+		})
+	}
+}
+
+func TestAllowPercentage(t *testing.T) {
+	const seed, n = 7, 32
+	var out bytes.Buffer
+	c := DefaultConfig()
+	c.AllowPercentage = 50
+	c.Seed = seed
+	c.Logger = NewTextLogger(&out)
+	s := newTestServer(t, c)
+	defer s.close()
+	// The gRPC and HTTP check requests draw from the same sampler in the order they are decided.
+	want := samples(newSampler(50, seed), n)
+	for i := 0; i < n; i++ {
+		sampled := want[i] == '1'
+		var result string
+		var allowed bool
+		if i%2 == 0 {
+			response := checkGRPC(t, s, testRequest{})
+			allowed, result = grpcAllowed(response), grpcHeader(response, resultHeader)
+		} else {
+			response := checkHTTP(s, testRequest{})
+			allowed, result = response.Code == 200, response.Header().Get(resultHeader)
+		}
+		wantResult := "denied"
+		if sampled {
+			wantResult = "allowed-by-sampling"
+		}
+		if allowed != sampled || result != wantResult {
+			t.Fatalf("request %d: got allowed %v with %s %q, want %v with %q", i, allowed, resultHeader, result, sampled, wantResult)
+		}
+	}
+	if got, wantLogged := strings.Count(out.String(), "allowed by sampling 50% instead of: expected x-ext-authz"),
+		strings.Count(want, "1"); got != wantLogged {
+		t.Fatalf("got %d sampled decisions logged, want %d", got, wantLogged)
+	}
+}
+
+func TestAllowPercentageValidation(t *testing.T) {
+	cases := []struct {
+		percentage float64
+		wantErr    string
+	}{
+		{percentage: 0},
+		{percentage: 100},
+		{percentage: -1, wantErr: "-allow-percentage must be between 0 and 100 but got -1"},
+		{percentage: 100.5, wantErr: "-allow-percentage must be between 0 and 100 but got 100.5"},
+	}
+	for _, tc := range cases {
+		t.Run(fmt.Sprint(tc.percentage), func(t *testing.T) {
+			c := DefaultConfig()
+			c.AllowPercentage = tc.percentage
+			got := newServerError(c)
+			if (tc.wantErr == "") != (got == "") || !strings.Contains(got, tc.wantErr) {
+				t.Fatalf("got error %q, want %q", got, tc.wantErr)
+			}
+		})
+	}
+}
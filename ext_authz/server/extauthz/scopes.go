@@ -0,0 +1,96 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const missingScopeHeader = "x-ext-authz-missing-scope"
+
+// scopeRequirement requires the JWT of the requests under the path prefix to have all the scopes.
+//
+// Example:
+//
+//	scopes:
+//	- path_prefix: /admin/
+//	  scopes: [admin:write]
+type scopeRequirement struct {
+	PathPrefix string   `yaml:"path_prefix"`
+	Scopes     []string `yaml:"scopes"`
+}
+
+func (r *scopeRequirement) validate() error {
+	if !strings.HasPrefix(r.PathPrefix, "/") {
+		return fmt.Errorf("scopes: path_prefix must start with / but got %q", r.PathPrefix)
+	}
+	if len(r.Scopes) == 0 {
+		return fmt.Errorf("scopes %s: must have at least one scope", r.PathPrefix)
+	}
+	return nil
+}
+
+// scopes returns the scopes of the scope claim, a space-delimited string or an array of strings.
+// A token without the claim has no scopes.
+func (t *jwtToken) scopes() []string {
+	if v, ok := t.claims["scope"].(string); ok {
+		return strings.Fields(v)
+	}
+	return t.stringsClaim("scope")
+}
+
+// missingScope returns the first scope required for the request path that the token does not have,
+// the scopes of all matched requirements are required.
+func (p *policy) missingScope(request *checkRequest, token *jwtToken) (string, bool) {
+	var scopes []string
+	for _, r := range p.Scopes {
+		if !strings.HasPrefix(request.urlPath, r.PathPrefix) {
+			continue
+		}
+		if scopes == nil {
+			scopes = token.scopes()
+		}
+		for _, scope := range r.Scopes {
+			if !contains(scopes, scope) {
+				return scope, true
+			}
+		}
+	}
+	return "", false
+}
+
+// scopeDecision returns a denied decision if the token lacks a scope required by the selected
+// policy, ok is false otherwise.
+func (s *ExtAuthzServer) scopeDecision(request *checkRequest, token *jwtToken) (decision, bool) {
+	if request.files.policy == nil {
+		return decision{}, false
+	}
+	p, ok := request.files.policy.selected(request.policyName)
+	if !ok {
+		return decision{}, false
+	}
+	scope, ok := p.missingScope(request, token)
+	if !ok {
+		return decision{}, false
+	}
+	return decision{
+		reason:  "JWT is missing scope " + scope + " for " + s.redactPath(request.urlPath),
+		status:  http.StatusForbidden,
+		headers: map[string]string{missingScopeHeader: scope},
+		detail:  "missing-scope",
+	}, true
+}
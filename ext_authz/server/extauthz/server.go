@@ -0,0 +1,1499 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv2 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v2"
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	extproc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	rls "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/go-redis/redis/v7"
+	"github.com/gogo/googleapis/google/rpc"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"golang.org/x/net/context"
+	"golang.org/x/net/http/httpguts"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	channelzsvc "google.golang.org/grpc/channelz/service"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	// resultHeader is the default name of the -result-header.
+	resultHeader = "x-ext-authz-result"
+	// deniedValue is the check header value that denies the request if the default action is allow.
+	deniedValue = "deny"
+	// defaultAllowedValue is allowed if no allowed value, list or regex is configured.
+	defaultAllowedValue = "allow"
+)
+
+// The gRPC services and the HTTP handler are all served by the same configured instance.
+var (
+	_ auth.AuthorizationServer   = &ExtAuthzServer{}
+	_ authv2.AuthorizationServer = authorizationV2{}
+	_ http.Handler               = &ExtAuthzServer{}
+)
+
+// ExtAuthzServer implements the ext_authz gRPC and HTTP check request API.
+type ExtAuthzServer struct {
+	// checkHeader is the lowercase name of the header checked for allowedValues.
+	checkHeader   string
+	allowedValues map[string]bool
+	// allowedRegex replaces allowedValues if set.
+	allowedRegex *regexp.Regexp
+	// valueMatch is the -value-match mode, allowedValues are normalized by it.
+	valueMatch string
+	// defaultAction holds either actionAllow or actionDeny, in allow mode only the deniedValue is
+	// denied. It is changed at runtime by the admin server like forceMode.
+	defaultAction atomic.Value
+	// forceMode holds forceNone, forceAllowAll or forceDenyAll.
+	forceMode atomic.Value
+	// adminAddr serves the admin endpoints if set, the changes require adminToken if set.
+	adminAddr  string
+	adminToken string
+	// enablePprof serves the debug endpoints on the admin server if set.
+	enablePprof bool
+	// enableChannelz registers the channelz service on the gRPC server, channelz serves its summary
+	// on the admin server if set.
+	enableChannelz bool
+	channelz       *channelzClient
+	// tracer exports the spans of the check requests and their callouts if set.
+	tracer *tracer
+	// metrics are collected if set and served on /metrics of the admin server.
+	metrics *metrics
+	// bypassPaths are path prefixes without trailing slash that are always allowed.
+	bypassPaths []string
+	// deniedHosts are normalized host patterns that are always denied.
+	deniedHosts []string
+	// forbiddenHeaders are lowercase header names that deny the request, or are removed from the
+	// upstream request if stripHeaders is set.
+	forbiddenHeaders []string
+	stripHeaders     bool
+	// stripRequestHeaders are lowercase header names always removed from the allowed upstream request.
+	stripRequestHeaders []string
+	sizeLimits          sizeLimits
+	// requiredHeaders must all match instead of the check header if set.
+	requiredHeaders []headerRequirement
+	// deniedUserAgents and allowedUserAgents are matched against the user-agent header.
+	deniedUserAgents  []userAgentPattern
+	allowedUserAgents []userAgentPattern
+	// detectPathTraversal denies the paths rejected by pathTraversal.
+	detectPathTraversal bool
+	// logMaxLen truncates the attributes and headers in the decision log if set.
+	logMaxLen int
+	// allowedContentTypes are the lowercase media types allowed for the writeMethods.
+	allowedContentTypes []string
+	requireContentType  bool
+	// addHeaders are added to the allowed upstream request and addResponseHeaders to the downstream
+	// response of the allowed request.
+	addHeaders         []headerTemplate
+	addResponseHeaders []headerTemplate
+	// responseHeadersSeen is set once a check request carried an added response header back, until
+	// then responseHeadersMissing counts the allowed gRPC check requests without it.
+	responseHeadersSeen    int32
+	responseHeadersMissing uint32
+	// setQuery and removeQuery mutate the query of the allowed upstream request.
+	setQuery    []queryRequirement
+	removeQuery []string
+	// requiredQuery allows the request without the check header if any of the query parameters matches.
+	requiredQuery []queryRequirement
+	// allowedCIDRs allows the request without the check header if the peer IP is in any of them.
+	allowedCIDRs   []*net.IPNet
+	xffTrustedHops int
+	// tcpAllowedCIDRs and tcpAllowedPorts decide the check requests without HTTP attributes.
+	tcpAllowedCIDRs []*net.IPNet
+	tcpAllowedPorts map[uint32]bool
+	// jwtSecret enables the JWT validation mode if set.
+	jwtSecret []byte
+	jwks      *jwks
+	// jwtIssuers and jwtAudiences are allowed if set, the token must have one of them.
+	jwtIssuers   []string
+	jwtAudiences []string
+	jwtClockSkew time.Duration
+	claimHeaders []claimHeader
+	// exposeRuleHeader adds the matched rule header to every decision if set.
+	exposeRuleHeader bool
+	// echoRequestInfo adds the received summary header truncated to echoMaxLen if set.
+	echoRequestInfo bool
+	echoMaxLen      int
+	// emitDynamicMetadata adds the decision metadata to the gRPC check response if set.
+	emitDynamicMetadata bool
+	// appendHeaders are the lowercase injected headers appended instead of overwritten.
+	appendHeaders map[string]bool
+	// basicAuthRealm is the realm of the htpasswd and LDAP modes.
+	basicAuthRealm string
+	// ldap enables the LDAP mode if set, it also uses basicAuthRealm.
+	ldap         *ldapAuth
+	apiKeyHeader string
+	// quotas counts the requests of the API keys with a daily quota.
+	quotas quotaCounter
+	// allowedTokens are static bearer tokens allowed without the check header.
+	allowedTokens []string
+	// introspection enables the token introspection mode if set.
+	introspection *introspection
+	// allowedSpiffeIDs enables the SPIFFE identity mode if set.
+	allowedSpiffeIDs []string
+	// rateLimiter limits the requests per rateLimitKeyName if set.
+	rateLimiter         rateLimiter
+	rateLimitKeyName    string
+	rateLimiterFailOpen bool
+	// enableExtProc serves the Envoy ext_proc API if set.
+	enableExtProc bool
+	// rateLimitService serves the Envoy RateLimitService if set.
+	rateLimitService *rateLimitService
+	// redis is shared by the Redis backed stores if redisAddr is set, it is created by open as the
+	// client starts a goroutine.
+	redis        *redis.Client
+	redisAddr    string
+	redisTimeout time.Duration
+	// bodyMustContain and bodyMustNotContain are checked against the first maxBodyBytes of the body.
+	bodyMustContain    []string
+	bodyMustNotContain []string
+	maxBodyBytes       int64
+	// celPolicy decides the request instead of the check header if set.
+	celPolicy *celExpression
+	// opa decides the request instead of the check header if set.
+	opa *opa
+	// delegate decides the request instead of the check header if set.
+	delegate *delegate
+	// readOnlyAllow allows the readOnlyMethods, optionsAllow allows the OPTIONS method.
+	readOnlyAllow bool
+	optionsAllow  bool
+	// files are the reloaded policy, API keys and htpasswd files. The policy is evaluated before the
+	// check header, the API keys and htpasswd enable their modes if set.
+	files fileReloader
+	// hmacSecret enables the HMAC signature mode if set.
+	hmacSecret  []byte
+	hmacMaxSkew time.Duration
+	// nonces denies the requests with a missing or replayed nonce if set.
+	nonces *nonceCache
+	// maintenanceMode is non-zero if all requests except the bypass paths are denied, it is accessed
+	// atomically as it is toggled at runtime.
+	maintenanceMode       int32
+	maintenanceAdmin      bool
+	maintenanceBody       string
+	maintenanceRetryAfter time.Duration
+	// sessions allows the requests with a valid session cookie if set.
+	sessions *sessionStore
+	// setCookie is set in the downstream response of the allowed requests if set, and also added
+	// to the upstream request if setCookieUpstream is set.
+	setCookie         *http.Cookie
+	setCookieUpstream bool
+	// resultHeader and resultDetailHeader are the lowercase names of the result headers, disabled if empty.
+	resultHeader       string
+	resultDetailHeader string
+	// version is the value of the versionHeader, disabled if empty.
+	version string
+	// deniedStatus and deniedBody are used by the gRPC denied response if the decision has none.
+	deniedStatus int
+	deniedBody   string
+	// redirectOnDeny is the login URL of the unauthenticated browser requests if set.
+	redirectOnDeny *url.URL
+	// bodyTemplate renders the denied body if set and the decision has no body.
+	bodyTemplate *bodyTemplate
+	// challenge is the WWW-Authenticate header of the denials for missing or invalid credentials.
+	challenge string
+	// deniedPage is used by the HTTP denied response if the decision has no status or body.
+	deniedPage *deniedPage
+	// grpcTLS and httpTLS serve the gRPC and HTTP listeners over TLS if set.
+	grpcTLS *tls.Config
+	httpTLS *tls.Config
+	// grpcCerts and httpCerts reload the key pairs of grpcTLS and httpTLS.
+	grpcCerts *certReloader
+	httpCerts *certReloader
+	// grpcTuning is applied to the gRPC server.
+	grpcTuning grpcTuning
+	// pathPrefix is stripped from the path of the HTTP check requests if set.
+	pathPrefix string
+	// singlePort serves gRPC and HTTP on the HTTP listener if set.
+	singlePort bool
+	// httpH2C serves h2c in addition to HTTP/1.1 on the plaintext HTTP listener if set.
+	httpH2C bool
+	// decisionCache caches the decisions if set.
+	decisionCache *decisionCache
+	// sampler allows a percentage of the denied requests if set.
+	sampler *sampler
+	// clock returns the time to evaluate the time windows, time.Now is used if nil.
+	clock func() time.Time
+
+	// health serves the gRPC health checking protocol, it is NOT_SERVING until the gRPC listener is up.
+	health *health.Server
+	// logger writes the decisions and the messages at logLevel or above, the per-request decision
+	// lines only if logDecisions is set.
+	logger       Logger
+	logLevel     int32
+	logDecisions bool
+	// stats holds the *decisionStats served on /stats of the admin server, it is not set if disabled
+	// or without the admin server.
+	stats atomic.Value
+	// slowCheckThreshold logs the stages of the slower check requests at the debug level if set.
+	slowCheckThreshold time.Duration
+	// history keeps the recent decisions for /debug/decisions on the admin server if set.
+	history *decisionHistory
+	// statsd sends the decision metrics to a StatsD server if set.
+	statsd *statsd
+	// auditLog writes the attributes of every decision if set.
+	auditLog *auditLog
+	// accessLog writes a line per decision if set.
+	accessLog *accessLog
+	// healthIncludeDependencies reflects the reachability of the dependencies in health if set.
+	healthIncludeDependencies bool
+	// unreachable holds the []string of the failed dependency checks for /readyz.
+	unreachable atomic.Value
+	// listening is non-zero once Start bound all listeners and draining once the shutdown started,
+	// /readyz is ready only in between.
+	listening int32
+	draining  int32
+	// proxyProtocol requires the PROXY protocol header on the TCP listeners if set.
+	proxyProtocol bool
+	// socketMode is the file mode of the Unix domain sockets.
+	socketMode os.FileMode
+	// bindAddress is the host of the bare port addresses, all interfaces if empty.
+	bindAddress string
+	// servers are stopped by shutdown.
+	servers servers
+	// shutdownGracePeriod is the time Stop waits for the in-flight checks.
+	shutdownGracePeriod time.Duration
+	// shutdownDelay is the time Stop reports not ready before closing the listeners.
+	shutdownDelay time.Duration
+	// running is the number of servers started by Start, each sends its serve error or nil to errs
+	// when it stops.
+	running int
+	errs    chan error
+	// stopped is closed once Stop returns.
+	stopped  chan struct{}
+	stopOnce sync.Once
+	// closeOnce releases the sinks and the background goroutines once.
+	closeOnce sync.Once
+
+	// addrs are the addresses of the listeners once Start returns.
+	addrs listenAddrs
+}
+
+// validate checks the server configuration before any listener is started.
+func (s *ExtAuthzServer) validate() error {
+	if s.checkHeader == "" {
+		return fmt.Errorf("check header must not be empty")
+	}
+	if !httpguts.ValidHeaderFieldName(s.checkHeader) {
+		return fmt.Errorf("invalid check header name %q", s.checkHeader)
+	}
+	if action := s.currentDefaultAction(); action != actionAllow && action != actionDeny {
+		return fmt.Errorf("default action must be %q or %q but got %q", actionAllow, actionDeny, action)
+	}
+	if s.allowedRegex != nil && len(s.allowedValues) != 0 {
+		return fmt.Errorf("allowed value regex and allowed values are mutually exclusive")
+	}
+	if s.allowedRegex == nil && len(s.allowedValues) == 0 {
+		return fmt.Errorf("at least one allowed value is required")
+	}
+	for v := range s.allowedValues {
+		if v == "" {
+			return fmt.Errorf("allowed value must not be empty")
+		}
+	}
+	return nil
+}
+
+// isAllowedValue returns true if the check header value is allowed.
+func (s *ExtAuthzServer) isAllowedValue(value string) bool {
+	value = s.normalizeValue(value)
+	if s.allowedRegex != nil {
+		return s.allowedRegex.MatchString(value)
+	}
+	return s.allowedValues[value]
+}
+
+// expectedValues returns the allowed values in a stable order for logging.
+func (s *ExtAuthzServer) expectedValues() string {
+	if s.allowedRegex != nil {
+		return "/" + s.allowedRegex.String() + "/"
+	}
+	values := make([]string, 0, len(s.allowedValues))
+	for v := range s.allowedValues {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	return strings.Join(values, ",")
+}
+
+// Check implements gRPC check request.
+func (s *ExtAuthzServer) Check(ctx context.Context, request *auth.CheckRequest) (*auth.CheckResponse, error) {
+	start := time.Now()
+	if request.GetAttributes().GetRequest().GetHttp() == nil {
+		return s.tcpCheck(request, start), nil
+	}
+	checkRequest := s.newGRPCCheckRequest(ctx, request)
+	stages := s.startStages(checkRequest, start)
+	defer s.finishStages("grpc", checkRequest, stages)
+	d := s.decide(checkRequest)
+	stages.evaluated()
+	s.metrics.observeCheck("grpc", d, start)
+	metadata := s.dynamicMetadata(d, time.Since(start))
+	s.logDecision("grpc", checkRequest, d, start, func(debug bool) string {
+		host, path := request.GetAttributes().GetRequest().GetHttp().GetHost(), s.redactPath(request.GetAttributes().GetRequest().GetHttp().GetPath())
+		if debug {
+			return fmt.Sprintf("[gRPC][%s]: %s%s with attributes %v, %s, rule=%s\n", d.tag(), host, path,
+				s.truncateLog(s.redactAttributes(request.GetAttributes())), d.reason, d.ruleName())
+		}
+		return fmt.Sprintf("[gRPC][%s]: %s %s%s, %s, rule=%s\n", d.tag(), checkRequest.method, host, path, d.reason, d.ruleName())
+	})
+	if d.allowed {
+		s.observeResponseHeaders(checkRequest)
+		return &auth.CheckResponse{
+			// The headers are added to the upstream request, the response headers to the downstream
+			// response.
+			HttpResponse: &auth.CheckResponse_OkResponse{
+				OkResponse: &auth.OkHttpResponse{
+					Headers:                 s.headerValueOptions(d),
+					ResponseHeadersToAdd:    s.downstreamHeaderValueOptions(checkRequest, d),
+					HeadersToRemove:         d.headersToRemove,
+					QueryParametersToSet:    queryParameters(d.querySet),
+					QueryParametersToRemove: d.queryRemove,
+				},
+			},
+			Status:          &status.Status{Code: int32(rpc.OK)},
+			DynamicMetadata: metadata,
+		}, nil
+	}
+
+	d = s.grpcDeniedDecision(checkRequest, d)
+	return &auth.CheckResponse{
+		HttpResponse: &auth.CheckResponse_DeniedResponse{
+			DeniedResponse: &auth.DeniedHttpResponse{
+				Status:  &typev3.HttpStatus{Code: typev3.StatusCode(d.status)},
+				Headers: s.headerValueOptions(d),
+				Body:    d.body,
+			},
+		},
+		Status:          &status.Status{Code: int32(rpc.PERMISSION_DENIED)},
+		DynamicMetadata: metadata,
+	}, nil
+}
+
+// grpcDeniedDecision returns the denied decision with the final status, body and headers of the
+// denied response of the gRPC check request.
+func (s *ExtAuthzServer) grpcDeniedDecision(request *checkRequest, d decision) decision {
+	if redirect, ok := s.redirected(request, d); ok {
+		d = redirect
+	} else {
+		d = s.challenged(d, http.StatusUnauthorized)
+	}
+	if d.status == 0 {
+		d.status = s.deniedStatus
+	}
+	if d.body == "" {
+		if body, ok := s.templateBody(request, d); ok {
+			d.body = body
+		} else {
+			d.body = s.deniedBody
+		}
+	}
+	if request.isGRPC() {
+		d = grpcDenied(d)
+	}
+	return d
+}
+
+// ServeHTTP implements the HTTP check request.
+func (s *ExtAuthzServer) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	start := time.Now()
+	if s.sessions != nil && request.URL.Path == loginPath {
+		s.login(response, request)
+		return
+	}
+	logPath := s.redactPath(request.URL.RequestURI())
+	if s.pathPrefix != "" {
+		stripped, ok := s.stripPathPrefix(request)
+		if !ok {
+			s.logDecision("http", s.newHTTPCheckRequest(request), decision{detail: "missing-path-prefix"}, start, func(bool) string {
+				return fmt.Sprintf("[HTTP][ denied]: %s %s%s without the path prefix %s, check the path_prefix of the Envoy HTTP service",
+					request.Method, request.Host, logPath, s.pathPrefix)
+			})
+			http.NotFound(response, request)
+			return
+		}
+		request = stripped
+		logPath = s.redactPath(request.URL.RequestURI()) + " (raw path " + logPath + ")"
+	}
+	checkRequest := s.newHTTPCheckRequest(request)
+	stages := s.startStages(checkRequest, start)
+	defer s.finishStages("http", checkRequest, stages)
+	d := s.decide(checkRequest)
+	stages.evaluated()
+	redirect, redirected := s.redirected(checkRequest, d)
+	if redirected {
+		d = redirect
+	}
+	s.metrics.observeCheck("http", d, start)
+	s.logDecision("http", checkRequest, d, start, func(debug bool) string {
+		if debug {
+			return fmt.Sprintf("[HTTP][%s]: %s %s%s %s with headers: %s, %s, rule=%s\n",
+				d.tag(), request.Method, request.Host, logPath, request.Proto, s.truncateLog(redactHeaders(request.Header)), d.reason, d.ruleName())
+		}
+		return fmt.Sprintf("[HTTP][%s]: %s %s%s %s, %s, rule=%s\n", d.tag(), request.Method, request.Host, logPath, request.Proto, d.reason, d.ruleName())
+	})
+	if d.allowed {
+		s.setHeaders(response.Header(), d)
+		if s.setCookie != nil {
+			http.SetCookie(response, s.setCookie)
+		}
+		response.WriteHeader(http.StatusOK)
+	} else {
+		if redirected {
+			s.setHeaders(response.Header(), d)
+			http.Redirect(response, request, d.headers["location"], d.status)
+			return
+		}
+		d = s.httpDenied(checkRequest, s.challenged(d, 0))
+		if checkRequest.isGRPC() {
+			d = grpcDenied(d)
+		}
+		s.setHeaders(response.Header(), d)
+		response.WriteHeader(d.deniedStatus())
+		if d.body != "" {
+			fmt.Fprint(response, d.body)
+		}
+	}
+}
+
+// headerValueOptions returns the response headers of the gRPC check response, the append
+// field is always set so the behavior doesn't depend on the Envoy default.
+func (s *ExtAuthzServer) headerValueOptions(d decision) []*core.HeaderValueOption {
+	var headers []*core.HeaderValueOption
+	for _, h := range s.responseHeaders(d) {
+		headers = append(headers, &core.HeaderValueOption{
+			Header: &core.HeaderValue{Key: h.name, Value: h.value},
+			Append: &wrappers.BoolValue{Value: s.appended(h.name, d)},
+		})
+	}
+	if d.allowed && s.setCookieUpstream {
+		for _, h := range s.setCookieHeaders() {
+			headers = append(headers, &core.HeaderValueOption{Header: &core.HeaderValue{Key: h.name, Value: h.value}})
+		}
+	}
+	return headers
+}
+
+type responseHeader struct {
+	name  string
+	value string
+}
+
+// responseHeadersWarnAfter is the number of the allowed gRPC check requests without any of the
+// -add-response-headers carried back before the warning that Envoy may ignore them.
+const responseHeadersWarnAfter = 100
+
+// observeResponseHeaders records if the allowed gRPC check request carries an added response header
+// back, e.g. from a client or a test that echoes it. The server never sees the downstream response,
+// so the headers never observed after responseHeadersWarnAfter checks are warned about once.
+func (s *ExtAuthzServer) observeResponseHeaders(request *checkRequest) {
+	if len(s.addResponseHeaders) == 0 || atomic.LoadInt32(&s.responseHeadersSeen) != 0 {
+		return
+	}
+	for _, t := range s.addResponseHeaders {
+		if request.header(t.name) != "" {
+			atomic.StoreInt32(&s.responseHeadersSeen, 1)
+			return
+		}
+	}
+	if atomic.AddUint32(&s.responseHeadersMissing, 1) == responseHeadersWarnAfter {
+		names := make([]string, 0, len(s.addResponseHeaders))
+		for _, t := range s.addResponseHeaders {
+			names = append(names, t.name)
+		}
+		s.logger.Warnf("none of the first %d allowed gRPC check requests carried back the -add-response-headers %s, "+
+			"Envoy before 1.17 silently ignores them", responseHeadersWarnAfter, strings.Join(names, ","))
+	}
+}
+
+// downstreamHeaderValueOptions returns the headers added to the downstream response of the allowed
+// request. The -add-response-headers overwrite unless they are in the -append-headers, the
+// set-cookie is always appended as there can be multiple of them.
+func (s *ExtAuthzServer) downstreamHeaderValueOptions(request *checkRequest, d decision) []*core.HeaderValueOption {
+	var headers []*core.HeaderValueOption
+	now := s.now()
+	for _, t := range s.addResponseHeaders {
+		headers = append(headers, &core.HeaderValueOption{
+			Header: &core.HeaderValue{Key: t.name, Value: t.expand(request, now)},
+			Append: &wrappers.BoolValue{Value: s.appended(t.name, d)},
+		})
+	}
+	for _, h := range s.setCookieHeaders() {
+		headers = append(headers, &core.HeaderValueOption{
+			Header: &core.HeaderValue{Key: h.name, Value: h.value},
+			Append: &wrappers.BoolValue{Value: true},
+		})
+	}
+	return headers
+}
+
+// responseHeaders returns the enabled result headers followed by the decision headers.
+func (s *ExtAuthzServer) responseHeaders(d decision) []responseHeader {
+	var headers []responseHeader
+	if s.resultHeader != "" {
+		headers = append(headers, responseHeader{name: s.resultHeader, value: d.result()})
+	}
+	if s.resultDetailHeader != "" {
+		headers = append(headers, responseHeader{name: s.resultDetailHeader, value: d.resultDetail()})
+	}
+	if s.version != "" {
+		headers = append(headers, responseHeader{name: versionHeader, value: s.version})
+	}
+	for _, name := range d.headerNames() {
+		headers = append(headers, responseHeader{name: name, value: d.headers[name]})
+	}
+	return headers
+}
+
+// appended returns true if the header is appended to the existing values instead of replacing
+// them, the headers that must overwrite the client values are never appended.
+func (s *ExtAuthzServer) appended(name string, d decision) bool {
+	return s.appendHeaders[name] && !d.overwrite[name]
+}
+
+// setHeaders sets the result header and the decision headers in the HTTP check response with the
+// same append semantics as the gRPC check response.
+func (s *ExtAuthzServer) setHeaders(header http.Header, d decision) {
+	for _, h := range s.responseHeaders(d) {
+		if s.appended(h.name, d) {
+			header.Add(h.name, h.value)
+		} else {
+			header.Set(h.name, h.value)
+		}
+	}
+}
+
+// startGRPC listens on the gRPC address and serves the gRPC server in the background.
+func (s *ExtAuthzServer) startGRPC(server *grpc.Server, grpcAddr string) error {
+	listener, err := s.listen(grpcAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for the gRPC server: %v", err)
+	}
+	s.addrs.set(nil, listener.Addr())
+	s.startServing()
+
+	s.logger.Infof("Starting gRPC server at %s (%s), serving the ext_authz v2 and v3 APIs", listener.Addr(), tlsMode(s.grpcTLS))
+	go func() {
+		defer s.logger.Infof("Stopped gRPC server")
+		// Serve returns ErrServerStopped if Stop is called before it starts serving.
+		if err := server.Serve(listener); err != nil && err != grpc.ErrServerStopped {
+			s.errs <- fmt.Errorf("failed to serve gRPC server: %v", err)
+			return
+		}
+		s.errs <- nil
+	}()
+	return nil
+}
+
+// newGRPCServer returns the gRPC server with the ext_authz and health services registered.
+func (s *ExtAuthzServer) newGRPCServer(options ...grpc.ServerOption) *grpc.Server {
+	server := grpc.NewServer(append(options, s.metrics.serverOptions()...)...)
+	auth.RegisterAuthorizationServer(server, s)
+	authv2.RegisterAuthorizationServer(server, authorizationV2{s: s})
+	healthpb.RegisterHealthServer(server, s.health)
+	if s.rateLimitService != nil {
+		rls.RegisterRateLimitServiceServer(server, s.rateLimitService)
+	}
+	if s.enableExtProc {
+		extproc.RegisterExternalProcessorServer(server, externalProcessor{s: s})
+	}
+	if s.enableChannelz {
+		channelzsvc.RegisterChannelzServiceToServer(server)
+	}
+	return server
+}
+
+// startServing reports SERVING in the health service once the gRPC listener is up.
+func (s *ExtAuthzServer) startServing() {
+	s.health.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+}
+
+// newHTTPServer returns the HTTP server of the handler, served over TLS if configured or h2c if
+// allowH2C is set.
+func (s *ExtAuthzServer) newHTTPServer(handler http.Handler, allowH2C bool) *http.Server {
+	if s.httpTLS == nil && allowH2C {
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+	return &http.Server{Handler: handler, TLSConfig: s.httpTLS}
+}
+
+// serveHTTP serves the HTTP server on the listener until it is shut down.
+func serveHTTP(server *http.Server, listener net.Listener) error {
+	var err error
+	if server.TLSConfig != nil {
+		err = server.ServeTLS(listener, "", "")
+	} else {
+		err = server.Serve(listener)
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// startHTTP listens on the HTTP address and serves the HTTP server in the background.
+func (s *ExtAuthzServer) startHTTP(server *http.Server, httpAddr string) error {
+	listener, err := s.listen(httpAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for the HTTP server: %v", err)
+	}
+	s.addrs.set(listener.Addr(), nil)
+
+	if s.httpTLS != nil {
+		s.logger.Infof("Starting HTTP server at https://%s (%s)", listener.Addr(), tlsMode(s.httpTLS))
+	} else {
+		s.logger.Infof("Starting HTTP server at http://%s (h2c: %v)", listener.Addr(), s.httpH2C)
+	}
+	go func() {
+		defer s.logger.Infof("Stopped HTTP server")
+		if err := serveHTTP(server, listener); err != nil {
+			s.errs <- fmt.Errorf("failed to serve HTTP server: %v", err)
+			return
+		}
+		s.errs <- nil
+	}()
+	return nil
+}
+
+// Start listens on the HTTP and gRPC addresses and serves the check requests in the background
+// until Stop is called. An address is a port on the bind address, a host:port or a Unix domain
+// socket like unix:///var/run/ext_authz.sock, port 0 picks a free port. Either server is skipped if
+// its address is Disabled. The gRPC address is not used in the single port mode. /readyz reports
+// ready once Start returns nil.
+func (s *ExtAuthzServer) Start(httpAddr, grpcAddr string) error {
+	if err := s.start(httpAddr, grpcAddr); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&s.listening, 1)
+	if deps := s.dependencies(); s.healthIncludeDependencies && len(deps) > 0 {
+		go s.watchDependencies(deps)
+	}
+	return nil
+}
+
+func (s *ExtAuthzServer) start(httpAddr, grpcAddr string) error {
+	httpAddr, grpcAddr, err := s.listenAddresses(httpAddr, grpcAddr)
+	if err != nil {
+		return err
+	}
+	if s.singlePort {
+		// Only the max receive message size of the tuning applies, the connections are served by net/http.
+		grpcServer := s.newGRPCServer(s.grpcTuning.serverOptions()...)
+		handler := newSinglePortHandler(grpcServer, s)
+		httpServer := s.newHTTPServer(handler, true)
+		s.setServers(grpcServer, httpServer)
+		s.servers.mu.Lock()
+		s.servers.singlePort = handler
+		s.servers.mu.Unlock()
+		if err := s.startSinglePort(httpServer, httpAddr); err != nil {
+			return err
+		}
+		s.running = 1
+		return s.startAdminIfEnabled()
+	}
+
+	options := s.grpcTuning.serverOptions()
+	if s.grpcTLS != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(s.grpcTLS)))
+	}
+	var grpcServer *grpc.Server
+	if grpcAddr != Disabled {
+		grpcServer = s.newGRPCServer(options...)
+	}
+	var httpServer *http.Server
+	if httpAddr != Disabled {
+		httpServer = s.newHTTPServer(s, s.httpH2C)
+	}
+	s.setServers(grpcServer, httpServer)
+	s.addrs.mu.Lock()
+	s.addrs.httpDisabled, s.addrs.grpcDisabled = httpServer == nil, grpcServer == nil
+	s.addrs.mu.Unlock()
+	if grpcServer == nil {
+		s.logger.Infof("gRPC server is disabled")
+	} else {
+		if err := s.startGRPC(grpcServer, grpcAddr); err != nil {
+			return err
+		}
+		s.running++
+	}
+	if httpServer == nil {
+		s.logger.Infof("HTTP server is disabled")
+	} else {
+		if err := s.startHTTP(httpServer, httpAddr); err != nil {
+			s.closeServers()
+			return err
+		}
+		s.running++
+	}
+	return s.startAdminIfEnabled()
+}
+
+// startAdminIfEnabled starts the admin server if the admin address is set, the other servers are
+// closed if it fails.
+func (s *ExtAuthzServer) startAdminIfEnabled() error {
+	if s.adminAddr == "" {
+		return nil
+	}
+	server := &http.Server{Handler: s.adminHandler()}
+	s.servers.mu.Lock()
+	s.servers.admin = server
+	s.servers.mu.Unlock()
+	if err := s.startAdmin(server); err != nil {
+		s.closeServers()
+		return err
+	}
+	s.running++
+	return nil
+}
+
+// parseList splits a comma-separated flag value, trimming whitespace and dropping empty entries.
+func parseList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// NewExtAuthzServer creates the server from the DefaultConfig changed by the options.
+func NewExtAuthzServer(opts ...Option) (*ExtAuthzServer, error) {
+	c := DefaultConfig()
+	for _, opt := range opts {
+		opt(&c)
+	}
+	s, err := newServer(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.open(c.WatchConfig); err != nil {
+		s.close()
+		return nil, err
+	}
+	s.logger.Infof("Default action is %s", s.currentDefaultAction())
+	return s, nil
+}
+
+// ValidateConfig validates the configuration including the referenced files, the regular
+// expressions, the CEL policy and the listen addresses. Unlike NewExtAuthzServer it opens no sinks,
+// starts no watchers or goroutines and connects to no dependencies.
+func ValidateConfig(c Config, httpAddr, grpcAddr string) error {
+	s, err := newServer(c)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	_, _, err = s.listenAddresses(httpAddr, grpcAddr)
+	return err
+}
+
+// newServer parses and validates the configuration, the sinks, watchers and background goroutines
+// are only started by open.
+func newServer(c Config) (*ExtAuthzServer, error) {
+	s := &ExtAuthzServer{
+		checkHeader:    strings.ToLower(c.CheckHeader),
+		allowedValues:  map[string]bool{},
+		readOnlyAllow:  c.ReadOnlyAllow,
+		xffTrustedHops: c.XFFTrustedHops,
+		optionsAllow:   c.OptionsAllow,
+		health:         health.NewServer(),
+		errs:           make(chan error, 3),
+		stopped:        make(chan struct{}),
+		logger:         c.Logger,
+	}
+	// The steps log with the logger of configureLogging, the later ones depend on the admin server
+	// and Redis parsed before.
+	if err := s.configureLogging(c); err != nil {
+		return nil, err
+	}
+	if err := s.configureSinks(c); err != nil {
+		return nil, err
+	}
+	if err := s.configureAdmin(c); err != nil {
+		return nil, err
+	}
+	if err := s.configureRequestChecks(c); err != nil {
+		return nil, err
+	}
+	if err := s.configureLimits(c); err != nil {
+		return nil, err
+	}
+	if err := s.configureCredentials(c); err != nil {
+		return nil, err
+	}
+	if err := s.configurePolicy(c); err != nil {
+		return nil, err
+	}
+	if err := s.configureResponses(c); err != nil {
+		return nil, err
+	}
+	if err := s.configureListeners(c); err != nil {
+		return nil, err
+	}
+	if err := s.loadFiles(c); err != nil {
+		return nil, err
+	}
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// configureLogging sets up the logger and the decision logging, the other steps log with it.
+func (s *ExtAuthzServer) configureLogging(c Config) error {
+	switch c.LogFormat {
+	case LogFormatText:
+		if s.logger == nil {
+			s.logger = NewTextLogger(nil)
+		}
+	case LogFormatJSON:
+		if s.logger == nil {
+			s.logger = NewJSONLogger(os.Stderr)
+		}
+	default:
+		return fmt.Errorf("-log-format must be %s or %s but got %q", LogFormatText, LogFormatJSON, c.LogFormat)
+	}
+	level, err := parseLogLevel(c.LogLevel)
+	if err != nil {
+		return fmt.Errorf("invalid -log-level: %v", err)
+	}
+	s.logLevel = level
+	s.logger = leveledLogger{Logger: s.logger, s: s}
+	s.logDecisions = c.LogDecisions
+	s.slowCheckThreshold = c.SlowCheckThreshold
+	return nil
+}
+
+// configureSinks parses the access log, StatsD, audit log and tracing sinks, open starts them.
+func (s *ExtAuthzServer) configureSinks(c Config) error {
+	var err error
+	if c.AccessLogPath != "" {
+		if s.accessLog, err = newAccessLog(c.AccessLogPath, c.AccessLogFormat, s.logger); err != nil {
+			return err
+		}
+	}
+	if c.StatsdAddr != "" {
+		if s.statsd, err = newStatsd(c.StatsdAddr, c.StatsdTagsFormat, s.logger); err != nil {
+			return err
+		}
+	}
+	if c.AuditLogPath != "" {
+		if s.auditLog, err = newAuditLog(c.AuditLogPath, c.AuditLogMaxMB, s.logger); err != nil {
+			return err
+		}
+	}
+	if c.Tracing {
+		tracer, err := newTracer(s.logger)
+		if err != nil {
+			return fmt.Errorf("invalid -tracing configuration: %v", err)
+		}
+		s.tracer = tracer
+	}
+	return nil
+}
+
+// configureAdmin parses the admin server and the endpoints served only on it.
+func (s *ExtAuthzServer) configureAdmin(c Config) error {
+	if c.AdminPort != "" {
+		addr, err := adminAddress(c.AdminPort)
+		if err != nil {
+			return fmt.Errorf("invalid -admin-port: %v", err)
+		}
+		s.adminAddr, s.adminToken = addr, c.AdminToken
+	}
+	if c.Stats && s.adminAddr != "" {
+		s.resetStats()
+	}
+	if c.EnablePprof && s.adminAddr == "" {
+		return fmt.Errorf("-enable-pprof requires -admin-port, the debug endpoints are only served on the admin server")
+	}
+	s.enablePprof = c.EnablePprof
+	s.enableChannelz = c.EnableChannelz
+	if c.EnableChannelz && s.adminAddr != "" {
+		s.channelz = &channelzClient{}
+	}
+	if c.DecisionHistory < 0 {
+		return fmt.Errorf("-decision-history must not be negative but got %d", c.DecisionHistory)
+	}
+	if c.DecisionHistory > 0 && s.adminAddr != "" {
+		s.history = newDecisionHistory(c.DecisionHistory)
+	}
+	switch c.Metrics {
+	case "":
+	case metricsAdmin:
+		if s.adminAddr == "" {
+			return fmt.Errorf("-metrics=%s requires -admin-port, the metrics are never served on the check listeners", metricsAdmin)
+		}
+		s.metrics = newMetrics()
+	default:
+		return fmt.Errorf("-metrics must be %s or empty but got %q", metricsAdmin, c.Metrics)
+	}
+	return nil
+}
+
+// configureRequestChecks parses the checks of the request attributes, e.g. the check header,
+// the hosts, headers, query and body, and the mutations of the allowed upstream request.
+func (s *ExtAuthzServer) configureRequestChecks(c Config) error {
+	if !validValueMatch(c.ValueMatch) {
+		return fmt.Errorf("-value-match must be %s, %s or %s but got %q", valueMatchExact, valueMatchCaseInsensitive, valueMatchTrimmed, c.ValueMatch)
+	}
+	s.valueMatch = c.ValueMatch
+	s.setRuntime(c.DefaultAction, forceNone)
+	if c.AllowedValueRegex != "" {
+		if c.AllowedValue != "" || c.AllowedValues != "" {
+			return fmt.Errorf("-allowed-value-regex is mutually exclusive with -allowed-value and -allowed-values")
+		}
+		expr := c.AllowedValueRegex
+		if s.valueMatch == valueMatchCaseInsensitive {
+			expr = "(?i)" + expr
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("invalid -allowed-value-regex: %v", err)
+		}
+		s.allowedRegex = re
+	} else if c.AllowedValue != "" {
+		s.allowedValues[s.normalizeValue(c.AllowedValue)] = true
+	} else if c.AllowedValues == "" {
+		// The default allowed value only applies if no explicit list is given.
+		s.allowedValues[defaultAllowedValue] = true
+	}
+	for _, v := range parseList(c.AllowedValues) {
+		s.allowedValues[s.normalizeValue(v)] = true
+	}
+	for _, h := range parseList(c.DeniedHosts) {
+		pattern, err := parseHostPattern(h)
+		if err != nil {
+			return fmt.Errorf("invalid -denied-hosts: %v", err)
+		}
+		s.deniedHosts = append(s.deniedHosts, pattern)
+	}
+	for _, name := range parseList(c.ForbiddenHeaders) {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return fmt.Errorf("invalid -forbidden-headers: invalid header name %q", name)
+		}
+		s.forbiddenHeaders = append(s.forbiddenHeaders, strings.ToLower(name))
+	}
+	s.stripHeaders = c.StripHeaders
+	if s.stripHeaders && len(s.forbiddenHeaders) != 0 {
+		// The HTTP check response cannot remove headers from the upstream request.
+		s.logger.Infof("Removing headers %v from the allowed gRPC check requests", s.forbiddenHeaders)
+	}
+	for _, name := range parseList(c.StripRequestHeaders) {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return fmt.Errorf("invalid -strip-request-headers: invalid header name %q", name)
+		}
+		s.stripRequestHeaders = append(s.stripRequestHeaders, strings.ToLower(name))
+	}
+	if len(s.stripRequestHeaders) != 0 {
+		s.logger.Infof("Removing headers %v from the allowed gRPC check requests, the HTTP check response cannot remove headers "+
+			"so the HTTP ext_authz mode must strip them in Envoy instead", s.stripRequestHeaders)
+	}
+	if c.MaxHeaderBytesTotal < 0 || c.MaxHeaderValueLen < 0 || c.MaxPathLen < 0 || c.LogMaxLen < 0 {
+		return fmt.Errorf("-max-header-bytes-total, -max-header-value-len, -max-path-len and -log-max-len must not be negative")
+	}
+	s.sizeLimits = sizeLimits{maxHeaderBytesTotal: c.MaxHeaderBytesTotal, maxHeaderValueLen: c.MaxHeaderValueLen, maxPathLen: c.MaxPathLen}
+	s.logMaxLen = c.LogMaxLen
+	s.detectPathTraversal = c.DetectPathTraversal
+	types, err := parseMediaTypes(parseList(c.AllowedContentTypes))
+	if err != nil {
+		return fmt.Errorf("invalid -allowed-content-types: %v", err)
+	}
+	s.allowedContentTypes = types
+	s.requireContentType = c.RequireContentType
+	if s.deniedUserAgents, err = parseUserAgentPatterns(parseList(c.DeniedUserAgents)); err != nil {
+		return fmt.Errorf("invalid -denied-user-agents: %v", err)
+	}
+	if s.allowedUserAgents, err = parseUserAgentPatterns(parseList(c.AllowedUserAgents)); err != nil {
+		return fmt.Errorf("invalid -allowed-user-agents: %v", err)
+	}
+	if s.requiredHeaders, err = parseHeaderRequirements(c.RequiredHeaders); err != nil {
+		return fmt.Errorf("invalid -required-headers: %v", err)
+	}
+	if len(s.requiredHeaders) != 0 {
+		s.logger.Infof("Requiring %d headers instead of the check header", len(s.requiredHeaders))
+	}
+	queries, err := parseQueryRequirements(c.RequiredQuery)
+	if err != nil {
+		return fmt.Errorf("invalid -required-query: %v", err)
+	}
+	s.requiredQuery = queries
+	if s.addHeaders, err = parseHeaderTemplates(c.AddHeaders); err != nil {
+		return fmt.Errorf("invalid -add-headers: %v", err)
+	}
+	if s.addResponseHeaders, err = parseHeaderTemplates(c.AddResponseHeaders); err != nil {
+		return fmt.Errorf("invalid -add-response-headers: %v", err)
+	}
+	if len(s.addResponseHeaders) != 0 {
+		// The server never sees the downstream response, observeResponseHeaders warns if the headers
+		// are never carried back.
+		s.logger.Infof("Adding %d headers to the downstream responses of the allowed gRPC check requests, "+
+			"they are silently ignored by Envoy before 1.17", len(s.addResponseHeaders))
+	}
+	if s.setQuery, err = parseQueryRequirements(c.SetQuery); err != nil {
+		return fmt.Errorf("invalid -set-query: %v", err)
+	}
+	s.removeQuery = parseList(c.RemoveQuery)
+	if len(s.setQuery) != 0 || len(s.removeQuery) != 0 {
+		// The HTTP check response cannot mutate the query of the upstream request.
+		s.logger.Infof("Setting query %s and removing query %s in the allowed gRPC check requests, requires Envoy 1.21 or later",
+			c.SetQuery, c.RemoveQuery)
+	}
+	s.allowedTokens = parseList(c.AllowedTokens)
+	s.bodyMustContain = parseList(c.BodyMustContain)
+	s.bodyMustNotContain = parseList(c.BodyMustNotContain)
+	s.maxBodyBytes = c.BodyMaxBytes
+	if s.bodyRulesEnabled() && s.maxBodyBytes <= 0 {
+		return fmt.Errorf("-body-max-bytes must be positive")
+	}
+	if s.tcpAllowedCIDRs, err = parseCIDRs(c.TCPAllowedCIDRs); err != nil {
+		return fmt.Errorf("invalid -tcp-allowed-cidrs: %v", err)
+	}
+	if s.tcpAllowedPorts, err = parsePorts(c.TCPAllowedPorts); err != nil {
+		return fmt.Errorf("invalid -tcp-allowed-ports: %v", err)
+	}
+	if s.allowedCIDRs, err = parseCIDRs(c.AllowedCIDRs); err != nil {
+		return fmt.Errorf("invalid -allowed-cidrs: %v", err)
+	}
+	for _, p := range parseList(c.BypassPaths) {
+		s.bypassPaths = append(s.bypassPaths, strings.TrimRight(p, "/"))
+	}
+	return nil
+}
+
+// configureLimits parses Redis and the rate limits stored in it if set, or in memory otherwise.
+func (s *ExtAuthzServer) configureLimits(c Config) error {
+	if c.RedisAddr != "" {
+		if c.RedisTimeout <= 0 {
+			return fmt.Errorf("-redis-timeout must be positive")
+		}
+		s.redisAddr, s.redisTimeout = c.RedisAddr, c.RedisTimeout
+	}
+	if c.RateLimitQPS > 0 {
+		if c.RateLimitBurst <= 0 {
+			return fmt.Errorf("-rate-limit-burst must be positive")
+		}
+		if c.RateLimitKey != rateLimitKeySourceIP && !httpguts.ValidHeaderFieldName(c.RateLimitKey) {
+			return fmt.Errorf("invalid -rate-limit-key %q", c.RateLimitKey)
+		}
+		s.rateLimitKeyName = strings.ToLower(c.RateLimitKey)
+		s.rateLimiterFailOpen = c.LimiterFailOpen
+		if s.redisAddr != "" {
+			s.rateLimiter = newRedisRateLimiter(nil, c.RateLimitQPS, c.RateLimitBurst, c.RedisTimeout)
+			s.logger.Infof("Rate limiting %v qps with burst %d per %s in Redis %s (fail open: %v)",
+				c.RateLimitQPS, c.RateLimitBurst, s.rateLimitKeyName, c.RedisAddr, c.LimiterFailOpen)
+		} else {
+			s.rateLimiter = newLocalRateLimiter(c.RateLimitQPS, c.RateLimitBurst, s.logger)
+			s.logger.Infof("Rate limiting %v qps with burst %d per %s", c.RateLimitQPS, c.RateLimitBurst, s.rateLimitKeyName)
+		}
+	}
+	if c.EnableRateLimitService {
+		limit, err := parseRequestsPerUnit(c.RateLimitServiceLimit)
+		if err != nil {
+			return fmt.Errorf("invalid -ratelimit-service-limit: %v", err)
+		}
+		s.rateLimitService = newRateLimitService(limit, nil, c.RedisTimeout, c.LimiterFailOpen, s.logger, s.decisionsLogged)
+		s.logger.Infof("Serving the rate limit service with default limit %s (fail open: %v)", limit, c.LimiterFailOpen)
+	}
+	return nil
+}
+
+// configureCredentials parses the credential modes, the nonces and the session cookies. The API
+// key quotas are stored in Redis if set by configureLimits.
+func (s *ExtAuthzServer) configureCredentials(c Config) error {
+	var err error
+	if c.JWTHS256Secret != "" {
+		s.jwtSecret = []byte(c.JWTHS256Secret)
+		s.logger.Infof("Validating HS256 bearer tokens instead of the check header")
+	}
+	if c.JWKSURL != "" {
+		s.jwks = newJWKS(c.JWKSURL, c.JWKSRefreshInterval, s.logger)
+		s.logger.Infof("Validating bearer tokens with JWKS %s instead of the check header", c.JWKSURL)
+	}
+	if c.HtpasswdFile != "" {
+		if _, err := os.Stat(c.HtpasswdFile); err != nil {
+			return fmt.Errorf("failed to read htpasswd file: %v", err)
+		}
+		s.files.htpasswdFile = c.HtpasswdFile
+		s.basicAuthRealm = c.BasicAuthRealm
+		s.logger.Infof("Validating basic auth credentials with %s instead of the check header", c.HtpasswdFile)
+	}
+	if c.LDAPURL != "" {
+		if c.LDAPBaseDN == "" {
+			return fmt.Errorf("-ldap-base-dn is required with -ldap-url")
+		}
+		if c.LDAPTimeout <= 0 {
+			return fmt.Errorf("-ldap-timeout must be positive")
+		}
+		if c.LDAPStartTLS && strings.HasPrefix(c.LDAPURL, "ldaps://") {
+			return fmt.Errorf("-ldap-start-tls cannot be used with ldaps://")
+		}
+		a, err := newLDAPAuth(c.LDAPURL, c.LDAPBaseDN, c.LDAPUserAttr, c.LDAPBindDN, c.LDAPBindPassword, c.LDAPCAFile,
+			c.LDAPStartTLS, c.LDAPTimeout, c.LDAPNegativeCacheTTL)
+		if err != nil {
+			return err
+		}
+		s.ldap = a
+		s.basicAuthRealm = c.BasicAuthRealm
+		s.logger.Infof("Validating basic auth credentials with LDAP server %s instead of the check header", c.LDAPURL)
+	}
+	if c.APIKeysFile != "" {
+		if !httpguts.ValidHeaderFieldName(c.APIKeyHeader) {
+			return fmt.Errorf("invalid -api-key-header %q", c.APIKeyHeader)
+		}
+		s.files.apiKeysFile = c.APIKeysFile
+		if s.redisAddr != "" {
+			s.quotas = &redisQuotaCounter{timeout: c.RedisTimeout}
+		} else {
+			s.quotas = &localQuotaCounter{}
+		}
+		s.apiKeyHeader = strings.ToLower(c.APIKeyHeader)
+		s.logger.Infof("Validating the API keys of %s in %s instead of the check header", c.APIKeysFile, s.apiKeyHeader)
+	}
+	if c.IntrospectionURL != "" {
+		if c.IntrospectionTimeout <= 0 {
+			return fmt.Errorf("-introspection-timeout must be positive")
+		}
+		s.introspection = &introspection{
+			url:          c.IntrospectionURL,
+			clientID:     c.IntrospectionClientID,
+			clientSecret: c.IntrospectionClientSecret,
+			timeout:      c.IntrospectionTimeout,
+			failOpen:     c.FailOpen,
+			cacheTTL:     c.IntrospectionCacheTTL,
+			client:       &http.Client{},
+		}
+		s.logger.Infof("Validating bearer tokens with introspection endpoint %s instead of the check header (fail open: %v)",
+			c.IntrospectionURL, c.FailOpen)
+	}
+	for _, id := range parseList(c.AllowedSpiffeIDs) {
+		pattern, err := parseSpiffePattern(id)
+		if err != nil {
+			return fmt.Errorf("invalid -allowed-spiffe-ids: %v", err)
+		}
+		s.allowedSpiffeIDs = append(s.allowedSpiffeIDs, pattern)
+	}
+	if c.HMACSecret != "" {
+		if c.HMACMaxSkew <= 0 {
+			return fmt.Errorf("-hmac-max-skew must be positive")
+		}
+		s.hmacSecret = []byte(c.HMACSecret)
+		s.hmacMaxSkew = c.HMACMaxSkew
+		s.logger.Infof("Validating %s signatures with max skew %v instead of the check header", SignatureHeader, c.HMACMaxSkew)
+	}
+	if c.RequireNonce {
+		if c.NonceWindow <= 0 || c.NonceMaxEntries <= 0 {
+			return fmt.Errorf("-nonce-window and -nonce-max-entries must be positive")
+		}
+		s.nonces = newNonceCache(c.NonceWindow, c.NonceMaxEntries, s.logger)
+		s.logger.Infof("Requiring unique %s headers within %v", NonceHeader, c.NonceWindow)
+	}
+	if c.SessionCookieName != "" {
+		if c.SessionSecret == "" {
+			return fmt.Errorf("-session-secret is required with -session-cookie-name")
+		}
+		if c.SessionTTL <= 0 || c.SessionMaxEntries <= 0 {
+			return fmt.Errorf("-session-ttl and -session-max-entries must be positive")
+		}
+		s.sessions = newSessionStore(c.SessionCookieName, []byte(c.SessionSecret), c.SessionTTL, c.SessionMaxEntries)
+		s.logger.Infof("Allowing session cookie %s issued by %s with TTL %v", c.SessionCookieName, loginPath, c.SessionTTL)
+	}
+	s.jwtIssuers = parseList(c.JWTIssuers)
+	if c.JWTIssuer != "" {
+		s.jwtIssuers = append(s.jwtIssuers, c.JWTIssuer)
+	}
+	s.jwtAudiences = parseList(c.JWTAudiences)
+	if c.JWTAudience != "" {
+		s.jwtAudiences = append(s.jwtAudiences, c.JWTAudience)
+	}
+	if c.JWTClockSkew < 0 {
+		return fmt.Errorf("-jwt-clock-skew must not be negative but got %v", c.JWTClockSkew)
+	}
+	s.jwtClockSkew = c.JWTClockSkew
+	if s.claimHeaders, err = parseClaimHeaders(c.ClaimToHeader); err != nil {
+		return fmt.Errorf("invalid -claim-to-header: %v", err)
+	}
+	return nil
+}
+
+// configurePolicy parses the CEL, OPA and webhook policies, the decision cache and the sampling
+// of the denied requests.
+func (s *ExtAuthzServer) configurePolicy(c Config) error {
+	if c.CELPolicy != "" {
+		expr, err := compileCEL(c.CELPolicy)
+		if err != nil {
+			return err
+		}
+		s.celPolicy = expr
+		s.logger.Infof("Evaluating CEL policy %q instead of the check header", c.CELPolicy)
+	}
+	if c.OPAURL != "" {
+		if c.OPATimeout <= 0 {
+			return fmt.Errorf("-opa-timeout must be positive")
+		}
+		s.opa = &opa{
+			url:      c.OPAURL,
+			timeout:  c.OPATimeout,
+			failOpen: c.OPAFailOpen,
+			cacheTTL: c.OPACacheTTL,
+			client:   &http.Client{},
+		}
+		s.logger.Infof("Delegating decisions to OPA %s instead of the check header (fail open: %v)", c.OPAURL, c.OPAFailOpen)
+	}
+	if c.DelegateURL != "" {
+		if c.DelegateTimeout <= 0 {
+			return fmt.Errorf("-delegate-timeout must be positive")
+		}
+		var headers []string
+		for _, name := range parseList(c.DelegateHeaders) {
+			if !httpguts.ValidHeaderFieldName(name) {
+				return fmt.Errorf("invalid -delegate-headers: invalid header name %q", name)
+			}
+			headers = append(headers, strings.ToLower(name))
+		}
+		s.delegate = newDelegate(c.DelegateURL, headers, c.DelegateTimeout, c.DelegateFailOpen)
+		s.logger.Infof("Delegating decisions to webhook %s instead of the check header (fail open: %v)", c.DelegateURL, c.DelegateFailOpen)
+	}
+	if c.CacheTTL > 0 {
+		if c.CacheSize <= 0 {
+			return fmt.Errorf("-cache-size must be positive")
+		}
+		var ignored []string
+		for _, name := range parseList(c.CacheIgnoredHeaders) {
+			if !httpguts.ValidHeaderFieldName(name) {
+				return fmt.Errorf("invalid -cache-ignored-headers: invalid header name %q", name)
+			}
+			ignored = append(ignored, strings.ToLower(name))
+		}
+		s.decisionCache = newDecisionCache(c.CacheTTL, c.CacheSize, ignored, s.logger)
+		s.logger.Infof("Caching decisions for %v of at most %d requests", c.CacheTTL, c.CacheSize)
+	}
+	if c.AllowPercentage < 0 || c.AllowPercentage > 100 {
+		return fmt.Errorf("-allow-percentage must be between 0 and 100 but got %v", c.AllowPercentage)
+	}
+	if c.AllowPercentage > 0 {
+		seedValue := c.Seed
+		if seedValue == 0 {
+			seedValue = time.Now().UnixNano()
+		}
+		s.sampler = newSampler(c.AllowPercentage, seedValue)
+		s.logger.Infof("Allowing %v%% of the denied requests by sampling with seed %d", c.AllowPercentage, seedValue)
+	}
+	return nil
+}
+
+// configureResponses parses the denied responses, the maintenance mode and the headers added to
+// the check responses. The maintenance toggle requires the admin server of configureAdmin.
+func (s *ExtAuthzServer) configureResponses(c Config) error {
+	var err error
+	if c.DeniedStatus < 400 || c.DeniedStatus > 599 {
+		return fmt.Errorf("-denied-status must be a 4xx or 5xx status but got %d", c.DeniedStatus)
+	}
+	s.deniedStatus = c.DeniedStatus
+	s.deniedBody = c.DeniedBody
+	if !httpguts.ValidHeaderFieldValue(c.Challenge) {
+		return fmt.Errorf("invalid -challenge %q", c.Challenge)
+	}
+	s.challenge = c.Challenge
+	if c.DeniedBodyTemplateFile != "" {
+		if s.bodyTemplate, err = loadBodyTemplate(c.DeniedBodyTemplateFile); err != nil {
+			return err
+		}
+	}
+	if s.redirectOnDeny, err = parseRedirectURL(c.RedirectOnDenyURL); err != nil {
+		return fmt.Errorf("invalid -redirect-on-deny-url: %v", err)
+	}
+	for _, name := range []string{c.ResultHeader, c.ResultDetailHeader} {
+		if name != "" && !httpguts.ValidHeaderFieldName(name) {
+			return fmt.Errorf("invalid -result-header or -result-detail-header: invalid header name %q", name)
+		}
+	}
+	s.resultHeader = strings.ToLower(c.ResultHeader)
+	s.resultDetailHeader = strings.ToLower(c.ResultDetailHeader)
+	if c.VersionHeader {
+		s.version = GetBuildInfo().header()
+	}
+	if s.deniedPage, err = newDeniedPage(c.HTTPDeniedStatus, c.HTTPDeniedBody, c.HTTPDeniedBodyFile, c.HTTPDeniedContentType, c.HTTPDeniedRealm, s.logger); err != nil {
+		return err
+	}
+	if c.MaintenanceAdmin && s.adminAddr == "" {
+		return fmt.Errorf("-maintenance-admin requires -admin-port, the toggle is never served on the check listeners")
+	}
+	s.maintenanceAdmin = c.MaintenanceAdmin
+	s.maintenanceBody = c.MaintenanceBody
+	s.maintenanceRetryAfter = c.MaintenanceRetryAfter
+	s.setMaintenance(c.Maintenance)
+	if c.Maintenance {
+		s.logger.Infof("Starting in the maintenance mode")
+	}
+	if s.setCookie, err = newSetCookie(c.SetCookie, c.SetCookiePath, c.SetCookieMaxAge, c.SetCookieHTTPOnly, c.SetCookieSecure); err != nil {
+		return fmt.Errorf("invalid -set-cookie: %v", err)
+	}
+	s.setCookieUpstream = c.SetCookieUpstream
+	s.emitDynamicMetadata = c.EmitDynamicMetadata
+	s.exposeRuleHeader = c.ExposeRuleHeader
+	s.echoRequestInfo = c.EchoRequestInfo
+	s.echoMaxLen = c.EchoMaxLen
+	if s.echoRequestInfo {
+		s.logger.Infof("Echoing the check request summary in the %s header, max length %d", receivedHeader, s.echoMaxLen)
+	}
+	s.appendHeaders = map[string]bool{}
+	for _, name := range parseList(c.AppendHeaders) {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return fmt.Errorf("invalid -append-headers: invalid header name %q", name)
+		}
+		s.appendHeaders[strings.ToLower(name)] = true
+	}
+	return nil
+}
+
+// configureListeners parses the health, shutdown, TLS and listener options of the servers.
+func (s *ExtAuthzServer) configureListeners(c Config) error {
+	var err error
+	s.enableExtProc = c.EnableExtProc
+	s.health.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	s.healthIncludeDependencies = c.HealthIncludeDependencies
+	s.shutdownGracePeriod = c.ShutdownGracePeriod
+	s.shutdownDelay = c.ShutdownDelay
+	if s.grpcTLS, s.grpcCerts, err = newServerTLSConfig("grpc", c.GRPCTLSCert, c.GRPCTLSKey, c.GRPCTLSClientCA, s.logger); err != nil {
+		return err
+	}
+	mode, err := strconv.ParseUint(c.UnixSocketMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return fmt.Errorf("-unix-socket-mode must be an octal file mode like 0660 but got %q", c.UnixSocketMode)
+	}
+	s.socketMode = os.FileMode(mode)
+	if s.bindAddress, err = parseBindAddress(c.BindAddress); err != nil {
+		return fmt.Errorf("invalid -bind-address: %v", err)
+	}
+	if s.httpTLS, s.httpCerts, err = newServerTLSConfig("http", c.HTTPTLSCert, c.HTTPTLSKey, c.HTTPTLSClientCA, s.logger); err != nil {
+		return err
+	}
+	if c.HTTPH2C && s.httpTLS != nil {
+		return fmt.Errorf("-http-h2c is exclusive with -http-tls-cert, HTTP/2 is negotiated over TLS")
+	}
+	s.httpH2C = c.HTTPH2C
+	if s.pathPrefix, err = parsePathPrefix(c.PathPrefix); err != nil {
+		return fmt.Errorf("invalid -path-prefix: %v", err)
+	}
+	if c.SinglePort && s.grpcTLS != nil {
+		return fmt.Errorf("-grpc-tls-cert is not used with -single-port, use -http-tls-cert instead")
+	}
+	s.singlePort = c.SinglePort
+	s.proxyProtocol = c.ProxyProtocol
+	s.grpcTuning = grpcTuning{
+		keepaliveTime:        c.GRPCKeepaliveTime,
+		keepaliveTimeout:     c.GRPCKeepaliveTimeout,
+		maxConcurrentStreams: uint32(c.GRPCMaxConcurrentStreams),
+		maxRecvMsgSize:       c.GRPCMaxRecvMsgSize,
+		maxConnectionAge:     c.GRPCMaxConnectionAge,
+	}
+	if err := s.grpcTuning.validate(); err != nil {
+		return err
+	}
+	s.grpcTuning.log(s.logger)
+	return nil
+}
+
+// loadFiles loads the policy, API keys and htpasswd files referenced by the configuration.
+func (s *ExtAuthzServer) loadFiles(c Config) error {
+	s.files.policyFile = c.PolicyFile
+	s.files.logger = s.logger
+	files, err := s.files.load(1)
+	if err != nil {
+		return err
+	}
+	s.files.current.Store(files)
+	if files.policy != nil {
+		s.logger.Infof("Loaded %d rules from policy file %s", len(files.policy.Rules), c.PolicyFile)
+	}
+	if files.apiKeys != nil {
+		s.logger.Infof("Loaded %d API keys from %s", files.apiKeys.size(), c.APIKeysFile)
+	}
+	if c.WatchConfig && len(s.files.paths()) == 0 {
+		return fmt.Errorf("-watch-config requires -policy-file, -api-keys-file or -htpasswd-file")
+	}
+	return nil
+}
+
+// openRedis creates the Redis client and hands it to the Redis backed stores, it does nothing if
+// -redis-addr is not set.
+func (s *ExtAuthzServer) openRedis() {
+	if s.redisAddr == "" {
+		return
+	}
+	s.redis = newRedisClient(s.redisAddr, s.redisTimeout)
+	if q, ok := s.quotas.(*redisQuotaCounter); ok {
+		q.client = s.redis
+	}
+	if l, ok := s.rateLimiter.(*redisRateLimiter); ok {
+		l.client = s.redis
+	}
+	if s.rateLimitService != nil {
+		s.rateLimitService.redis = s.redis
+	}
+}
+
+// open starts the sinks, the watchers and the background goroutines of the validated server, the
+// ones started before a failure are released by close.
+func (s *ExtAuthzServer) open(watch bool) error {
+	if err := s.accessLog.start(); err != nil {
+		return err
+	}
+	if err := s.statsd.start(); err != nil {
+		return err
+	}
+	if err := s.auditLog.start(); err != nil {
+		return err
+	}
+	s.tracer.start()
+	s.openRedis()
+	if err := s.jwks.start(); err != nil {
+		return err
+	}
+	s.decisionCache.start()
+	if l, ok := s.rateLimiter.(*localRateLimiter); ok {
+		l.start()
+	}
+	s.deniedPage.start()
+	s.grpcCerts.start()
+	s.httpCerts.start()
+	if len(s.files.paths()) != 0 {
+		return s.watchFiles(watch)
+	}
+	return nil
+}
@@ -0,0 +1,389 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/genproto/googleapis/rpc/status"
+)
+
+// newTestServer returns the server of the config, it logs nowhere unless the config has a logger.
+// The caller closes it.
+func newTestServer(t testing.TB, c Config) *ExtAuthzServer {
+	t.Helper()
+	if c.Logger == nil {
+		c.Logger = NewTextLogger(ioutil.Discard)
+	}
+	s, err := NewExtAuthzServer(WithConfig(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// newServerError returns the error of NewExtAuthzServer with the config, "" if it succeeds.
+func newServerError(c Config) string {
+	c.Logger = NewTextLogger(ioutil.Discard)
+	s, err := NewExtAuthzServer(WithConfig(c))
+	if err != nil {
+		return err.Error()
+	}
+	s.close()
+	return ""
+}
+
+// testRequest is the downstream request of the check requests sent to the gRPC and HTTP check
+// handlers, the empty method, host and path are GET, example.com and /.
+type testRequest struct {
+	method  string
+	host    string
+	path    string
+	headers map[string]string
+	// sourceIP is the address of the downstream peer if set.
+	sourceIP string
+}
+
+func (r testRequest) withDefaults() testRequest {
+	if r.method == "" {
+		r.method = http.MethodGet
+	}
+	if r.host == "" {
+		r.host = "example.com"
+	}
+	if r.path == "" {
+		r.path = "/"
+	}
+	return r
+}
+
+// grpc returns the gRPC check request of the request like Envoy sends it.
+func (r testRequest) grpc() *auth.CheckRequest {
+	r = r.withDefaults()
+	headers := map[string]string{":method": r.method, ":authority": r.host, ":path": r.path}
+	for name, value := range r.headers {
+		headers[strings.ToLower(name)] = value
+	}
+	return &auth.CheckRequest{Attributes: &auth.AttributeContext{
+		Source: &auth.AttributeContext_Peer{Address: &core.Address{Address: &core.Address_SocketAddress{
+			SocketAddress: &core.SocketAddress{Address: r.sourceIP},
+		}}},
+		Request: &auth.AttributeContext_Request{Http: &auth.AttributeContext_HttpRequest{
+			Method: r.method, Host: r.host, Path: r.path, Protocol: "HTTP/1.1", Headers: headers,
+		}},
+	}}
+}
+
+// http returns the HTTP check request of the request like the Envoy HTTP service sends it.
+func (r testRequest) http() *http.Request {
+	r = r.withDefaults()
+	request := httptest.NewRequest(r.method, "http://"+r.host+r.path, nil)
+	request.Host = r.host
+	for name, value := range r.headers {
+		request.Header.Set(name, value)
+	}
+	if r.sourceIP != "" {
+		request.RemoteAddr = r.sourceIP + ":34567"
+	}
+	return request
+}
+
+// checkGRPC sends the gRPC check request of the request.
+func checkGRPC(t *testing.T, s *ExtAuthzServer, r testRequest) *auth.CheckResponse {
+	t.Helper()
+	response, err := s.Check(context.Background(), r.grpc())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+// checkHTTP sends the HTTP check request of the request.
+func checkHTTP(s *ExtAuthzServer, r testRequest) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	s.ServeHTTP(recorder, r.http())
+	return recorder
+}
+
+func grpcAllowed(response *auth.CheckResponse) bool {
+	return response.GetStatus().GetCode() == int32(code.Code_OK)
+}
+
+// grpcHeader returns the value of the header added to the upstream request by the allowed gRPC
+// check response, or to the denied response.
+func grpcHeader(response *auth.CheckResponse, name string) string {
+	headers := response.GetOkResponse().GetHeaders()
+	if response.GetDeniedResponse() != nil {
+		headers = response.GetDeniedResponse().GetHeaders()
+	}
+	for _, h := range headers {
+		if strings.EqualFold(h.GetHeader().GetKey(), name) {
+			return h.GetHeader().GetValue()
+		}
+	}
+	return ""
+}
+
+// checkBoth returns the decisions of the gRPC and HTTP check requests of the request.
+func checkBoth(t *testing.T, s *ExtAuthzServer, r testRequest) (grpcOK, httpOK bool) {
+	t.Helper()
+	return grpcAllowed(checkGRPC(t, s, r)), checkHTTP(s, r).Code == http.StatusOK
+}
+
+func TestCheckHeaderFlags(t *testing.T) {
+	c := DefaultConfig()
+	c.CheckHeader = "X-Team"
+	c.AllowedValue = "blue"
+	cases := []struct {
+		name    string
+		headers map[string]string
+		want    bool
+	}{
+		{name: "allowed value", headers: map[string]string{"x-team": "blue"}, want: true},
+		{name: "header name is case-insensitive", headers: map[string]string{"X-TEAM": "blue"}, want: true},
+		{name: "other value", headers: map[string]string{"x-team": "red"}},
+		{name: "missing header", headers: map[string]string{}},
+		{name: "default header is not checked", headers: map[string]string{"x-ext-authz": "allow"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, c)
+			defer s.close()
+			grpcOK, httpOK := checkBoth(t, s, testRequest{headers: tc.headers})
+			if grpcOK != tc.want || httpOK != tc.want {
+				t.Fatalf("got allowed gRPC %v and HTTP %v, want %v", grpcOK, httpOK, tc.want)
+			}
+		})
+	}
+}
+
+func TestCheckHeaderValidation(t *testing.T) {
+	cases := []struct {
+		name        string
+		checkHeader string
+		value       string
+		wantErr     string
+	}{
+		{name: "valid", checkHeader: "x-team", value: "blue"},
+		{name: "empty header", checkHeader: "", value: "blue", wantErr: "check header must not be empty"},
+		{name: "invalid header", checkHeader: "x team", value: "blue", wantErr: `invalid check header name "x team"`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.CheckHeader, c.AllowedValue = tc.checkHeader, tc.value
+			got := newServerError(c)
+			if (tc.wantErr == "") != (got == "") || !strings.Contains(got, tc.wantErr) {
+				t.Fatalf("got error %q, want %q", got, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestDeniedLogShowsExpectedHeader(t *testing.T) {
+	cases := []struct {
+		protocol string
+		check    func(t *testing.T, s *ExtAuthzServer)
+	}{
+		{protocol: "gRPC", check: func(t *testing.T, s *ExtAuthzServer) { checkGRPC(t, s, testRequest{}) }},
+		{protocol: "HTTP", check: func(t *testing.T, s *ExtAuthzServer) { checkHTTP(s, testRequest{}) }},
+	}
+	for _, tc := range cases {
+		t.Run(tc.protocol, func(t *testing.T) {
+			var out bytes.Buffer
+			c := DefaultConfig()
+			c.CheckHeader, c.AllowedValue = "x-team", "blue"
+			c.Logger = NewTextLogger(&out)
+			s := newTestServer(t, c)
+			defer s.close()
+			tc.check(t, s)
+			if want := "[" + tc.protocol + "][ denied]"; !strings.Contains(out.String(), want) {
+				t.Fatalf("got log %q, want %s", out.String(), want)
+			}
+			if want := "expected x-team: blue"; !strings.Contains(out.String(), want) {
+				t.Fatalf("got log %q, want %s", out.String(), want)
+			}
+		})
+	}
+}
+
+// resultHeaderOption returns the result header of the gRPC check response.
+func resultHeaderOption(result string) []*core.HeaderValueOption {
+	return []*core.HeaderValueOption{{
+		Header: &core.HeaderValue{Key: resultHeader, Value: result},
+		Append: &wrappers.BoolValue{Value: false},
+	}}
+}
+
+func TestCheckResponseShape(t *testing.T) {
+	cases := []struct {
+		name    string
+		config  func(c *Config)
+		request testRequest
+		want    *auth.CheckResponse
+	}{
+		{name: "allowed", request: testRequest{headers: map[string]string{"x-ext-authz": "allow"}}, want: &auth.CheckResponse{
+			Status: &status.Status{Code: int32(code.Code_OK)},
+			HttpResponse: &auth.CheckResponse_OkResponse{OkResponse: &auth.OkHttpResponse{
+				Headers: resultHeaderOption("allowed"),
+			}},
+		}},
+		{name: "denied with the defaults", want: &auth.CheckResponse{
+			Status: &status.Status{Code: int32(code.Code_PERMISSION_DENIED)},
+			HttpResponse: &auth.CheckResponse_DeniedResponse{DeniedResponse: &auth.DeniedHttpResponse{
+				Status:  &typev3.HttpStatus{Code: typev3.StatusCode_Forbidden},
+				Headers: resultHeaderOption("denied"),
+			}},
+		}},
+		{name: "denied with the status and body flags", config: func(c *Config) {
+			c.DeniedStatus = http.StatusUnavailableForLegalReasons
+			c.DeniedBody = "access denied"
+		}, want: &auth.CheckResponse{
+			Status: &status.Status{Code: int32(code.Code_PERMISSION_DENIED)},
+			HttpResponse: &auth.CheckResponse_DeniedResponse{DeniedResponse: &auth.DeniedHttpResponse{
+				Status:  &typev3.HttpStatus{Code: typev3.StatusCode(http.StatusUnavailableForLegalReasons)},
+				Headers: resultHeaderOption("denied"),
+				Body:    "access denied",
+			}},
+		}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := DefaultConfig()
+			if tc.config != nil {
+				tc.config(&c)
+			}
+			s := newTestServer(t, c)
+			defer s.close()
+			got := checkGRPC(t, s, tc.request)
+			// The dynamic metadata has the varying duration of the check.
+			got.DynamicMetadata = nil
+			if !proto.Equal(got, tc.want) {
+				t.Fatalf("got response %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDeniedStatusValidation(t *testing.T) {
+	cases := []struct {
+		status  int
+		wantErr string
+	}{
+		{status: http.StatusForbidden},
+		{status: http.StatusServiceUnavailable},
+		{status: http.StatusOK, wantErr: "-denied-status must be a 4xx or 5xx status but got 200"},
+		{status: 600, wantErr: "-denied-status must be a 4xx or 5xx status but got 600"},
+	}
+	for _, tc := range cases {
+		t.Run(fmt.Sprint(tc.status), func(t *testing.T) {
+			c := DefaultConfig()
+			c.DeniedStatus = tc.status
+			got := newServerError(c)
+			if (tc.wantErr == "") != (got == "") || !strings.Contains(got, tc.wantErr) {
+				t.Fatalf("got error %q, want %q", got, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestInjectedHeaderAppend(t *testing.T) {
+	cases := []struct {
+		name          string
+		appendHeaders string
+		wantAppend    bool
+		wantValues    []string
+	}{
+		{name: "overwrite by default", wantValues: []string{"allowed"}},
+		{name: "append", appendHeaders: "x-ext-authz-result", wantAppend: true, wantValues: []string{"spoofed", "allowed"}},
+		{name: "append is case-insensitive", appendHeaders: "X-Ext-Authz-Result", wantAppend: true,
+			wantValues: []string{"spoofed", "allowed"}},
+		{name: "other header appended", appendHeaders: "x-other", wantValues: []string{"allowed"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.AppendHeaders = tc.appendHeaders
+			s := newTestServer(t, c)
+			defer s.close()
+			// The client already sends the result header.
+			r := testRequest{headers: map[string]string{"x-ext-authz": "allow", resultHeader: "spoofed"}}
+			response := checkGRPC(t, s, r)
+			var found bool
+			for _, h := range response.GetOkResponse().GetHeaders() {
+				if h.GetHeader().GetKey() == resultHeader {
+					found = true
+					if got := h.GetAppend().GetValue(); got != tc.wantAppend {
+						t.Fatalf("got append %v, want %v", got, tc.wantAppend)
+					}
+				}
+			}
+			if !found {
+				t.Fatalf("got headers %v, want %s", response.GetOkResponse().GetHeaders(), resultHeader)
+			}
+			// The HTTP check response adds or sets the header over the client value like Envoy does.
+			header := http.Header{}
+			header.Set(resultHeader, "spoofed")
+			s.setHeaders(header, decision{allowed: true})
+			if got := header[http.CanonicalHeaderKey(resultHeader)]; strings.Join(got, ",") != strings.Join(tc.wantValues, ",") {
+				t.Fatalf("got HTTP values %q, want %q", got, tc.wantValues)
+			}
+		})
+	}
+}
+
+func TestAppendedOverwritten(t *testing.T) {
+	c := DefaultConfig()
+	c.AppendHeaders = "x-user,x-team"
+	s := newTestServer(t, c)
+	defer s.close()
+	d := decision{allowed: true, overwrite: map[string]bool{"x-user": true}}
+	cases := []struct {
+		name string
+		want bool
+	}{
+		{name: "x-user"},
+		{name: "x-team", want: true},
+		{name: "x-other"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := s.appended(tc.name, d); got != tc.want {
+				t.Fatalf("got appended %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAppendHeadersValidation(t *testing.T) {
+	c := DefaultConfig()
+	c.AppendHeaders = "x-ok,x bad"
+	if got, want := newServerError(c), `invalid -append-headers: invalid header name "x bad"`; !strings.Contains(got, want) {
+		t.Fatalf("got error %q, want %q", got, want)
+	}
+}
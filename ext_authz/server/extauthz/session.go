@@ -0,0 +1,158 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loginPath is served by the HTTP listener to issue the session cookie when sessions are enabled.
+const loginPath = "/login"
+
+// sessionStore keeps the issued sessions in memory, the least recently used session is evicted
+// once maxEntries is reached. The cookie value is the session ID and its HMAC signature.
+type sessionStore struct {
+	cookieName string
+	secret     []byte
+	ttl        time.Duration
+	maxEntries int
+
+	mu       sync.Mutex
+	lru      *list.List
+	sessions map[string]*list.Element
+}
+
+type session struct {
+	id      string
+	expires time.Time
+}
+
+func newSessionStore(cookieName string, secret []byte, ttl time.Duration, maxEntries int) *sessionStore {
+	return &sessionStore{
+		cookieName: cookieName,
+		secret:     secret,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		lru:        list.New(),
+		sessions:   map[string]*list.Element{},
+	}
+}
+
+func (s *sessionStore) sign(id string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// create returns the cookie value of a new session.
+func (s *sessionStore) create() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[id] = s.lru.PushFront(&session{id: id, expires: time.Now().Add(s.ttl)})
+	for s.lru.Len() > s.maxEntries {
+		oldest := s.lru.Remove(s.lru.Back()).(*session)
+		delete(s.sessions, oldest.id)
+	}
+	return id + "." + s.sign(id), nil
+}
+
+// valid returns the expiry of the session if the cookie value is signed and its session is not
+// expired.
+func (s *sessionStore) valid(value string) (time.Time, bool) {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(s.sign(parts[0]))) {
+		return time.Time{}, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.sessions[parts[0]]
+	if !ok {
+		return time.Time{}, false
+	}
+	expires := e.Value.(*session).expires
+	if time.Now().After(expires) {
+		s.lru.Remove(e)
+		delete(s.sessions, parts[0])
+		return time.Time{}, false
+	}
+	s.lru.MoveToFront(e)
+	return expires, true
+}
+
+// cookies returns the values of the named cookie in the cookie header, in any order.
+func cookies(header, name string) []string {
+	r := http.Request{Header: http.Header{"Cookie": {header}}}
+	var values []string
+	for _, c := range r.Cookies() {
+		if c.Name == name {
+			values = append(values, c.Value)
+		}
+	}
+	return values
+}
+
+// sessionAllowed returns true if the request carries a valid session cookie, the cached decision
+// expires with the session.
+func (s *ExtAuthzServer) sessionAllowed(request *checkRequest) bool {
+	for _, value := range cookies(request.header("cookie"), s.sessions.cookieName) {
+		if expires, ok := s.sessions.valid(value); ok {
+			request.expireAt(expires)
+			return true
+		}
+	}
+	return false
+}
+
+// login issues a session cookie if the request has an allowed check header value.
+func (s *ExtAuthzServer) login(response http.ResponseWriter, request *http.Request) {
+	value := request.Header.Get(s.checkHeader)
+	if !s.isAllowedValue(value) {
+		s.logger.Infof("[HTTP][ denied]: login without %s: %s", s.checkHeader, s.expectedValues())
+		http.Error(response, "expected "+s.checkHeader+": "+s.expectedValues(), http.StatusForbidden)
+		return
+	}
+	cookie, err := s.sessions.create()
+	if err != nil {
+		s.logger.Errorf("Failed to create session: %v", err)
+		http.Error(response, "failed to create session", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(response, &http.Cookie{
+		Name:     s.sessions.cookieName,
+		Value:    cookie,
+		Path:     "/",
+		MaxAge:   int(s.sessions.ttl.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	s.logger.Infof("[HTTP][allowed]: login with %s: %s, issued session cookie %s", s.checkHeader, value, s.sessions.cookieName)
+	fmt.Fprintln(response, "logged in")
+}
@@ -0,0 +1,174 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// servers keeps the servers started by Start for the shutdown.
+type servers struct {
+	mu    sync.Mutex
+	grpc  *grpc.Server
+	http  *http.Server
+	admin *http.Server
+	// singlePort serves the gRPC calls on the HTTP server in the single port mode.
+	singlePort *singlePortHandler
+}
+
+func (s *ExtAuthzServer) setServers(grpcServer *grpc.Server, httpServer *http.Server) {
+	s.servers.mu.Lock()
+	defer s.servers.mu.Unlock()
+	s.servers.grpc, s.servers.http = grpcServer, httpServer
+}
+
+// closeServers closes the servers right away when Start fails.
+func (s *ExtAuthzServer) closeServers() {
+	s.servers.mu.Lock()
+	defer s.servers.mu.Unlock()
+	if s.servers.grpc != nil {
+		s.servers.grpc.Stop()
+	}
+	for _, server := range []*http.Server{s.servers.http, s.servers.admin} {
+		if server != nil {
+			server.Close()
+		}
+	}
+}
+
+// Stop stops the servers started by Start, it returns once the in-flight checks completed or the
+// shutdown grace period elapsed.
+func (s *ExtAuthzServer) Stop() {
+	s.stopOnce.Do(func() {
+		s.shutdown(s.shutdownGracePeriod)
+		close(s.stopped)
+	})
+}
+
+// Wait blocks until the servers are stopped and returns the errors of the servers that failed to
+// serve, nil if they were all stopped by Stop. The other servers are stopped once one fails.
+func (s *ExtAuthzServer) Wait() error {
+	var errs []string
+	for i := 0; i < s.running; i++ {
+		if err := <-s.errs; err != nil {
+			s.logger.Errorf("Stopping the servers: %v", err)
+			errs = append(errs, err.Error())
+			s.Stop()
+		}
+	}
+	<-s.stopped
+	if len(errs) != 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// shutdown reports NOT_SERVING and not ready in /readyz first so Envoy and kube-proxy stop sending
+// new checks during the shutdown delay, then waits for the in-flight checks to complete and
+// force-closes the remaining connections after the grace period. The gRPC calls of the single port
+// mode are drained before the HTTP server is stopped, as their h2c connections are hijacked from it.
+func (s *ExtAuthzServer) shutdown(grace time.Duration) {
+	atomic.StoreInt32(&s.draining, 1)
+	s.health.Shutdown()
+	if s.shutdownDelay > 0 {
+		s.logger.Infof("Reporting not ready for %v before closing the listeners", s.shutdownDelay)
+		time.Sleep(s.shutdownDelay)
+	}
+	s.servers.mu.Lock()
+	grpcServer, httpServer, adminServer, singlePort := s.servers.grpc, s.servers.http, s.servers.admin, s.servers.singlePort
+	s.servers.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	var wg sync.WaitGroup
+	if grpcServer != nil && !s.singlePort {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stopped := make(chan struct{})
+			go func() {
+				grpcServer.GracefulStop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-ctx.Done():
+				s.logger.Infof("gRPC server did not stop within %v, closing the remaining connections", grace)
+				grpcServer.Stop()
+			}
+		}()
+	}
+	if httpServer != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if singlePort != nil && !singlePort.drain(ctx) {
+				s.logger.Infof("gRPC calls did not complete within %v, closing the remaining connections", grace)
+			}
+			if err := httpServer.Shutdown(ctx); err != nil {
+				s.logger.Infof("HTTP server did not stop within %v, closing the remaining connections: %v", grace, err)
+				httpServer.Close()
+			}
+			if s.singlePort && grpcServer != nil {
+				// The gRPC streams are served by the HTTP server in the single port mode.
+				grpcServer.Stop()
+			}
+		}()
+	}
+	if adminServer != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := adminServer.Shutdown(ctx); err != nil {
+				adminServer.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	s.close()
+}
+
+// close releases the sinks, the background goroutines and the signal handlers started by
+// NewExtAuthzServer once the servers are stopped, or when NewExtAuthzServer fails.
+func (s *ExtAuthzServer) close() {
+	s.closeOnce.Do(func() {
+		s.tracer.shutdown()
+		s.accessLog.close()
+		s.auditLog.close()
+		s.statsd.close()
+		s.channelz.close()
+		s.decisionCache.close()
+		if l, ok := s.rateLimiter.(*localRateLimiter); ok {
+			l.close()
+		}
+		s.rateLimitService.close()
+		s.deniedPage.close()
+		s.jwks.close()
+		s.grpcCerts.close()
+		s.httpCerts.close()
+		s.files.close()
+		if s.redis != nil {
+			s.redis.Close()
+		}
+	})
+}
@@ -0,0 +1,269 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/grpc"
+)
+
+func TestSinglePortShutdownDrainsInFlightCalls(t *testing.T) {
+	cases := []struct {
+		name  string
+		grace time.Duration
+		// hold is how long the OPA callout of the in-flight call takes once the shutdown started.
+		hold    time.Duration
+		wantErr bool
+	}{
+		{name: "completes within the grace period", grace: 5 * time.Second, hold: 200 * time.Millisecond},
+		{name: "exceeds the grace period", grace: 200 * time.Millisecond, hold: 2 * time.Second, wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			opa, received, release := blockingOPA()
+			defer opa.Close()
+
+			c := DefaultConfig()
+			c.SinglePort = true
+			c.OPAURL = opa.URL
+			c.OPATimeout = 10 * time.Second
+			c.ShutdownGracePeriod = tc.grace
+			c.Logger = NewTextLogger(ioutil.Discard)
+			s, err := NewExtAuthzServer(WithConfig(c))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Start("127.0.0.1:0", Disabled); err != nil {
+				t.Fatal(err)
+			}
+			conn, err := grpc.Dial(s.GRPCAddr().String(), grpc.WithInsecure())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			result := make(chan error, 1)
+			go func() {
+				response, err := auth.NewAuthorizationClient(conn).Check(context.Background(), &auth.CheckRequest{
+					Attributes: &auth.AttributeContext{
+						Source:  &auth.AttributeContext_Peer{Address: &core.Address{}},
+						Request: &auth.AttributeContext_Request{Http: &auth.AttributeContext_HttpRequest{Method: "GET", Host: "example.com", Path: "/"}},
+					},
+				})
+				if err == nil && response.GetStatus().GetCode() != int32(code.Code_OK) {
+					t.Errorf("got status %v, want OK", response.GetStatus())
+				}
+				result <- err
+			}()
+			<-received
+
+			stopped := make(chan struct{})
+			go func() {
+				s.Stop()
+				close(stopped)
+			}()
+			time.AfterFunc(tc.hold, func() { close(release) })
+			err = <-result
+			<-stopped
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// blockingOPA allows the checks once released, received gets a value per OPA callout.
+func blockingOPA() (server *httptest.Server, received chan struct{}, release chan struct{}) {
+	received = make(chan struct{}, 1)
+	release = make(chan struct{})
+	server = httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		received <- struct{}{}
+		<-release
+		response.Write([]byte(`{"result": true}`))
+	}))
+	return server, received, release
+}
+
+// inFlightCheck sends the check request of the protocol, it returns an error if the check failed
+// or was not allowed.
+func inFlightCheck(s *ExtAuthzServer, protocol string) error {
+	if protocol == "gRPC" {
+		response, err := grpcCheck(s, testRequest{}, grpc.WithInsecure())
+		if err == nil && !grpcAllowed(response) {
+			err = fmt.Errorf("got status %v, want OK", response.GetStatus())
+		}
+		return err
+	}
+	response, err := http.Get("http://" + s.HTTPAddr().String() + "/check")
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("got HTTP status %d, want %d", response.StatusCode, http.StatusOK)
+	}
+	return nil
+}
+
+func TestShutdownDrainsInFlightChecks(t *testing.T) {
+	cases := []struct {
+		name     string
+		protocol string
+		grace    time.Duration
+		// hold is how long the OPA callout of the in-flight check takes once the shutdown started.
+		hold    time.Duration
+		wantErr bool
+	}{
+		{name: "gRPC completes within the grace period", protocol: "gRPC", grace: 5 * time.Second, hold: 300 * time.Millisecond},
+		{name: "gRPC exceeds the grace period", protocol: "gRPC", grace: 200 * time.Millisecond, hold: time.Second, wantErr: true},
+		{name: "HTTP completes within the grace period", protocol: "HTTP", grace: 5 * time.Second, hold: 300 * time.Millisecond},
+		{name: "HTTP exceeds the grace period", protocol: "HTTP", grace: 200 * time.Millisecond, hold: time.Second, wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			opa, received, release := blockingOPA()
+			defer opa.Close()
+			c := DefaultConfig()
+			c.OPAURL = opa.URL
+			c.OPATimeout = 10 * time.Second
+			c.OPACacheTTL = 0
+			c.ShutdownGracePeriod = tc.grace
+			s := startTLSServer(t, c)
+			addr := s.GRPCAddr().String()
+			if tc.protocol == "HTTP" {
+				addr = s.HTTPAddr().String()
+			}
+
+			result := make(chan error, 1)
+			go func() { result <- inFlightCheck(s, tc.protocol) }()
+			<-received
+			stopped := make(chan struct{})
+			go func() {
+				s.Stop()
+				close(stopped)
+			}()
+			time.AfterFunc(tc.hold, func() { close(release) })
+
+			// The listener is closed while the in-flight check is held.
+			deadline := time.Now().Add(tc.hold)
+			for {
+				conn, err := net.DialTimeout("tcp", addr, time.Second)
+				if err != nil {
+					break
+				}
+				conn.Close()
+				if time.Now().After(deadline) {
+					t.Fatalf("got new %s connections accepted during the shutdown, want refused", tc.protocol)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			err := <-result
+			<-stopped
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestStartListenErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		// used is the listener bound before Start, either http or grpc.
+		used    string
+		wantErr string
+	}{
+		{name: "gRPC port in use", used: "grpc", wantErr: "failed to listen for the gRPC server: listen tcp"},
+		{name: "HTTP port in use", used: "http", wantErr: "failed to listen for the HTTP server: listen tcp"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			used, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer used.Close()
+			httpAddr, grpcAddr := "127.0.0.1:0", "127.0.0.1:0"
+			if tc.used == "http" {
+				httpAddr = used.Addr().String()
+			} else {
+				grpcAddr = used.Addr().String()
+			}
+			s := newTestServer(t, DefaultConfig())
+			defer s.close()
+			err = s.Start(httpAddr, grpcAddr)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) || !strings.Contains(err.Error(), used.Addr().String()) {
+				t.Fatalf("got error %v, want %q with the address", err, tc.wantErr)
+			}
+			// The gRPC server started before the HTTP server failed is closed.
+			if addr := s.GRPCAddr(); tc.used == "http" && addr != nil {
+				if conn, err := net.DialTimeout("tcp", addr.String(), time.Second); err == nil {
+					conn.Close()
+					t.Fatalf("got the gRPC listener open after Start failed, want closed")
+				}
+			}
+		})
+	}
+}
+
+func TestWaitStopsTheOtherServers(t *testing.T) {
+	cases := []struct {
+		name    string
+		errs    []error
+		wantErr string
+	}{
+		{name: "one server fails", errs: []error{errors.New("failed to serve gRPC server: boom")},
+			wantErr: "failed to serve gRPC server: boom"},
+		{name: "errors are combined", errs: []error{errors.New("failed to serve gRPC server: boom"), errors.New("failed to serve HTTP server: bang")},
+			wantErr: "failed to serve gRPC server: boom; failed to serve HTTP server: bang"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := startTLSServer(t, DefaultConfig())
+			httpAddr := s.HTTPAddr().String()
+			// The failures are reported to Wait like the serve errors of the servers.
+			for _, err := range tc.errs {
+				s.errs <- err
+			}
+			done := make(chan error, 1)
+			go func() { done <- s.Wait() }()
+			select {
+			case err := <-done:
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("got error %v, want %q", err, tc.wantErr)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("got Wait blocked, want the other servers stopped")
+			}
+			if conn, err := net.DialTimeout("tcp", httpAddr, time.Second); err == nil {
+				conn.Close()
+				t.Fatal("got the HTTP listener open, want closed once a server failed")
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignatureHeader and TimestampHeader carry the Signature of the request and the signed timestamp,
+// NonceHeader carries the unique nonce of the request required by -require-nonce.
+const (
+	SignatureHeader = "x-signature"
+	TimestampHeader = "x-timestamp"
+	NonceHeader     = "x-nonce"
+)
+
+// Signature returns the hex encoded HMAC-SHA256 of the method, path, timestamp (Unix seconds) and
+// nonce joined by newlines, the path includes the query string. The nonce is only signed if not
+// empty, a captured request cannot be replayed with a new nonce if it is signed.
+func Signature(secret []byte, method, path, timestamp, nonce string) string {
+	input := method + "\n" + path + "\n" + timestamp
+	if nonce != "" {
+		input += "\n" + nonce
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(input))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signatureDecision returns the decision for a request in the HMAC signature mode.
+func (s *ExtAuthzServer) signatureDecision(request *checkRequest) decision {
+	signature := request.header(SignatureHeader)
+	if signature == "" {
+		return decision{reason: "missing " + SignatureHeader + " header", status: http.StatusUnauthorized}
+	}
+	timestamp := request.header(TimestampHeader)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return decision{reason: fmt.Sprintf("malformed %s header %q: must be Unix seconds", TimestampHeader, timestamp),
+			status: http.StatusUnauthorized}
+	}
+	signed := time.Unix(seconds, 0)
+	skew := s.now().Sub(signed)
+	// The timestamp becomes valid or stale at the max skew from it.
+	if skew < -s.hmacMaxSkew {
+		s.expireDecisionAt(request, signed.Add(-s.hmacMaxSkew))
+	} else if skew <= s.hmacMaxSkew {
+		s.expireDecisionAt(request, signed.Add(s.hmacMaxSkew))
+	}
+	if skew > s.hmacMaxSkew || skew < -s.hmacMaxSkew {
+		return decision{reason: fmt.Sprintf("%s %s is off by %v, more than %v", TimestampHeader, timestamp,
+			skew.Truncate(time.Second), s.hmacMaxSkew), status: http.StatusUnauthorized}
+	}
+	if _, err := hex.DecodeString(signature); err != nil || len(signature) != 2*sha256.Size {
+		return decision{reason: "malformed " + SignatureHeader + " header: must be a hex encoded HMAC-SHA256",
+			status: http.StatusUnauthorized}
+	}
+	// The nonce is signed if required, the requests without it are denied before.
+	nonce := ""
+	if s.nonces != nil {
+		nonce = request.header(NonceHeader)
+	}
+	expected := Signature(s.hmacSecret, request.method, request.path, timestamp, nonce)
+	if !hmac.Equal([]byte(strings.ToLower(signature)), []byte(expected)) {
+		return decision{reason: "invalid signature for " + request.method + " " + s.redactPath(request.path),
+			status: http.StatusUnauthorized}
+	}
+	return decision{allowed: true, reason: "valid signature"}
+}
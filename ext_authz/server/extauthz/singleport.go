@@ -0,0 +1,118 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// singlePortDrainInterval is the interval to poll the in-flight gRPC calls during the shutdown.
+const singlePortDrainInterval = 10 * time.Millisecond
+
+// singlePortHandler routes the HTTP/2 gRPC calls of the registered services to the gRPC server and
+// everything else to the HTTP check. The path is matched as well as the content-type because the
+// HTTP check of a gRPC request may carry the application/grpc content-type of the original request.
+type singlePortHandler struct {
+	// calls is the number of the in-flight gRPC calls, it comes first for the alignment of the
+	// atomic on 32-bit platforms.
+	calls int64
+	// draining rejects the new gRPC calls once set.
+	draining int32
+	grpc     *grpc.Server
+	http     http.Handler
+	services map[string]bool
+}
+
+func newSinglePortHandler(server *grpc.Server, handler http.Handler) *singlePortHandler {
+	h := &singlePortHandler{grpc: server, http: handler, services: map[string]bool{}}
+	for name := range server.GetServiceInfo() {
+		h.services[name] = true
+	}
+	return h
+}
+
+func (h *singlePortHandler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	if request.ProtoMajor == 2 && strings.HasPrefix(request.Header.Get("Content-Type"), "application/grpc") {
+		// The gRPC path is /<service>/<method>.
+		if parts := strings.SplitN(strings.TrimPrefix(request.URL.Path, "/"), "/", 2); len(parts) == 2 && h.services[parts[0]] {
+			h.serveGRPC(response, request)
+			return
+		}
+	}
+	h.http.ServeHTTP(response, request)
+}
+
+func (h *singlePortHandler) serveGRPC(response http.ResponseWriter, request *http.Request) {
+	atomic.AddInt64(&h.calls, 1)
+	defer atomic.AddInt64(&h.calls, -1)
+	if atomic.LoadInt32(&h.draining) != 0 {
+		// The gRPC clients map the status to UNAVAILABLE and retry on another server.
+		http.Error(response, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	h.grpc.ServeHTTP(response, request)
+}
+
+// drain rejects the new gRPC calls and waits for the in-flight ones, it returns false if they did
+// not complete before the context is done. The h2c connections are hijacked from the HTTP server,
+// so its Shutdown doesn't wait for their calls, and GracefulStop of the gRPC server is not
+// supported for the calls served by ServeHTTP.
+func (h *singlePortHandler) drain(ctx context.Context) bool {
+	atomic.StoreInt32(&h.draining, 1)
+	ticker := time.NewTicker(singlePortDrainInterval)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&h.calls) != 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// startSinglePort listens on the HTTP address and serves both the gRPC and HTTP checks in the
+// background, HTTP/2 is negotiated with ALPN over TLS or h2c with prior knowledge otherwise.
+func (s *ExtAuthzServer) startSinglePort(server *http.Server, httpAddr string) error {
+	listener, err := s.listen(httpAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for the single port server: %v", err)
+	}
+	s.addrs.set(listener.Addr(), listener.Addr())
+	s.startServing()
+
+	if s.httpTLS != nil {
+		s.logger.Infof("Starting gRPC and HTTP server at https://%s (%s), serving the ext_authz v2 and v3 APIs",
+			listener.Addr(), tlsMode(s.httpTLS))
+	} else {
+		s.logger.Infof("Starting gRPC and HTTP server at http://%s (h2c), serving the ext_authz v2 and v3 APIs", listener.Addr())
+	}
+	go func() {
+		defer s.logger.Infof("Stopped single port server")
+		if err := serveHTTP(server, listener); err != nil {
+			s.errs <- fmt.Errorf("failed to serve single port server: %v", err)
+			return
+		}
+		s.errs <- nil
+	}()
+	return nil
+}
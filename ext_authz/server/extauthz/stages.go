@@ -0,0 +1,146 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The stages of a check request in the order they run.
+const (
+	// stageParse reads the attributes of the check request.
+	stageParse = iota
+	// stageLocalRules evaluates the check request without the callouts.
+	stageLocalRules
+	// stageExternalCallout waits for the OPA, webhook, introspection, JWKS and Redis callouts.
+	stageExternalCallout
+	// stageResponseBuild builds the response of the decision.
+	stageResponseBuild
+	numStages
+)
+
+var stageNames = [numStages]string{"parse", "local_rules", "external_callout", "response_build"}
+
+// stageTimes are the durations of the stages of a check request, carried in the context of the
+// check request for the callouts. A nil *stageTimes records nothing.
+type stageTimes struct {
+	start time.Time
+	// mark is the end of the last finished stage.
+	mark      time.Time
+	durations [numStages]time.Duration
+	// ran is false for the stages that didn't run, e.g. without callouts.
+	ran [numStages]bool
+	// mu guards the callouts that may run concurrently.
+	mu       sync.Mutex
+	callouts []calloutTime
+}
+
+type calloutTime struct {
+	name     string
+	duration time.Duration
+}
+
+type stagesKey struct{}
+
+// startStages finishes the parse stage of the check request and carries the stage times in its
+// context, it returns nil if the stages are neither observed in the metrics nor logged.
+func (s *ExtAuthzServer) startStages(request *checkRequest, start time.Time) *stageTimes {
+	if s.metrics == nil && s.statsd == nil && (s.slowCheckThreshold <= 0 || s.currentLogLevel() > levelDebug) {
+		return nil
+	}
+	st := &stageTimes{start: start, mark: start}
+	st.finish(stageParse)
+	request.ctx = context.WithValue(request.ctx, stagesKey{}, st)
+	return st
+}
+
+// finish ends the stage at the current time.
+func (st *stageTimes) finish(stage int) {
+	now := time.Now()
+	st.durations[stage], st.ran[stage] = now.Sub(st.mark), true
+	st.mark = now
+}
+
+// evaluated finishes the local rules and the external callout stages, the time spent in the
+// callouts is not counted as local.
+func (st *stageTimes) evaluated() {
+	if st == nil {
+		return
+	}
+	st.finish(stageLocalRules)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, c := range st.callouts {
+		st.durations[stageExternalCallout] += c.duration
+		st.ran[stageExternalCallout] = true
+	}
+	st.durations[stageLocalRules] -= st.durations[stageExternalCallout]
+}
+
+// callout times a callout of the check request until done is called, it records nothing if the
+// context carries no stage times.
+type callout struct {
+	st    *stageTimes
+	name  string
+	start time.Time
+}
+
+func startCallout(ctx context.Context, name string) callout {
+	st, _ := ctx.Value(stagesKey{}).(*stageTimes)
+	if st == nil {
+		return callout{}
+	}
+	return callout{st: st, name: name, start: time.Now()}
+}
+
+func (c callout) done() {
+	if c.st == nil {
+		return
+	}
+	elapsed := time.Since(c.start)
+	c.st.mu.Lock()
+	defer c.st.mu.Unlock()
+	c.st.callouts = append(c.st.callouts, calloutTime{name: c.name, duration: elapsed})
+}
+
+// finishStages finishes the response build stage, observes the stages in the metrics and StatsD,
+// and logs the breakdown at the debug level if the check request took at least the -slow-check-threshold.
+func (s *ExtAuthzServer) finishStages(protocol string, request *checkRequest, st *stageTimes) {
+	if st == nil {
+		return
+	}
+	st.finish(stageResponseBuild)
+	s.metrics.observeStages(protocol, st)
+	s.statsd.observeStages(protocol, st)
+	total := st.mark.Sub(st.start)
+	if s.slowCheckThreshold <= 0 || total < s.slowCheckThreshold || s.currentLogLevel() > levelDebug {
+		return
+	}
+	var stages []string
+	for stage, name := range stageNames {
+		if st.ran[stage] {
+			stages = append(stages, fmt.Sprintf("%s=%v", name, st.durations[stage]))
+		}
+	}
+	for _, c := range st.callouts {
+		stages = append(stages, fmt.Sprintf("%s=%v", c.name, c.duration))
+	}
+	s.logger.Debugf("Slow check request took %v (threshold %v): %s %s %s%s, %s", total, s.slowCheckThreshold,
+		protocol, request.method, request.host, s.redactPath(request.path), strings.Join(stages, " "))
+}
@@ -0,0 +1,266 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	statsPath      = "/stats"
+	statsResetPath = "/stats/reset"
+	// latencyWindow is the number of the most recent check durations the percentiles are estimated
+	// from.
+	latencyWindow = 1024
+)
+
+// decisionCounts are the allowed and denied decisions of a protocol or rule.
+type decisionCounts struct {
+	allowed uint64
+	denied  uint64
+}
+
+func (c *decisionCounts) add(allowed bool) {
+	if allowed {
+		atomic.AddUint64(&c.allowed, 1)
+	} else {
+		atomic.AddUint64(&c.denied, 1)
+	}
+}
+
+func (c *decisionCounts) load() countsJSON {
+	return countsJSON{Allowed: atomic.LoadUint64(&c.allowed), Denied: atomic.LoadUint64(&c.denied)}
+}
+
+// decisionStats are the in-memory statistics of the decisions since the start or the last reset.
+// They are updated with atomics only so that the concurrent checks don't serialize on a lock.
+type decisionStats struct {
+	// next is the number of observed durations, the 64-bit fields come first for the alignment of
+	// the atomics on 32-bit platforms.
+	next uint64
+	// latencies is the ring of the most recent durations in nanoseconds.
+	latencies [latencyWindow]int64
+	since     time.Time
+	// protocols and rules map to *decisionCounts, reasons map the denied details to *uint64.
+	protocols sync.Map
+	rules     sync.Map
+	reasons   sync.Map
+}
+
+func newDecisionStats() *decisionStats {
+	return &decisionStats{since: time.Now()}
+}
+
+// currentStats returns the statistics, nil if disabled.
+func (s *ExtAuthzServer) currentStats() *decisionStats {
+	stats, _ := s.stats.Load().(*decisionStats)
+	return stats
+}
+
+// resetStats starts new statistics, a check observed concurrently may count in the old ones.
+func (s *ExtAuthzServer) resetStats() {
+	s.stats.Store(newDecisionStats())
+}
+
+// observe counts the decision of a check request of the protocol, it does nothing if nil.
+func (st *decisionStats) observe(protocol string, d decision, duration time.Duration) {
+	if st == nil {
+		return
+	}
+	counts(&st.protocols, protocol).add(d.allowed)
+	if d.rule != "" {
+		counts(&st.rules, d.rule).add(d.allowed)
+	}
+	if !d.allowed {
+		reason, ok := st.reasons.Load(d.resultDetail())
+		if !ok {
+			reason, _ = st.reasons.LoadOrStore(d.resultDetail(), new(uint64))
+		}
+		atomic.AddUint64(reason.(*uint64), 1)
+	}
+	i := atomic.AddUint64(&st.next, 1) - 1
+	atomic.StoreInt64(&st.latencies[i%latencyWindow], int64(duration))
+}
+
+func counts(m *sync.Map, key string) *decisionCounts {
+	c, ok := m.Load(key)
+	if !ok {
+		c, _ = m.LoadOrStore(key, &decisionCounts{})
+	}
+	return c.(*decisionCounts)
+}
+
+type countsJSON struct {
+	Allowed uint64 `json:"allowed"`
+	Denied  uint64 `json:"denied"`
+}
+
+type latencyJSON struct {
+	// Samples is the number of the durations the percentiles are estimated from.
+	Samples int     `json:"samples"`
+	P50     float64 `json:"p50_ms"`
+	P95     float64 `json:"p95_ms"`
+	P99     float64 `json:"p99_ms"`
+}
+
+// statsJSON is the JSON of /stats.
+type statsJSON struct {
+	Since       time.Time             `json:"since"`
+	Total       countsJSON            `json:"total"`
+	Protocols   map[string]countsJSON `json:"protocols"`
+	DenyReasons map[string]uint64     `json:"deny_reasons"`
+	Rules       map[string]countsJSON `json:"rules"`
+	Latency     latencyJSON           `json:"latency"`
+}
+
+func (st *decisionStats) snapshot() statsJSON {
+	result := statsJSON{
+		Since:       st.since,
+		Protocols:   map[string]countsJSON{},
+		DenyReasons: map[string]uint64{},
+		Rules:       map[string]countsJSON{},
+	}
+	st.protocols.Range(func(key, value interface{}) bool {
+		c := value.(*decisionCounts).load()
+		result.Protocols[key.(string)] = c
+		result.Total.Allowed += c.Allowed
+		result.Total.Denied += c.Denied
+		return true
+	})
+	st.rules.Range(func(key, value interface{}) bool {
+		result.Rules[key.(string)] = value.(*decisionCounts).load()
+		return true
+	})
+	st.reasons.Range(func(key, value interface{}) bool {
+		result.DenyReasons[key.(string)] = atomic.LoadUint64(value.(*uint64))
+		return true
+	})
+
+	n := atomic.LoadUint64(&st.next)
+	if n > latencyWindow {
+		n = latencyWindow
+	}
+	samples := make([]int64, n)
+	for i := range samples {
+		samples[i] = atomic.LoadInt64(&st.latencies[i])
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	result.Latency = latencyJSON{Samples: len(samples),
+		P50: percentile(samples, 0.50), P95: percentile(samples, 0.95), P99: percentile(samples, 0.99)}
+	return result
+}
+
+// percentile returns the nearest-rank percentile of the sorted durations in milliseconds.
+func percentile(sorted []int64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return float64(sorted[i]) / float64(time.Millisecond)
+}
+
+// serveStats serves GET /stats as JSON, or as text with ?format=text, and POST /stats/reset with
+// the -admin-token if set on the admin server. It returns false for the other paths or if the
+// statistics are disabled.
+func (s *ExtAuthzServer) serveStats(response http.ResponseWriter, request *http.Request) bool {
+	stats := s.currentStats()
+	if stats == nil {
+		return false
+	}
+	switch request.URL.Path {
+	case statsPath:
+		if request.Method != http.MethodGet {
+			response.Header().Set("Allow", "GET")
+			http.Error(response, "method not allowed", http.StatusMethodNotAllowed)
+			return true
+		}
+	case statsResetPath:
+		if request.Method != http.MethodPost {
+			response.Header().Set("Allow", "POST")
+			http.Error(response, "method not allowed", http.StatusMethodNotAllowed)
+			return true
+		}
+		if !s.adminAuthorized(request) {
+			http.Error(response, "invalid admin token", http.StatusUnauthorized)
+			return true
+		}
+		s.logger.Infof("Admin %s reset the statistics", request.RemoteAddr)
+		s.resetStats()
+		stats = s.currentStats()
+	default:
+		return false
+	}
+	snapshot := stats.snapshot()
+	response.Header().Set("cache-control", "no-store")
+	var err error
+	if request.URL.Query().Get("format") == "text" {
+		response.Header().Set("content-type", "text/plain; charset=utf-8")
+		err = writeStatsText(response, snapshot)
+	} else {
+		response.Header().Set("content-type", "application/json")
+		encoder := json.NewEncoder(response)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(snapshot)
+	}
+	if err != nil {
+		s.logger.Errorf("Failed to write the %s response: %v", request.URL.Path, err)
+	}
+	return true
+}
+
+func writeStatsText(out http.ResponseWriter, stats statsJSON) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "since\t%s (%v ago)\n", stats.Since.Format(time.RFC3339), time.Since(stats.Since).Round(time.Second))
+	fmt.Fprintf(w, "total\tallowed %d\tdenied %d\n", stats.Total.Allowed, stats.Total.Denied)
+	for _, protocol := range sortedKeys(stats.Protocols) {
+		c := stats.Protocols[protocol]
+		fmt.Fprintf(w, "protocol %s\tallowed %d\tdenied %d\n", protocol, c.Allowed, c.Denied)
+	}
+	for _, rule := range sortedKeys(stats.Rules) {
+		c := stats.Rules[rule]
+		fmt.Fprintf(w, "rule %s\tallowed %d\tdenied %d\n", rule, c.Allowed, c.Denied)
+	}
+	reasons := make([]string, 0, len(stats.DenyReasons))
+	for reason := range stats.DenyReasons {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "denied %s\t%d\n", reason, stats.DenyReasons[reason])
+	}
+	l := stats.Latency
+	fmt.Fprintf(w, "latency\tp50 %.3fms\tp95 %.3fms\tp99 %.3fms\tof the last %d\n", l.P50, l.P95, l.P99, l.Samples)
+	return w.Flush()
+}
+
+func sortedKeys(m map[string]countsJSON) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
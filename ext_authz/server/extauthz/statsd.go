@@ -0,0 +1,227 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// statsdTagsStatsd appends the tag values to the metric name, statsdTagsDatadog uses the
+	// DogStatsD tags.
+	statsdTagsStatsd  = "statsd"
+	statsdTagsDatadog = "datadog"
+	// statsdQueue is the number of the metrics queued for the sender, more are dropped.
+	statsdQueue = 4096
+	// statsdMaxPacket keeps the packets below the MTU of the common networks.
+	statsdMaxPacket = 1432
+	// statsdReportInterval is the interval of the counter of the dropped metrics.
+	statsdReportInterval = 10 * time.Second
+)
+
+var (
+	// statsdNameEscaper replaces the characters of the tag values that break the StatsD line or the
+	// dotted name.
+	statsdNameEscaper = strings.NewReplacer(".", "_", ":", "_", "|", "_", "@", "_", "#", "_", ",", "_", " ", "_", "\n", "_")
+	statsdTagEscaper  = strings.NewReplacer("|", "_", "#", "_", ",", "_", " ", "_", "\n", "_")
+)
+
+// statsd sends the decision counters and timings of the Prometheus metrics to a StatsD server over
+// UDP. The metrics are queued so that the check requests never wait for the socket.
+type statsd struct {
+	// dropped comes first for the alignment of the atomic on 32-bit platforms.
+	dropped uint64
+	addr    string
+	datadog bool
+	logger  Logger
+	conn    net.Conn
+	lines   chan string
+	stop    chan struct{}
+	done    chan struct{}
+	// reported is the dropped count already sent, nextWarning limits the warnings of the failed
+	// sends, both are only used by the sender.
+	reported    uint64
+	nextWarning time.Time
+}
+
+func newStatsd(addr, tagsFormat string, logger Logger) (*statsd, error) {
+	if tagsFormat != statsdTagsStatsd && tagsFormat != statsdTagsDatadog {
+		return nil, fmt.Errorf("-statsd-tags-format must be %s or %s but got %q", statsdTagsStatsd, statsdTagsDatadog, tagsFormat)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("invalid -statsd-addr: %v", err)
+	}
+	return &statsd{
+		addr:    addr,
+		datadog: tagsFormat == statsdTagsDatadog,
+		logger:  logger,
+		lines:   make(chan string, statsdQueue),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// start connects the socket and starts the sender, it does nothing if nil.
+func (sd *statsd) start() error {
+	if sd == nil {
+		return nil
+	}
+	conn, err := net.Dial("udp", sd.addr)
+	if err != nil {
+		return fmt.Errorf("invalid -statsd-addr: %v", err)
+	}
+	sd.conn = conn
+	go sd.run()
+	return nil
+}
+
+// line formats the metric with the tags of the names and values.
+func (sd *statsd) line(name, value, kind string, names []string, values ...string) string {
+	var b strings.Builder
+	b.WriteString(name)
+	if !sd.datadog {
+		for _, v := range values {
+			b.WriteString(".")
+			b.WriteString(statsdNameEscaper.Replace(v))
+		}
+	}
+	b.WriteString(":")
+	b.WriteString(value)
+	b.WriteString("|")
+	b.WriteString(kind)
+	if sd.datadog && len(names) != 0 {
+		b.WriteString("|#")
+		for i, n := range names {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			b.WriteString(n)
+			b.WriteString(":")
+			b.WriteString(statsdTagEscaper.Replace(values[i]))
+		}
+	}
+	return b.String()
+}
+
+// send queues the line, it is dropped if the queue is full.
+func (sd *statsd) send(line string) {
+	select {
+	case sd.lines <- line:
+	default:
+		atomic.AddUint64(&sd.dropped, 1)
+	}
+}
+
+func milliseconds(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', -1, 64)
+}
+
+// observeCheck sends the counter and the timing of the decision, it does nothing if nil.
+func (sd *statsd) observeCheck(protocol string, d decision, duration time.Duration) {
+	if sd == nil {
+		return
+	}
+	sd.send(sd.line("extauthz_checks_total", "1", "c", []string{"protocol", "decision", "reason"}, protocol, d.result(), d.resultDetail()))
+	sd.send(sd.line("extauthz_check_duration_ms", milliseconds(duration), "ms", []string{"protocol"}, protocol))
+}
+
+// observeStages sends the timings of the stages of a check request that ran, it does nothing if
+// nil.
+func (sd *statsd) observeStages(protocol string, st *stageTimes) {
+	if sd == nil {
+		return
+	}
+	for stage, name := range stageNames {
+		if st.ran[stage] {
+			sd.send(sd.line("extauthz_check_stage_duration_ms", milliseconds(st.durations[stage]), "ms", []string{"protocol", "stage"}, protocol, name))
+		}
+	}
+}
+
+// droppedMetrics returns the number of the metrics dropped for the full queue.
+func (sd *statsd) droppedMetrics() uint64 {
+	return atomic.LoadUint64(&sd.dropped)
+}
+
+// run batches the queued lines into packets, a packet is sent once full or once the queue is
+// drained.
+func (sd *statsd) run() {
+	defer close(sd.done)
+	ticker := time.NewTicker(statsdReportInterval)
+	defer ticker.Stop()
+	var packet []byte
+	add := func(line string) {
+		if len(packet) != 0 && len(packet)+1+len(line) > statsdMaxPacket {
+			sd.write(packet)
+			packet = packet[:0]
+		}
+		if len(packet) != 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	for {
+		select {
+		case line := <-sd.lines:
+			add(line)
+			if len(sd.lines) != 0 {
+				continue
+			}
+		case <-ticker.C:
+			// The drops are reported as a counter too, the line itself is never dropped.
+			if dropped := sd.droppedMetrics(); dropped != sd.reported {
+				add(sd.line("extauthz_statsd_dropped_total", strconv.FormatUint(dropped-sd.reported, 10), "c", nil))
+				sd.reported = dropped
+			}
+		case <-sd.stop:
+			// The sender is the only receiver, the queued lines can't be taken by another.
+			for len(sd.lines) != 0 {
+				add(<-sd.lines)
+			}
+			if len(packet) != 0 {
+				sd.write(packet)
+			}
+			sd.conn.Close()
+			return
+		}
+		if len(packet) != 0 {
+			sd.write(packet)
+			packet = packet[:0]
+		}
+	}
+}
+
+func (sd *statsd) write(packet []byte) {
+	if _, err := sd.conn.Write(packet); err != nil {
+		if now := time.Now(); now.After(sd.nextWarning) {
+			sd.logger.Warnf("failed to send the StatsD metrics to %s: %v", sd.addr, err)
+			sd.nextWarning = now.Add(time.Minute)
+		}
+	}
+}
+
+// close sends the queued metrics and closes the socket, it does nothing if nil or not started.
+func (sd *statsd) close() {
+	if sd == nil || sd.conn == nil {
+		return
+	}
+	close(sd.stop)
+	<-sd.done
+}
@@ -0,0 +1,249 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeStatsd receives the StatsD packets on a local UDP socket.
+type fakeStatsd struct {
+	conn    net.PacketConn
+	packets chan string
+}
+
+func newFakeStatsd(t *testing.T) *fakeStatsd {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeStatsd{conn: conn, packets: make(chan string, 1024)}
+	go func() {
+		buf := make([]byte, 64<<10)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				close(f.packets)
+				return
+			}
+			f.packets <- string(buf[:n])
+		}
+	}()
+	return f
+}
+
+func (f *fakeStatsd) addr() string {
+	return f.conn.LocalAddr().String()
+}
+
+// receive returns the packets received until no packet arrives for a while.
+func (f *fakeStatsd) receive() []string {
+	var packets []string
+	for {
+		select {
+		case packet, ok := <-f.packets:
+			if !ok {
+				return packets
+			}
+			packets = append(packets, packet)
+		case <-time.After(200 * time.Millisecond):
+			return packets
+		}
+	}
+}
+
+// statsdLines returns the metric lines of the packets.
+func statsdLines(packets []string) []string {
+	var result []string
+	for _, packet := range packets {
+		result = append(result, strings.Split(packet, "\n")...)
+	}
+	return result
+}
+
+func TestStatsdChecks(t *testing.T) {
+	cases := []struct {
+		tagsFormat string
+		// want are the lines of the counters and the prefix and suffix of the timing lines.
+		want       []string
+		wantTiming [2]string
+	}{
+		{tagsFormat: statsdTagsStatsd, want: []string{
+			"extauthz_checks_total.grpc.allowed.allowed-value:1|c",
+			"extauthz_checks_total.grpc.denied.bad-header-value:1|c",
+			"extauthz_checks_total.http.allowed.allowed-value:1|c",
+		}, wantTiming: [2]string{"extauthz_check_duration_ms.grpc:", "|ms"}},
+		{tagsFormat: statsdTagsDatadog, want: []string{
+			"extauthz_checks_total:1|c|#protocol:grpc,decision:allowed,reason:allowed-value",
+			"extauthz_checks_total:1|c|#protocol:grpc,decision:denied,reason:bad-header-value",
+			"extauthz_checks_total:1|c|#protocol:http,decision:allowed,reason:allowed-value",
+		}, wantTiming: [2]string{"extauthz_check_duration_ms:", "|ms|#protocol:grpc"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.tagsFormat, func(t *testing.T) {
+			fake := newFakeStatsd(t)
+			defer fake.conn.Close()
+			c := DefaultConfig()
+			c.StatsdAddr = fake.addr()
+			c.StatsdTagsFormat = tc.tagsFormat
+			s := startTLSServer(t, c)
+			checkGRPC(t, s, testRequest{headers: map[string]string{"x-ext-authz": "allow"}})
+			checkGRPC(t, s, testRequest{headers: map[string]string{"x-ext-authz": "deny"}})
+			checkHTTP(s, testRequest{headers: map[string]string{"x-ext-authz": "allow"}})
+			// Stop sends the queued metrics.
+			s.Stop()
+			got := statsdLines(fake.receive())
+			for _, want := range tc.want {
+				if !containsLine(got, want) {
+					t.Fatalf("got lines %q, want %q", got, want)
+				}
+			}
+			timings := 0
+			for _, line := range got {
+				if strings.HasPrefix(line, tc.wantTiming[0]) && strings.HasSuffix(line, tc.wantTiming[1]) {
+					timings++
+				}
+			}
+			if timings != 2 {
+				t.Fatalf("got %d gRPC timings %s...%s in %q, want 2", timings, tc.wantTiming[0], tc.wantTiming[1], got)
+			}
+		})
+	}
+}
+
+func containsLine(lines []string, want string) bool {
+	for _, line := range lines {
+		if line == want {
+			return true
+		}
+	}
+	return false
+}
+
+func TestStatsdLine(t *testing.T) {
+	names := []string{"protocol", "reason"}
+	cases := []struct {
+		name    string
+		datadog bool
+		metric  string
+		values  []string
+		want    string
+	}{
+		{name: "statsd", metric: "extauthz_checks_total", values: []string{"grpc", "allowed"}, want: "extauthz_checks_total.grpc.allowed:1|c"},
+		{name: "statsd escapes the name", metric: "extauthz_checks_total", values: []string{"grpc", "v1.2:a|b@c#d,e f"},
+			want: "extauthz_checks_total.grpc.v1_2_a_b_c_d_e_f:1|c"},
+		{name: "datadog", datadog: true, metric: "extauthz_checks_total", values: []string{"grpc", "allowed"},
+			want: "extauthz_checks_total:1|c|#protocol:grpc,reason:allowed"},
+		{name: "datadog escapes the tags", datadog: true, metric: "extauthz_checks_total", values: []string{"grpc", "v1.2:a|b#c,d e"},
+			want: "extauthz_checks_total:1|c|#protocol:grpc,reason:v1.2:a_b_c_d_e"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			sd := &statsd{datadog: tc.datadog}
+			if got := sd.line(tc.metric, "1", "c", names, tc.values...); got != tc.want {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+	// The metrics without tags are the same in both formats.
+	for _, datadog := range []bool{false, true} {
+		if got := (&statsd{datadog: datadog}).line("extauthz_statsd_dropped_total", "3", "c", nil); got != "extauthz_statsd_dropped_total:3|c" {
+			t.Fatalf("got %q with datadog %v, want extauthz_statsd_dropped_total:3|c", got, datadog)
+		}
+	}
+}
+
+func TestStatsdPackets(t *testing.T) {
+	fake := newFakeStatsd(t)
+	defer fake.conn.Close()
+	sd, err := newStatsd(fake.addr(), statsdTagsStatsd, NewTextLogger(ioutil.Discard))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The lines are queued before the sender starts so that they are batched.
+	const count = 200
+	for i := 0; i < count; i++ {
+		sd.send(fmt.Sprintf("extauthz_checks_total.grpc.line%d:1|c", i))
+	}
+	if err := sd.start(); err != nil {
+		t.Fatal(err)
+	}
+	sd.close()
+	packets := fake.receive()
+	if len(packets) < 2 {
+		t.Fatalf("got %d packets, want the lines split into several", len(packets))
+	}
+	for _, packet := range packets {
+		if len(packet) > statsdMaxPacket {
+			t.Fatalf("got a packet of %d bytes, want at most %d", len(packet), statsdMaxPacket)
+		}
+	}
+	got := statsdLines(packets)
+	if len(got) != count {
+		t.Fatalf("got %d lines, want %d", len(got), count)
+	}
+	for i, line := range got {
+		if want := fmt.Sprintf("extauthz_checks_total.grpc.line%d:1|c", i); line != want {
+			t.Fatalf("got line %q, want %q", line, want)
+		}
+	}
+}
+
+func TestStatsdDropsWhenFull(t *testing.T) {
+	sd, err := newStatsd("127.0.0.1:8125", statsdTagsStatsd, NewTextLogger(ioutil.Discard))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The sender is not started, the lines beyond the queue never block.
+	sd.lines = make(chan string, 2)
+	for i := 0; i < 5; i++ {
+		sd.observeCheck("grpc", decision{allowed: true}, time.Millisecond)
+	}
+	// Every check sends a counter and a timing.
+	if got := sd.droppedMetrics(); got != 8 {
+		t.Fatalf("got %d dropped metrics, want 8", got)
+	}
+}
+
+func TestNewStatsd(t *testing.T) {
+	cases := []struct {
+		name       string
+		addr       string
+		tagsFormat string
+		wantErr    string
+	}{
+		{name: "statsd", addr: "127.0.0.1:8125", tagsFormat: statsdTagsStatsd},
+		{name: "datadog", addr: "localhost:8125", tagsFormat: statsdTagsDatadog},
+		{name: "unknown tags format", addr: "127.0.0.1:8125", tagsFormat: "influx",
+			wantErr: `-statsd-tags-format must be statsd or datadog but got "influx"`},
+		{name: "missing port", addr: "127.0.0.1", tagsFormat: statsdTagsStatsd, wantErr: "invalid -statsd-addr"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.StatsdAddr = tc.addr
+			c.StatsdTagsFormat = tc.tagsFormat
+			if got := newServerError(c); (tc.wantErr == "") != (got == "") || !strings.Contains(got, tc.wantErr) {
+				t.Fatalf("got error %q, want %q", got, tc.wantErr)
+			}
+		})
+	}
+}
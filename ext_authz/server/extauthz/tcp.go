@@ -0,0 +1,93 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/gogo/googleapis/google/rpc"
+	"google.golang.org/genproto/googleapis/rpc/status"
+)
+
+// parsePorts parses a comma-separated list of ports.
+func parsePorts(value string) (map[uint32]bool, error) {
+	ports := map[uint32]bool{}
+	for _, p := range parseList(value) {
+		port, err := strconv.ParseUint(p, 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("invalid port %q", p)
+		}
+		ports[uint32(port)] = true
+	}
+	return ports, nil
+}
+
+// socketAddress returns the host:port of the address for the decision log, - if not set.
+func socketAddress(address *core.Address) string {
+	socket := address.GetSocketAddress()
+	if socket == nil {
+		return "-"
+	}
+	return net.JoinHostPort(socket.GetAddress(), strconv.FormatUint(uint64(socket.GetPortValue()), 10))
+}
+
+// tcpDecision returns the decision of a check request from the Envoy ext_authz network filter,
+// which has no HTTP attributes. The source must be in the -tcp-allowed-cidrs and the destination
+// port in the -tcp-allowed-ports if set, the default action applies if neither is set.
+func (s *ExtAuthzServer) tcpDecision(request *auth.CheckRequest) decision {
+	source := parseIP(request.GetAttributes().GetSource().GetAddress().GetSocketAddress().GetAddress())
+	port := request.GetAttributes().GetDestination().GetAddress().GetSocketAddress().GetPortValue()
+	if len(s.tcpAllowedCIDRs) == 0 && len(s.tcpAllowedPorts) == 0 {
+		if s.currentDefaultAction() == actionAllow {
+			return decision{allowed: true, reason: "no TCP policy, default action is allow", detail: "default-allow"}
+		}
+		return decision{reason: "no TCP policy, default action is deny"}
+	}
+	if len(s.tcpAllowedCIDRs) > 0 {
+		if _, ok := matchCIDRs(s.tcpAllowedCIDRs, source); !ok {
+			return decision{reason: fmt.Sprintf("source %v is not in -tcp-allowed-cidrs", source), detail: "denied-cidr"}
+		}
+	}
+	if len(s.tcpAllowedPorts) > 0 && !s.tcpAllowedPorts[port] {
+		return decision{reason: fmt.Sprintf("destination port %d is not in -tcp-allowed-ports", port), detail: "denied-port"}
+	}
+	return decision{allowed: true, reason: "allowed by the TCP policy", detail: "allowed-tcp"}
+}
+
+// tcpCheck implements the check request of the network filter, the response has no HTTP response
+// as the header mutations don't apply to a TCP connection.
+func (s *ExtAuthzServer) tcpCheck(request *auth.CheckRequest, start time.Time) *auth.CheckResponse {
+	d := s.tcpDecision(request)
+	s.metrics.observeCheck("tcp", d, start)
+	source, destination := request.GetAttributes().GetSource().GetAddress(), request.GetAttributes().GetDestination().GetAddress()
+	checkRequest := &checkRequest{host: socketAddress(destination), sourceIP: parseIP(source.GetSocketAddress().GetAddress()),
+		attributes: request.GetAttributes()}
+	s.logDecision("tcp", checkRequest, d, start, func(bool) string {
+		return fmt.Sprintf("[TCP][%s]: %s -> %s, %s\n", d.tag(), socketAddress(source), socketAddress(destination), d.reason)
+	})
+	code := rpc.OK
+	if !d.allowed {
+		code = rpc.PERMISSION_DENIED
+	}
+	return &auth.CheckResponse{
+		Status:          &status.Status{Code: int32(code)},
+		DynamicMetadata: s.dynamicMetadata(d, time.Since(start)),
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// timeWindow is a daily time range on some weekdays, e.g. "Mon-Fri 09:00-17:00" or "22:00-06:00".
+// A range whose end is not after its start wraps midnight and belongs to the weekday it starts on.
+type timeWindow struct {
+	text     string
+	days     [7]bool
+	start    int
+	end      int
+	location *time.Location
+}
+
+// parseTimeWindow parses "[days] HH:MM-HH:MM", days is a comma-separated list of weekdays or
+// weekday ranges (e.g. "Mon-Fri", "Sat,Sun", "Fri-Mon") and defaults to every day.
+func parseTimeWindow(text, timezone string) (*timeWindow, error) {
+	w := &timeWindow{text: text, location: time.UTC}
+	if timezone != "" {
+		location, err := time.LoadLocation(timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone %q: %v", timezone, err)
+		}
+		w.location = location
+		w.text += " " + timezone
+	}
+
+	fields := strings.Fields(text)
+	switch len(fields) {
+	case 1:
+		for i := range w.days {
+			w.days[i] = true
+		}
+	case 2:
+		if err := w.parseDays(fields[0]); err != nil {
+			return nil, fmt.Errorf("invalid time window %q: %v", text, err)
+		}
+		fields = fields[1:]
+	default:
+		return nil, fmt.Errorf("invalid time window %q: must be [days] HH:MM-HH:MM", text)
+	}
+
+	hours := strings.Split(fields[0], "-")
+	if len(hours) != 2 {
+		return nil, fmt.Errorf("invalid time window %q: must be [days] HH:MM-HH:MM", text)
+	}
+	var err error
+	if w.start, err = parseClock(hours[0]); err != nil {
+		return nil, fmt.Errorf("invalid time window %q: %v", text, err)
+	}
+	if w.end, err = parseClock(hours[1]); err != nil {
+		return nil, fmt.Errorf("invalid time window %q: %v", text, err)
+	}
+	return w, nil
+}
+
+func (w *timeWindow) parseDays(days string) error {
+	for _, item := range strings.Split(days, ",") {
+		bounds := strings.Split(item, "-")
+		if len(bounds) > 2 {
+			return fmt.Errorf("invalid weekday range %q", item)
+		}
+		first, ok := weekdays[strings.ToLower(bounds[0])]
+		if !ok {
+			return fmt.Errorf("invalid weekday %q", bounds[0])
+		}
+		last, ok := weekdays[strings.ToLower(bounds[len(bounds)-1])]
+		if !ok {
+			return fmt.Errorf("invalid weekday %q", bounds[len(bounds)-1])
+		}
+		for day := first; ; day = (day + 1) % 7 {
+			w.days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseClock returns the minutes after midnight of HH:MM, 24:00 is accepted as an end of day.
+func parseClock(clock string) (int, error) {
+	var hour, minute int
+	if n, err := fmt.Sscanf(clock, "%d:%d", &hour, &minute); err != nil || n != 2 || len(clock) != 5 {
+		return 0, fmt.Errorf("invalid time %q: must be HH:MM", clock)
+	}
+	if hour < 0 || minute < 0 || minute > 59 || hour > 24 || (hour == 24 && minute != 0) {
+		return 0, fmt.Errorf("invalid time %q: must be HH:MM", clock)
+	}
+	return hour*60 + minute, nil
+}
+
+// contains returns true if the time is in the window.
+func (w *timeWindow) contains(t time.Time) bool {
+	t = t.In(w.location)
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if w.start < w.end {
+		return w.days[day] && minute >= w.start && minute < w.end
+	}
+	// The window wraps midnight, the early part belongs to the window started the day before.
+	return (w.days[day] && minute >= w.start) || (w.days[(day+6)%7] && minute < w.end)
+}
+
+// now returns the current time of the clock, the clock can be replaced for deterministic tests.
+func (s *ExtAuthzServer) now() time.Time {
+	if s.clock != nil {
+		return s.clock()
+	}
+	return time.Now()
+}
@@ -0,0 +1,159 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// weekTime returns the UTC time on the weekday of the week starting on Monday 2024-01-01.
+func weekTime(day time.Weekday, hour, minute int) time.Time {
+	return time.Date(2024, 1, 1+(int(day)+6)%7, hour, minute, 0, 0, time.UTC)
+}
+
+func TestParseTimeWindow(t *testing.T) {
+	cases := []struct {
+		text     string
+		timezone string
+		wantErr  string
+	}{
+		{text: "Mon-Fri 09:00-17:00"},
+		{text: "22:00-06:00"},
+		{text: "Sat,Sun 00:00-24:00"},
+		{text: "Fri-Mon 18:00-08:00", timezone: "Europe/Berlin"},
+		{text: "Mon-Fri", wantErr: "invalid time \"Mon\""},
+		{text: "Mon-Fri 09:00-17:00 UTC", wantErr: "must be [days] HH:MM-HH:MM"},
+		{text: "Mon-Fri 09:00", wantErr: "must be [days] HH:MM-HH:MM"},
+		{text: "Mon-Funday 09:00-17:00", wantErr: `invalid weekday "Funday"`},
+		{text: "Mon-Wed-Fri 09:00-17:00", wantErr: `invalid weekday range "Mon-Wed-Fri"`},
+		{text: "9:00-17:00", wantErr: `invalid time "9:00"`},
+		{text: "09:60-17:00", wantErr: `invalid time "09:60"`},
+		{text: "09:00-24:30", wantErr: `invalid time "24:30"`},
+		{text: "09:00-17:00", timezone: "Mars/Olympus", wantErr: `invalid timezone "Mars/Olympus"`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.text+" "+tc.timezone, func(t *testing.T) {
+			_, err := parseTimeWindow(tc.text, tc.timezone)
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Fatalf("got error %v, want valid", err)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+				t.Fatalf("got error %v, want error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestTimeWindowContains(t *testing.T) {
+	cases := []struct {
+		window   string
+		timezone string
+		at       time.Time
+		want     bool
+	}{
+		// The start is in the window, the end is not.
+		{window: "Mon-Fri 09:00-17:00", at: weekTime(time.Monday, 9, 0), want: true},
+		{window: "Mon-Fri 09:00-17:00", at: weekTime(time.Monday, 8, 59)},
+		{window: "Mon-Fri 09:00-17:00", at: weekTime(time.Friday, 16, 59), want: true},
+		{window: "Mon-Fri 09:00-17:00", at: weekTime(time.Friday, 17, 0)},
+		{window: "Mon-Fri 09:00-17:00", at: weekTime(time.Saturday, 12, 0)},
+		{window: "Sat,Sun 00:00-24:00", at: weekTime(time.Sunday, 23, 59), want: true},
+		{window: "Sat,Sun 00:00-24:00", at: weekTime(time.Monday, 0, 0)},
+		// The window wraps midnight, the early hours belong to the weekday before.
+		{window: "Fri 22:00-06:00", at: weekTime(time.Friday, 21, 59)},
+		{window: "Fri 22:00-06:00", at: weekTime(time.Friday, 22, 0), want: true},
+		{window: "Fri 22:00-06:00", at: weekTime(time.Saturday, 0, 0), want: true},
+		{window: "Fri 22:00-06:00", at: weekTime(time.Saturday, 5, 59), want: true},
+		{window: "Fri 22:00-06:00", at: weekTime(time.Saturday, 6, 0)},
+		{window: "Fri 22:00-06:00", at: weekTime(time.Saturday, 22, 30)},
+		{window: "Fri 22:00-06:00", at: weekTime(time.Friday, 5, 0)},
+		// The weekday range wraps the week.
+		{window: "Sun-Mon 22:00-02:00", at: weekTime(time.Tuesday, 1, 0), want: true},
+		{window: "Sun-Mon 22:00-02:00", at: weekTime(time.Monday, 1, 0), want: true},
+		{window: "Sun-Mon 22:00-02:00", at: weekTime(time.Sunday, 1, 0)},
+		{window: "Fri-Mon 10:00-11:00", at: weekTime(time.Sunday, 10, 30), want: true},
+		{window: "Fri-Mon 10:00-11:00", at: weekTime(time.Wednesday, 10, 30)},
+		// The window is evaluated in its timezone, Berlin is UTC+1 in January.
+		{window: "Mon 09:00-17:00", timezone: "Europe/Berlin", at: weekTime(time.Monday, 8, 0), want: true},
+		{window: "Mon 09:00-17:00", timezone: "Europe/Berlin", at: weekTime(time.Monday, 16, 0)},
+		{window: "Mon 23:00-01:00", timezone: "Europe/Berlin", at: weekTime(time.Monday, 23, 30), want: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.window+" "+tc.timezone+" "+tc.at.Format("Mon 15:04"), func(t *testing.T) {
+			w, err := parseTimeWindow(tc.window, tc.timezone)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := w.contains(tc.at); got != tc.want {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTimeWindowRules(t *testing.T) {
+	file := writeTestFile(t, `
+rules:
+- name: allow-business-hours-writes
+  methods: [POST, PUT, DELETE]
+  time_window: Mon-Fri 09:00-17:00
+  action: allow
+- name: allow-night-reads
+  method: GET
+  time_window: 22:00-06:00
+  action: allow
+- name: deny-all
+  action: deny
+`)
+	defer os.Remove(file)
+	cases := []struct {
+		name        string
+		method      string
+		at          time.Time
+		want        bool
+		wantOutside string
+	}{
+		{name: "write in the window", method: "POST", at: weekTime(time.Wednesday, 10, 0), want: true},
+		{name: "write at the end of the window", method: "PUT", at: weekTime(time.Wednesday, 17, 0),
+			wantOutside: "outside time window Mon-Fri 09:00-17:00 of rule allow-business-hours-writes"},
+		{name: "write on the weekend", method: "DELETE", at: weekTime(time.Saturday, 10, 0),
+			wantOutside: "outside time window Mon-Fri 09:00-17:00 of rule allow-business-hours-writes"},
+		{name: "read after midnight", method: "GET", at: weekTime(time.Thursday, 3, 0), want: true},
+		{name: "read in the day", method: "GET", at: weekTime(time.Thursday, 12, 0),
+			wantOutside: "outside time window 22:00-06:00 of rule allow-night-reads"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			c := DefaultConfig()
+			c.PolicyFile = file
+			c.Logger = NewTextLogger(&out)
+			s := newTestServer(t, c)
+			defer s.close()
+			s.clock = func() time.Time { return tc.at }
+			grpcOK, httpOK := checkBoth(t, s, testRequest{method: tc.method})
+			if grpcOK != tc.want || httpOK != tc.want {
+				t.Fatalf("got allowed gRPC %v and HTTP %v, want %v", grpcOK, httpOK, tc.want)
+			}
+			if tc.wantOutside != "" && strings.Count(out.String(), tc.wantOutside) != 2 {
+				t.Fatalf("got log %q, want %q in both decisions", out.String(), tc.wantOutside)
+			}
+		})
+	}
+}
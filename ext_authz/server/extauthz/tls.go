@@ -0,0 +1,69 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// newServerTLSConfig returns the TLS config of the listener named by the flag prefix, e.g. grpc
+// for -grpc-tls-cert, or nil if neither the cert nor the key is set. The client certificate is
+// required and verified if the client CA file is set. The key pair is reloaded by the returned
+// reloader when it is rotated once started.
+func newServerTLSConfig(prefix, certFile, keyFile, clientCAFile string, logger Logger) (*tls.Config, *certReloader, error) {
+	if certFile == "" && keyFile == "" {
+		if clientCAFile != "" {
+			return nil, nil, fmt.Errorf("-%s-tls-client-ca requires -%s-tls-cert and -%s-tls-key", prefix, prefix, prefix)
+		}
+		return nil, nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, nil, fmt.Errorf("-%s-tls-cert and -%s-tls-key must be set together", prefix, prefix)
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if clientCAFile != "" {
+		data, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read -%s-tls-client-ca: %v", prefix, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, nil, fmt.Errorf("no certificate found in -%s-tls-client-ca %s", prefix, clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	reloader, err := newCertReloader(prefix, certFile, keyFile, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	config.GetCertificate = reloader.getCertificate
+	return config, reloader, nil
+}
+
+// tlsMode describes the TLS config in the startup log.
+func tlsMode(config *tls.Config) string {
+	switch {
+	case config == nil:
+		return "plaintext"
+	case config.ClientAuth == tls.RequireAndVerifyClientCert:
+		return "mTLS"
+	default:
+		return "TLS"
+	}
+}
@@ -0,0 +1,322 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// testPKI is a self-signed CA with a server certificate for 127.0.0.1 and a client certificate, the
+// PEM files are in dir.
+type testPKI struct {
+	dir      string
+	caFile   string
+	certFile string
+	keyFile  string
+	// otherKeyFile is a key that does not match the certFile.
+	otherKeyFile string
+	pool         *x509.CertPool
+	client       tls.Certificate
+}
+
+// newTestPKI returns the PKI, the caller removes its dir.
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "ext-authz-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testPKI{dir: dir, pool: x509.NewCertPool()}
+	newKey := func() *ecdsa.PrivateKey {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	writePEM := func(name, blockType string, der []byte) string {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	writeKey := func(name string, key *ecdsa.PrivateKey) string {
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return writePEM(name, "EC PRIVATE KEY", der)
+	}
+	caKey := newKey()
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.pool.AddCert(ca)
+	p.caFile = writePEM("ca.pem", "CERTIFICATE", caDER)
+	issue := func(serial int64, name string, usage x509.ExtKeyUsage) ([]byte, *ecdsa.PrivateKey) {
+		key := newKey()
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return der, key
+	}
+	serverDER, serverKey := issue(2, "ext-authz", x509.ExtKeyUsageServerAuth)
+	p.certFile = writePEM("cert.pem", "CERTIFICATE", serverDER)
+	p.keyFile = writeKey("key.pem", serverKey)
+	p.otherKeyFile = writeKey("other-key.pem", newKey())
+	clientDER, clientKey := issue(3, "envoy", x509.ExtKeyUsageClientAuth)
+	p.client = tls.Certificate{Certificate: [][]byte{clientDER}, PrivateKey: clientKey}
+	return p
+}
+
+// clientTLS returns the client config trusting the CA, with the client certificate if mutual.
+func (p *testPKI) clientTLS(mutual bool) *tls.Config {
+	config := &tls.Config{RootCAs: p.pool}
+	if mutual {
+		config.Certificates = []tls.Certificate{p.client}
+	}
+	return config
+}
+
+// startTLSServer starts the server of the config on local ports, the caller stops it.
+func startTLSServer(t *testing.T, c Config) *ExtAuthzServer {
+	t.Helper()
+	s := newTestServer(t, c)
+	if err := s.Start("127.0.0.1:0", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// grpcCheck dials the gRPC listener with the options and sends the check request of the request, it
+// fails without waiting if the handshake fails.
+func grpcCheck(s *ExtAuthzServer, r testRequest, options ...grpc.DialOption) (*auth.CheckResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, s.GRPCAddr().String(), options...)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return auth.NewAuthorizationClient(conn).Check(ctx, r.grpc())
+}
+
+func TestGRPCTLS(t *testing.T) {
+	p := newTestPKI(t)
+	defer os.RemoveAll(p.dir)
+	allow := testRequest{headers: map[string]string{"x-ext-authz": "allow"}}
+	cases := []struct {
+		name     string
+		clientCA bool
+		dial     grpc.DialOption
+		request  testRequest
+		want     bool
+		wantErr  bool
+	}{
+		{name: "allowed", dial: grpc.WithTransportCredentials(credentials.NewTLS(p.clientTLS(false))), request: allow, want: true},
+		{name: "denied", dial: grpc.WithTransportCredentials(credentials.NewTLS(p.clientTLS(false)))},
+		{name: "plaintext client", dial: grpc.WithInsecure(), request: allow, wantErr: true},
+		{name: "untrusted server", dial: grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{})), request: allow,
+			wantErr: true},
+		{name: "mutual", clientCA: true, dial: grpc.WithTransportCredentials(credentials.NewTLS(p.clientTLS(true))),
+			request: allow, want: true},
+		{name: "mutual without client certificate", clientCA: true,
+			dial: grpc.WithTransportCredentials(credentials.NewTLS(p.clientTLS(false))), request: allow, wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.GRPCTLSCert, c.GRPCTLSKey = p.certFile, p.keyFile
+			if tc.clientCA {
+				c.GRPCTLSClientCA = p.caFile
+			}
+			s := startTLSServer(t, c)
+			defer s.Stop()
+			response, err := grpcCheck(s, tc.request, tc.dial)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tc.wantErr)
+			}
+			if err == nil && grpcAllowed(response) != tc.want {
+				t.Fatalf("got allowed %v, want %v", grpcAllowed(response), tc.want)
+			}
+		})
+	}
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+	p := newTestPKI(t)
+	defer os.RemoveAll(p.dir)
+	missing := filepath.Join(p.dir, "missing.pem")
+	cases := []struct {
+		name     string
+		cert     string
+		key      string
+		clientCA string
+		wantErr  string
+	}{
+		{name: "valid", cert: p.certFile, key: p.keyFile, clientCA: p.caFile},
+		{name: "plaintext"},
+		{name: "cert without key", cert: p.certFile, wantErr: "-grpc-tls-cert and -grpc-tls-key must be set together"},
+		{name: "client CA without cert", clientCA: p.caFile,
+			wantErr: "-grpc-tls-client-ca requires -grpc-tls-cert and -grpc-tls-key"},
+		{name: "unreadable key", cert: p.certFile, key: missing, wantErr: "failed to read -grpc-tls-cert and -grpc-tls-key"},
+		{name: "mismatched key", cert: p.certFile, key: p.otherKeyFile,
+			wantErr: "failed to load -grpc-tls-cert and -grpc-tls-key"},
+		{name: "unreadable client CA", cert: p.certFile, key: p.keyFile, clientCA: missing,
+			wantErr: "failed to read -grpc-tls-client-ca"},
+		{name: "client CA without certificates", cert: p.certFile, key: p.keyFile, clientCA: p.keyFile,
+			wantErr: "no certificate found in -grpc-tls-client-ca"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.GRPCTLSCert, c.GRPCTLSKey, c.GRPCTLSClientCA = tc.cert, tc.key, tc.clientCA
+			got := newServerError(c)
+			if (tc.wantErr == "") != (got == "") || !strings.Contains(got, tc.wantErr) {
+				t.Fatalf("got error %q, want %q", got, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestHTTPTLS(t *testing.T) {
+	p := newTestPKI(t)
+	defer os.RemoveAll(p.dir)
+	cases := []struct {
+		name       string
+		clientCA   bool
+		scheme     string
+		client     *tls.Config
+		allow      bool
+		wantStatus int
+		wantErr    bool
+	}{
+		{name: "allowed", scheme: "https", client: p.clientTLS(false), allow: true, wantStatus: http.StatusOK},
+		{name: "denied", scheme: "https", client: p.clientTLS(false), wantStatus: http.StatusForbidden},
+		{name: "untrusted server", scheme: "https", client: &tls.Config{}, allow: true, wantErr: true},
+		{name: "plaintext client", scheme: "http", allow: true, wantStatus: http.StatusBadRequest},
+		{name: "mutual", clientCA: true, scheme: "https", client: p.clientTLS(true), allow: true, wantStatus: http.StatusOK},
+		{name: "mutual without client certificate", clientCA: true, scheme: "https", client: p.clientTLS(false), allow: true,
+			wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			c := DefaultConfig()
+			c.HTTPTLSCert, c.HTTPTLSKey = p.certFile, p.keyFile
+			if tc.clientCA {
+				c.HTTPTLSClientCA = p.caFile
+			}
+			c.Logger = NewTextLogger(&out)
+			s := startTLSServer(t, c)
+			defer s.Stop()
+			if want := "Starting HTTP server at https://" + s.HTTPAddr().String(); !strings.Contains(out.String(), want) {
+				t.Fatalf("got log %q, want %q", out.String(), want)
+			}
+			request, err := http.NewRequest(http.MethodGet, tc.scheme+"://"+s.HTTPAddr().String()+"/api", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.allow {
+				request.Header.Set("x-ext-authz", "allow")
+			}
+			client := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{TLSClientConfig: tc.client}}
+			response, err := client.Do(request)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			response.Body.Close()
+			if response.StatusCode != tc.wantStatus {
+				t.Fatalf("got status %d, want %d", response.StatusCode, tc.wantStatus)
+			}
+		})
+	}
+}
+
+func TestHTTPTLSConfigErrors(t *testing.T) {
+	p := newTestPKI(t)
+	defer os.RemoveAll(p.dir)
+	cases := []struct {
+		name     string
+		cert     string
+		key      string
+		clientCA string
+		wantErr  string
+	}{
+		{name: "valid", cert: p.certFile, key: p.keyFile, clientCA: p.caFile},
+		{name: "key without cert", key: p.keyFile, wantErr: "-http-tls-cert and -http-tls-key must be set together"},
+		{name: "client CA without cert", clientCA: p.caFile, wantErr: "-http-tls-client-ca requires -http-tls-cert and -http-tls-key"},
+		{name: "mismatched key", cert: p.certFile, key: p.otherKeyFile, wantErr: "failed to load -http-tls-cert and -http-tls-key"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.HTTPTLSCert, c.HTTPTLSKey, c.HTTPTLSClientCA = tc.cert, tc.key, tc.clientCA
+			got := newServerError(c)
+			if (tc.wantErr == "") != (got == "") || !strings.Contains(got, tc.wantErr) {
+				t.Fatalf("got error %q, want %q", got, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+)
+
+// tokenAllowed returns true if the bearer token is in the allowed tokens. Every token is compared in
+// constant time so the timing doesn't tell which or how much of a token matched.
+func (s *ExtAuthzServer) tokenAllowed(token string) bool {
+	allowed := 0
+	for _, t := range s.allowedTokens {
+		allowed |= subtle.ConstantTimeCompare([]byte(t), []byte(token))
+	}
+	return allowed == 1
+}
+
+// tokenFingerprint returns a short SHA-256 prefix of the token that is safe to log.
+func tokenFingerprint(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "sha256:" + hex.EncodeToString(sum[:])[:12]
+}
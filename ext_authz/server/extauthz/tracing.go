@@ -0,0 +1,459 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// tracingScope is the instrumentation scope of the spans.
+	tracingScope = "github.com/yangminzhu/playground/ext_authz/server/extauthz"
+	// defaultTracesEndpoint is the OTLP/HTTP traces endpoint of a local collector.
+	defaultTracesEndpoint = "http://localhost:4318/v1/traces"
+	// tracingBatchSize and tracingBatchInterval bound the spans buffered before an export.
+	tracingBatchSize     = 512
+	tracingBatchInterval = 5 * time.Second
+	// tracingMaxQueued drops the spans beyond it while the collector is unreachable.
+	tracingMaxQueued = 4096
+
+	traceparentHeader = "traceparent"
+
+	// spanKindServer and spanKindClient are the OTLP span kinds.
+	spanKindServer = 2
+	spanKindClient = 3
+	// spanStatusError is the OTLP status code of a failed span.
+	spanStatusError = 2
+)
+
+// spanContext identifies a span across processes.
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+func (c spanContext) valid() bool {
+	return c.traceID != [16]byte{} && c.spanID != [8]byte{}
+}
+
+func (c spanContext) traceparent() string {
+	flags := "00"
+	if c.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(c.traceID[:]) + "-" + hex.EncodeToString(c.spanID[:]) + "-" + flags
+}
+
+// parseTraceparent parses the W3C traceparent header, ok is false if invalid.
+func parseTraceparent(value string) (spanContext, bool) {
+	var c spanContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return c, false
+	}
+	if !decodeHex(c.traceID[:], parts[1]) || !decodeHex(c.spanID[:], parts[2]) || len(parts[3]) != 2 {
+		return c, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return c, false
+	}
+	c.sampled = flags&1 == 1
+	return c, c.valid()
+}
+
+// parseB3 parses the single b3 header or the multi x-b3-* headers, a 64-bit trace ID is padded.
+func parseB3(header func(name string) string) (spanContext, bool) {
+	traceID, spanID, sampled := header("x-b3-traceid"), header("x-b3-spanid"), header("x-b3-sampled")
+	if single := header("b3"); single != "" {
+		parts := strings.Split(single, "-")
+		if len(parts) < 2 {
+			return spanContext{}, false
+		}
+		traceID, spanID, sampled = parts[0], parts[1], ""
+		if len(parts) > 2 {
+			sampled = parts[2]
+		}
+	} else if header("x-b3-flags") == "1" {
+		sampled = "1"
+	}
+	if len(traceID) == 16 {
+		traceID = strings.Repeat("0", 16) + traceID
+	}
+	var c spanContext
+	if !decodeHex(c.traceID[:], traceID) || !decodeHex(c.spanID[:], spanID) {
+		return c, false
+	}
+	// A missing sampling state means that the caller deferred the decision, it is treated as sampled.
+	c.sampled = sampled == "" || sampled == "1" || sampled == "d" || sampled == "true"
+	return c, c.valid()
+}
+
+func decodeHex(dst []byte, value string) bool {
+	if len(value) != 2*len(dst) {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(value))
+	return err == nil
+}
+
+// tracingSampler decides the sampling of the root spans and of the spans with a remote parent.
+type tracingSampler struct {
+	parentBased bool
+	// ratio is the sampled fraction of the trace IDs, 0 never and 1 always samples.
+	ratio float64
+}
+
+// newTracingSampler returns the sampler of OTEL_TRACES_SAMPLER and OTEL_TRACES_SAMPLER_ARG, the
+// default parentbased_always_on follows the sampling of the caller and samples the root spans.
+func newTracingSampler(name, arg string) (tracingSampler, error) {
+	ratio := 1.0
+	if arg != "" {
+		var err error
+		if ratio, err = strconv.ParseFloat(arg, 64); err != nil || ratio < 0 || ratio > 1 {
+			return tracingSampler{}, fmt.Errorf("OTEL_TRACES_SAMPLER_ARG must be a ratio between 0 and 1 but got %q", arg)
+		}
+	}
+	switch name {
+	case "", "parentbased_always_on":
+		return tracingSampler{parentBased: true, ratio: 1}, nil
+	case "parentbased_always_off":
+		return tracingSampler{parentBased: true, ratio: 0}, nil
+	case "parentbased_traceidratio":
+		return tracingSampler{parentBased: true, ratio: ratio}, nil
+	case "always_on":
+		return tracingSampler{ratio: 1}, nil
+	case "always_off":
+		return tracingSampler{ratio: 0}, nil
+	case "traceidratio":
+		return tracingSampler{ratio: ratio}, nil
+	}
+	return tracingSampler{}, fmt.Errorf("unsupported OTEL_TRACES_SAMPLER %q", name)
+}
+
+func (s tracingSampler) sample(parent spanContext, hasParent bool, traceID [16]byte) bool {
+	if s.parentBased && hasParent {
+		return parent.sampled
+	}
+	// The lower 8 bytes of the trace ID are random like in the OpenTelemetry SDKs.
+	return float64(binary.BigEndian.Uint64(traceID[8:])>>1) < s.ratio*float64(uint64(1)<<63)
+}
+
+// tracer exports the spans to an OTLP/HTTP collector with the JSON encoding in batches.
+type tracer struct {
+	endpoint    string
+	headers     map[string]string
+	serviceName string
+	sampler     tracingSampler
+	client      *http.Client
+	logger      Logger
+
+	mu      sync.Mutex
+	pending []*span
+	flush   chan struct{}
+	stop    chan struct{}
+	stopped chan struct{}
+	// started is set by start before the servers run.
+	started bool
+}
+
+// newTracer returns the tracer configured by the standard OTEL_EXPORTER_OTLP_* environment
+// variables, only the http/json protocol is supported.
+func newTracer(logger Logger) (*tracer, error) {
+	if protocol := otelEnv("PROTOCOL"); protocol != "" && protocol != "http/json" {
+		return nil, fmt.Errorf("OTEL_EXPORTER_OTLP_PROTOCOL must be http/json but got %q", protocol)
+	}
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			endpoint = strings.TrimRight(base, "/") + "/v1/traces"
+		} else {
+			endpoint = defaultTracesEndpoint
+		}
+	}
+	if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid OTLP traces endpoint %q", endpoint)
+	}
+	headers := map[string]string{}
+	for _, pair := range parseList(otelEnv("HEADERS")) {
+		i := strings.Index(pair, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("OTEL_EXPORTER_OTLP_HEADERS must be key=value pairs but got %q", pair)
+		}
+		value, err := url.QueryUnescape(strings.TrimSpace(pair[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_HEADERS value of %s: %v", pair[:i], err)
+		}
+		headers[strings.TrimSpace(pair[:i])] = value
+	}
+	timeout := 10 * time.Second
+	if value := otelEnv("TIMEOUT"); value != "" {
+		ms, err := strconv.Atoi(value)
+		if err != nil || ms <= 0 {
+			return nil, fmt.Errorf("OTEL_EXPORTER_OTLP_TIMEOUT must be positive milliseconds but got %q", value)
+		}
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+	sampler, err := newTracingSampler(os.Getenv("OTEL_TRACES_SAMPLER"), os.Getenv("OTEL_TRACES_SAMPLER_ARG"))
+	if err != nil {
+		return nil, err
+	}
+	serviceName := os.Getenv("OTEL_SERVICE_NAME")
+	if serviceName == "" {
+		serviceName = "ext-authz"
+	}
+	return &tracer{
+		endpoint:    endpoint,
+		headers:     headers,
+		serviceName: serviceName,
+		sampler:     sampler,
+		client:      &http.Client{Timeout: timeout},
+		logger:      logger,
+		flush:       make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}, nil
+}
+
+// start starts the exporter, it does nothing if the tracing is disabled.
+func (t *tracer) start() {
+	if t == nil {
+		return
+	}
+	t.started = true
+	go t.run()
+	t.logger.Infof("Exporting traces to %s as service %s", t.endpoint, t.serviceName)
+}
+
+// otelEnv returns the traces specific OTEL_EXPORTER_OTLP_TRACES_<name> or the OTEL_EXPORTER_OTLP_<name>.
+func otelEnv(name string) string {
+	if value := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_" + name); value != "" {
+		return value
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_" + name)
+}
+
+// span is a finished or running span, the methods of a nil span do nothing so that the callers
+// don't check whether the tracing is enabled or the trace sampled.
+type span struct {
+	tracer     *tracer
+	name       string
+	kind       int
+	context    spanContext
+	parentID   [8]byte
+	start      time.Time
+	end        time.Time
+	attributes [][2]string
+	err        string
+}
+
+type spanKey struct{}
+
+// startCheckSpan starts the server span of the check request with the traceparent or B3 headers
+// as the remote parent, nil if not sampled.
+func (t *tracer) startCheckSpan(ctx context.Context, header func(name string) string) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+	parent, hasParent := parseTraceparent(header(traceparentHeader))
+	if !hasParent {
+		parent, hasParent = parseB3(header)
+	}
+	sp := &span{tracer: t, name: "ext_authz.Check", kind: spanKindServer, start: time.Now()}
+	if hasParent {
+		sp.context.traceID, sp.parentID = parent.traceID, parent.spanID
+	} else {
+		rand.Read(sp.context.traceID[:])
+	}
+	if !t.sampler.sample(parent, hasParent, sp.context.traceID) {
+		return ctx, nil
+	}
+	rand.Read(sp.context.spanID[:])
+	sp.context.sampled = true
+	return context.WithValue(ctx, spanKey{}, sp), sp
+}
+
+// startSpan starts a client span of a callout as a child of the span in the context, nil if the
+// context has none.
+func startSpan(ctx context.Context, name string) (context.Context, *span) {
+	parent, _ := ctx.Value(spanKey{}).(*span)
+	if parent == nil {
+		return ctx, nil
+	}
+	sp := &span{tracer: parent.tracer, name: name, kind: spanKindClient, parentID: parent.context.spanID, start: time.Now()}
+	sp.context.traceID, sp.context.sampled = parent.context.traceID, true
+	rand.Read(sp.context.spanID[:])
+	return context.WithValue(ctx, spanKey{}, sp), sp
+}
+
+// injectTraceContext sets the traceparent of the span in the context in the outgoing request.
+func injectTraceContext(ctx context.Context, header http.Header) {
+	if sp, _ := ctx.Value(spanKey{}).(*span); sp != nil {
+		header.Set(traceparentHeader, sp.context.traceparent())
+	}
+}
+
+func (sp *span) set(key, value string) {
+	if sp != nil {
+		sp.attributes = append(sp.attributes, [2]string{key, value})
+	}
+}
+
+// finish ends the span with the error status if err is not nil and queues it for the export.
+func (sp *span) finish(err error) {
+	if sp == nil {
+		return
+	}
+	sp.end = time.Now()
+	if err != nil {
+		sp.err = err.Error()
+	}
+	sp.tracer.queue(sp)
+}
+
+func (t *tracer) queue(sp *span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.pending) >= tracingMaxQueued {
+		return
+	}
+	t.pending = append(t.pending, sp)
+	if len(t.pending) == tracingBatchSize {
+		select {
+		case t.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (t *tracer) run() {
+	defer close(t.stopped)
+	ticker := time.NewTicker(tracingBatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.flush:
+		case <-t.stop:
+			t.export()
+			return
+		}
+		t.export()
+	}
+}
+
+// shutdown exports the queued spans, it does nothing if the tracing is disabled or not started.
+func (t *tracer) shutdown() {
+	if t == nil || !t.started {
+		return
+	}
+	close(t.stop)
+	<-t.stopped
+}
+
+// export posts the queued spans, they are dropped if the collector fails.
+func (t *tracer) export() {
+	t.mu.Lock()
+	spans := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+	data, err := json.Marshal(t.otlpRequest(spans))
+	if err != nil {
+		t.logger.Errorf("Failed to encode %d spans: %v", len(spans), err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(data))
+	if err != nil {
+		t.logger.Errorf("Failed to export %d spans: %v", len(spans), err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range t.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		t.logger.Errorf("Failed to export %d spans to %s: %v", len(spans), t.endpoint, err)
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		t.logger.Errorf("Failed to export %d spans to %s: status %d", len(spans), t.endpoint, resp.StatusCode)
+	}
+}
+
+// otlpRequest returns the ExportTraceServiceRequest of the spans in the OTLP JSON encoding, the IDs
+// are hex and the times decimal strings.
+func (t *tracer) otlpRequest(spans []*span) map[string]interface{} {
+	encoded := make([]map[string]interface{}, 0, len(spans))
+	for _, sp := range spans {
+		e := map[string]interface{}{
+			"traceId":           hex.EncodeToString(sp.context.traceID[:]),
+			"spanId":            hex.EncodeToString(sp.context.spanID[:]),
+			"name":              sp.name,
+			"kind":              sp.kind,
+			"startTimeUnixNano": strconv.FormatInt(sp.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(sp.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(sp.attributes),
+		}
+		if sp.parentID != [8]byte{} {
+			e["parentSpanId"] = hex.EncodeToString(sp.parentID[:])
+		}
+		if sp.err != "" {
+			e["status"] = map[string]interface{}{"code": spanStatusError, "message": sp.err}
+		}
+		encoded = append(encoded, e)
+	}
+	info := GetBuildInfo()
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes([][2]string{{"service.name", t.serviceName}, {"service.version", info.Version}}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": tracingScope, "version": info.Version},
+				"spans": encoded,
+			}},
+		}},
+	}
+}
+
+func otlpAttributes(attributes [][2]string) []interface{} {
+	encoded := make([]interface{}, 0, len(attributes))
+	for _, a := range attributes {
+		encoded = append(encoded, map[string]interface{}{"key": a[0], "value": map[string]string{"stringValue": a[1]}})
+	}
+	return encoded
+}
@@ -0,0 +1,452 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// otlpSpan is the decoded span of an OTLP/HTTP JSON export.
+type otlpSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Kind         int    `json:"kind"`
+	Attributes   []struct {
+		Key   string `json:"key"`
+		Value struct {
+			StringValue string `json:"stringValue"`
+		} `json:"value"`
+	} `json:"attributes"`
+	Status struct {
+		Code int `json:"code"`
+	} `json:"status"`
+}
+
+func (sp otlpSpan) attribute(key string) string {
+	for _, a := range sp.Attributes {
+		if a.Key == key {
+			return a.Value.StringValue
+		}
+	}
+	return ""
+}
+
+// fakeCollector records the spans and the headers of the OTLP/HTTP JSON exports.
+type fakeCollector struct {
+	mu      sync.Mutex
+	spans   []otlpSpan
+	headers []http.Header
+	service string
+}
+
+func (f *fakeCollector) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	var export struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []struct {
+					Key   string `json:"key"`
+					Value struct {
+						StringValue string `json:"stringValue"`
+					} `json:"value"`
+				} `json:"attributes"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&export); err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.headers = append(f.headers, request.Header)
+	for _, resource := range export.ResourceSpans {
+		for _, a := range resource.Resource.Attributes {
+			if a.Key == "service.name" {
+				f.service = a.Value.StringValue
+			}
+		}
+		for _, scope := range resource.ScopeSpans {
+			f.spans = append(f.spans, scope.Spans...)
+		}
+	}
+}
+
+// exported exports the queued spans of the server and returns them by name.
+func (f *fakeCollector) exported(s *ExtAuthzServer) map[string]otlpSpan {
+	s.tracer.export()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	spans := map[string]otlpSpan{}
+	for _, sp := range f.spans {
+		spans[sp.Name] = sp
+	}
+	f.spans = nil
+	return spans
+}
+
+// newTracingServer returns the server exporting its spans to the collector and calling the OPA
+// server, the traceparent received by OPA is sent to opaTraceparent.
+func newTracingServer(t *testing.T, collector *fakeCollector, opaTraceparent chan<- string) (*ExtAuthzServer, func()) {
+	t.Helper()
+	traces := httptest.NewServer(collector)
+	fake := &fakeOPA{status: http.StatusOK, body: `{"result": true}`}
+	opa := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		select {
+		case opaTraceparent <- request.Header.Get(traceparentHeader):
+		default:
+		}
+		fake.ServeHTTP(response, request)
+	}))
+	unset := setEnv(t, map[string]string{
+		"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT": traces.URL + "/v1/traces",
+		"OTEL_EXPORTER_OTLP_HEADERS":         "x-tenant=mesh%20one",
+		"OTEL_SERVICE_NAME":                  "ext-authz-test",
+	})
+	c := DefaultConfig()
+	c.Tracing = true
+	c.OPAURL = opa.URL
+	c.OPACacheTTL = 0
+	s := newTestServer(t, c)
+	unset()
+	return s, func() {
+		s.close()
+		opa.Close()
+		traces.Close()
+	}
+}
+
+// setEnv sets the environment variables until unset is called.
+func setEnv(t *testing.T, env map[string]string) (unset func()) {
+	t.Helper()
+	for name, value := range env {
+		if err := os.Setenv(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return func() {
+		for name := range env {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func TestTracingSpans(t *testing.T) {
+	const (
+		parentTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parentSpanID  = "00f067aa0ba902b7"
+	)
+	cases := []struct {
+		name    string
+		headers map[string]string
+		// wantTraceID and wantParentID are the IDs of the remote parent, the check span is a root
+		// span if empty.
+		wantTraceID  string
+		wantParentID string
+		wantNone     bool
+	}{
+		{name: "traceparent", headers: map[string]string{"traceparent": "00-" + parentTraceID + "-" + parentSpanID + "-01"},
+			wantTraceID: parentTraceID, wantParentID: parentSpanID},
+		{name: "b3 single header", headers: map[string]string{"b3": parentTraceID + "-" + parentSpanID + "-1"},
+			wantTraceID: parentTraceID, wantParentID: parentSpanID},
+		{name: "b3 multi headers with a 64-bit trace ID", headers: map[string]string{
+			"x-b3-traceid": "a3ce929d0e0e4736", "x-b3-spanid": parentSpanID, "x-b3-sampled": "1"},
+			wantTraceID: "0000000000000000a3ce929d0e0e4736", wantParentID: parentSpanID},
+		{name: "root span"},
+		{name: "parent not sampled", headers: map[string]string{"traceparent": "00-" + parentTraceID + "-" + parentSpanID + "-00"},
+			wantNone: true},
+	}
+	for _, tc := range cases {
+		for _, protocol := range []string{"grpc", "http"} {
+			t.Run(tc.name+"/"+protocol, func(t *testing.T) {
+				collector := &fakeCollector{}
+				opaTraceparent := make(chan string, 1)
+				s, done := newTracingServer(t, collector, opaTraceparent)
+				defer done()
+				r := testRequest{host: "example.com", path: "/api/items?id=1", headers: tc.headers}
+				if protocol == "grpc" {
+					checkGRPC(t, s, r)
+				} else {
+					checkHTTP(s, r)
+				}
+				spans := collector.exported(s)
+				if tc.wantNone {
+					if len(spans) != 0 {
+						t.Fatalf("got spans %v, want none", spans)
+					}
+					return
+				}
+				check, opa := spans["ext_authz.Check"], spans["opa"]
+				if len(spans) != 2 || check.SpanID == "" || opa.SpanID == "" {
+					t.Fatalf("got spans %v, want ext_authz.Check and opa", spans)
+				}
+				if tc.wantTraceID != "" && check.TraceID != tc.wantTraceID {
+					t.Fatalf("got trace ID %s, want %s", check.TraceID, tc.wantTraceID)
+				}
+				if check.ParentSpanID != tc.wantParentID || check.Kind != spanKindServer {
+					t.Fatalf("got check span parent %q and kind %d, want %q and %d", check.ParentSpanID, check.Kind, tc.wantParentID, spanKindServer)
+				}
+				// The callout is a child of the check span in the same trace.
+				if opa.TraceID != check.TraceID || opa.ParentSpanID != check.SpanID || opa.Kind != spanKindClient {
+					t.Fatalf("got opa span %+v, want a client child of %+v", opa, check)
+				}
+				if got, want := <-opaTraceparent, "00-"+opa.TraceID+"-"+opa.SpanID+"-01"; got != want {
+					t.Fatalf("got OPA traceparent %q, want %q", got, want)
+				}
+				want := map[string]string{
+					"server.address":     "example.com",
+					"url.path":           "/api/items",
+					"ext_authz.decision": "allowed",
+					"ext_authz.rule":     "default",
+				}
+				for key, value := range want {
+					if got := check.attribute(key); got != value {
+						t.Fatalf("got attribute %s %q, want %q", key, got, value)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestTracingExport(t *testing.T) {
+	collector := &fakeCollector{}
+	s, done := newTracingServer(t, collector, nil)
+	defer done()
+	checkGRPC(t, s, testRequest{})
+	spans := collector.exported(s)
+	if len(spans) != 2 {
+		t.Fatalf("got spans %v, want 2", spans)
+	}
+	cases := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{name: "service name", got: collector.service, want: "ext-authz-test"},
+		{name: "content type", got: collector.headers[0].Get("content-type"), want: "application/json"},
+		{name: "OTEL_EXPORTER_OTLP_HEADERS", got: collector.headers[0].Get("x-tenant"), want: "mesh one"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.got != tc.want {
+				t.Fatalf("got %q, want %q", tc.got, tc.want)
+			}
+		})
+	}
+	// Nothing is exported without new spans.
+	if spans := collector.exported(s); len(spans) != 0 || len(collector.headers) != 1 {
+		t.Fatalf("got spans %v and %d exports, want none and 1", spans, len(collector.headers))
+	}
+}
+
+func TestTracingCalloutError(t *testing.T) {
+	collector := &fakeCollector{}
+	traces := httptest.NewServer(collector)
+	defer traces.Close()
+	opa := httptest.NewServer(&fakeOPA{status: http.StatusInternalServerError})
+	defer opa.Close()
+	defer setEnv(t, map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": traces.URL + "/"})()
+	c := DefaultConfig()
+	c.Tracing = true
+	c.OPAURL = opa.URL
+	s := newTestServer(t, c)
+	defer s.close()
+	checkGRPC(t, s, testRequest{})
+	spans := collector.exported(s)
+	if got := spans["opa"].Status.Code; got != spanStatusError {
+		t.Fatalf("got opa span status %d, want %d", got, spanStatusError)
+	}
+	if got := spans["ext_authz.Check"].attribute("ext_authz.decision"); got != "denied" {
+		t.Fatalf("got decision %q, want denied", got)
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	cases := []struct {
+		name        string
+		value       string
+		want        bool
+		wantSampled bool
+	}{
+		{name: "sampled", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", want: true, wantSampled: true},
+		{name: "not sampled", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", want: true},
+		{name: "future version with more fields", value: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", want: true, wantSampled: true},
+		{name: "version 00 with more fields", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"},
+		{name: "invalid version", value: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{name: "zero trace ID", value: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		{name: "zero span ID", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01"},
+		{name: "short trace ID", value: "00-4bf92f3577b34da6-00f067aa0ba902b7-01"},
+		{name: "invalid flags", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-zz"},
+		{name: "empty"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := parseTraceparent(tc.value)
+			if ok != tc.want || (ok && got.sampled != tc.wantSampled) {
+				t.Fatalf("got %v sampled %v, want %v sampled %v", ok, got.sampled, tc.want, tc.wantSampled)
+			}
+			// The IDs are kept, the traceparent of the span is of version 00.
+			if ok && got.traceparent()[2:55] != tc.value[2:55] {
+				t.Fatalf("got traceparent %s, want the IDs of %s", got.traceparent(), tc.value)
+			}
+		})
+	}
+}
+
+func TestParseB3(t *testing.T) {
+	cases := []struct {
+		name        string
+		headers     map[string]string
+		want        bool
+		wantSampled bool
+	}{
+		{name: "single", headers: map[string]string{"b3": "4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-1"}, want: true, wantSampled: true},
+		{name: "single not sampled", headers: map[string]string{"b3": "4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-0"}, want: true},
+		{name: "single deferred", headers: map[string]string{"b3": "4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7"}, want: true, wantSampled: true},
+		{name: "single sampling only", headers: map[string]string{"b3": "0"}},
+		{name: "multi", headers: map[string]string{"x-b3-traceid": "a3ce929d0e0e4736", "x-b3-spanid": "00f067aa0ba902b7", "x-b3-sampled": "0"}, want: true},
+		{name: "multi debug", headers: map[string]string{"x-b3-traceid": "a3ce929d0e0e4736", "x-b3-spanid": "00f067aa0ba902b7",
+			"x-b3-sampled": "0", "x-b3-flags": "1"}, want: true, wantSampled: true},
+		{name: "invalid span ID", headers: map[string]string{"x-b3-traceid": "a3ce929d0e0e4736", "x-b3-spanid": "xyz"}},
+		{name: "none"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := parseB3(func(name string) string { return tc.headers[name] })
+			if ok != tc.want || (ok && got.sampled != tc.wantSampled) {
+				t.Fatalf("got %v sampled %v, want %v sampled %v", ok, got.sampled, tc.want, tc.wantSampled)
+			}
+		})
+	}
+}
+
+func TestTracingSampler(t *testing.T) {
+	var low, high [16]byte
+	copy(high[8:], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	sampled, notSampled := spanContext{sampled: true}, spanContext{}
+	cases := []struct {
+		name    string
+		sampler string
+		arg     string
+		parent  *spanContext
+		traceID [16]byte
+		want    bool
+		wantErr string
+	}{
+		{name: "default samples the root spans", want: true},
+		{name: "default follows the sampled parent", parent: &sampled, want: true},
+		{name: "default follows the parent not sampled", parent: &notSampled},
+		{name: "parentbased_always_off root", sampler: "parentbased_always_off"},
+		{name: "parentbased_always_off sampled parent", sampler: "parentbased_always_off", parent: &sampled, want: true},
+		{name: "always_on ignores the parent", sampler: "always_on", parent: &notSampled, want: true},
+		{name: "always_off ignores the parent", sampler: "always_off", parent: &sampled},
+		{name: "ratio below", sampler: "traceidratio", arg: "0.5", traceID: low, want: true},
+		{name: "ratio above", sampler: "traceidratio", arg: "0.5", traceID: high},
+		{name: "parent based ratio root", sampler: "parentbased_traceidratio", arg: "0.5", traceID: high},
+		{name: "parent based ratio sampled parent", sampler: "parentbased_traceidratio", arg: "0.5", parent: &sampled, traceID: high, want: true},
+		{name: "invalid ratio", sampler: "traceidratio", arg: "2", wantErr: "OTEL_TRACES_SAMPLER_ARG must be a ratio between 0 and 1"},
+		{name: "unsupported", sampler: "jaeger_remote", wantErr: `unsupported OTEL_TRACES_SAMPLER "jaeger_remote"`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			sampler, err := newTracingSampler(tc.sampler, tc.arg)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var parent spanContext
+			if tc.parent != nil {
+				parent = *tc.parent
+			}
+			if got := sampler.sample(parent, tc.parent != nil, tc.traceID); got != tc.want {
+				t.Fatalf("got sampled %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewTracer(t *testing.T) {
+	cases := []struct {
+		name         string
+		env          map[string]string
+		wantEndpoint string
+		wantErr      string
+	}{
+		{name: "default", wantEndpoint: defaultTracesEndpoint},
+		{name: "base endpoint", env: map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "https://collector:4318/"},
+			wantEndpoint: "https://collector:4318/v1/traces"},
+		{name: "traces endpoint over base", env: map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "https://collector:4318",
+			"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT": "http://traces:4318/custom"}, wantEndpoint: "http://traces:4318/custom"},
+		{name: "grpc protocol", env: map[string]string{"OTEL_EXPORTER_OTLP_PROTOCOL": "grpc"},
+			wantErr: `OTEL_EXPORTER_OTLP_PROTOCOL must be http/json but got "grpc"`},
+		{name: "invalid endpoint", env: map[string]string{"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT": "collector:4318"},
+			wantErr: `invalid OTLP traces endpoint "collector:4318"`},
+		{name: "invalid headers", env: map[string]string{"OTEL_EXPORTER_OTLP_HEADERS": "x-tenant"},
+			wantErr: `OTEL_EXPORTER_OTLP_HEADERS must be key=value pairs but got "x-tenant"`},
+		{name: "invalid timeout", env: map[string]string{"OTEL_EXPORTER_OTLP_TRACES_TIMEOUT": "-1"},
+			wantErr: `OTEL_EXPORTER_OTLP_TIMEOUT must be positive milliseconds but got "-1"`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			defer setEnv(t, tc.env)()
+			got, err := newTracer(NewTextLogger(ioutil.Discard))
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.endpoint != tc.wantEndpoint {
+				t.Fatalf("got endpoint %q, want %q", got.endpoint, tc.wantEndpoint)
+			}
+		})
+	}
+}
+
+// TestTracingDisabled checks that the nil tracer and spans do nothing.
+func TestTracingDisabled(t *testing.T) {
+	s := newTestServer(t, DefaultConfig())
+	defer s.close()
+	if s.tracer != nil {
+		t.Fatal("got a tracer without -tracing")
+	}
+	checkGRPC(t, s, testRequest{headers: map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}})
+	header := http.Header{}
+	injectTraceContext(context.Background(), header)
+	if got := header.Get(traceparentHeader); got != "" {
+		t.Fatalf("got traceparent %q without a span", got)
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// encodedSeparators are still percent-encoded after decoding once if the path is double-encoded.
+var encodedSeparators = []string{"%2e", "%2f", "%5c", "%00"}
+
+// pathTraversal returns the reason if the path, including any query string, contains ".." segments,
+// null bytes or double-encoded separators after percent-decoding it once, ok is false otherwise.
+func pathTraversal(rawPath string) (reason string, ok bool) {
+	rawPath = strings.SplitN(rawPath, "?", 2)[0]
+	decoded, err := url.PathUnescape(rawPath)
+	if err != nil {
+		return fmt.Sprintf("malformed percent-encoding in path: %v", err), true
+	}
+	if strings.Contains(decoded, "\x00") {
+		return "null byte in path", true
+	}
+	lower := strings.ToLower(decoded)
+	for _, encoded := range encodedSeparators {
+		if strings.Contains(lower, encoded) {
+			return "double-encoded " + encoded + " in path", true
+		}
+	}
+	// Backslashes are treated as separators by some upstream servers.
+	normalized := strings.Replace(decoded, `\`, "/", -1)
+	for _, segment := range strings.Split(normalized, "/") {
+		if segment == ".." {
+			return fmt.Sprintf("path traversal, %s resolves to %s", rawPath, path.Clean("/"+normalized)), true
+		}
+	}
+	return "", false
+}
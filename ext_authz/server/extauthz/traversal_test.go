@@ -0,0 +1,97 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPathTraversal(t *testing.T) {
+	cases := []struct {
+		name       string
+		path       string
+		wantReason string
+	}{
+		{name: "clean path", path: "/api/v1/orders"},
+		{name: "dots in a segment", path: "/files/archive..tar.gz"},
+		{name: "single dot segment", path: "/api/./orders"},
+		{name: "dots in the query", path: "/search?q=../../etc/passwd"},
+		{name: "encoded slash in the query", path: "/search?next=%252e%252e"},
+		{name: "plain traversal", path: "/static/../../etc/passwd", wantReason: "path traversal, /static/../../etc/passwd resolves to /etc/passwd"},
+		{name: "trailing traversal", path: "/static/..", wantReason: "path traversal"},
+		{name: "traversal with a query", path: "/static/../admin?x=1", wantReason: "path traversal, /static/../admin resolves to /admin"},
+		// Single encoding is decoded once before the segments are checked.
+		{name: "single-encoded dots", path: "/static/%2e%2e/admin", wantReason: "path traversal"},
+		{name: "single-encoded uppercase dots", path: "/static/%2E%2E/admin", wantReason: "path traversal"},
+		{name: "single-encoded slash", path: "/static/..%2fadmin", wantReason: "path traversal"},
+		{name: "single-encoded backslash", path: "/static/..%5cadmin", wantReason: "path traversal"},
+		{name: "backslash", path: `/static\..\admin`, wantReason: "path traversal"},
+		{name: "encoded null byte", path: "/file.txt%00.png", wantReason: "null byte in path"},
+		// Double encoding is still encoded after decoding once.
+		{name: "double-encoded dots", path: "/static/%252e%252e/admin", wantReason: "double-encoded %2e in path"},
+		{name: "double-encoded uppercase slash", path: "/static/..%252Fadmin", wantReason: "double-encoded %2f in path"},
+		{name: "double-encoded null byte", path: "/file%2500", wantReason: "double-encoded %00 in path"},
+		// Mixed encodings of the dots of one segment.
+		{name: "mixed plain and encoded dot", path: "/static/.%2e/admin", wantReason: "path traversal"},
+		{name: "mixed single and double encoding", path: "/static/%2e%252e/admin", wantReason: "double-encoded %2e in path"},
+		{name: "malformed encoding", path: "/static/%zz", wantReason: "malformed percent-encoding in path"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			reason, found := pathTraversal(tc.path)
+			if found != (tc.wantReason != "") || !strings.Contains(reason, tc.wantReason) {
+				t.Fatalf("got reason %q and found %v, want %q", reason, found, tc.wantReason)
+			}
+		})
+	}
+}
+
+func TestDetectPathTraversal(t *testing.T) {
+	cases := []struct {
+		name   string
+		detect bool
+		path   string
+		want   bool
+	}{
+		{name: "clean path", detect: true, path: "/api/orders", want: true},
+		{name: "traversal", detect: true, path: "/api/../admin"},
+		{name: "encoded traversal", detect: true, path: "/api/%2e%2e/admin"},
+		{name: "double-encoded traversal", detect: true, path: "/api/%252e%252e/admin"},
+		{name: "traversal in the query", detect: true, path: "/api?next=../admin", want: true},
+		{name: "disabled", path: "/api/%2e%2e/admin", want: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.DefaultAction = actionAllow
+			c.DetectPathTraversal = tc.detect
+			s := newTestServer(t, c)
+			defer s.close()
+			r := testRequest{path: tc.path}
+			if got := grpcAllowed(checkGRPC(t, s, r)); got != tc.want {
+				t.Fatalf("got allowed gRPC %v, want %v", got, tc.want)
+			}
+			wantStatus := http.StatusOK
+			if !tc.want {
+				wantStatus = http.StatusBadRequest
+			}
+			if got := checkHTTP(s, r).Code; got != wantStatus {
+				t.Fatalf("got HTTP status %d, want %d", got, wantStatus)
+			}
+		})
+	}
+}
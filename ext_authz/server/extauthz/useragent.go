@@ -0,0 +1,80 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// userAgentRegexPrefix marks a user agent pattern as regex, other patterns match as substring.
+	userAgentRegexPrefix = "re:"
+	userAgentLogLen      = 128
+)
+
+type userAgentPattern struct {
+	text  string
+	regex *regexp.Regexp
+}
+
+func parseUserAgentPatterns(values []string) ([]userAgentPattern, error) {
+	var patterns []userAgentPattern
+	for _, value := range values {
+		p := userAgentPattern{text: value}
+		if strings.HasPrefix(value, userAgentRegexPrefix) {
+			regex, err := regexp.Compile(strings.TrimPrefix(value, userAgentRegexPrefix))
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex %q: %v", value, err)
+			}
+			p.regex = regex
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+func matchUserAgent(patterns []userAgentPattern, userAgent string) (string, bool) {
+	for _, p := range patterns {
+		if (p.regex != nil && p.regex.MatchString(userAgent)) || (p.regex == nil && strings.Contains(userAgent, p.text)) {
+			return p.text, true
+		}
+	}
+	return "", false
+}
+
+// userAgentDecision returns the decision of the user agent lists, ok is false if the request has no
+// user agent or it matches neither list. A denied user agent is still allowed with an allowed check
+// header value, and deny wins over allow.
+func (s *ExtAuthzServer) userAgentDecision(request *checkRequest) (decision, bool) {
+	userAgent := request.header("user-agent")
+	if userAgent == "" {
+		return decision{}, false
+	}
+	if pattern, ok := matchUserAgent(s.deniedUserAgents, userAgent); ok {
+		if s.isAllowedValue(request.header(s.checkHeader)) {
+			return decision{}, false
+		}
+		if len(userAgent) > userAgentLogLen {
+			userAgent = userAgent[:userAgentLogLen] + "..."
+		}
+		return decision{reason: fmt.Sprintf("denied user agent %q by pattern %s", userAgent, pattern)}, true
+	}
+	if pattern, ok := matchUserAgent(s.allowedUserAgents, userAgent); ok {
+		return decision{allowed: true, reason: "allowed user agent pattern " + pattern}, true
+	}
+	return decision{}, false
+}
@@ -0,0 +1,94 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	corev2 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv2 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v2"
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev2 "github.com/envoyproxy/go-control-plane/envoy/type"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+)
+
+// authorizationV2 serves the ext_authz v2 API for older Envoy by adapting the requests to the v3
+// Check, the v3 only fields of the response are dropped.
+type authorizationV2 struct {
+	s *ExtAuthzServer
+}
+
+// Check implements the v2 gRPC check request.
+func (a authorizationV2) Check(ctx context.Context, request *authv2.CheckRequest) (*authv2.CheckResponse, error) {
+	v3Request, err := checkRequestToV3(request)
+	if err != nil {
+		return nil, grpcstatus.Errorf(codes.InvalidArgument, "failed to convert the v2 check request: %v", err)
+	}
+	response, err := a.s.Check(ctx, v3Request)
+	if err != nil {
+		return nil, err
+	}
+	return checkResponseToV2(response), nil
+}
+
+// checkRequestToV3 converts the request through the wire format, the v3 attribute context keeps
+// the field numbers of v2.
+func checkRequestToV3(request *authv2.CheckRequest) (*auth.CheckRequest, error) {
+	b, err := proto.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	v3Request := &auth.CheckRequest{}
+	if err := proto.Unmarshal(b, v3Request); err != nil {
+		return nil, err
+	}
+	return v3Request, nil
+}
+
+// checkResponseToV2 converts the response. The v2 response has no equivalent of these fields and
+// they are dropped: the DynamicMetadata of the response, and the HeadersToRemove,
+// ResponseHeadersToAdd, QueryParametersToSet and QueryParametersToRemove of the OK response.
+func checkResponseToV2(response *auth.CheckResponse) *authv2.CheckResponse {
+	v2Response := &authv2.CheckResponse{Status: response.GetStatus()}
+	if ok := response.GetOkResponse(); ok != nil {
+		v2Response.HttpResponse = &authv2.CheckResponse_OkResponse{
+			OkResponse: &authv2.OkHttpResponse{Headers: headerValueOptionsToV2(ok.GetHeaders())},
+		}
+	} else if denied := response.GetDeniedResponse(); denied != nil {
+		v2Response.HttpResponse = &authv2.CheckResponse_DeniedResponse{
+			DeniedResponse: &authv2.DeniedHttpResponse{
+				Status:  &typev2.HttpStatus{Code: typev2.StatusCode(denied.GetStatus().GetCode())},
+				Headers: headerValueOptionsToV2(denied.GetHeaders()),
+				Body:    denied.GetBody(),
+			},
+		}
+	}
+	return v2Response
+}
+
+// headerValueOptionsToV2 converts the headers, the append action has no v2 equivalent and is
+// dropped.
+func headerValueOptionsToV2(headers []*core.HeaderValueOption) []*corev2.HeaderValueOption {
+	var v2Headers []*corev2.HeaderValueOption
+	for _, h := range headers {
+		v2Headers = append(v2Headers, &corev2.HeaderValueOption{
+			Header: &corev2.HeaderValue{Key: h.GetHeader().GetKey(), Value: h.GetHeader().GetValue()},
+			Append: h.GetAppend(),
+		})
+	}
+	return v2Headers
+}
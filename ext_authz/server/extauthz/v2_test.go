@@ -0,0 +1,211 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	corev2 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv2 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v2"
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev2 "github.com/envoyproxy/go-control-plane/envoy/type"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/golang/protobuf/proto"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/genproto/googleapis/rpc/status"
+)
+
+func v2CheckRequest(r testRequest) *authv2.CheckRequest {
+	r = r.withDefaults()
+	headers := map[string]string{":method": r.method, ":authority": r.host, ":path": r.path}
+	for name, value := range r.headers {
+		headers[name] = value
+	}
+	return &authv2.CheckRequest{Attributes: &authv2.AttributeContext{
+		Source: &authv2.AttributeContext_Peer{Address: &corev2.Address{Address: &corev2.Address_SocketAddress{
+			SocketAddress: &corev2.SocketAddress{Address: r.sourceIP},
+		}}},
+		Request: &authv2.AttributeContext_Request{Http: &authv2.AttributeContext_HttpRequest{
+			Method: r.method, Host: r.host, Path: r.path, Protocol: "HTTP/1.1", Headers: headers,
+		}},
+	}}
+}
+
+func TestCheckRequestToV3(t *testing.T) {
+	r := testRequest{method: "POST", host: "api.example.com", path: "/v1/orders?id=1",
+		headers: map[string]string{"x-ext-authz": "allow"}, sourceIP: "10.1.2.3"}
+	got, err := checkRequestToV3(v2CheckRequest(r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := r.grpc(); !proto.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestCheckResponseToV2(t *testing.T) {
+	v3Header := func(key, value string, append bool) *core.HeaderValueOption {
+		return &core.HeaderValueOption{Header: &core.HeaderValue{Key: key, Value: value}, Append: &wrappers.BoolValue{Value: append}}
+	}
+	v2Header := func(key, value string, append bool) *corev2.HeaderValueOption {
+		return &corev2.HeaderValueOption{Header: &corev2.HeaderValue{Key: key, Value: value}, Append: &wrappers.BoolValue{Value: append}}
+	}
+	metadata := &structpb.Struct{Fields: map[string]*structpb.Value{"decision": stringValue("allowed")}}
+	cases := []struct {
+		name string
+		v3   *auth.CheckResponse
+		want *authv2.CheckResponse
+		// wantV3 is the v3 response after the round trip through v2, without the dropped fields.
+		wantV3 *auth.CheckResponse
+	}{
+		{
+			name: "OK",
+			v3: &auth.CheckResponse{
+				Status:       &status.Status{Code: int32(code.Code_OK)},
+				HttpResponse: &auth.CheckResponse_OkResponse{OkResponse: &auth.OkHttpResponse{}},
+			},
+			want: &authv2.CheckResponse{
+				Status:       &status.Status{Code: int32(code.Code_OK)},
+				HttpResponse: &authv2.CheckResponse_OkResponse{OkResponse: &authv2.OkHttpResponse{}},
+			},
+			wantV3: &auth.CheckResponse{
+				Status:       &status.Status{Code: int32(code.Code_OK)},
+				HttpResponse: &auth.CheckResponse_OkResponse{OkResponse: &auth.OkHttpResponse{}},
+			},
+		},
+		{
+			name: "OK with headers and v3 only fields",
+			v3: &auth.CheckResponse{
+				Status: &status.Status{Code: int32(code.Code_OK)},
+				HttpResponse: &auth.CheckResponse_OkResponse{OkResponse: &auth.OkHttpResponse{
+					Headers:                 []*core.HeaderValueOption{v3Header(resultHeader, "allowed", false), v3Header("x-user", "alice", true)},
+					HeadersToRemove:         []string{"x-user-id"},
+					ResponseHeadersToAdd:    []*core.HeaderValueOption{v3Header("set-cookie", "authz=ok", true)},
+					QueryParametersToSet:    []*core.QueryParameter{{Key: "tenant", Value: "a"}},
+					QueryParametersToRemove: []string{"debug"},
+				}},
+				DynamicMetadata: metadata,
+			},
+			want: &authv2.CheckResponse{
+				Status: &status.Status{Code: int32(code.Code_OK)},
+				HttpResponse: &authv2.CheckResponse_OkResponse{OkResponse: &authv2.OkHttpResponse{
+					Headers: []*corev2.HeaderValueOption{v2Header(resultHeader, "allowed", false), v2Header("x-user", "alice", true)},
+				}},
+			},
+			wantV3: &auth.CheckResponse{
+				Status: &status.Status{Code: int32(code.Code_OK)},
+				HttpResponse: &auth.CheckResponse_OkResponse{OkResponse: &auth.OkHttpResponse{
+					Headers: []*core.HeaderValueOption{v3Header(resultHeader, "allowed", false), v3Header("x-user", "alice", true)},
+				}},
+			},
+		},
+		{
+			name: "denied",
+			v3: &auth.CheckResponse{
+				Status: &status.Status{Code: int32(code.Code_PERMISSION_DENIED)},
+				HttpResponse: &auth.CheckResponse_DeniedResponse{DeniedResponse: &auth.DeniedHttpResponse{
+					Status:  &typev3.HttpStatus{Code: typev3.StatusCode_TooManyRequests},
+					Headers: []*core.HeaderValueOption{v3Header(resultHeader, "denied", false), v3Header("retry-after", "3", false)},
+					Body:    "rate limited",
+				}},
+				DynamicMetadata: metadata,
+			},
+			want: &authv2.CheckResponse{
+				Status: &status.Status{Code: int32(code.Code_PERMISSION_DENIED)},
+				HttpResponse: &authv2.CheckResponse_DeniedResponse{DeniedResponse: &authv2.DeniedHttpResponse{
+					Status:  &typev2.HttpStatus{Code: typev2.StatusCode_TooManyRequests},
+					Headers: []*corev2.HeaderValueOption{v2Header(resultHeader, "denied", false), v2Header("retry-after", "3", false)},
+					Body:    "rate limited",
+				}},
+			},
+			wantV3: &auth.CheckResponse{
+				Status: &status.Status{Code: int32(code.Code_PERMISSION_DENIED)},
+				HttpResponse: &auth.CheckResponse_DeniedResponse{DeniedResponse: &auth.DeniedHttpResponse{
+					Status:  &typev3.HttpStatus{Code: typev3.StatusCode_TooManyRequests},
+					Headers: []*core.HeaderValueOption{v3Header(resultHeader, "denied", false), v3Header("retry-after", "3", false)},
+					Body:    "rate limited",
+				}},
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := checkResponseToV2(tc.v3)
+			if !proto.Equal(got, tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+			// The v2 and v3 responses have the same field numbers.
+			b, err := proto.Marshal(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			roundTrip := &auth.CheckResponse{}
+			if err := proto.Unmarshal(b, roundTrip); err != nil {
+				t.Fatal(err)
+			}
+			if !proto.Equal(roundTrip, tc.wantV3) {
+				t.Fatalf("got round trip %v, want %v", roundTrip, tc.wantV3)
+			}
+		})
+	}
+}
+
+func TestAuthorizationV2Check(t *testing.T) {
+	cases := []struct {
+		name       string
+		request    testRequest
+		wantCode   code.Code
+		wantStatus int
+		wantResult string
+	}{
+		{name: "OK", request: testRequest{headers: map[string]string{"x-ext-authz": "allow"}}, wantCode: code.Code_OK,
+			wantResult: "allowed"},
+		{name: "denied", request: testRequest{headers: map[string]string{"x-ext-authz": "deny"}},
+			wantCode: code.Code_PERMISSION_DENIED, wantStatus: http.StatusForbidden, wantResult: "denied"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.StripRequestHeaders = "x-user-id"
+			s := newTestServer(t, c)
+			defer s.close()
+			response, err := authorizationV2{s}.Check(context.Background(), v2CheckRequest(tc.request))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := code.Code(response.GetStatus().GetCode()); got != tc.wantCode {
+				t.Fatalf("got code %v, want %v", got, tc.wantCode)
+			}
+			if got := int(response.GetDeniedResponse().GetStatus().GetCode()); got != tc.wantStatus {
+				t.Fatalf("got denied status %d, want %d", got, tc.wantStatus)
+			}
+			headers := append(response.GetOkResponse().GetHeaders(), response.GetDeniedResponse().GetHeaders()...)
+			var result string
+			for _, h := range headers {
+				if h.GetHeader().GetKey() == resultHeader {
+					result = h.GetHeader().GetValue()
+				}
+			}
+			if result != tc.wantResult {
+				t.Fatalf("got %s %q, want %q", resultHeader, result, tc.wantResult)
+			}
+		})
+	}
+}
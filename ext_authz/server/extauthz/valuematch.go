@@ -0,0 +1,59 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The -value-match modes of the check header value comparison.
+const (
+	valueMatchExact           = "exact"
+	valueMatchCaseInsensitive = "case-insensitive"
+	valueMatchTrimmed         = "trimmed"
+)
+
+func validValueMatch(mode string) bool {
+	return mode == valueMatchExact || mode == valueMatchCaseInsensitive || mode == valueMatchTrimmed
+}
+
+// normalizeValue normalizes a check header value for the comparison, it is applied to both the
+// configured allowed values and the request header.
+func (s *ExtAuthzServer) normalizeValue(value string) string {
+	switch s.valueMatch {
+	case valueMatchCaseInsensitive:
+		return strings.ToLower(value)
+	case valueMatchTrimmed:
+		return strings.TrimSpace(value)
+	default:
+		return value
+	}
+}
+
+// nearMiss returns a description of the raw and normalized value if the denied value would have
+// been allowed by ignoring case and surrounding whitespace, ok is false otherwise.
+func (s *ExtAuthzServer) nearMiss(value string) (string, bool) {
+	if s.allowedRegex != nil || value == "" {
+		return "", false
+	}
+	lenient := strings.ToLower(strings.TrimSpace(value))
+	for allowed := range s.allowedValues {
+		if strings.ToLower(strings.TrimSpace(allowed)) == lenient {
+			return fmt.Sprintf("near miss: got %q normalized to %q with -value-match=%s", value, s.normalizeValue(value), s.valueMatch), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,94 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+const (
+	modulePath = "github.com/yangminzhu/playground/ext_authz/server"
+	// versionHeader carries the version of the server in the decisions with -version-header.
+	versionHeader = "x-ext-authz-server-version"
+	versionPath   = "/version"
+)
+
+// Version, Commit and BuildDate are injected at build time, e.g.
+//
+//	go build -ldflags "-X github.com/yangminzhu/playground/ext_authz/server/extauthz.Commit=$(git rev-parse --short HEAD)"
+//
+// Version defaults to the module version if the server is built as a dependency.
+var (
+	Version   = ""
+	Commit    = "unknown"
+	BuildDate = "unknown"
+)
+
+// BuildInfo identifies the build of the server.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+// GetBuildInfo returns the build of the server.
+func GetBuildInfo() BuildInfo {
+	info := BuildInfo{Version: Version, Commit: Commit, BuildDate: BuildDate, GoVersion: runtime.Version()}
+	if info.Version == "" {
+		info.Version = moduleVersion()
+	}
+	return info
+}
+
+// moduleVersion returns the version of the module in the binary, "dev" if built from the source tree.
+func moduleVersion() string {
+	if build, ok := debug.ReadBuildInfo(); ok {
+		if build.Main.Path == modulePath && build.Main.Version != "(devel)" && build.Main.Version != "" {
+			return build.Main.Version
+		}
+		for _, dep := range build.Deps {
+			if dep.Path == modulePath {
+				return dep.Version
+			}
+		}
+	}
+	return "dev"
+}
+
+func (b BuildInfo) String() string {
+	return fmt.Sprintf("ext-authz-server %s (commit %s, built %s, %s)", b.Version, b.Commit, b.BuildDate, b.GoVersion)
+}
+
+// header returns the value of the versionHeader.
+func (b BuildInfo) header() string {
+	return b.Version + "/" + b.Commit
+}
+
+func (s *ExtAuthzServer) serveVersion(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		response.Header().Set("Allow", "GET")
+		http.Error(response, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	response.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(response).Encode(GetBuildInfo()); err != nil {
+		s.logger.Errorf("Failed to write the version: %v", err)
+	}
+}
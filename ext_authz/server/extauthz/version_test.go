@@ -0,0 +1,124 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+// setBuild sets the injected build variables until restore is called.
+func setBuild(version, commit, buildDate string) (restore func()) {
+	oldVersion, oldCommit, oldBuildDate := Version, Commit, BuildDate
+	Version, Commit, BuildDate = version, commit, buildDate
+	return func() {
+		Version, Commit, BuildDate = oldVersion, oldCommit, oldBuildDate
+	}
+}
+
+func TestServeVersion(t *testing.T) {
+	defer setBuild("v1.2.3", "abc1234", "2024-01-02T03:04:05Z")()
+	c := DefaultConfig()
+	c.AdminPort = "0"
+	s := newTestServer(t, c)
+	defer s.close()
+	cases := []struct {
+		name       string
+		method     string
+		wantStatus int
+		want       map[string]interface{}
+	}{
+		{name: "GET", method: http.MethodGet, wantStatus: http.StatusOK, want: map[string]interface{}{
+			"version": "v1.2.3", "commit": "abc1234", "build_date": "2024-01-02T03:04:05Z", "go_version": runtime.Version(),
+		}},
+		{name: "POST", method: http.MethodPost, wantStatus: http.StatusMethodNotAllowed},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := adminRequest(s, tc.method, versionPath, "", "")
+			if got.Code != tc.wantStatus {
+				t.Fatalf("got status %d, want %d", got.Code, tc.wantStatus)
+			}
+			if tc.want == nil {
+				return
+			}
+			if content := got.Header().Get("content-type"); content != "application/json" {
+				t.Fatalf("got content-type %q, want application/json", content)
+			}
+			var body map[string]interface{}
+			if err := json.Unmarshal(got.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(body, tc.want) {
+				t.Fatalf("got %v, want %v", body, tc.want)
+			}
+		})
+	}
+}
+
+func TestGetBuildInfo(t *testing.T) {
+	cases := []struct {
+		name        string
+		version     string
+		wantVersion string
+		wantString  string
+	}{
+		{name: "injected version", version: "v1.2.3", wantVersion: "v1.2.3",
+			wantString: "ext-authz-server v1.2.3 (commit abc1234, built today, " + runtime.Version() + ")"},
+		// The test binary is built from the source tree.
+		{name: "source tree", wantVersion: "dev",
+			wantString: "ext-authz-server dev (commit abc1234, built today, " + runtime.Version() + ")"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			defer setBuild(tc.version, "abc1234", "today")()
+			info := GetBuildInfo()
+			if info.Version != tc.wantVersion || info.String() != tc.wantString {
+				t.Fatalf("got version %q and %q, want %q and %q", info.Version, info, tc.wantVersion, tc.wantString)
+			}
+		})
+	}
+}
+
+func TestVersionHeader(t *testing.T) {
+	defer setBuild("v1.2.3", "abc1234", "today")()
+	cases := []struct {
+		name    string
+		enabled bool
+		request testRequest
+		want    string
+	}{
+		{name: "allowed", enabled: true, request: testRequest{headers: map[string]string{"x-ext-authz": "allow"}}, want: "v1.2.3/abc1234"},
+		{name: "denied", enabled: true, want: "v1.2.3/abc1234"},
+		{name: "disabled", request: testRequest{headers: map[string]string{"x-ext-authz": "allow"}}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.VersionHeader = tc.enabled
+			s := newTestServer(t, c)
+			defer s.close()
+			if got := grpcHeader(checkGRPC(t, s, tc.request), versionHeader); got != tc.want {
+				t.Fatalf("got gRPC %s %q, want %q", versionHeader, got, tc.want)
+			}
+			if got := checkHTTP(s, tc.request).Header().Get(versionHeader); got != tc.want {
+				t.Fatalf("got HTTP %s %q, want %q", versionHeader, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extauthz
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	xfccHeader = "x-forwarded-client-cert"
+	peerHeader = "x-ext-authz-peer"
+)
+
+// parseSpiffePattern validates a SPIFFE ID pattern, a "*" matches exactly one path segment.
+func parseSpiffePattern(pattern string) (string, error) {
+	if !strings.HasPrefix(pattern, "spiffe://") {
+		return "", fmt.Errorf("invalid SPIFFE ID %q: must start with spiffe://", pattern)
+	}
+	segments := strings.Split(strings.TrimPrefix(pattern, "spiffe://"), "/")
+	for i, segment := range segments {
+		if strings.Contains(segment, "*") && (i == 0 || segment != "*") {
+			return "", fmt.Errorf("invalid SPIFFE ID %q: wildcard is only supported as a whole path segment", pattern)
+		}
+	}
+	return pattern, nil
+}
+
+func spiffeMatches(pattern, id string) bool {
+	patternSegments := strings.Split(pattern, "/")
+	idSegments := strings.Split(id, "/")
+	if len(patternSegments) != len(idSegments) {
+		return false
+	}
+	for i, segment := range patternSegments {
+		if segment != "*" && segment != idSegments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// splitQuoted splits the value by the separator outside of double quotes.
+func splitQuoted(value string, sep rune) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i, c := range value {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			parts = append(parts, value[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, value[start:])
+}
+
+// xfccURIs returns the URI values of the left-most XFCC element, i.e. the original client.
+func xfccURIs(xfcc string) []string {
+	var uris []string
+	element := splitQuoted(xfcc, ',')[0]
+	for _, pair := range splitQuoted(element, ';') {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 || !strings.EqualFold(kv[0], "URI") {
+			continue
+		}
+		value := strings.Trim(kv[1], `"`)
+		if unescaped, err := url.PathUnescape(value); err == nil {
+			value = unescaped
+		}
+		uris = append(uris, value)
+	}
+	return uris
+}
+
+// spiffeDecision returns the decision for a request in the SPIFFE identity mode.
+func (s *ExtAuthzServer) spiffeDecision(request *checkRequest) decision {
+	xfcc := request.header(xfccHeader)
+	if xfcc == "" {
+		return decision{reason: "missing " + xfccHeader + " header"}
+	}
+	uris := xfccURIs(xfcc)
+	if len(uris) == 0 {
+		return decision{reason: "no URI in " + xfccHeader + " header"}
+	}
+	for _, uri := range uris {
+		for _, pattern := range s.allowedSpiffeIDs {
+			if spiffeMatches(pattern, uri) {
+				return decision{allowed: true, reason: "allowed peer " + uri, headers: map[string]string{peerHeader: uri}, principal: uri}
+			}
+		}
+	}
+	return decision{reason: "peer " + strings.Join(uris, ",") + " is not allowed"}
+}
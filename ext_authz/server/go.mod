@@ -3,9 +3,18 @@ module github.com/yangminzhu/playground/ext_authz/server
 go 1.13
 
 require (
-	github.com/envoyproxy/go-control-plane v0.9.7
+	github.com/alicebob/miniredis/v2 v2.14.1
+	github.com/envoyproxy/go-control-plane v0.10.1
+	github.com/fsnotify/fsnotify v1.4.7
+	github.com/go-ldap/ldap/v3 v3.2.4
+	github.com/go-redis/redis/v7 v7.4.0
 	github.com/gogo/googleapis v1.3.2
-	golang.org/x/net v0.0.0-20190311183353-d8887717615a
-	google.golang.org/genproto v0.0.0-20190819201941-24fa4b261c55
-	google.golang.org/grpc v1.27.1
+	github.com/golang/protobuf v1.5.0
+	github.com/google/cel-go v0.6.0
+	golang.org/x/crypto v0.0.0-20201016220609-9e8e0b390897
+	golang.org/x/net v0.0.0-20201021035429-f5854403a974
+	golang.org/x/time v0.0.0-20200630173020-3af7569d3a1e
+	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013
+	google.golang.org/grpc v1.36.0
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -4,7 +4,7 @@
 // you may not use this file except in compliance with the License.
 // You may obtain a copy of the License at
 //
-//     http://www.apache.org/licenses/LICENSE-2.0
+//	http://www.apache.org/licenses/LICENSE-2.0
 //
 // Unless required by applicable law or agreed to in writing, software
 // distributed under the License is distributed on an "AS IS" BASIS,
@@ -18,149 +18,72 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"net"
-	"net/http"
-	"sync"
+	"os"
+	"os/signal"
+	"syscall"
 
-	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
-	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
-	"github.com/gogo/googleapis/google/rpc"
-	"golang.org/x/net/context"
-	"google.golang.org/genproto/googleapis/rpc/status"
-	"google.golang.org/grpc"
-)
-
-const (
-	checkHeader  = "x-ext-authz"
-	allowedValue = "allow"
-	resultHeader = "x-ext-authz-result"
+	"github.com/yangminzhu/playground/ext_authz/server/extauthz"
 )
 
 var (
-	httpPort = flag.String("http", "8000", "HTTP server port")
-	grpcPort = flag.String("grpc", "9000", "gRPC server port")
+	httpPort   = flag.String("http", "8000", "HTTP server port on -bind-address, host:port like 127.0.0.1:8000, a Unix domain socket like unix:///var/run/ext_authz_http.sock, or disabled")
+	grpcPort   = flag.String("grpc", "9000", "gRPC server port on -bind-address, host:port like [::1]:9000, a Unix domain socket like unix:///var/run/ext_authz.sock, or disabled")
+	configPath = flag.String("config", "", "YAML file with version: v1 and the flag values keyed by the flag names, overridden by the flags and the environment")
+	validate   = flag.Bool("validate-config", false, "Validate the configuration including the referenced files and exit with 0 if valid or 1 otherwise without listening")
+	version    = flag.Bool("version", false, "Print the version, commit and build date and exit")
 )
 
-// ExtAuthzServer implements the ext_authz gRPC and HTTP check request API.
-type ExtAuthzServer struct {
-	// For test only
-	httpPort chan int
-	grpcPort chan int
-}
-
-// Check implements gRPC check request.
-func (s *ExtAuthzServer) Check(ctx context.Context, request *auth.CheckRequest) (*auth.CheckResponse, error) {
-	if allowedValue == request.GetAttributes().GetRequest().GetHttp().GetHeaders()[checkHeader] {
-		log.Printf("[gRPC][allowed]: %s%s with attributes %v\n",
-			request.GetAttributes().GetRequest().GetHttp().GetHost(),
-			request.GetAttributes().GetRequest().GetHttp().GetPath(),
-			request.GetAttributes())
-		return &auth.CheckResponse{
-			// This actually sets the cookie for the upstream request.
-			// It seems gRPC ext_authz doesn't support setting header for downstream response?
-			HttpResponse: &auth.CheckResponse_OkResponse{
-				OkResponse: &auth.OkHttpResponse{
-					Headers: []*core.HeaderValueOption{
-						{
-							Header: &core.HeaderValue{
-								Key:   resultHeader,
-								Value: "allowed",
-							},
-						},
-					},
-				},
-			},
-			Status: &status.Status{Code: int32(rpc.OK)},
-		}, nil
-	}
-
-	log.Printf("[gRPC][ denied]: %s%s with attributes %v\n",
-		request.GetAttributes().GetRequest().GetHttp().GetHost(),
-		request.GetAttributes().GetRequest().GetHttp().GetPath(),
-		request.GetAttributes())
-	return &auth.CheckResponse{
-		HttpResponse: &auth.CheckResponse_OkResponse{
-			OkResponse: &auth.OkHttpResponse{
-				Headers: []*core.HeaderValueOption{
-					{
-						Header: &core.HeaderValue{
-							Key:   resultHeader,
-							Value: "denied",
-						},
-					},
-				},
-			},
-		},
-		Status: &status.Status{Code: int32(rpc.PERMISSION_DENIED)},
-	}, nil
-}
-
-// ServeHTTP implements the HTTP check request.
-func (s *ExtAuthzServer) ServeHTTP(response http.ResponseWriter, request *http.Request) {
-	if allowedValue == request.Header.Get(checkHeader) {
-		log.Printf("[HTTP][allowed]: %s %s%s with headers: %s\n", request.Method, request.Host, request.URL, request.Header)
-		response.Header().Set(resultHeader, "allowed")
-		response.WriteHeader(http.StatusOK)
-	} else {
-		log.Printf("[HTTP][ denied]: %s %s%s with headers: %s\n", request.Method, request.Host, request.URL, request.Header)
-		response.Header().Set(resultHeader, "denied")
-		response.WriteHeader(http.StatusForbidden)
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "sign" {
+		signCommand(os.Args[2:])
+		return
 	}
-}
-
-func (s *ExtAuthzServer) startGRPC(address string, wg *sync.WaitGroup) {
-	defer func() {
-		wg.Done()
-		log.Printf("Stopped gRPC server")
-	}()
-
-	listener, err := net.Listen("tcp", address)
-	if err != nil {
-		log.Fatalf("Failed to start gRPC server: %v", err)
+	config := extauthz.DefaultConfig()
+	config.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+	if *version {
+		fmt.Println(extauthz.GetBuildInfo())
 		return
 	}
-	// Store the port for test only.
-	s.grpcPort <- listener.Addr().(*net.TCPAddr).Port
-
-	server := grpc.NewServer()
-	auth.RegisterAuthorizationServer(server, &ExtAuthzServer{})
-
-	log.Printf("Starting gRPC server at %s", listener.Addr())
-	if err := server.Serve(listener); err != nil {
-		log.Fatalf("Failed to serve gRPC server: %v", err)
+	if err := setFlagsFromEnv(flag.CommandLine); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if *configPath != "" {
+		if err := setFlagsFromFile(flag.CommandLine, *configPath); err != nil {
+			log.Fatalf("Invalid configuration: %v", err)
+		}
+	}
+	if config.LogFormat == extauthz.LogFormatJSON {
+		// The messages of the standard logger are written as JSON objects too.
+		logger := extauthz.NewJSONLogger(os.Stderr)
+		log.SetFlags(0)
+		log.SetOutput(logger)
+		config.Logger = logger
+	}
+	log.Printf("Starting %v", extauthz.GetBuildInfo())
+	logFlags(flag.CommandLine)
+	if *validate {
+		if err := extauthz.ValidateConfig(config, *httpPort, *grpcPort); err != nil {
+			log.Fatalf("Invalid configuration: %v", err)
+		}
+		log.Printf("Configuration is valid")
 		return
 	}
-}
-
-func (s *ExtAuthzServer) startHTTP(address string, wg *sync.WaitGroup) {
-	defer func() {
-		wg.Done()
-		log.Printf("Stopped HTTP server")
-	}()
-
-	listener, err := net.Listen("tcp", address)
+	s, err := extauthz.NewExtAuthzServer(extauthz.WithConfig(config))
 	if err != nil {
-		log.Fatalf("Failed to create HTTP server: %v", err)
+		log.Fatalf("Invalid configuration: %v", err)
 	}
-	// Store the port for test only.
-	s.httpPort <- listener.Addr().(*net.TCPAddr).Port
-
-	log.Printf("Starting HTTP server at %s", listener.Addr())
-	if err := http.Serve(listener, s); err != nil {
-		log.Fatalf("Failed to start HTTP server: %v", err)
+	if err := s.Start(*httpPort, *grpcPort); err != nil {
+		log.Fatalf("Failed to start: %v", err)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %v, shutting down within %v", sig, config.ShutdownGracePeriod)
+		s.Stop()
+	}()
+	if err := s.Wait(); err != nil {
+		log.Fatalf("Failed to serve: %v", err)
 	}
-}
-
-func (s *ExtAuthzServer) run(httpAddr, grpcAddr string) {
-	var wg sync.WaitGroup
-	wg.Add(2)
-	go s.startGRPC(httpAddr, &wg)
-	go s.startHTTP(grpcAddr, &wg)
-	wg.Wait()
-}
-
-func main() {
-	flag.Parse()
-	s := &ExtAuthzServer{httpPort: make(chan int, 1), grpcPort: make(chan int, 1)}
-	s.run(fmt.Sprintf(":%s", *httpPort), fmt.Sprintf(":%s", *grpcPort))
 }
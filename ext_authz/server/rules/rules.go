@@ -0,0 +1,204 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package rules implements the composable all_of/any_of/not conditions of the policy file,
+// independent of the gRPC and HTTP check protocols.
+package rules
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// MaxDepth is the maximum nesting of the combinators in a condition.
+const MaxDepth = 8
+
+// Request is the part of a check request the conditions are matched against.
+type Request struct {
+	Method string
+	Path   string
+	// Headers is keyed by the lowercase header name.
+	Headers  map[string]string
+	SourceIP net.IP
+}
+
+// Matcher matches a request.
+type Matcher interface {
+	Match(r *Request) bool
+}
+
+// Condition is the YAML form of a matcher, all of its non-empty fields must match, e.g.
+//
+//	any_of:
+//	- all_of:
+//	  - path_prefix: /admin
+//	  - header: {name: x-role, value: admin}
+//	- source_cidr: 10.0.0.0/8
+type Condition struct {
+	PathPrefix string       `yaml:"path_prefix"`
+	Method     string       `yaml:"method"`
+	Header     *Header      `yaml:"header"`
+	SourceCIDR string       `yaml:"source_cidr"`
+	AllOf      []*Condition `yaml:"all_of"`
+	AnyOf      []*Condition `yaml:"any_of"`
+	Not        *Condition   `yaml:"not"`
+}
+
+// Header requires the header to have the value.
+type Header struct {
+	Name  string `yaml:"name"`
+	Value string `yaml:"value"`
+}
+
+// Compile validates the condition and returns its matcher.
+func (c *Condition) Compile() (Matcher, error) {
+	return c.compile(1)
+}
+
+func (c *Condition) compile(depth int) (Matcher, error) {
+	if depth > MaxDepth {
+		return nil, fmt.Errorf("conditions are nested deeper than %d levels", MaxDepth)
+	}
+	var all AllOf
+	if c.PathPrefix != "" {
+		all = append(all, PathPrefix(c.PathPrefix))
+	}
+	if c.Method != "" {
+		all = append(all, Method(c.Method))
+	}
+	if c.Header != nil {
+		if c.Header.Name == "" {
+			return nil, fmt.Errorf("header condition requires a name")
+		}
+		all = append(all, HeaderValue{Name: strings.ToLower(c.Header.Name), Value: c.Header.Value})
+	}
+	if c.SourceCIDR != "" {
+		_, cidr, err := net.ParseCIDR(c.SourceCIDR)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source_cidr %q: %v", c.SourceCIDR, err)
+		}
+		all = append(all, SourceCIDR{cidr})
+	}
+	if len(c.AllOf) != 0 {
+		m, err := compileList(c.AllOf, depth)
+		if err != nil {
+			return nil, fmt.Errorf("all_of: %v", err)
+		}
+		all = append(all, AllOf(m))
+	}
+	if len(c.AnyOf) != 0 {
+		m, err := compileList(c.AnyOf, depth)
+		if err != nil {
+			return nil, fmt.Errorf("any_of: %v", err)
+		}
+		all = append(all, AnyOf(m))
+	}
+	if c.Not != nil {
+		m, err := c.Not.compile(depth + 1)
+		if err != nil {
+			return nil, fmt.Errorf("not: %v", err)
+		}
+		all = append(all, Not{m})
+	}
+	if len(all) == 0 {
+		return nil, fmt.Errorf("empty condition")
+	}
+	if len(all) == 1 {
+		return all[0], nil
+	}
+	return all, nil
+}
+
+func compileList(conditions []*Condition, depth int) ([]Matcher, error) {
+	matchers := make([]Matcher, 0, len(conditions))
+	for i, c := range conditions {
+		if c == nil {
+			return nil, fmt.Errorf("[%d]: empty condition", i)
+		}
+		m, err := c.compile(depth + 1)
+		if err != nil {
+			return nil, fmt.Errorf("[%d]: %v", i, err)
+		}
+		matchers = append(matchers, m)
+	}
+	return matchers, nil
+}
+
+// PathPrefix matches the path by prefix.
+type PathPrefix string
+
+func (p PathPrefix) Match(r *Request) bool {
+	return strings.HasPrefix(r.Path, string(p))
+}
+
+// Method matches the method case-insensitively.
+type Method string
+
+func (m Method) Match(r *Request) bool {
+	return strings.EqualFold(string(m), r.Method)
+}
+
+// HeaderValue matches the value of the header, Name is lowercase.
+type HeaderValue struct {
+	Name  string
+	Value string
+}
+
+func (h HeaderValue) Match(r *Request) bool {
+	value, ok := r.Headers[h.Name]
+	return ok && value == h.Value
+}
+
+// SourceCIDR matches the source IP.
+type SourceCIDR struct {
+	CIDR *net.IPNet
+}
+
+func (s SourceCIDR) Match(r *Request) bool {
+	return r.SourceIP != nil && s.CIDR.Contains(r.SourceIP)
+}
+
+// AllOf matches if all matchers match.
+type AllOf []Matcher
+
+func (a AllOf) Match(r *Request) bool {
+	for _, m := range a {
+		if !m.Match(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// AnyOf matches if any matcher matches.
+type AnyOf []Matcher
+
+func (a AnyOf) Match(r *Request) bool {
+	for _, m := range a {
+		if m.Match(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// Not matches if the matcher does not match.
+type Not struct {
+	Matcher Matcher
+}
+
+func (n Not) Match(r *Request) bool {
+	return !n.Matcher.Match(r)
+}
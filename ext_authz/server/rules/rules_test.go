@@ -0,0 +1,118 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func compileYAML(t *testing.T, text string) (Matcher, error) {
+	t.Helper()
+	var c Condition
+	if err := yaml.UnmarshalStrict([]byte(text), &c); err != nil {
+		t.Fatal(err)
+	}
+	return c.Compile()
+}
+
+// nested returns the condition of the not combinators nested depth times around a method.
+func nested(depth int) string {
+	var b strings.Builder
+	for i := 1; i < depth; i++ {
+		b.WriteString(strings.Repeat("  ", i-1) + "not:\n")
+	}
+	b.WriteString(strings.Repeat("  ", depth-1) + "method: GET\n")
+	return b.String()
+}
+
+func TestMatch(t *testing.T) {
+	const adminOrInternal = `
+any_of:
+- all_of:
+  - path_prefix: /admin
+  - header: {name: X-Role, value: admin}
+- source_cidr: 10.0.0.0/8
+`
+	cases := []struct {
+		name      string
+		condition string
+		request   Request
+		want      bool
+	}{
+		{name: "admin with the role", condition: adminOrInternal,
+			request: Request{Path: "/admin/users", Headers: map[string]string{"x-role": "admin"}}, want: true},
+		{name: "admin without the role", condition: adminOrInternal, request: Request{Path: "/admin/users"}},
+		{name: "role without admin", condition: adminOrInternal,
+			request: Request{Path: "/api", Headers: map[string]string{"x-role": "admin"}}},
+		{name: "internal source", condition: adminOrInternal,
+			request: Request{Path: "/api", SourceIP: net.ParseIP("10.1.2.3")}, want: true},
+		{name: "external source", condition: adminOrInternal,
+			request: Request{Path: "/api", SourceIP: net.ParseIP("192.168.1.1")}},
+		{name: "missing source", condition: adminOrInternal, request: Request{Path: "/api"}},
+		{name: "fields of one condition are all required", condition: "path_prefix: /api\nmethod: POST\n",
+			request: Request{Method: "GET", Path: "/api"}},
+		{name: "method is case-insensitive", condition: "method: POST", request: Request{Method: "post"}, want: true},
+		{name: "header value is case-sensitive", condition: "header: {name: x-role, value: admin}",
+			request: Request{Headers: map[string]string{"x-role": "Admin"}}},
+		{name: "empty header value", condition: "header: {name: x-role}",
+			request: Request{Headers: map[string]string{"x-role": ""}}, want: true},
+		{name: "empty header value requires the header", condition: "header: {name: x-role}", request: Request{}},
+		{name: "not", condition: "not: {path_prefix: /admin}", request: Request{Path: "/api"}, want: true},
+		{name: "not of a match", condition: "not: {path_prefix: /admin}", request: Request{Path: "/admin"}},
+		{name: "all_of with not", condition: "all_of:\n- method: GET\n- not: {source_cidr: 10.0.0.0/8}\n",
+			request: Request{Method: "GET", SourceIP: net.ParseIP("172.16.0.1")}, want: true},
+		{name: "deepest allowed nesting", condition: nested(MaxDepth), request: Request{Method: "POST"}, want: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := compileYAML(t, tc.condition)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := m.Match(&tc.request); got != tc.want {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	cases := []struct {
+		name      string
+		condition string
+		wantErr   string
+	}{
+		{name: "empty", condition: "{}", wantErr: "empty condition"},
+		{name: "empty list entry", condition: "any_of:\n- method: GET\n- {}\n", wantErr: "any_of: [1]: empty condition"},
+		{name: "null list entry", condition: "all_of:\n- method: GET\n-\n", wantErr: "all_of: [1]: empty condition"},
+		{name: "header without a name", condition: "header: {value: admin}", wantErr: "header condition requires a name"},
+		{name: "invalid CIDR", condition: "not: {source_cidr: 10.0.0.0/33}", wantErr: `not: invalid source_cidr "10.0.0.0/33"`},
+		{name: "too deep", condition: nested(MaxDepth + 1), wantErr: "conditions are nested deeper than 8 levels"},
+		{name: "too deep in a list", condition: "any_of:\n- " + strings.Replace(nested(MaxDepth), "\n", "\n  ", -1),
+			wantErr: "any_of: [0]: not: not: not: not: not: not: not: conditions are nested deeper than 8 levels"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := compileYAML(t, tc.condition)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("got error %v, want error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/yangminzhu/playground/ext_authz/server/extauthz"
+)
+
+// signCommand implements the sign subcommand that prints the curl arguments of a signed request.
+func signCommand(args []string) {
+	fs := flag.NewFlagSet("sign", flag.ExitOnError)
+	secret := fs.String("hmac-secret", "", "Secret to sign the request")
+	method := fs.String("method", http.MethodGet, "Method of the request")
+	path := fs.String("path", "/", "Path of the request including the query string")
+	nonce := fs.String("nonce", "", "Unique nonce of the request, required if the server runs with -require-nonce")
+	_ = fs.Parse(args)
+	if *secret == "" {
+		fmt.Fprintln(os.Stderr, "-hmac-secret is required")
+		os.Exit(2)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	curl := fmt.Sprintf("-X %s -H '%s: %s' -H '%s: %s'", *method, extauthz.TimestampHeader, timestamp,
+		extauthz.SignatureHeader, extauthz.Signature([]byte(*secret), *method, *path, timestamp, *nonce))
+	if *nonce != "" {
+		curl += fmt.Sprintf(" -H '%s: %s'", extauthz.NonceHeader, *nonce)
+	}
+	fmt.Println(curl)
+}